@@ -67,15 +67,24 @@ func (c *CredentialsStore) Load(r io.Reader) error {
 }
 
 // Check returns true if the password is correct for the given username.
+// A user without a password, such as one which authenticates with a client
+// certificate, cannot authenticate with a password.
 func (c *CredentialsStore) Check(username, password string) bool {
 	pw, ok := c.store[username]
-	if !ok {
+	if !ok || pw == "" {
 		return false
 	}
 	return password == pw ||
 		bcrypt.CompareHashAndPassword([]byte(pw), []byte(password)) == nil
 }
 
+// Exists returns true if username is in the store, whether or not it has
+// a password.
+func (c *CredentialsStore) Exists(username string) bool {
+	_, ok := c.store[username]
+	return ok
+}
+
 // CheckRequest returns true if b contains a valid username and password.
 func (c *CredentialsStore) CheckRequest(b BasicAuther) bool {
 	username, password, ok := b.BasicAuth()
@@ -328,3 +328,32 @@ func Test_AuthPermsNilLoadSingle(t *testing.T) {
 		t.Fatalf("wrong has foo perm")
 	}
 }
+
+func Test_AuthNoPasswordLoadSingle(t *testing.T) {
+	const jsonStream = `
+		[
+			{
+				"username": "service1",
+				"perms": ["query"]
+			}
+		]
+	`
+
+	store := NewCredentialsStore()
+	if err := store.Load(strings.NewReader(jsonStream)); err != nil {
+		t.Fatalf("failed to load single credential: %s", err.Error())
+	}
+
+	if !store.Exists("service1") {
+		t.Fatalf("single credential not loaded correctly")
+	}
+	if store.Exists("service2") {
+		t.Fatalf("unknown user exists")
+	}
+	if check := store.Check("service1", ""); check {
+		t.Fatalf("user without password authenticated with empty password")
+	}
+	if perm := store.HasPerm("service1", "query"); !perm {
+		t.Fatalf("service1 does not have query perm")
+	}
+}
@@ -1,10 +1,8 @@
 package cluster
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"sync"
 	"time"
@@ -24,20 +22,31 @@ type Client struct {
 	dialer  Dialer
 	timeout time.Duration
 
+	// MaxMessageSize is the largest request sent, or response accepted.
+	MaxMessageSize int64
+
+	// BuildVersion is the version of rqlite, reported to other nodes.
+	BuildVersion string
+
 	lMu           sync.RWMutex
 	localNodeAddr string
 	localServ     *Service
 
 	mu    sync.RWMutex
 	pools map[string]pool.Pool
+
+	iMu   sync.RWMutex
+	nodes map[string]*NodeInfo // Learned by handshake, keyed by node address.
 }
 
 // NewClient returns a client instance for talking to a remote node.
 func NewClient(dl Dialer) *Client {
 	return &Client{
-		dialer:  dl,
-		timeout: 30 * time.Second,
-		pools:   make(map[string]pool.Pool),
+		dialer:         dl,
+		timeout:        30 * time.Second,
+		MaxMessageSize: DefaultMaxMessageSize,
+		pools:          make(map[string]pool.Pool),
+		nodes:          make(map[string]*NodeInfo),
 	}
 }
 
@@ -74,62 +83,45 @@ func (c *Client) GetNodeAPIAddr(nodeAddr string, timeout time.Duration) (string,
 	}
 	defer conn.Close()
 
-	// Send the request
-	command := &Command{
-		Type: Command_COMMAND_TYPE_GET_NODE_API_URL,
-	}
-	p, err := proto.Marshal(command)
-	if err != nil {
-		return "", fmt.Errorf("command marshal: %s", err)
-	}
-
-	// Write length of Protobuf
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint16(b[0:], uint16(len(p)))
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		handleConnError(conn)
-		return "", err
-	}
-	_, err = conn.Write(b)
-	if err != nil {
-		handleConnError(conn)
-		return "", fmt.Errorf("write protobuf length: %s", err)
-	}
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		handleConnError(conn)
+	a := &Address{}
+	if err := c.roundTrip(conn, nodeAddr, &Command{
+		Type:      Command_COMMAND_TYPE_GET_NODE_API_URL,
+		Handshake: newHandshake(c.BuildVersion),
+	}, a, timeout); err != nil {
 		return "", err
 	}
-	_, err = conn.Write(p)
-	if err != nil {
-		handleConnError(conn)
-		return "", fmt.Errorf("write protobuf: %s", err)
-	}
+	c.setNodeInfo(nodeAddr, nodeInfoFromAddress(a))
+	return a.Url, nil
+}
 
-	// Read length of response.
-	_, err = io.ReadFull(conn, b)
-	if err != nil {
-		return "", err
-	}
-	sz := binary.LittleEndian.Uint16(b[0:])
+// NodeInfo returns what is known of the node at nodeAddr, or nil if this
+// client has not yet connected to the node.
+func (c *Client) NodeInfo(nodeAddr string) *NodeInfo {
+	c.iMu.RLock()
+	defer c.iMu.RUnlock()
+	return c.nodes[nodeAddr]
+}
 
-	// Read in the actual response.
-	p = make([]byte, sz)
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		handleConnError(conn)
-		return "", err
-	}
-	_, err = io.ReadFull(conn, p)
-	if err != nil {
-		return "", err
+// NodeBuildVersion returns the version of rqlite running on the node at
+// nodeAddr, or an empty string if it is not known.
+func (c *Client) NodeBuildVersion(nodeAddr string) string {
+	c.lMu.RLock()
+	if c.localNodeAddr == nodeAddr && c.localServ != nil {
+		defer c.lMu.RUnlock()
+		return c.localServ.BuildVersion
 	}
+	c.lMu.RUnlock()
 
-	a := &Address{}
-	err = proto.Unmarshal(p, a)
-	if err != nil {
-		return "", fmt.Errorf("protobuf unmarshal: %s", err)
+	if n := c.NodeInfo(nodeAddr); n != nil {
+		return n.BuildVersion
 	}
+	return ""
+}
 
-	return a.Url, nil
+func (c *Client) setNodeInfo(nodeAddr string, n *NodeInfo) {
+	c.iMu.Lock()
+	defer c.iMu.Unlock()
+	c.nodes[nodeAddr] = n
 }
 
 // Execute performs an Execute on a remote node.
@@ -140,144 +132,195 @@ func (c *Client) Execute(er *command.ExecuteRequest, nodeAddr string, timeout ti
 	}
 	defer conn.Close()
 
-	// Create the request.
-	command := &Command{
+	a := &CommandExecuteResponse{}
+	if err := c.roundTrip(conn, nodeAddr, &Command{
 		Type: Command_COMMAND_TYPE_EXECUTE,
 		Request: &Command_ExecuteRequest{
 			ExecuteRequest: er,
 		},
-	}
-	p, err := proto.Marshal(command)
-	if err != nil {
-		return nil, fmt.Errorf("command marshal: %s", err)
-	}
-
-	// Write length of Protobuf
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint16(b[0:], uint16(len(p)))
-
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		handleConnError(conn)
-		return nil, err
-	}
-	_, err = conn.Write(b)
-	if err != nil {
-		handleConnError(conn)
+		RequestId:    er.GetRequest().GetRequestId(),
+		ParentSpanId: er.GetRequest().GetParentSpanId(),
+	}, a, timeout); err != nil {
 		return nil, err
 	}
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		handleConnError(conn)
-		return nil, err
+
+	if a.Error != "" {
+		return nil, errors.New(a.Error)
 	}
-	_, err = conn.Write(p)
+	return a.Results, nil
+}
+
+// Query performs an Query on a remote node.
+func (c *Client) Query(qr *command.QueryRequest, nodeAddr string, timeout time.Duration) ([]*command.QueryRows, error) {
+	conn, err := c.dial(nodeAddr, c.timeout)
 	if err != nil {
-		handleConnError(conn)
 		return nil, err
 	}
+	defer conn.Close()
 
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		handleConnError(conn)
+	a := &CommandQueryResponse{}
+	if err := c.roundTrip(conn, nodeAddr, &Command{
+		Type: Command_COMMAND_TYPE_QUERY,
+		Request: &Command_QueryRequest{
+			QueryRequest: qr,
+		},
+		RequestId:    qr.GetRequest().GetRequestId(),
+		ParentSpanId: qr.GetRequest().GetParentSpanId(),
+	}, a, timeout); err != nil {
 		return nil, err
 	}
 
-	// Read length of response.
-	_, err = io.ReadFull(conn, b)
-	if err != nil {
-		return nil, err
+	if a.Error != "" {
+		return nil, errors.New(a.Error)
 	}
-	sz := binary.LittleEndian.Uint16(b[0:])
+	return a.Rows, nil
+}
 
-	// Read in the actual response.
-	p = make([]byte, sz)
-	_, err = io.ReadFull(conn, p)
+// ExecuteQueued adds the request to the write queue of a remote node,
+// returning its sequence number. If wait is set, the remote node waits until
+// timeout for the write to be committed. If the write was queued, but waiting
+// for it failed, both the sequence number and the error are returned.
+func (c *Client) ExecuteQueued(er *command.ExecuteRequest, wait bool, nodeAddr string, timeout time.Duration) (uint64, error) {
+	conn, err := c.dial(nodeAddr, c.timeout)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	defer conn.Close()
 
-	a := &CommandExecuteResponse{}
-	err = proto.Unmarshal(p, a)
-	if err != nil {
-		return nil, err
+	// The remote node may wait for up to the timeout before responding.
+	a := &CommandExecuteQueuedResponse{}
+	if err := c.roundTrip(conn, nodeAddr, &Command{
+		Type: Command_COMMAND_TYPE_EXECUTE_QUEUED,
+		Request: &Command_ExecuteQueuedRequest{
+			ExecuteQueuedRequest: &ExecuteQueuedRequest{
+				Request: er,
+				Wait:    wait,
+				Timeout: timeout.Nanoseconds(),
+			},
+		},
+		RequestId:    er.GetRequest().GetRequestId(),
+		ParentSpanId: er.GetRequest().GetParentSpanId(),
+	}, a, 2*timeout); err != nil {
+		return 0, err
 	}
 
 	if a.Error != "" {
-		return nil, errors.New(a.Error)
+		return a.SequenceNumber, errors.New(a.Error)
 	}
-	return a.Results, nil
+	return a.SequenceNumber, nil
 }
 
-// Query performs an Query on a remote node.
-func (c *Client) Query(qr *command.QueryRequest, nodeAddr string, timeout time.Duration) ([]*command.QueryRows, error) {
+// Checksum returns the checksum the remote node computed at the given index.
+// The remote node waits until timeout for the index to be applied.
+func (c *Client) Checksum(idx uint64, nodeAddr string, timeout time.Duration) (string, error) {
 	conn, err := c.dial(nodeAddr, c.timeout)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer conn.Close()
 
-	// Create the request.
-	command := &Command{
-		Type: Command_COMMAND_TYPE_QUERY,
-		Request: &Command_QueryRequest{
-			QueryRequest: qr,
+	// The remote node may wait for up to the timeout before responding.
+	a := &CommandChecksumResponse{}
+	if err := c.roundTrip(conn, nodeAddr, &Command{
+		Type: Command_COMMAND_TYPE_CHECKSUM,
+		Request: &Command_ChecksumRequest{
+			ChecksumRequest: &ChecksumRequest{
+				Index:   idx,
+				Timeout: timeout.Nanoseconds(),
+			},
 		},
-	}
-	p, err := proto.Marshal(command)
-	if err != nil {
-		return nil, fmt.Errorf("command marshal: %s", err)
+	}, a, 2*timeout); err != nil {
+		return "", err
 	}
 
-	// Write length of Protobuf, then the Protobuf
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint16(b[0:], uint16(len(p)))
+	if a.Error != "" {
+		return "", errors.New(a.Error)
+	}
+	return a.Checksum, nil
+}
 
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		handleConnError(conn)
-		return nil, err
+// roundTrip sends the command cmd over conn, a connection to the node at
+// nodeAddr, and reads the response into resp. The exchange must complete
+// within the timeout.
+func (c *Client) roundTrip(conn net.Conn, nodeAddr string, cmd *Command, resp proto.Message, timeout time.Duration) error {
+	info := c.NodeInfo(nodeAddr)
+	if info != nil && !info.Supports(cmd.Type) {
+		stats.Add(numUnsupportedCommand, 1)
+		return fmt.Errorf("%w: node %s does not support %s", ErrUnsupportedCommand, nodeAddr, cmd.Type)
 	}
-	_, err = conn.Write(b)
+
+	cmd.ProtocolVersion = ProtocolVersion
+	p, err := proto.Marshal(cmd)
 	if err != nil {
-		handleConnError(conn)
-		return nil, err
+		return fmt.Errorf("command marshal: %s", err)
 	}
+	if int64(len(p)) > c.MaxMessageSize {
+		stats.Add(numMessageTooLarge, 1)
+		return fmt.Errorf("request of %d bytes exceeds maximum message size of %d bytes",
+			len(p), c.MaxMessageSize)
+	}
+
 	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
 		handleConnError(conn)
-		return nil, err
+		return err
 	}
-	_, err = conn.Write(p)
-	if err != nil {
-		handleConnError(conn)
-		return nil, err
+
+	// A node speaking version 1 of the protocol would misread a request
+	// too large for a 16-bit length, so check the node can receive it.
+	if len(p) > legacyMaxMessageSize && info != nil && info.ProtocolVersion < protocolVersionChunked {
+		stats.Add(numMessageTooLarge, 1)
+		return fmt.Errorf("request of %d bytes exceeds maximum message size of %d bytes of node %s, which uses cluster protocol version %d",
+			len(p), legacyMaxMessageSize, nodeAddr, info.ProtocolVersion)
 	}
 
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+	if err := writeMessage(conn, p); err != nil {
 		handleConnError(conn)
-		return nil, err
+		return fmt.Errorf("write protobuf: %s", err)
 	}
-
-	// Read length of response.
-	_, err = io.ReadFull(conn, b)
+	p, err = readMessage(conn, c.MaxMessageSize)
 	if err != nil {
-		return nil, err
+		handleConnError(conn)
+		if err == ErrMessageTooLarge {
+			stats.Add(numMessageTooLarge, 1)
+		}
+		return err
+	}
+	if err := proto.Unmarshal(p, resp); err != nil {
+		return fmt.Errorf("protobuf unmarshal: %s", err)
 	}
-	sz := binary.LittleEndian.Uint16(b[0:])
+	return nil
+}
 
-	// Read in the actual response.
-	p = make([]byte, sz)
-	_, err = io.ReadFull(conn, p)
+// handshake exchanges versions, and supported commands, with the node at
+// nodeAddr, over conn, a new connection to the node. The handshake is a
+// request for the node's API address, so nodes which predate the handshake
+// answer it too, and are then sent only the commands they handled before.
+func (c *Client) handshake(conn net.Conn, nodeAddr string) error {
+	p, err := proto.Marshal(&Command{
+		Type:            Command_COMMAND_TYPE_GET_NODE_API_URL,
+		ProtocolVersion: ProtocolVersion,
+		Handshake:       newHandshake(c.BuildVersion),
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	a := &CommandQueryResponse{}
-	err = proto.Unmarshal(p, a)
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	if err := writeMessage(conn, p); err != nil {
+		return err
+	}
+	p, err = readMessage(conn, legacyMaxMessageSize)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	if a.Error != "" {
-		return nil, errors.New(a.Error)
+	a := &Address{}
+	if err := proto.Unmarshal(p, a); err != nil {
+		return err
 	}
-	return a.Rows, nil
+	c.setNodeInfo(nodeAddr, nodeInfoFromAddress(a))
+	stats.Add(numHandshake, 1)
+	return conn.SetDeadline(time.Time{})
 }
 
 // Stats returns stats on the Client instance
@@ -286,9 +329,26 @@ func (c *Client) Stats() (map[string]interface{}, error) {
 	defer c.mu.RUnlock()
 
 	stats := map[string]interface{}{
-		"timeout":         c.timeout,
-		"local_node_addr": c.localNodeAddr,
+		"timeout":          c.timeout,
+		"local_node_addr":  c.localNodeAddr,
+		"max_message_size": c.MaxMessageSize,
+		"protocol_version": ProtocolVersion,
+		"build_version":    c.BuildVersion,
+	}
+
+	c.iMu.RLock()
+	if len(c.nodes) > 0 {
+		nodes := make(map[string]interface{}, len(c.nodes))
+		for k, v := range c.nodes {
+			nodes[k] = map[string]interface{}{
+				"protocol_version": v.ProtocolVersion,
+				"build_version":    v.BuildVersion,
+				"commands":         v.Commands(),
+			}
+		}
+		stats["nodes"] = nodes
 	}
+	c.iMu.RUnlock()
 
 	if (len(c.pools)) == 0 {
 		return stats, nil
@@ -325,7 +385,17 @@ func (c *Client) dial(nodeAddr string, timeout time.Duration) (net.Conn, error)
 			}
 
 			// New pool is needed for given address.
-			factory := func() (net.Conn, error) { return c.dialer.Dial(nodeAddr, c.timeout) }
+			factory := func() (net.Conn, error) {
+				conn, err := c.dialer.Dial(nodeAddr, c.timeout)
+				if err != nil {
+					return nil, err
+				}
+				if err := c.handshake(conn, nodeAddr); err != nil {
+					conn.Close()
+					return nil, fmt.Errorf("handshake with %s: %s", nodeAddr, err)
+				}
+				return conn, nil
+			}
 			p, err := pool.NewChannelPool(initialPoolSize, maxPoolCapacity, factory)
 			if err != nil {
 				return err
@@ -0,0 +1,114 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+const (
+	// ProtocolVersion is the version of the cluster protocol spoken by this
+	// node. Version 1 sends each message as a single frame with a 16-bit
+	// length, so messages are limited to 64 KiB. Version 2 sends messages of
+	// any size as a sequence of chunks, each with a 32-bit length. Version 3
+	// adds a handshake to each new connection.
+	ProtocolVersion = 3
+
+	// protocolVersionChunked is the first version which sends messages in
+	// chunks.
+	protocolVersionChunked = 2
+
+	// protocolVersionLegacy is the version spoken by nodes which do not
+	// report a version.
+	protocolVersionLegacy = 1
+
+	// legacyMaxMessageSize is the largest message a node speaking version 1
+	// of the protocol can receive.
+	legacyMaxMessageSize = math.MaxUint16
+
+	// DefaultMaxMessageSize is the default limit on the size of a message
+	// sent or received.
+	DefaultMaxMessageSize = 64 * 1024 * 1024
+
+	// maxChunkSize is the largest chunk this node sends.
+	maxChunkSize = 1024 * 1024
+
+	// moreChunks is set in the header of every chunk of a message but the
+	// last.
+	moreChunks = 1 << 31
+)
+
+// ErrMessageTooLarge is returned when a message exceeds the maximum size.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// writeMessage writes p to w as a sequence of chunks. Each chunk is preceded
+// by a 4-byte little-endian header holding the length of the chunk, with
+// the top bit set if further chunks follow. A message of less than 64 KiB
+// is therefore sent exactly as version 1 of the protocol sends it.
+func writeMessage(w io.Writer, p []byte) error {
+	for {
+		n := len(p)
+		hdr := uint32(n)
+		if n > maxChunkSize {
+			n = maxChunkSize
+			hdr = uint32(n) | moreChunks
+		}
+
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], hdr)
+		bufs := net.Buffers{b[:], p[:n]}
+		if _, err := bufs.WriteTo(w); err != nil {
+			return err
+		}
+
+		p = p[n:]
+		if hdr&moreChunks == 0 {
+			return nil
+		}
+	}
+}
+
+// readMessage reads a message, written by writeMessage, from r. If the
+// message is larger than maxSize, the rest of the message is discarded, and
+// ErrMessageTooLarge is returned.
+func readMessage(r io.Reader, maxSize int64) ([]byte, error) {
+	var p []byte
+	var sz int64
+	for {
+		var b [4]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		hdr := binary.LittleEndian.Uint32(b[:])
+		n := int64(hdr &^ moreChunks)
+
+		sz += n
+		if sz > maxSize {
+			p = nil
+			if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+				return nil, err
+			}
+		} else {
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return nil, err
+			}
+			if p == nil {
+				p = chunk
+			} else {
+				p = append(p, chunk...)
+			}
+		}
+
+		if hdr&moreChunks == 0 {
+			break
+		}
+	}
+	if sz > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+	return p, nil
+}
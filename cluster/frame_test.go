@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func Test_MessageLegacyFraming(t *testing.T) {
+	p := []byte("some protobuf")
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, p); err != nil {
+		t.Fatalf("failed to write message: %s", err)
+	}
+
+	// Version 1 of the protocol wrote a 16-bit length into a 4-byte header.
+	exp := make([]byte, 4)
+	binary.LittleEndian.PutUint16(exp, uint16(len(p)))
+	exp = append(exp, p...)
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Fatalf("small message not framed as version 1, exp %v, got %v", exp, buf.Bytes())
+	}
+
+	got, err := readMessage(&buf, legacyMaxMessageSize)
+	if err != nil {
+		t.Fatalf("failed to read message: %s", err)
+	}
+	if !bytes.Equal(got, p) {
+		t.Fatalf("wrong message read, exp %s, got %s", p, got)
+	}
+}
+
+func Test_MessageChunked(t *testing.T) {
+	p := bytes.Repeat([]byte("abcdefg"), maxChunkSize/2)
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, p); err != nil {
+		t.Fatalf("failed to write message: %s", err)
+	}
+	if err := writeMessage(&buf, []byte("next")); err != nil {
+		t.Fatalf("failed to write message: %s", err)
+	}
+	if exp, got := len(p)+4*4+len("next")+4, buf.Len(); exp != got {
+		t.Fatalf("wrong number of bytes written, exp %d, got %d", exp, got)
+	}
+
+	got, err := readMessage(&buf, DefaultMaxMessageSize)
+	if err != nil {
+		t.Fatalf("failed to read message: %s", err)
+	}
+	if !bytes.Equal(got, p) {
+		t.Fatalf("chunked message not read correctly")
+	}
+	got, err = readMessage(&buf, DefaultMaxMessageSize)
+	if err != nil {
+		t.Fatalf("failed to read message: %s", err)
+	}
+	if string(got) != "next" {
+		t.Fatalf("wrong message read after chunked message, got %s", got)
+	}
+}
+
+func Test_MessageTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, make([]byte, 2*maxChunkSize+1)); err != nil {
+		t.Fatalf("failed to write message: %s", err)
+	}
+	if err := writeMessage(&buf, []byte("next")); err != nil {
+		t.Fatalf("failed to write message: %s", err)
+	}
+
+	if _, err := readMessage(&buf, maxChunkSize); err != ErrMessageTooLarge {
+		t.Fatalf("wrong error for message too large: %v", err)
+	}
+
+	// The rest of the message is discarded, so the next can be read.
+	got, err := readMessage(&buf, maxChunkSize)
+	if err != nil {
+		t.Fatalf("failed to read message: %s", err)
+	}
+	if string(got) != "next" {
+		t.Fatalf("wrong message read after message too large, got %s", got)
+	}
+}
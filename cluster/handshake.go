@@ -0,0 +1,80 @@
+package cluster
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrUnsupportedCommand is returned when a command is sent to a node which
+// does not support it.
+var ErrUnsupportedCommand = errors.New("command not supported by node")
+
+// supportedCommands are the types of command this node handles.
+var supportedCommands = []Command_Type{
+	Command_COMMAND_TYPE_GET_NODE_API_URL,
+	Command_COMMAND_TYPE_EXECUTE,
+	Command_COMMAND_TYPE_QUERY,
+	Command_COMMAND_TYPE_CHECKSUM,
+	Command_COMMAND_TYPE_EXECUTE_QUEUED,
+}
+
+// legacyCommands are the types of command handled by nodes which predate the
+// handshake. Such nodes do not answer other types, so none may be sent.
+var legacyCommands = []Command_Type{
+	Command_COMMAND_TYPE_GET_NODE_API_URL,
+	Command_COMMAND_TYPE_EXECUTE,
+	Command_COMMAND_TYPE_QUERY,
+}
+
+// newHandshake returns the handshake describing this node.
+func newHandshake(buildVersion string) *Handshake {
+	return &Handshake{
+		ProtocolVersion: ProtocolVersion,
+		BuildVersion:    buildVersion,
+		Commands:        supportedCommands,
+	}
+}
+
+// NodeInfo describes a remote node, as reported by the node.
+type NodeInfo struct {
+	ProtocolVersion uint32
+	BuildVersion    string // Empty if not reported.
+
+	// commands are the types of command the node supports.
+	commands map[Command_Type]bool
+}
+
+// nodeInfoFromAddress returns the description of a node contained in the
+// response a, from the node, to a request for its API address.
+func nodeInfoFromAddress(a *Address) *NodeInfo {
+	n := &NodeInfo{ProtocolVersion: a.ProtocolVersion}
+	if n.ProtocolVersion == 0 {
+		n.ProtocolVersion = protocolVersionLegacy
+	}
+	commands := legacyCommands
+	if h := a.Handshake; h != nil {
+		n.ProtocolVersion = h.ProtocolVersion
+		n.BuildVersion = h.BuildVersion
+		commands = h.Commands
+	}
+	n.commands = make(map[Command_Type]bool, len(commands))
+	for _, t := range commands {
+		n.commands[t] = true
+	}
+	return n
+}
+
+// Supports returns whether the node supports commands of the given type.
+func (n *NodeInfo) Supports(t Command_Type) bool {
+	return n.commands[t]
+}
+
+// Commands returns the names of the types of command the node supports.
+func (n *NodeInfo) Commands() []string {
+	names := make([]string, 0, len(n.commands))
+	for t := range n.commands {
+		names = append(names, t.String())
+	}
+	sort.Strings(names)
+	return names
+}
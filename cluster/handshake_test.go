@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func Test_ClientHandshake(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	defer ln.Close()
+	tn := mux.Listen(1) // Could be any byte value.
+	s := New(tn, mustNewMockDatabase())
+	s.BuildVersion = "v1.2.3"
+	if err := s.Open(); err != nil {
+		t.Fatalf("failed to open cluster service: %s", err.Error())
+	}
+	defer s.Close()
+
+	c := NewClient(mustNewDialer(1, false, false))
+	c.BuildVersion = "v4.5.6"
+	if n := c.NodeInfo(s.Addr()); n != nil {
+		t.Fatalf("node info known before connecting")
+	}
+	if _, err := c.GetNodeAPIAddr(s.Addr(), fiveSec); err != nil {
+		t.Fatalf("failed to get node API address: %s", err)
+	}
+
+	n := c.NodeInfo(s.Addr())
+	if n == nil {
+		t.Fatalf("node info not known after connecting")
+	}
+	if n.ProtocolVersion != ProtocolVersion {
+		t.Fatalf("wrong protocol version, exp %d, got %d", ProtocolVersion, n.ProtocolVersion)
+	}
+	if exp, got := "v1.2.3", c.NodeBuildVersion(s.Addr()); exp != got {
+		t.Fatalf("wrong build version, exp %s, got %s", exp, got)
+	}
+	for _, typ := range supportedCommands {
+		if !n.Supports(typ) {
+			t.Fatalf("node does not support %s", typ)
+		}
+	}
+	if n.Supports(Command_Type(99)) {
+		t.Fatalf("node supports unknown command type")
+	}
+
+	// The local node is not contacted.
+	if err := c.SetLocal(s.Addr(), s); err != nil {
+		t.Fatalf("failed to set local: %s", err)
+	}
+	s.BuildVersion = "v7.8.9"
+	if exp, got := "v7.8.9", c.NodeBuildVersion(s.Addr()); exp != got {
+		t.Fatalf("wrong build version of local node, exp %s, got %s", exp, got)
+	}
+}
+
+func Test_ClientUnsupportedCommand(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	defer ln.Close()
+	tn := mux.Listen(1) // Could be any byte value.
+
+	// A node which does not support checksums.
+	go serveAddress(tn, &Address{
+		Url:             "http://localhost:4001",
+		ProtocolVersion: ProtocolVersion,
+		Handshake: &Handshake{
+			ProtocolVersion: ProtocolVersion,
+			BuildVersion:    "v1.2.3",
+			Commands: []Command_Type{
+				Command_COMMAND_TYPE_GET_NODE_API_URL,
+				Command_COMMAND_TYPE_EXECUTE,
+				Command_COMMAND_TYPE_QUERY,
+			},
+		},
+	})
+
+	c := NewClient(mustNewDialer(1, false, false))
+	_, err := c.Checksum(1, tn.Addr().String(), fiveSec)
+	if !errors.Is(err, ErrUnsupportedCommand) {
+		t.Fatalf("failed to receive expected error, got: %v", err)
+	}
+	if exp, got := "v1.2.3", c.NodeBuildVersion(tn.Addr().String()); exp != got {
+		t.Fatalf("wrong build version, exp %s, got %s", exp, got)
+	}
+}
+
+func Test_ClientLegacyNodeCommands(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	defer ln.Close()
+	tn := mux.Listen(1) // Could be any byte value.
+
+	// A node which predates the handshake.
+	go serveAddress(tn, &Address{Url: "http://localhost:4001", ProtocolVersion: 2})
+
+	c := NewClient(mustNewDialer(1, false, false))
+	if _, err := c.GetNodeAPIAddr(tn.Addr().String(), fiveSec); err != nil {
+		t.Fatalf("failed to get node API address: %s", err)
+	}
+	n := c.NodeInfo(tn.Addr().String())
+	if n == nil || n.ProtocolVersion != 2 || n.BuildVersion != "" {
+		t.Fatalf("wrong node info for legacy node: %+v", n)
+	}
+	for _, typ := range legacyCommands {
+		if !n.Supports(typ) {
+			t.Fatalf("legacy node does not support %s", typ)
+		}
+	}
+	if n.Supports(Command_COMMAND_TYPE_CHECKSUM) {
+		t.Fatalf("legacy node supports checksums")
+	}
+	if exp, got := `[COMMAND_TYPE_EXECUTE COMMAND_TYPE_GET_NODE_API_URL COMMAND_TYPE_QUERY]`, fmt.Sprint(n.Commands()); exp != got {
+		t.Fatalf("wrong commands for legacy node, exp %s, got %s", exp, got)
+	}
+}
+
+func Test_ClientLegacyNodeChecksum(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	defer ln.Close()
+	tn := mux.Listen(1) // Could be any byte value.
+
+	// A node which predates the handshake, and never answers checksums.
+	go serveAddress(tn, &Address{Url: "http://localhost:4001", ProtocolVersion: 2})
+
+	c := NewClient(mustNewDialer(1, false, false))
+	start := time.Now()
+	_, err := c.Checksum(1, tn.Addr().String(), fiveSec)
+	if !errors.Is(err, ErrUnsupportedCommand) {
+		t.Fatalf("failed to receive expected error, got: %v", err)
+	}
+	if d := time.Since(start); d >= fiveSec {
+		t.Fatalf("checksum of legacy node not refused immediately, took %s", d)
+	}
+}
+
+func Test_ServiceUnsupportedCommand(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	defer ln.Close()
+	tn := mux.Listen(1) // Could be any byte value.
+	s := New(tn, mustNewMockDatabase())
+	if err := s.Open(); err != nil {
+		t.Fatalf("failed to open cluster service: %s", err.Error())
+	}
+	defer s.Close()
+
+	conn, err := mustNewDialer(1, false, false).Dial(s.Addr(), fiveSec)
+	if err != nil {
+		t.Fatalf("failed to dial cluster service: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(fiveSec))
+
+	p, _ := proto.Marshal(&Command{Type: Command_Type(99), ProtocolVersion: ProtocolVersion})
+	if err := writeMessage(conn, p); err != nil {
+		t.Fatalf("failed to write command: %s", err)
+	}
+	p, err = readMessage(conn, DefaultMaxMessageSize)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	resp := &CommandErrorResponse{}
+	if err := proto.Unmarshal(p, resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	if !strings.Contains(resp.Error, "unsupported command type") {
+		t.Fatalf("wrong error in response: %s", resp.Error)
+	}
+
+	// The connection remains usable.
+	p, _ = proto.Marshal(&Command{Type: Command_COMMAND_TYPE_GET_NODE_API_URL, ProtocolVersion: ProtocolVersion})
+	if err := writeMessage(conn, p); err != nil {
+		t.Fatalf("failed to write command: %s", err)
+	}
+	if _, err := readMessage(conn, DefaultMaxMessageSize); err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+}
@@ -7,14 +7,14 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
+	sql "github.com/rqlite/rqlite/db"
 	httpd "github.com/rqlite/rqlite/http"
+	"github.com/rqlite/rqlite/logging"
 )
 
 var (
@@ -30,7 +30,7 @@ func Join(srcIP string, joinAddr []string, id, addr string, voter bool, numAttem
 	attemptInterval time.Duration, tlsConfig *tls.Config) (string, error) {
 	var err error
 	var j string
-	logger := log.New(os.Stderr, "[cluster-join] ", log.LstdFlags)
+	logger := logging.New("cluster")
 	if tlsConfig == nil {
 		tlsConfig = &tls.Config{InsecureSkipVerify: true}
 	}
@@ -43,14 +43,14 @@ func Join(srcIP string, joinAddr []string, id, addr string, voter bool, numAttem
 				return j, nil
 			}
 		}
-		logger.Printf("failed to join cluster at %s: %s, sleeping %s before retry", joinAddr, err.Error(), attemptInterval)
+		logger.Warnf("failed to join cluster at %s: %s, sleeping %s before retry", joinAddr, err.Error(), attemptInterval)
 		time.Sleep(attemptInterval)
 	}
-	logger.Printf("failed to join cluster at %s, after %d attempts", joinAddr, numAttempts)
+	logger.Errorf("failed to join cluster at %s, after %d attempts", joinAddr, numAttempts)
 	return "", ErrJoinFailed
 }
 
-func join(srcIP, joinAddr, id, addr string, voter bool, tlsConfig *tls.Config, logger *log.Logger) (string, error) {
+func join(srcIP, joinAddr, id, addr string, voter bool, tlsConfig *tls.Config, logger *logging.Logger) (string, error) {
 	if id == "" {
 		return "", fmt.Errorf("node ID not set")
 	}
@@ -88,6 +88,9 @@ func join(srcIP, joinAddr, id, addr string, voter bool, tlsConfig *tls.Config, l
 			"id":    id,
 			"addr":  resv.String(),
 			"voter": voter,
+			// Allow the cluster to check this node loads the same
+			// SQLite extensions.
+			"extensions": sql.Extensions(),
 		})
 		if err != nil {
 			return "", err
@@ -124,7 +127,7 @@ func join(srcIP, joinAddr, id, addr string, voter bool, tlsConfig *tls.Config, l
 				return "", fmt.Errorf("failed to join, node returned: %s: (%s)", resp.Status, string(b))
 			}
 
-			logger.Print("join via HTTP failed, trying via HTTPS")
+			logger.Infof("join via HTTP failed, trying via HTTPS")
 			fullAddr = httpd.EnsureHTTPS(fullAddr)
 			continue
 		default:
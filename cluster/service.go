@@ -1,29 +1,32 @@
 package cluster
 
 import (
-	"encoding/binary"
 	"expvar"
 	"fmt"
-	"io"
-	"log"
 	"net"
-	"os"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/rqlite/rqlite/command"
+	"github.com/rqlite/rqlite/logging"
+	"github.com/rqlite/rqlite/tracing"
 )
 
 // stats captures stats for the Cluster service.
 var stats *expvar.Map
 
 const (
-	numGetNodeAPIRequest  = "num_get_node_api_req"
-	numGetNodeAPIResponse = "num_get_node_api_resp"
-	numExecuteRequest     = "num_execute_req"
-	numQueryRequest       = "num_query_req"
+	numGetNodeAPIRequest    = "num_get_node_api_req"
+	numGetNodeAPIResponse   = "num_get_node_api_resp"
+	numExecuteRequest       = "num_execute_req"
+	numQueryRequest         = "num_query_req"
+	numChecksumRequest      = "num_checksum_req"
+	numExecuteQueuedRequest = "num_execute_queued_req"
+	numMessageTooLarge      = "num_message_too_large"
+	numHandshake            = "num_handshake"
+	numUnsupportedCommand   = "num_unsupported_command"
 
 	// Client stats for this package.
 	numGetNodeAPIRequestLocal = "num_get_node_api_req_local"
@@ -43,6 +46,11 @@ func init() {
 	stats.Add(numGetNodeAPIResponse, 0)
 	stats.Add(numExecuteRequest, 0)
 	stats.Add(numQueryRequest, 0)
+	stats.Add(numChecksumRequest, 0)
+	stats.Add(numExecuteQueuedRequest, 0)
+	stats.Add(numMessageTooLarge, 0)
+	stats.Add(numHandshake, 0)
+	stats.Add(numUnsupportedCommand, 0)
 	stats.Add(numGetNodeAPIRequestLocal, 0)
 }
 
@@ -61,6 +69,18 @@ type Database interface {
 
 	// Query executes a slice of queries, each of which returns rows.
 	Query(qr *command.QueryRequest) ([]*command.QueryRows, error)
+
+	// ChecksumAt returns the checksum computed at the given index, waiting
+	// until timeout for the index to be applied.
+	ChecksumAt(idx uint64, timeout time.Duration) (string, error)
+
+	// ExecuteQueued adds the request to the write queue, returning its
+	// sequence number without waiting for it to be committed.
+	ExecuteQueued(er *command.ExecuteRequest) (uint64, error)
+
+	// WaitForQueued waits until the queued write with the given sequence
+	// number has been committed.
+	WaitForQueued(seq uint64, timeout time.Duration) error
 }
 
 // Transport is the interface the network layer must provide.
@@ -80,23 +100,33 @@ type Service struct {
 	https   bool   // Serving HTTPS?
 	apiAddr string // host:port this node serves the HTTP API.
 
-	logger *log.Logger
+	// Tracer records spans for forwarded requests. May be nil.
+	Tracer *tracing.Tracer
+
+	// MaxMessageSize is the largest request accepted, or response sent.
+	MaxMessageSize int64
+
+	// BuildVersion is the version of rqlite, reported to other nodes.
+	BuildVersion string
+
+	logger *logging.Logger
 }
 
 // New returns a new instance of the cluster service
 func New(tn Transport, db Database) *Service {
 	return &Service{
-		tn:     tn,
-		addr:   tn.Addr(),
-		db:     db,
-		logger: log.New(os.Stderr, "[cluster] ", log.LstdFlags),
+		tn:             tn,
+		addr:           tn.Addr(),
+		db:             db,
+		MaxMessageSize: DefaultMaxMessageSize,
+		logger:         logging.New("cluster"),
 	}
 }
 
 // Open opens the Service.
 func (s *Service) Open() error {
 	go s.serve()
-	s.logger.Println("service listening on", s.tn.Addr())
+	s.logger.Infof("service listening on %s", s.tn.Addr())
 	return nil
 }
 
@@ -148,9 +178,12 @@ func (s *Service) GetNodeAPIURL() string {
 // Stats returns status of the Service.
 func (s *Service) Stats() (map[string]interface{}, error) {
 	st := map[string]interface{}{
-		"addr":     s.addr.String(),
-		"https":    strconv.FormatBool(s.https),
-		"api_addr": s.apiAddr,
+		"addr":             s.addr.String(),
+		"https":            strconv.FormatBool(s.https),
+		"api_addr":         s.apiAddr,
+		"max_message_size": s.MaxMessageSize,
+		"protocol_version": ProtocolVersion,
+		"build_version":    s.BuildVersion,
 	}
 
 	return st, nil
@@ -171,40 +204,44 @@ func (s *Service) handleConn(conn net.Conn) {
 	defer conn.Close()
 
 	for {
-		b := make([]byte, 4)
-		_, err := io.ReadFull(conn, b)
+		p, err := readMessage(conn, s.MaxMessageSize)
 		if err != nil {
+			if err == ErrMessageTooLarge {
+				stats.Add(numMessageTooLarge, 1)
+				s.logger.Warnf("closing connection from %s: request exceeds maximum message size of %d bytes",
+					conn.RemoteAddr(), s.MaxMessageSize)
+			}
 			return
 		}
-		sz := binary.LittleEndian.Uint16(b[0:])
 
-		p := make([]byte, sz)
-		_, err = io.ReadFull(conn, p)
+		c := &Command{}
+		err = proto.Unmarshal(p, c)
 		if err != nil {
 			return
 		}
 
-		c := &Command{}
-		err = proto.Unmarshal(p, c)
-		if err != nil {
-			conn.Close()
+		// A client speaking version 1 of the protocol would misread a
+		// response too large for a 16-bit length.
+		limit := s.MaxMessageSize
+		if c.ProtocolVersion < protocolVersionChunked && limit > legacyMaxMessageSize {
+			limit = legacyMaxMessageSize
 		}
 
 		switch c.Type {
 		case Command_COMMAND_TYPE_GET_NODE_API_URL:
 			stats.Add(numGetNodeAPIRequest, 1)
-			p, err = proto.Marshal(&Address{
-				Url: s.GetNodeAPIURL(),
-			})
-			if err != nil {
-				conn.Close()
+			if h := c.Handshake; h != nil {
+				stats.Add(numHandshake, 1)
+				s.logger.Debugf("handshake from %s, protocol version %d, build version %s",
+					conn.RemoteAddr(), h.ProtocolVersion, h.BuildVersion)
+			}
+			if err := writeResponse(conn, &Address{
+				Url:             s.GetNodeAPIURL(),
+				ProtocolVersion: ProtocolVersion,
+				Handshake:       newHandshake(s.BuildVersion),
+			}, limit, nil); err != nil {
+				return
 			}
-
-			// Write length of Protobuf first, then write the actual Protobuf.
-			b = make([]byte, 4)
-			binary.LittleEndian.PutUint16(b[0:], uint16(len(p)))
-			conn.Write(b)
-			conn.Write(p)
 			stats.Add(numGetNodeAPIResponse, 1)
 
 		case Command_COMMAND_TYPE_EXECUTE:
@@ -213,10 +250,13 @@ func (s *Service) handleConn(conn net.Conn) {
 			resp := &CommandExecuteResponse{}
 
 			er := c.GetExecuteRequest()
+			s.logger.Debugf("request %s: execute forwarded by %s", c.RequestId, conn.RemoteAddr())
+			span := s.startSpan("cluster.execute", c, er.GetRequest())
 			if er == nil {
 				resp.Error = "ExecuteRequest is nil"
 			} else {
 				res, err := s.db.Execute(er)
+				span.SetError(err)
 				if err != nil {
 					resp.Error = err.Error()
 				} else {
@@ -226,16 +266,13 @@ func (s *Service) handleConn(conn net.Conn) {
 					}
 				}
 			}
+			span.End()
 
-			p, err := proto.Marshal(resp)
-			if err != nil {
+			if err := writeResponse(conn, resp, limit, func(err error) proto.Message {
+				return &CommandExecuteResponse{Error: err.Error()}
+			}); err != nil {
 				return
 			}
-			// Write length of Protobuf first, then write the actual Protobuf.
-			b = make([]byte, 4)
-			binary.LittleEndian.PutUint16(b[0:], uint16(len(p)))
-			conn.Write(b)
-			conn.Write(p)
 
 		case Command_COMMAND_TYPE_QUERY:
 			stats.Add(numQueryRequest, 1)
@@ -243,10 +280,13 @@ func (s *Service) handleConn(conn net.Conn) {
 			resp := &CommandQueryResponse{}
 
 			qr := c.GetQueryRequest()
+			s.logger.Debugf("request %s: query forwarded by %s", c.RequestId, conn.RemoteAddr())
+			span := s.startSpan("cluster.query", c, qr.GetRequest())
 			if qr == nil {
 				resp.Error = "QueryRequest is nil"
 			} else {
 				res, err := s.db.Query(qr)
+				span.SetError(err)
 				if err != nil {
 					resp.Error = err.Error()
 				} else {
@@ -256,16 +296,108 @@ func (s *Service) handleConn(conn net.Conn) {
 					}
 				}
 			}
+			span.End()
+
+			if err := writeResponse(conn, resp, limit, func(err error) proto.Message {
+				return &CommandQueryResponse{Error: err.Error()}
+			}); err != nil {
+				return
+			}
+
+		case Command_COMMAND_TYPE_CHECKSUM:
+			stats.Add(numChecksumRequest, 1)
+
+			resp := &CommandChecksumResponse{}
+
+			cr := c.GetChecksumRequest()
+			if cr == nil {
+				resp.Error = "ChecksumRequest is nil"
+			} else {
+				sum, err := s.db.ChecksumAt(cr.Index, time.Duration(cr.Timeout))
+				if err != nil {
+					resp.Error = err.Error()
+				} else {
+					resp.Checksum = sum
+				}
+			}
 
-			p, err = proto.Marshal(resp)
-			if err != nil {
+			if err := writeResponse(conn, resp, limit, func(err error) proto.Message {
+				return &CommandChecksumResponse{Error: err.Error()}
+			}); err != nil {
+				return
+			}
+
+		case Command_COMMAND_TYPE_EXECUTE_QUEUED:
+			stats.Add(numExecuteQueuedRequest, 1)
+
+			resp := &CommandExecuteQueuedResponse{}
+
+			qr := c.GetExecuteQueuedRequest()
+			er := qr.GetRequest()
+			s.logger.Debugf("request %s: queued execute forwarded by %s", c.RequestId, conn.RemoteAddr())
+			span := s.startSpan("cluster.execute_queued", c, er.GetRequest())
+			if er == nil {
+				resp.Error = "ExecuteQueuedRequest is nil"
+			} else {
+				seq, err := s.db.ExecuteQueued(er)
+				if err == nil && qr.Wait {
+					err = s.db.WaitForQueued(seq, time.Duration(qr.Timeout))
+				}
+				span.SetError(err)
+				resp.SequenceNumber = seq
+				if err != nil {
+					resp.Error = err.Error()
+				}
+			}
+			span.End()
+
+			if err := writeResponse(conn, resp, limit, nil); err != nil {
+				return
+			}
+
+		default:
+			// Respond, rather than close the connection, so the client
+			// learns why the command failed.
+			stats.Add(numUnsupportedCommand, 1)
+			s.logger.Warnf("unsupported command type %s from %s", c.Type, conn.RemoteAddr())
+			if err := writeResponse(conn, &CommandErrorResponse{
+				Error: fmt.Sprintf("unsupported command type %s", c.Type),
+			}, limit, nil); err != nil {
 				return
 			}
-			// Write length of Protobuf first, then write the actual Protobuf.
-			b = make([]byte, 4)
-			binary.LittleEndian.PutUint16(b[0:], uint16(len(p)))
-			conn.Write(b)
-			conn.Write(p)
 		}
 	}
 }
+
+// writeResponse writes the response m to conn. If m is larger than limit,
+// the response returned by tooLarge, reporting the error, is written instead.
+// If tooLarge is nil, an error is returned.
+func writeResponse(conn net.Conn, m proto.Message, limit int64, tooLarge func(err error) proto.Message) error {
+	p, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if int64(len(p)) > limit {
+		stats.Add(numMessageTooLarge, 1)
+		err := fmt.Errorf("response of %d bytes exceeds maximum message size of %d bytes", len(p), limit)
+		if tooLarge == nil {
+			return err
+		}
+		if p, err = proto.Marshal(tooLarge(err)); err != nil {
+			return err
+		}
+	}
+	return writeMessage(conn, p)
+}
+
+// startSpan starts a span for handling the forwarded command c. The request
+// r carried by the command is then traced under that span.
+func (s *Service) startSpan(name string, c *Command, r *command.Request) *tracing.Span {
+	span := s.Tracer.Start(name, tracing.TraceIDFromRequestID(c.RequestId), tracing.SpanIDFromBytes(c.ParentSpanId))
+	span.SetKind(tracing.KindServer)
+	span.SetAttribute("request_id", c.RequestId)
+	if span != nil && r != nil {
+		r.ParentSpanId = span.ID().Bytes()
+	}
+	return span
+}
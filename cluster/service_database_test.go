@@ -1,14 +1,23 @@
 package cluster
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/rqlite/rqlite/command"
 	"github.com/rqlite/rqlite/command/encoding"
+	"github.com/rqlite/rqlite/tracing"
 )
 
 const oneSec = 1 * time.Second
@@ -101,6 +110,67 @@ func Test_ServiceExecute(t *testing.T) {
 	}
 }
 
+func Test_ServiceExecuteTraced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rqlite-cluster-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tracePath := filepath.Join(dir, "traces.json")
+	e, err := tracing.NewFileExporter(tracePath)
+	if err != nil {
+		t.Fatalf("failed to create trace exporter: %s", err)
+	}
+	tracer := tracing.NewTracer("rqlite", "node1", e)
+
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	tn := mux.Listen(1) // Could be any byte value.
+	db := mustNewMockDatabase()
+	s := New(tn, db)
+	s.Tracer = tracer
+	if err := s.Open(); err != nil {
+		t.Fatalf("failed to open cluster service: %s", err.Error())
+	}
+	defer s.Close()
+	defer ln.Close()
+	c := NewClient(mustNewDialer(1, false, false))
+
+	parent := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	db.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		if er.Request.RequestId != "req-1" {
+			t.Fatalf("request ID not received, got %s", er.Request.RequestId)
+		}
+		if len(er.Request.ParentSpanId) != 8 || bytes.Equal(er.Request.ParentSpanId, parent) {
+			t.Fatalf("request not traced under service span")
+		}
+		return []*command.ExecuteResult{}, nil
+	}
+	er := executeRequestFromString("some SQL")
+	er.Request.RequestId = "req-1"
+	er.Request.ParentSpanId = parent
+	if _, err := c.Execute(er, s.Addr(), fiveSec); err != nil {
+		t.Fatalf("failed to execute: %s", err.Error())
+	}
+
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("failed to close tracer: %s", err)
+	}
+	b, err := ioutil.ReadFile(tracePath)
+	if err != nil {
+		t.Fatalf("failed to read trace file: %s", err)
+	}
+	for _, exp := range []string{
+		`"name":"cluster.execute"`,
+		`"parentSpanId":"0102030405060708"`,
+		tracing.TraceIDFromRequestID("req-1").String(),
+	} {
+		if !strings.Contains(string(b), exp) {
+			t.Fatalf("trace file does not contain %s: %s", exp, b)
+		}
+	}
+}
+
 func Test_ServiceQuery(t *testing.T) {
 	ln, mux := mustNewMux()
 	go mux.Serve()
@@ -188,6 +258,303 @@ func Test_ServiceQuery(t *testing.T) {
 	}
 }
 
+func Test_ServiceLargeMessages(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	tn := mux.Listen(1) // Could be any byte value.
+	db := mustNewMockDatabase()
+	s := New(tn, db)
+	if err := s.Open(); err != nil {
+		t.Fatalf("failed to open cluster service: %s", err.Error())
+	}
+	defer s.Close()
+	defer ln.Close()
+	c := NewClient(mustNewDialer(1, false, false))
+
+	// Requests and responses well over 64 KiB, spanning several chunks.
+	bigSQL := "INSERT INTO foo(name) VALUES('" + strings.Repeat("a", 3*maxChunkSize) + "')"
+	db.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		if er.Request.Statements[0].Sql != bigSQL {
+			t.Fatalf("large SQL statement not received intact")
+		}
+		return []*command.ExecuteResult{{RowsAffected: 1}}, nil
+	}
+	res, err := c.Execute(executeRequestFromString(bigSQL), s.Addr(), fiveSec)
+	if err != nil {
+		t.Fatalf("failed to execute large request: %s", err.Error())
+	}
+	if exp, got := `[{"rows_affected":1}]`, asJSON(res); exp != got {
+		t.Fatalf("unexpected results for execute, expected %s, got %s", exp, got)
+	}
+
+	values := make([]*command.Values, 50000)
+	for i := range values {
+		values[i] = &command.Values{
+			Parameters: []*command.Parameter{{Value: &command.Parameter_S{S: "some value"}}},
+		}
+	}
+	db.queryFn = func(qr *command.QueryRequest) ([]*command.QueryRows, error) {
+		return []*command.QueryRows{{Columns: []string{"c1"}, Values: values}}, nil
+	}
+	rows, err := c.Query(queryRequestFromString("SELECT * FROM foo"), s.Addr(), fiveSec)
+	if err != nil {
+		t.Fatalf("failed to query: %s", err.Error())
+	}
+	if exp, got := len(values), len(rows[0].Values); exp != got {
+		t.Fatalf("wrong number of rows, exp %d, got %d", exp, got)
+	}
+
+	// Responses larger than the maximum message size are reported as errors.
+	s.MaxMessageSize = 64 * 1024
+	_, err = c.Query(queryRequestFromString("SELECT * FROM foo"), s.Addr(), fiveSec)
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum message size") {
+		t.Fatalf("failed to receive expected error, got: %v", err)
+	}
+
+	// As are requests.
+	c.MaxMessageSize = 64 * 1024
+	_, err = c.Execute(executeRequestFromString(bigSQL), s.Addr(), fiveSec)
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum message size") {
+		t.Fatalf("failed to receive expected error, got: %v", err)
+	}
+}
+
+func Test_ServiceLegacyClient(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	tn := mux.Listen(1) // Could be any byte value.
+	db := mustNewMockDatabase()
+	s := New(tn, db)
+	if err := s.Open(); err != nil {
+		t.Fatalf("failed to open cluster service: %s", err.Error())
+	}
+	defer s.Close()
+	defer ln.Close()
+
+	conn, err := mustNewDialer(1, false, false).Dial(s.Addr(), fiveSec)
+	if err != nil {
+		t.Fatalf("failed to dial cluster service: %s", err)
+	}
+	defer conn.Close()
+
+	// A client speaking version 1 sends no version, and frames messages
+	// with a 16-bit length.
+	request := func(c *Command) []byte {
+		p, err := proto.Marshal(c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint16(b[0:], uint16(len(p)))
+		if _, err := conn.Write(append(b, p...)); err != nil {
+			t.Fatalf("failed to write command: %s", err)
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("failed to read response length: %s", err)
+		}
+		if binary.LittleEndian.Uint16(b[2:]) != 0 {
+			t.Fatalf("response too large for version 1 client")
+		}
+		p = make([]byte, binary.LittleEndian.Uint16(b[0:]))
+		if _, err := io.ReadFull(conn, p); err != nil {
+			t.Fatalf("failed to read response: %s", err)
+		}
+		return p
+	}
+
+	a := &Address{}
+	if err := proto.Unmarshal(request(&Command{Type: Command_COMMAND_TYPE_GET_NODE_API_URL}), a); err != nil {
+		t.Fatalf("failed to unmarshal address: %s", err)
+	}
+	if a.ProtocolVersion != ProtocolVersion {
+		t.Fatalf("wrong protocol version, exp %d, got %d", ProtocolVersion, a.ProtocolVersion)
+	}
+
+	db.queryFn = func(qr *command.QueryRequest) ([]*command.QueryRows, error) {
+		return []*command.QueryRows{{Columns: []string{strings.Repeat("c", legacyMaxMessageSize)}}}, nil
+	}
+	resp := &CommandQueryResponse{}
+	if err := proto.Unmarshal(request(&Command{
+		Type:    Command_COMMAND_TYPE_QUERY,
+		Request: &Command_QueryRequest{QueryRequest: queryRequestFromString("SELECT * FROM foo")},
+	}), resp); err != nil {
+		t.Fatalf("failed to unmarshal query response: %s", err)
+	}
+	if !strings.Contains(resp.Error, "exceeds maximum message size of 65535 bytes") {
+		t.Fatalf("wrong error for large response to version 1 client: %s", resp.Error)
+	}
+}
+
+func Test_ClientLegacyNode(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	defer ln.Close()
+	tn := mux.Listen(1) // Could be any byte value.
+
+	// A node speaking version 1 reports no version.
+	go serveAddress(tn, &Address{Url: "http://localhost:4001"})
+
+	c := NewClient(mustNewDialer(1, false, false))
+	bigSQL := strings.Repeat("a", legacyMaxMessageSize)
+	_, err := c.Execute(executeRequestFromString(bigSQL), tn.Addr().String(), fiveSec)
+	if err == nil || !strings.Contains(err.Error(), "cluster protocol version 1") {
+		t.Fatalf("failed to receive expected error, got: %v", err)
+	}
+}
+
+// serveAddress accepts connections on ln, and answers requests for the API
+// address with a. Other requests are ignored, as by a node which predates
+// the handshake.
+func serveAddress(ln net.Listener, a *Address) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				p, err := readMessage(conn, DefaultMaxMessageSize)
+				if err != nil {
+					return
+				}
+				c := &Command{}
+				if err := proto.Unmarshal(p, c); err != nil {
+					return
+				}
+				if c.Type != Command_COMMAND_TYPE_GET_NODE_API_URL {
+					continue
+				}
+				p, _ = proto.Marshal(a)
+				writeMessage(conn, p)
+			}
+		}()
+	}
+}
+
+func Test_ServiceChecksum(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	tn := mux.Listen(1) // Could be any byte value.
+	db := mustNewMockDatabase()
+	s := New(tn, db)
+	if s == nil {
+		t.Fatalf("failed to create cluster service")
+	}
+
+	c := NewClient(mustNewDialer(1, false, false))
+
+	if err := s.Open(); err != nil {
+		t.Fatalf("failed to open cluster service: %s", err.Error())
+	}
+
+	db.checksumAtFn = func(idx uint64, timeout time.Duration) (string, error) {
+		if idx != 1234 {
+			t.Fatalf("incorrect index received, got %d", idx)
+		}
+		if timeout != fiveSec {
+			t.Fatalf("incorrect timeout received, got %s", timeout)
+		}
+		return "abcd", nil
+	}
+	sum, err := c.Checksum(1234, s.Addr(), fiveSec)
+	if err != nil {
+		t.Fatalf("failed to get checksum: %s", err.Error())
+	}
+	if sum != "abcd" {
+		t.Fatalf("incorrect checksum received, got %s", sum)
+	}
+
+	db.checksumAtFn = func(idx uint64, timeout time.Duration) (string, error) {
+		return "", errors.New("checksum not found")
+	}
+	_, err = c.Checksum(1234, s.Addr(), fiveSec)
+	if err == nil {
+		t.Fatalf("client failed to report error")
+	}
+	if err.Error() != "checksum not found" {
+		t.Fatalf("incorrect error message received, got: %s", err.Error())
+	}
+
+	// Clean up resources.
+	if err := ln.Close(); err != nil {
+		t.Fatalf("failed to close Mux's listener: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close cluster service")
+	}
+}
+
+func Test_ServiceExecuteQueued(t *testing.T) {
+	ln, mux := mustNewMux()
+	go mux.Serve()
+	tn := mux.Listen(1) // Could be any byte value.
+	db := mustNewMockDatabase()
+	s := New(tn, db)
+	if s == nil {
+		t.Fatalf("failed to create cluster service")
+	}
+
+	c := NewClient(mustNewDialer(1, false, false))
+
+	if err := s.Open(); err != nil {
+		t.Fatalf("failed to open cluster service: %s", err.Error())
+	}
+
+	var waitedFor uint64
+	db.queuedFn = func(er *command.ExecuteRequest) (uint64, error) {
+		if exp, got := "INSERT INTO foo(id) VALUES(1)", er.Request.Statements[0].Sql; exp != got {
+			t.Fatalf("incorrect statement queued, exp %s, got %s", exp, got)
+		}
+		return 7, nil
+	}
+	db.waitFn = func(seq uint64, timeout time.Duration) error {
+		if timeout != fiveSec {
+			t.Fatalf("incorrect timeout received, got %s", timeout)
+		}
+		waitedFor = seq
+		return nil
+	}
+	er := executeRequestFromString("INSERT INTO foo(id) VALUES(1)")
+	for _, wait := range []bool{false, true} {
+		waitedFor = 0
+		seq, err := c.ExecuteQueued(er, wait, s.Addr(), fiveSec)
+		if err != nil {
+			t.Fatalf("failed to queue write: %s", err.Error())
+		}
+		if seq != 7 {
+			t.Fatalf("incorrect sequence number received, got %d", seq)
+		}
+		if wait != (waitedFor == 7) {
+			t.Fatalf("incorrect wait behavior, wait %v, waited for %d", wait, waitedFor)
+		}
+	}
+
+	db.waitFn = func(seq uint64, timeout time.Duration) error {
+		return errors.New("queued write dropped")
+	}
+	seq, err := c.ExecuteQueued(er, true, s.Addr(), fiveSec)
+	if seq != 7 || err == nil || err.Error() != "queued write dropped" {
+		t.Fatalf("incorrect result for dropped write, got %d, %v", seq, err)
+	}
+
+	db.queuedFn = func(er *command.ExecuteRequest) (uint64, error) {
+		return 0, errors.New("write queue full")
+	}
+	seq, err = c.ExecuteQueued(er, true, s.Addr(), fiveSec)
+	if seq != 0 || err == nil || err.Error() != "write queue full" {
+		t.Fatalf("incorrect result for full queue, got %d, %v", seq, err)
+	}
+
+	// Clean up resources.
+	if err := ln.Close(); err != nil {
+		t.Fatalf("failed to close Mux's listener: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close cluster service")
+	}
+}
+
 func executeRequestFromString(s string) *command.ExecuteRequest {
 	return executeRequestFromStrings([]string{s})
 }
@@ -245,8 +245,11 @@ func mustNewMockTLSTransport() *mockTransport {
 }
 
 type mockDatabase struct {
-	executeFn func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error)
-	queryFn   func(qr *command.QueryRequest) ([]*command.QueryRows, error)
+	executeFn    func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error)
+	queryFn      func(qr *command.QueryRequest) ([]*command.QueryRows, error)
+	checksumAtFn func(idx uint64, timeout time.Duration) (string, error)
+	queuedFn     func(er *command.ExecuteRequest) (uint64, error)
+	waitFn       func(seq uint64, timeout time.Duration) error
 }
 
 func (m *mockDatabase) Execute(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
@@ -257,6 +260,18 @@ func (m *mockDatabase) Query(qr *command.QueryRequest) ([]*command.QueryRows, er
 	return m.queryFn(qr)
 }
 
+func (m *mockDatabase) ChecksumAt(idx uint64, timeout time.Duration) (string, error) {
+	return m.checksumAtFn(idx, timeout)
+}
+
+func (m *mockDatabase) ExecuteQueued(er *command.ExecuteRequest) (uint64, error) {
+	return m.queuedFn(er)
+}
+
+func (m *mockDatabase) WaitForQueued(seq uint64, timeout time.Duration) error {
+	return m.waitFn(seq, timeout)
+}
+
 func mustNewMockDatabase() *mockDatabase {
 	return &mockDatabase{}
 }
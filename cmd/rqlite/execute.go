@@ -9,14 +9,18 @@ import (
 	"strings"
 
 	"github.com/mkideal/cli"
+	"github.com/mkideal/pkg/textutil"
 )
 
 // Result represents execute result
 type Result struct {
-	LastInsertID int     `json:"last_insert_id,omitempty"`
-	RowsAffected int     `json:"rows_affected,omitempty"`
-	Time         float64 `json:"time,omitempty"`
-	Error        string  `json:"error,omitempty"`
+	LastInsertID int             `json:"last_insert_id,omitempty"`
+	RowsAffected int             `json:"rows_affected,omitempty"`
+	Columns      []string        `json:"columns,omitempty"`
+	Types        []string        `json:"types,omitempty"`
+	Values       [][]interface{} `json:"values,omitempty"`
+	Time         float64         `json:"time,omitempty"`
+	Error        string          `json:"error,omitempty"`
 }
 
 type executeResponse struct {
@@ -102,6 +106,15 @@ func executeWithClient(ctx *cli.Context, client *http.Client, argv *argT, timer
 			return nil
 		}
 
+		// Statements with a RETURNING clause return rows as well.
+		if len(result.Columns) > 0 {
+			textutil.WriteTable(ctx, &Rows{
+				Columns: result.Columns,
+				Types:   result.Types,
+				Values:  result.Values,
+			}, headerRender)
+		}
+
 		rowString := "row"
 		if result.RowsAffected > 1 {
 			rowString = "rows"
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mkideal/cli"
+)
+
+// planNode represents a single step of a query plan.
+type planNode struct {
+	Detail    string      `json:"detail"`
+	FullScan  bool        `json:"full_scan"`
+	TempBTree bool        `json:"temp_btree"`
+	Children  []*planNode `json:"children"`
+}
+
+// queryPlan represents the query plan for a single statement.
+type queryPlan struct {
+	Plan  []*planNode `json:"plan"`
+	Error string      `json:"error,omitempty"`
+}
+
+type explainResponse struct {
+	Results []*queryPlan `json:"results"`
+	Error   string       `json:"error,omitempty"`
+}
+
+func makeExplainRequest(urlStr string) (*http.Request, error) {
+	return http.NewRequest("GET", urlStr, nil)
+}
+
+func explain(ctx *cli.Context, query string, argv *argT) error {
+	queryStr := url.Values{}
+	queryStr.Set("q", query)
+	u := url.URL{
+		Scheme:   argv.Protocol,
+		Host:     fmt.Sprintf("%s:%d", argv.Host, argv.Port),
+		Path:     fmt.Sprintf("%sdb/explain", argv.Prefix),
+		RawQuery: queryStr.Encode(),
+	}
+	response, err := sendRequest(ctx, makeExplainRequest, u.String(), argv)
+	if err != nil {
+		return err
+	}
+
+	ret := &explainResponse{}
+	if err := parseResponse(response, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return fmt.Errorf(ret.Error)
+	}
+	if len(ret.Results) != 1 {
+		return fmt.Errorf("unexpected results length: %d", len(ret.Results))
+	}
+	if ret.Results[0].Error != "" {
+		return fmt.Errorf(ret.Results[0].Error)
+	}
+
+	ctx.String("%s\n", ctx.Color().Cyan("QUERY PLAN"))
+	printPlan(ctx, ret.Results[0].Plan, "")
+	return nil
+}
+
+// printPlan renders the plan nodes as a tree, in the style of the sqlite3 shell.
+func printPlan(ctx *cli.Context, nodes []*planNode, indent string) {
+	for i, n := range nodes {
+		branch, next := "|--", "|  "
+		if i == len(nodes)-1 {
+			branch, next = "`--", "   "
+		}
+
+		var flags []string
+		if n.FullScan {
+			flags = append(flags, ctx.Color().Red("full scan"))
+		}
+		if n.TempBTree {
+			flags = append(flags, ctx.Color().Yellow("temp b-tree"))
+		}
+		if len(flags) > 0 {
+			ctx.String("%s%s%s [%s]\n", indent, branch, n.Detail, strings.Join(flags, ", "))
+		} else {
+			ctx.String("%s%s%s\n", indent, branch, n.Detail)
+		}
+		printPlan(ctx, n.Children, indent+next)
+	}
+}
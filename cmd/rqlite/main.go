@@ -30,6 +30,8 @@ type argT struct {
 	Prefix      string `cli:"P,prefix" usage:"rqlited HTTP URL prefix" dft:"/"`
 	Insecure    bool   `cli:"i,insecure" usage:"do not verify rqlited HTTPS certificate" dft:"false"`
 	CACert      string `cli:"c,ca-cert" usage:"path to trusted X.509 root CA certificate"`
+	ClientCert  string `cli:"client-cert" usage:"path to X.509 certificate presented to rqlited"`
+	ClientKey   string `cli:"client-key" usage:"path to X.509 private key of the client certificate"`
 	Credentials string `cli:"u,user" usage:"set basic auth credentials in form username:password"`
 	Version     bool   `cli:"v,version" usage:"display CLI version"`
 }
@@ -38,9 +40,11 @@ var cliHelp = []string{
 	`.backup <file>                      Write database backup to SQLite file`,
 	`.consistency [none|weak|strong]     Show or set read consistency level`,
 	`.dump <file>                        Dump the database in SQL text format to a file`,
+	`.explain <sql>                      Show the query plan for a statement`,
 	`.expvar                             Show expvar (Go runtime) information for connected node`,
 	`.help                               Show this message`,
 	`.indexes                            Show names of all indexes`,
+	`.migrate status|up <dir>            Show applied schema migrations, or apply those in a directory`,
 	`.restore <file>                     Restore the database from a SQLite dump file`,
 	`.nodes                              Show connection status of all nodes in cluster`,
 	`.schema                             Show CREATE statements for all tables`,
@@ -132,6 +136,18 @@ func main() {
 				err = status(ctx, cmd, line, argv)
 			case ".NODES":
 				err = nodes(ctx, cmd, line, argv)
+			case ".EXPLAIN":
+				if index == -1 || index == len(line)-1 {
+					err = fmt.Errorf("Please specify a statement to explain")
+					break
+				}
+				err = explain(ctx, line[index+1:], argv)
+			case ".MIGRATE":
+				if index == -1 || index == len(line)-1 {
+					err = fmt.Errorf("Please specify status or up")
+					break
+				}
+				err = migrate(ctx, line[index+1:], argv)
 			case ".EXPVAR":
 				err = expvar(ctx, cmd, line, argv)
 			case ".REMOVE":
@@ -258,8 +274,13 @@ func getHTTPClient(argv *argT) (*http.Client, error) {
 		}
 	}
 
+	certs, err := clientCertificates(argv)
+	if err != nil {
+		return nil, err
+	}
+
 	client := http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: argv.Insecure, RootCAs: rootCAs},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: argv.Insecure, RootCAs: rootCAs, Certificates: certs},
 		Proxy:           http.ProxyFromEnvironment,
 	}}
 
@@ -271,6 +292,19 @@ func getHTTPClient(argv *argT) (*http.Client, error) {
 	return &client, nil
 }
 
+// clientCertificates returns the client certificate to present to rqlited,
+// if one is set.
+func clientCertificates(argv *argT) ([]tls.Certificate, error) {
+	if argv.ClientCert == "" && argv.ClientKey == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(argv.ClientCert, argv.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %s", err)
+	}
+	return []tls.Certificate{cert}, nil
+}
+
 func getVersionWithClient(client *http.Client, argv *argT) (string, error) {
 	u := url.URL{
 		Scheme: argv.Protocol,
@@ -321,8 +355,13 @@ func sendRequest(ctx *cli.Context, makeNewRequest func(string) (*http.Request, e
 		}
 	}
 
+	certs, err := clientCertificates(argv)
+	if err != nil {
+		return nil, err
+	}
+
 	client := http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: argv.Insecure, RootCAs: rootCAs},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: argv.Insecure, RootCAs: rootCAs, Certificates: certs},
 		Proxy:           http.ProxyFromEnvironment,
 	}}
 
@@ -407,8 +446,12 @@ func cliJSON(ctx *cli.Context, cmd, line, url string, argv *argT) error {
 		}
 	}
 
+	certs, err := clientCertificates(argv)
+	if err != nil {
+		return err
+	}
 	client := http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: argv.Insecure},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: argv.Insecure, Certificates: certs},
 		Proxy:           http.ProxyFromEnvironment,
 	}}
 
@@ -455,9 +498,13 @@ func cliJSON(ctx *cli.Context, cmd, line, url string, argv *argT) error {
 }
 
 func urlsToWriter(urls []string, w io.Writer, argv *argT) error {
+	certs, err := clientCertificates(argv)
+	if err != nil {
+		return err
+	}
 	client := http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: argv.Insecure},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: argv.Insecure, Certificates: certs},
 			Proxy:           http.ProxyFromEnvironment,
 		},
 		Timeout: 10 * time.Second,
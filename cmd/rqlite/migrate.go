@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mkideal/cli"
+	"github.com/mkideal/pkg/textutil"
+)
+
+// migration is a versioned schema migration script.
+type migration struct {
+	Version int64  `json:"version"`
+	Name    string `json:"name,omitempty"`
+	SQL     string `json:"sql"`
+}
+
+// appliedMigration is a record of a migration applied to the database.
+type appliedMigration struct {
+	Version   int64  `json:"version"`
+	Name      string `json:"name"`
+	Checksum  string `json:"checksum"`
+	AppliedAt string `json:"applied_at"`
+}
+
+type migrationsResponse struct {
+	Migrations []*appliedMigration `json:"migrations"`
+	Applied    []*appliedMigration `json:"applied"`
+	Error      string              `json:"error,omitempty"`
+}
+
+func migrate(ctx *cli.Context, args string, argv *argT) error {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return fmt.Errorf("Please specify status or up")
+	}
+
+	u := url.URL{
+		Scheme: argv.Protocol,
+		Host:   fmt.Sprintf("%s:%d", argv.Host, argv.Port),
+		Path:   fmt.Sprintf("%sdb/migrations", argv.Prefix),
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "status":
+		response, err := sendRequest(ctx, func(urlStr string) (*http.Request, error) {
+			return http.NewRequest("GET", urlStr, nil)
+		}, u.String(), argv)
+		if err != nil {
+			return err
+		}
+		ret := &migrationsResponse{}
+		if err := parseResponse(response, &ret); err != nil {
+			return err
+		}
+		if ret.Error != "" {
+			return fmt.Errorf(ret.Error)
+		}
+		if len(ret.Migrations) == 0 {
+			ctx.String("no migrations applied\n")
+			return nil
+		}
+		textutil.WriteTable(ctx, migrationRows(ret.Migrations), headerRender)
+		return nil
+	case "up":
+		if len(fields) != 2 {
+			return fmt.Errorf("Please specify a directory of migration scripts")
+		}
+		migrations, err := readMigrations(fields[1])
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(migrations)
+		if err != nil {
+			return err
+		}
+		response, err := sendRequest(ctx, func(urlStr string) (*http.Request, error) {
+			req, err := http.NewRequest("POST", urlStr, bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			return req, nil
+		}, u.String(), argv)
+		if err != nil {
+			return err
+		}
+		ret := &migrationsResponse{}
+		if err := parseResponse(response, &ret); err != nil {
+			return err
+		}
+		if ret.Error != "" {
+			return fmt.Errorf(ret.Error)
+		}
+		if len(ret.Applied) == 0 {
+			ctx.String("database is up to date\n")
+			return nil
+		}
+		textutil.WriteTable(ctx, migrationRows(ret.Applied), headerRender)
+		return nil
+	default:
+		return fmt.Errorf("Unknown migrate command %s, please specify status or up", fields[0])
+	}
+}
+
+// readMigrations reads the migration scripts in dir, in order of version.
+// Each script must be named <version>_<name>.sql, for example
+// 0001_create_users.sql.
+func readMigrations(dir string) ([]*migration, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no migration scripts found in %s", dir)
+	}
+
+	var migrations []*migration
+	for _, p := range paths {
+		base := strings.TrimSuffix(filepath.Base(p), ".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration script %s is not named <version>_<name>.sql", p)
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		m := &migration{Version: version, SQL: string(b)}
+		if len(parts) == 2 {
+			m.Name = parts[1]
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// migrationRows returns the migrations as Rows, for display as a table.
+func migrationRows(migrations []*appliedMigration) *Rows {
+	rows := &Rows{Columns: []string{"version", "name", "checksum", "applied_at"}}
+	for _, m := range migrations {
+		rows.Values = append(rows.Values, []interface{}{m.Version, m.Name, m.Checksum, m.AppliedAt})
+	}
+	return rows
+}
@@ -15,15 +15,20 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/rqlite/rqlite/auth"
 	"github.com/rqlite/rqlite/cluster"
 	"github.com/rqlite/rqlite/cmd"
+	sql "github.com/rqlite/rqlite/db"
 	"github.com/rqlite/rqlite/disco"
+	"github.com/rqlite/rqlite/encryption"
 	httpd "github.com/rqlite/rqlite/http"
+	"github.com/rqlite/rqlite/logging"
 	"github.com/rqlite/rqlite/store"
 	"github.com/rqlite/rqlite/tcp"
+	"github.com/rqlite/rqlite/tracing"
 )
 
 const logo = `
@@ -45,6 +50,7 @@ var authFile string
 var x509CACert string
 var x509Cert string
 var x509Key string
+var httpVerifyClient bool
 var nodeEncrypt bool
 var nodeX509CACert string
 var nodeX509Cert string
@@ -63,8 +69,32 @@ var expvar bool
 var pprofEnabled bool
 var onDisk bool
 var onDiskPath string
+var onDiskStartup bool
+var encryptionKeyFile string
 var fkConstraints bool
+var extensionPaths string
+var rewriteNonDeterministic bool
+var dbTimeout string
+var slowQueryThreshold string
+var slowQueryLogPath string
+var auditLogPath string
+var auditLogMaxSize int64
+var auditLogMaxBackups int
+var auditRedactParams bool
+var traceFile string
+var traceCollectorURL string
+var clusterMaxMessageSize int64
+var writeBatchWindow string
+var writeBatchMaxSize int
+var writeQueueCapacity int
+var writeQueueInterval string
+var idempotencyTTL string
+var idempotencyMaxKeys int
+var verifyInterval string
 var raftLogLevel string
+var logFormat string
+var logLevel string
+var logLevels string
 var raftNonVoter bool
 var raftSnapThreshold uint64
 var raftSnapInterval string
@@ -94,6 +124,7 @@ func init() {
 	flag.StringVar(&x509CACert, "http-ca-cert", "", "Path to root X.509 certificate for HTTP endpoint")
 	flag.StringVar(&x509Cert, "http-cert", "", "Path to X.509 certificate for HTTP endpoint")
 	flag.StringVar(&x509Key, "http-key", "", "Path to X.509 private key for HTTP endpoint")
+	flag.BoolVar(&httpVerifyClient, "http-verify-client", false, "Require HTTP clients present a certificate signed by the HTTP root CA certificate, identifying the user")
 	flag.BoolVar(&noVerify, "http-no-verify", false, "Skip verification of remote HTTPS cert when joining cluster")
 	flag.BoolVar(&nodeEncrypt, "node-encrypt", false, "Enable node-to-node encryption")
 	flag.StringVar(&nodeX509CACert, "node-ca-cert", "", "Path to root X.509 certificate for node-to-node encryption")
@@ -112,7 +143,28 @@ func init() {
 	flag.BoolVar(&pprofEnabled, "pprof", true, "Serve pprof data on HTTP server")
 	flag.BoolVar(&onDisk, "on-disk", false, "Use an on-disk SQLite database")
 	flag.StringVar(&onDiskPath, "on-disk-path", "", "Path for SQLite on-disk database file. If not set, use file in data directory")
+	flag.BoolVar(&onDiskStartup, "on-disk-startup", false, "Do not initialize on-disk database in memory first at startup")
+	flag.StringVar(&encryptionKeyFile, "encryption-key-file", "", "Path to file of keys for encrypting the Raft log and snapshots. If not set, data is not encrypted")
 	flag.BoolVar(&fkConstraints, "fk", false, "Enable SQLite foreign key constraints")
+	flag.StringVar(&extensionPaths, "extensions", "", "Comma-delimited list of paths to SQLite extensions, loaded on every connection")
+	flag.BoolVar(&rewriteNonDeterministic, "rewrite-nondeterministic", true, "Replace non-deterministic SQL functions with values computed by the leader")
+	flag.StringVar(&dbTimeout, "db-timeout", "0s", "Default time a read may run before being interrupted. Use 0s for no limit")
+	flag.StringVar(&slowQueryThreshold, "slow-query-threshold", "0s", "Log statements taking longer than this to the slow query log. Use 0s to disable")
+	flag.StringVar(&slowQueryLogPath, "slow-query-log", "", "Path for the slow query log. If not set, use file in data directory")
+	flag.StringVar(&auditLogPath, "audit-log", "", "Path for the audit log of writes and administrative requests. If not set, not enabled")
+	flag.Int64Var(&auditLogMaxSize, "audit-log-max-size", 100*1024*1024, "Size in bytes at which the audit log is rotated. Use 0 to disable rotation")
+	flag.IntVar(&auditLogMaxBackups, "audit-log-max-backups", 10, "Number of rotated audit log files to retain")
+	flag.BoolVar(&auditRedactParams, "audit-redact-params", false, "Leave parameter values out of the audit log")
+	flag.StringVar(&traceFile, "trace-file", "", "Path of file to which request traces are written, in OpenTelemetry JSON format. If not set, not enabled")
+	flag.Int64Var(&clusterMaxMessageSize, "cluster-max-message-size", cluster.DefaultMaxMessageSize, "Maximum size in bytes of a request forwarded to, or response received from, another node")
+	flag.StringVar(&traceCollectorURL, "trace-collector-url", "", "URL of OpenTelemetry collector to which request traces are sent, such as http://localhost:4318/v1/traces")
+	flag.StringVar(&writeBatchWindow, "write-batch-window", "0s", "Time to gather concurrent writes into a single Raft log entry. Use 0s to disable")
+	flag.IntVar(&writeBatchMaxSize, "write-batch-size", 64, "Maximum number of write requests in a single Raft log entry")
+	flag.IntVar(&writeQueueCapacity, "write-queue-capacity", 1024, "Maximum number of queued writes awaiting commit. Use 0 to disable queued writes")
+	flag.StringVar(&writeQueueInterval, "write-queue-interval", "50ms", "Interval at which queued writes are committed")
+	flag.StringVar(&idempotencyTTL, "idempotency-ttl", "10m", "Time for which the outcome of a write request with an idempotency key is retained")
+	flag.IntVar(&idempotencyMaxKeys, "idempotency-max-keys", 10000, "Maximum number of idempotency keys retained. Use 0 for no limit")
+	flag.StringVar(&verifyInterval, "verify-interval", "0s", "Interval at which the leader checks every node holds the same data. Use 0s to disable")
 	flag.BoolVar(&showVersion, "version", false, "Show version information and exit")
 	flag.BoolVar(&raftNonVoter, "raft-non-voter", false, "Configure as non-voting node")
 	flag.StringVar(&raftHeartbeatTimeout, "raft-timeout", "1s", "Raft heartbeat timeout")
@@ -124,7 +176,10 @@ func init() {
 	flag.StringVar(&raftSnapInterval, "raft-snap-int", "30s", "Snapshot threshold check interval")
 	flag.StringVar(&raftLeaderLeaseTimeout, "raft-leader-lease-timeout", "0s", "Raft leader lease timeout. Use 0s for Raft default")
 	flag.BoolVar(&raftShutdownOnRemove, "raft-remove-shutdown", false, "Shutdown Raft if node removed")
-	flag.StringVar(&raftLogLevel, "raft-log-level", "INFO", "Minimum log level for Raft module")
+	flag.StringVar(&raftLogLevel, "raft-log-level", "", "Minimum log level for Raft module. If not set, as set by -log-level")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of log output, text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum log level: debug, info, warn, or error")
+	flag.StringVar(&logLevels, "log-levels", "", "Comma-delimited list of minimum log levels for individual subsystems, such as store=debug,raft=warn")
 	flag.IntVar(&compressionSize, "compression-size", 150, "Request query size for compression attempt")
 	flag.IntVar(&compressionBatch, "compression-batch", 5, "Request batch threshold for compression attempt")
 	flag.StringVar(&cpuProfile, "cpu-profile", "", "Path to file for CPU profiling information")
@@ -169,9 +224,12 @@ func main() {
 	fmt.Println(logo)
 
 	// Configure logging and pump out initial message.
-	log.SetFlags(log.LstdFlags)
-	log.SetOutput(os.Stderr)
-	log.SetPrefix(fmt.Sprintf("[%s] ", name))
+	if err := configureLogging(); err != nil {
+		log.Fatalf("failed to configure logging: %s", err.Error())
+	}
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(logging.New(name).Writer(logging.LevelInfo))
 	log.Printf("%s starting, version %s, commit %s, branch %s", name, cmd.Version, cmd.Commit, cmd.Branch)
 	log.Printf("%s, target architecture is %s, operating system target is %s", runtime.Version(), runtime.GOARCH, runtime.GOOS)
 	log.Printf("launch command: %s", strings.Join(os.Args, " "))
@@ -191,6 +249,14 @@ func main() {
 	raftTn := mux.Listen(cluster.MuxRaftHeader)
 	log.Printf("Raft TCP mux Listener registered with %d", cluster.MuxRaftHeader)
 
+	// Load any SQLite extensions, before any database is opened.
+	if extensionPaths != "" {
+		if err := sql.LoadExtensions(strings.Split(extensionPaths, ",")); err != nil {
+			log.Fatalf("failed to load SQLite extensions: %s", err.Error())
+		}
+		log.Printf("SQLite extensions loaded: %s", sql.Extensions())
+	}
+
 	// Create and open the store.
 	dataPath, err = filepath.Abs(dataPath)
 	if err != nil {
@@ -199,6 +265,7 @@ func main() {
 	dbConf := store.NewDBConfig(!onDisk)
 	dbConf.FKConstraints = fkConstraints
 	dbConf.OnDiskPath = onDiskPath
+	dbConf.OnDiskStartup = onDiskStartup
 
 	str := store.New(raftTn, &store.StoreConfig{
 		DBConf: dbConf,
@@ -208,7 +275,6 @@ func main() {
 
 	// Set optional parameters on store.
 	str.SetRequestCompression(compressionBatch, compressionSize)
-	str.RaftLogLevel = raftLogLevel
 	str.ShutdownOnRemove = raftShutdownOnRemove
 	str.SnapshotThreshold = raftSnapThreshold
 	str.SnapshotInterval, err = time.ParseDuration(raftSnapInterval)
@@ -231,6 +297,40 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to parse Raft apply timeout %s: %s", raftApplyTimeout, err.Error())
 	}
+	str.SlowQueryThreshold, err = time.ParseDuration(slowQueryThreshold)
+	if err != nil {
+		log.Fatalf("failed to parse slow query threshold %s: %s", slowQueryThreshold, err.Error())
+	}
+	str.SlowQueryLogPath = slowQueryLogPath
+	str.RewriteNonDeterministic = rewriteNonDeterministic
+	str.WriteBatchWindow, err = time.ParseDuration(writeBatchWindow)
+	if err != nil {
+		log.Fatalf("failed to parse write batch window %s: %s", writeBatchWindow, err.Error())
+	}
+	str.WriteBatchMaxSize = writeBatchMaxSize
+	str.WriteQueueCapacity = writeQueueCapacity
+	str.IdempotencyTTL, err = time.ParseDuration(idempotencyTTL)
+	if err != nil {
+		log.Fatalf("failed to parse idempotency TTL %s: %s", idempotencyTTL, err.Error())
+	}
+	str.IdempotencyMaxKeys = idempotencyMaxKeys
+	str.WriteQueueInterval, err = time.ParseDuration(writeQueueInterval)
+	if err != nil {
+		log.Fatalf("failed to parse write queue interval %s: %s", writeQueueInterval, err.Error())
+	}
+	if encryptionKeyFile != "" {
+		keys, err := encryption.LoadKeyringFile(encryptionKeyFile)
+		if err != nil {
+			log.Fatalf("failed to load encryption key file %s: %s", encryptionKeyFile, err.Error())
+		}
+		str.Encryption = keys
+		log.Printf("encryption of Raft log and snapshots enabled")
+	}
+	tracer, err := startTracer()
+	if err != nil {
+		log.Fatalf("failed to start tracing: %s", err.Error())
+	}
+	str.Tracer = tracer
 
 	// Any prexisting node state?
 	var enableBootstrap bool
@@ -264,7 +364,7 @@ func main() {
 	}
 
 	// Create cluster service now, so nodes will be able to learn information about each other.
-	clstr, err := clusterService(mux.Listen(cluster.MuxClusterHeader), str)
+	clstr, err := clusterService(mux.Listen(cluster.MuxClusterHeader), str, tracer)
 	if err != nil {
 		log.Fatalf("failed to create cluster service: %s", err.Error())
 	}
@@ -291,6 +391,15 @@ func main() {
 				log.Fatalf("failed to parse root CA certificate(s) in %q", x509CACert)
 			}
 		}
+		if httpVerifyClient {
+			// Nodes in the cluster require client certificates, so present
+			// this node's own.
+			cert, err := tls.LoadX509KeyPair(x509Cert, x509Key)
+			if err != nil {
+				log.Fatalf("failed to load X.509 key pair for joining: %s", err.Error())
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
 
 		if j, err := cluster.Join(joinSrcIP, joins, str.ID(), raftAdv, !raftNonVoter,
 			joinAttempts, joinDur, &tlsConfig); err != nil {
@@ -309,11 +418,14 @@ func main() {
 
 	// Start the HTTP API server.
 	clstrDialer := tcp.NewDialer(cluster.MuxClusterHeader, nodeEncrypt, noNodeVerify)
+	clstrDialer.CACerts = mux.CACerts()
 	clstrClient := cluster.NewClient(clstrDialer)
+	clstrClient.MaxMessageSize = clusterMaxMessageSize
+	clstrClient.BuildVersion = cmd.Version
 	if err := clstrClient.SetLocal(raftAdv, clstr); err != nil {
 		log.Fatalf("failed to set cluster client local parameters: %s", err.Error())
 	}
-	httpServ, err := startHTTPService(str, clstrClient)
+	httpServ, err := startHTTPService(str, clstrClient, tracer)
 	if err != nil {
 		log.Fatalf("failed to start HTTP server: %s", err.Error())
 	}
@@ -323,6 +435,23 @@ func main() {
 
 	log.Println("node is ready")
 
+	// Reload certificates when signalled, so renewed certificates can be
+	// used without a restart. Changed files are also picked up without a
+	// signal, on the next connection.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			log.Println("reloading TLS certificates")
+			if err := httpServ.ReloadCertificates(); err != nil {
+				log.Printf("failed to reload HTTP certificates: %s", err.Error())
+			}
+			if err := mux.ReloadCertificates(); err != nil {
+				log.Printf("failed to reload node-to-node certificates: %s", err.Error())
+			}
+		}
+	}()
+
 	// Block until signalled.
 	terminate := make(chan os.Signal, 1)
 	signal.Notify(terminate, os.Interrupt)
@@ -332,6 +461,9 @@ func main() {
 	}
 	clstr.Close()
 	muxLn.Close()
+	if err := tracer.Close(); err != nil {
+		log.Printf("failed to close tracer: %s", err.Error())
+	}
 	stopProfile()
 	log.Println("rqlite server stopped")
 }
@@ -388,7 +520,7 @@ func waitForConsensus(str *store.Store) error {
 	return nil
 }
 
-func startHTTPService(str *store.Store, cltr *cluster.Client) (*httpd.Service, error) {
+func startHTTPService(str *store.Store, cltr *cluster.Client, tracer *tracing.Tracer) (*httpd.Service, error) {
 	// Get the credential store.
 	credStr, err := credentialStore()
 	if err != nil {
@@ -405,9 +537,24 @@ func startHTTPService(str *store.Store, cltr *cluster.Client) (*httpd.Service, e
 
 	s.CertFile = x509Cert
 	s.KeyFile = x509Key
+	s.CACertFile = x509CACert
+	s.ClientCertAuth = httpVerifyClient
 	s.TLS1011 = tls1011
 	s.Expvar = expvar
 	s.Pprof = pprofEnabled
+	s.AuditLogPath = auditLogPath
+	s.AuditLogMaxSize = auditLogMaxSize
+	s.AuditLogMaxBackups = auditLogMaxBackups
+	s.AuditRedactParams = auditRedactParams
+	s.Tracer = tracer
+	s.DBTimeout, err = time.ParseDuration(dbTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database timeout %s: %s", dbTimeout, err.Error())
+	}
+	s.VerifyInterval, err = time.ParseDuration(verifyInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse verify interval %s: %s", verifyInterval, err.Error())
+	}
 	s.BuildInfo = map[string]interface{}{
 		"commit":     cmd.Commit,
 		"branch":     cmd.Branch,
@@ -445,6 +592,50 @@ func startNodeMux(ln net.Listener) (*tcp.Mux, error) {
 	return mux, nil
 }
 
+// configureLogging sets the format and levels of log output.
+func configureLogging() error {
+	f, err := logging.ParseFormat(logFormat)
+	if err != nil {
+		return err
+	}
+	logging.SetFormat(f)
+
+	lvl, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	logging.SetDefaultLevel(lvl)
+	if raftLogLevel != "" {
+		lvl, err := logging.ParseLevel(raftLogLevel)
+		if err != nil {
+			return err
+		}
+		logging.SetLevel("raft", lvl)
+	}
+	return logging.SetLevels(logLevels)
+}
+
+// startTracer returns a Tracer exporting request traces to the configured
+// file and collector, or nil if tracing is not enabled.
+func startTracer() (*tracing.Tracer, error) {
+	var exporters []tracing.Exporter
+	if traceFile != "" {
+		e, err := tracing.NewFileExporter(traceFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file %s: %s", traceFile, err.Error())
+		}
+		exporters = append(exporters, e)
+	}
+	if traceCollectorURL != "" {
+		exporters = append(exporters, tracing.NewHTTPExporter(traceCollectorURL))
+	}
+	if len(exporters) == 0 {
+		return nil, nil
+	}
+	log.Printf("request tracing enabled")
+	return tracing.NewTracer(name, idOrRaftAddr(), exporters...), nil
+}
+
 func credentialStore() (*auth.CredentialsStore, error) {
 	if authFile == "" {
 		return nil, nil
@@ -462,8 +653,11 @@ func credentialStore() (*auth.CredentialsStore, error) {
 	return cs, nil
 }
 
-func clusterService(tn cluster.Transport, db cluster.Database) (*cluster.Service, error) {
+func clusterService(tn cluster.Transport, db cluster.Database, tracer *tracing.Tracer) (*cluster.Service, error) {
 	c := cluster.New(tn, db)
+	c.Tracer = tracer
+	c.MaxMessageSize = clusterMaxMessageSize
+	c.BuildVersion = cmd.Version
 	apiAddr := httpAddr
 	if httpAdv != "" {
 		apiAddr = httpAdv
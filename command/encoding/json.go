@@ -3,16 +3,23 @@ package encoding
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/rqlite/rqlite/command"
 )
 
 // Result represents the outcome of an operation that changes rows.
+// If the operation returns rows, such as a statement with a RETURNING clause,
+// Columns, Types, and Values are also set.
 type Result struct {
-	LastInsertID int64   `json:"last_insert_id,omitempty"`
-	RowsAffected int64   `json:"rows_affected,omitempty"`
-	Error        string  `json:"error,omitempty"`
-	Time         float64 `json:"time,omitempty"`
+	LastInsertID int64           `json:"last_insert_id,omitempty"`
+	RowsAffected int64           `json:"rows_affected,omitempty"`
+	Columns      []string        `json:"columns,omitempty"`
+	Types        []string        `json:"types,omitempty"`
+	Values       [][]interface{} `json:"values,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	Time         float64         `json:"time,omitempty"`
 }
 
 // Rows represents the outcome of an operation that returns query data.
@@ -24,20 +31,46 @@ type Rows struct {
 	Time    float64         `json:"time,omitempty"`
 }
 
+// Encoder controls how Execute and Query results are serialized to the
+// JSON API format. The zero value is ready to use.
+type Encoder struct {
+	// Int64AsString causes 64-bit integer values to be encoded as JSON
+	// strings, so clients such as JavaScript do not lose precision.
+	Int64AsString bool
+}
+
 // NewResultFromExecuteResult returns an API Result object from an ExecuteResult.
 func NewResultFromExecuteResult(e *command.ExecuteResult) (*Result, error) {
+	return (&Encoder{}).newResultFromExecuteResult(e)
+}
+
+func (e *Encoder) newResultFromExecuteResult(r *command.ExecuteResult) (*Result, error) {
+	var values [][]interface{}
+	if len(r.Values) > 0 {
+		values = make([][]interface{}, len(r.Values))
+		if err := e.newValuesFromQueryValues(values, r.Values); err != nil {
+			return nil, err
+		}
+	}
 	return &Result{
-		LastInsertID: e.LastInsertId,
-		RowsAffected: e.RowsAffected,
-		Error:        e.Error,
-		Time:         e.Time,
+		LastInsertID: r.LastInsertId,
+		RowsAffected: r.RowsAffected,
+		Columns:      r.Columns,
+		Types:        r.Types,
+		Values:       values,
+		Error:        r.Error,
+		Time:         r.Time,
 	}, nil
 }
 
 // NewRowsFromQueryRows returns an API Rows object from a QueryRows
 func NewRowsFromQueryRows(q *command.QueryRows) (*Rows, error) {
+	return (&Encoder{}).newRowsFromQueryRows(q)
+}
+
+func (e *Encoder) newRowsFromQueryRows(q *command.QueryRows) (*Rows, error) {
 	values := make([][]interface{}, len(q.Values))
-	if err := NewValuesFromQueryValues(values, q.Values); err != nil {
+	if err := e.newValuesFromQueryValues(values, q.Values); err != nil {
 		return nil, err
 	}
 	return &Rows{
@@ -51,6 +84,10 @@ func NewRowsFromQueryRows(q *command.QueryRows) (*Rows, error) {
 
 // NewValuesFromQueryValues sets Values from a QueryValue object.
 func NewValuesFromQueryValues(dest [][]interface{}, v []*command.Values) error {
+	return (&Encoder{}).newValuesFromQueryValues(dest, v)
+}
+
+func (e *Encoder) newValuesFromQueryValues(dest [][]interface{}, v []*command.Values) error {
 	for n := range v {
 		vals := v[n]
 		if vals == nil {
@@ -68,7 +105,11 @@ func NewValuesFromQueryValues(dest [][]interface{}, v []*command.Values) error {
 		for p := range params {
 			switch w := params[p].GetValue().(type) {
 			case *command.Parameter_I:
-				rowValues[p] = w.I
+				if e.Int64AsString {
+					rowValues[p] = strconv.FormatInt(w.I, 10)
+				} else {
+					rowValues[p] = w.I
+				}
 			case *command.Parameter_D:
 				rowValues[p] = w.D
 			case *command.Parameter_B:
@@ -77,6 +118,10 @@ func NewValuesFromQueryValues(dest [][]interface{}, v []*command.Values) error {
 				rowValues[p] = w.Y
 			case *command.Parameter_S:
 				rowValues[p] = w.S
+			case *command.Parameter_T:
+				rowValues[p] = time.Unix(0, w.T).UTC().Format(time.RFC3339Nano)
+			case *command.Parameter_N:
+				rowValues[p] = nil
 			case nil:
 				rowValues[p] = nil
 			default:
@@ -91,22 +136,33 @@ func NewValuesFromQueryValues(dest [][]interface{}, v []*command.Values) error {
 
 // JSONMarshal serializes Execute and Query results to JSON API format.
 func JSONMarshal(i interface{}) ([]byte, error) {
-	return jsonMarshal(i, json.Marshal)
+	return (&Encoder{}).JSONMarshal(i)
 }
 
 // JSONMarshalIndent serializes Execute and Query results to JSON API format,
 // but also applies indent to the output.
 func JSONMarshalIndent(i interface{}, prefix, indent string) ([]byte, error) {
+	return (&Encoder{}).JSONMarshalIndent(i, prefix, indent)
+}
+
+// JSONMarshal serializes Execute and Query results to JSON API format.
+func (e *Encoder) JSONMarshal(i interface{}) ([]byte, error) {
+	return e.jsonMarshal(i, json.Marshal)
+}
+
+// JSONMarshalIndent serializes Execute and Query results to JSON API format,
+// but also applies indent to the output.
+func (e *Encoder) JSONMarshalIndent(i interface{}, prefix, indent string) ([]byte, error) {
 	f := func(i interface{}) ([]byte, error) {
 		return json.MarshalIndent(i, prefix, indent)
 	}
-	return jsonMarshal(i, f)
+	return e.jsonMarshal(i, f)
 }
 
-func jsonMarshal(i interface{}, f func(i interface{}) ([]byte, error)) ([]byte, error) {
+func (e *Encoder) jsonMarshal(i interface{}, f func(i interface{}) ([]byte, error)) ([]byte, error) {
 	switch v := i.(type) {
 	case *command.ExecuteResult:
-		r, err := NewResultFromExecuteResult(v)
+		r, err := e.newResultFromExecuteResult(v)
 		if err != nil {
 			return nil, err
 		}
@@ -115,14 +171,14 @@ func jsonMarshal(i interface{}, f func(i interface{}) ([]byte, error)) ([]byte,
 		var err error
 		results := make([]*Result, len(v))
 		for j := range v {
-			results[j], err = NewResultFromExecuteResult(v[j])
+			results[j], err = e.newResultFromExecuteResult(v[j])
 			if err != nil {
 				return nil, err
 			}
 		}
 		return f(results)
 	case *command.QueryRows:
-		r, err := NewRowsFromQueryRows(v)
+		r, err := e.newRowsFromQueryRows(v)
 		if err != nil {
 			return nil, err
 		}
@@ -131,7 +187,7 @@ func jsonMarshal(i interface{}, f func(i interface{}) ([]byte, error)) ([]byte,
 		var err error
 		rows := make([]*Rows, len(v))
 		for j := range v {
-			rows[j], err = NewRowsFromQueryRows(v[j])
+			rows[j], err = e.newRowsFromQueryRows(v[j])
 			if err != nil {
 				return nil, err
 			}
@@ -139,7 +195,7 @@ func jsonMarshal(i interface{}, f func(i interface{}) ([]byte, error)) ([]byte,
 		return f(rows)
 	case []*command.Values:
 		values := make([][]interface{}, len(v))
-		if err := NewValuesFromQueryValues(values, v); err != nil {
+		if err := e.newValuesFromQueryValues(values, v); err != nil {
 			return nil, err
 		}
 		return f(values)
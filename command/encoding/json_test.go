@@ -80,6 +80,41 @@ func Test_MarshalExecuteResults(t *testing.T) {
 	}
 }
 
+// Test_MarshalExecuteResultRows tests JSON marshaling of an ExecuteResult
+// which returns rows.
+func Test_MarshalExecuteResultRows(t *testing.T) {
+	r := &command.ExecuteResult{
+		LastInsertId: 2,
+		RowsAffected: 1,
+		Columns:      []string{"id", "name"},
+		Types:        []string{"integer", "text"},
+		Values: []*command.Values{
+			{
+				Parameters: []*command.Parameter{
+					{Value: &command.Parameter_I{I: 2}},
+					{Value: &command.Parameter_S{S: "fiona"}},
+				},
+			},
+		},
+	}
+	b, err := JSONMarshal(r)
+	if err != nil {
+		t.Fatalf("failed to marshal ExecuteResult: %s", err.Error())
+	}
+	if exp, got := `{"last_insert_id":2,"rows_affected":1,"columns":["id","name"],"types":["integer","text"],"values":[[2,"fiona"]]}`, string(b); exp != got {
+		t.Fatalf("failed to marshal ExecuteResult: exp %s, got %s", exp, got)
+	}
+
+	enc := Encoder{Int64AsString: true}
+	b, err = enc.JSONMarshal([]*command.ExecuteResult{r})
+	if err != nil {
+		t.Fatalf("failed to marshal ExecuteResults: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":2,"rows_affected":1,"columns":["id","name"],"types":["integer","text"],"values":[["2","fiona"]]}]`, string(b); exp != got {
+		t.Fatalf("failed to marshal ExecuteResults: exp %s, got %s", exp, got)
+	}
+}
+
 // Test_MarshalQueryRows tests JSON marshaling of a QueryRows
 func Test_MarshalQueryRows(t *testing.T) {
 	var b []byte
@@ -190,3 +225,49 @@ func Test_MarshalQueryRowses(t *testing.T) {
 		t.Fatalf("failed to marshal QueryRows: exp %s, got %s", exp, got)
 	}
 }
+
+// Test_MarshalQueryRowsTypes tests JSON marshaling of NULL, timestamp, and
+// 64-bit integer values.
+func Test_MarshalQueryRowsTypes(t *testing.T) {
+	r := &command.QueryRows{
+		Columns: []string{"c1", "c2", "c3"},
+		Types:   []string{"integer", "text", "datetime"},
+	}
+	values := []*command.Parameter{
+		{
+			Value: &command.Parameter_I{
+				I: 9007199254740993,
+			},
+		},
+		{
+			Value: &command.Parameter_N{
+				N: true,
+			},
+		},
+		{
+			Value: &command.Parameter_T{
+				T: 1630499445000000000,
+			},
+		},
+	}
+	r.Values = []*command.Values{
+		{Parameters: values},
+	}
+
+	b, err := JSONMarshal(r)
+	if err != nil {
+		t.Fatalf("failed to marshal QueryRows: %s", err.Error())
+	}
+	if exp, got := `{"columns":["c1","c2","c3"],"types":["integer","text","datetime"],"values":[[9007199254740993,null,"2021-09-01T12:30:45Z"]]}`, string(b); exp != got {
+		t.Fatalf("failed to marshal QueryRows: exp %s, got %s", exp, got)
+	}
+
+	enc := &Encoder{Int64AsString: true}
+	b, err = enc.JSONMarshal(r)
+	if err != nil {
+		t.Fatalf("failed to marshal QueryRows: %s", err.Error())
+	}
+	if exp, got := `{"columns":["c1","c2","c3"],"types":["integer","text","datetime"],"values":[["9007199254740993",null,"2021-09-01T12:30:45Z"]]}`, string(b); exp != got {
+		t.Fatalf("failed to marshal QueryRows: exp %s, got %s", exp, got)
+	}
+}
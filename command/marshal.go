@@ -22,6 +22,16 @@ type Requester interface {
 	GetRequest() *Request
 }
 
+// GetRequest returns a Request containing the statements of every request in
+// the batch, allowing a batch to be marshaled by a RequestMarshaler.
+func (b *ExecuteBatchRequest) GetRequest() *Request {
+	r := &Request{}
+	for _, er := range b.GetRequests() {
+		r.Statements = append(r.Statements, er.GetRequest().GetStatements()...)
+	}
+	return r
+}
+
 // RequestMarshaler marshals Request objects, potentially performing
 // gzip compression.
 type RequestMarshaler struct {
@@ -151,6 +161,16 @@ func UnmarshalNoop(b []byte, c *Noop) error {
 	return proto.Unmarshal(b, c)
 }
 
+// MarshalDatabaseRequest marshals a DatabaseRequest command
+func MarshalDatabaseRequest(c *DatabaseRequest) ([]byte, error) {
+	return proto.Marshal(c)
+}
+
+// MarshalMigrateRequest marshals a MigrateRequest command
+func MarshalMigrateRequest(c *MigrateRequest) ([]byte, error) {
+	return proto.Marshal(c)
+}
+
 // UnmarshalSubCommand unmarshalls a sub command m. It assumes that
 // m is the correct type.
 func UnmarshalSubCommand(c *Command, m proto.Message) error {
@@ -158,16 +178,16 @@ func UnmarshalSubCommand(c *Command, m proto.Message) error {
 	if c.Compressed {
 		gz, err := gzip.NewReader(bytes.NewReader(b))
 		if err != nil {
-			fmt.Errorf("unmarshal sub gzip NewReader: %s", err)
+			return fmt.Errorf("unmarshal sub gzip NewReader: %s", err)
 		}
 
 		ub, err := ioutil.ReadAll(gz)
 		if err != nil {
-			fmt.Errorf("unmarshal sub gzip ReadAll: %s", err)
+			return fmt.Errorf("unmarshal sub gzip ReadAll: %s", err)
 		}
 
 		if err := gz.Close(); err != nil {
-			fmt.Errorf("unmarshal sub gzip Close: %s", err)
+			return fmt.Errorf("unmarshal sub gzip Close: %s", err)
 		}
 		b = ub
 	}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math"
+	"strings"
+	"time"
+)
+
+// Checksum returns the hex-encoded SHA-256 digest of the logical contents
+// of the database: its schema, and every row of every table. Unlike a digest
+// of the database file, it does not depend on page layout, free pages, or
+// other details of storage which may differ between databases holding the
+// same data. SQLite's internal tables are not included.
+func (db *DB) Checksum() (string, error) {
+	ctx := context.Background()
+	conn, err := db.rwDB.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	rs, err := conn.QueryContext(ctx, `SELECT type, name, tbl_name, sql FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite\_%' ESCAPE '\' ORDER BY type, name`)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	var tables []string
+	for rs.Next() {
+		var typ, name, tblName string
+		var ddl sql.NullString
+		if err := rs.Scan(&typ, &name, &tblName, &ddl); err != nil {
+			rs.Close()
+			return "", err
+		}
+		for _, v := range []interface{}{typ, name, tblName, ddl.String} {
+			writeChecksumValue(h, v)
+		}
+		// The contents of a virtual table are held in its shadow tables,
+		// which are ordinary tables.
+		if typ == "table" && !strings.HasPrefix(strings.ToUpper(ddl.String), "CREATE VIRTUAL") {
+			tables = append(tables, name)
+		}
+	}
+	err = rs.Err()
+	rs.Close()
+	if err != nil {
+		return "", err
+	}
+
+	for _, t := range tables {
+		writeChecksumValue(h, t)
+		if err := checksumTable(ctx, conn, h, t); err != nil {
+			return "", fmt.Errorf("table %s: %s", t, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumTable writes every row of the given table to h. Rows are read in
+// rowid order, or in PRIMARY KEY order for a WITHOUT ROWID table, which is
+// the order in which they are stored, so no sort is needed. Nodes which
+// apply the same statements assign the same rowids, so read rows in the
+// same order.
+func checksumTable(ctx context.Context, conn *sql.Conn, h hash.Hash, table string) error {
+	quoted := `"` + strings.ReplaceAll(table, `"`, `""`) + `"`
+
+	var n int
+	if err := conn.QueryRowContext(ctx, `SELECT count(*) FROM pragma_table_info(?)`, table).Scan(&n); err != nil {
+		return err
+	}
+	order := "rowid"
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`SELECT rowid FROM %s LIMIT 0`, quoted)); err != nil {
+		// A WITHOUT ROWID table, which must have a PRIMARY KEY.
+		if order, err = primaryKeyOrder(ctx, conn, table); err != nil {
+			return err
+		}
+	}
+
+	rs, err := conn.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM %s ORDER BY %s`, quoted, order))
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+
+	dest := make([]interface{}, n)
+	ptrs := make([]interface{}, n)
+	for i := range dest {
+		ptrs[i] = &dest[i]
+	}
+	for rs.Next() {
+		if err := rs.Scan(ptrs...); err != nil {
+			return err
+		}
+		for _, v := range dest {
+			writeChecksumValue(h, v)
+		}
+	}
+	return rs.Err()
+}
+
+// primaryKeyOrder returns the columns of the PRIMARY KEY of the given table,
+// quoted, and in key order, for use in an ORDER BY clause.
+func primaryKeyOrder(ctx context.Context, conn *sql.Conn, table string) (string, error) {
+	rs, err := conn.QueryContext(ctx, `SELECT name FROM pragma_table_info(?) WHERE pk > 0 ORDER BY pk`, table)
+	if err != nil {
+		return "", err
+	}
+	defer rs.Close()
+
+	var cols []string
+	for rs.Next() {
+		var name string
+		if err := rs.Scan(&name); err != nil {
+			return "", err
+		}
+		cols = append(cols, `"`+strings.ReplaceAll(name, `"`, `""`)+`"`)
+	}
+	if err := rs.Err(); err != nil {
+		return "", err
+	}
+	if len(cols) == 0 {
+		return "", fmt.Errorf("table has neither rowid nor primary key")
+	}
+	return strings.Join(cols, ", "), nil
+}
+
+// writeChecksumValue writes v to h, tagged with its type, and with its
+// length if variable, so that distinct sequences of values never produce
+// the same input to h.
+func writeChecksumValue(h hash.Hash, v interface{}) {
+	var b [9]byte
+	switch v := v.(type) {
+	case nil:
+		h.Write([]byte{'n'})
+	case int64:
+		b[0] = 'i'
+		binary.BigEndian.PutUint64(b[1:], uint64(v))
+		h.Write(b[:])
+	case float64:
+		b[0] = 'f'
+		binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+		h.Write(b[:])
+	case bool:
+		b[0] = 'b'
+		if v {
+			b[1] = 1
+		}
+		h.Write(b[:2])
+	case time.Time:
+		b[0] = 't'
+		binary.BigEndian.PutUint64(b[1:], uint64(v.UnixNano()))
+		h.Write(b[:])
+	case []byte:
+		b[0] = 'y'
+		binary.BigEndian.PutUint64(b[1:], uint64(len(v)))
+		h.Write(b[:])
+		h.Write(v)
+	case string:
+		b[0] = 's'
+		binary.BigEndian.PutUint64(b[1:], uint64(len(v)))
+		h.Write(b[:])
+		h.Write([]byte(v))
+	default:
+		writeChecksumValue(h, fmt.Sprintf("%v", v))
+	}
+}
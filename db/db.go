@@ -5,6 +5,7 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"fmt"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rqlite/go-sqlite3"
@@ -20,6 +22,12 @@ import (
 
 const bkDelay = 250
 
+var (
+	// ErrQueryTimeout is returned when a statement is interrupted because
+	// it did not complete within the timeout set on the request.
+	ErrQueryTimeout = errors.New("query timeout")
+)
+
 const (
 	onDiskMaxOpenConns = 32
 	onDiskMaxIdleTime  = 120 * time.Second
@@ -30,6 +38,11 @@ const (
 	numQueryErrors     = "query_errors"
 	numETx             = "execute_transactions"
 	numQTx             = "query_transactions"
+	numTimeouts        = "timeouts"
+
+	numCheckpoints      = "checkpoints"
+	numCheckpointErrors = "checkpoint_errors"
+	numCheckpointsBusy  = "checkpoints_busy"
 )
 
 // DBVersion is the SQLite version.
@@ -47,19 +60,28 @@ func init() {
 	stats.Add(numQueryErrors, 0)
 	stats.Add(numETx, 0)
 	stats.Add(numQTx, 0)
-
+	stats.Add(numTimeouts, 0)
+	stats.Add(numCheckpoints, 0)
+	stats.Add(numCheckpointErrors, 0)
+	stats.Add(numCheckpointsBusy, 0)
 }
 
 // DB is the SQL database.
 type DB struct {
 	path   string // Path to database file.
 	memory bool   // In-memory only.
+	wal    bool   // In WAL mode.
 
 	rwDB *sql.DB // Database connection for database reads and writes.
 	roDB *sql.DB // Database connection database reads.
 
 	rwDSN string // DSN used for read-write connection
 	roDSN string // DSN used for read-only connections
+
+	statements *statementRegistry // Per-statement execution statistics.
+
+	checkpointMu sync.Mutex
+	checkpoints  checkpointStats
 }
 
 // PoolStats represents connection pool statistics
@@ -75,10 +97,19 @@ type PoolStats struct {
 	MaxLifetimeClosed  int64         `json:"max_lifetime_closed"`
 }
 
-// Open opens a file-based database, creating it if it does not exist.
-func Open(dbPath string, fkEnabled bool) (*DB, error) {
-	rwDSN := fmt.Sprintf("file:%s?_fk=%s", dbPath, strconv.FormatBool(fkEnabled))
-	rwDB, err := sql.Open("sqlite3", rwDSN)
+// Open opens a file-based database, creating it if it does not exist. If wal
+// is true, the database is placed in WAL mode, otherwise the journal mode of
+// the database is unchanged.
+func Open(dbPath string, fkEnabled, wal bool) (*DB, error) {
+	rwOpts := []string{
+		fmt.Sprintf("_fk=%s", strconv.FormatBool(fkEnabled)),
+	}
+	if wal {
+		rwOpts = append(rwOpts, "_journal_mode=WAL")
+	}
+
+	rwDSN := fmt.Sprintf("file:%s?%s", dbPath, strings.Join(rwOpts, "&"))
+	rwDB, err := sql.Open(driver(), rwDSN)
 	if err != nil {
 		return nil, err
 	}
@@ -89,7 +120,7 @@ func Open(dbPath string, fkEnabled bool) (*DB, error) {
 	}
 
 	roDSN := fmt.Sprintf("file:%s?%s", dbPath, strings.Join(roOpts, "&"))
-	roDB, err := sql.Open("sqlite3", roDSN)
+	roDB, err := sql.Open(driver(), roDSN)
 	if err != nil {
 		return nil, err
 	}
@@ -106,11 +137,13 @@ func Open(dbPath string, fkEnabled bool) (*DB, error) {
 	roDB.SetConnMaxLifetime(0)
 
 	return &DB{
-		path:  dbPath,
-		rwDB:  rwDB,
-		roDB:  roDB,
-		rwDSN: rwDSN,
-		roDSN: roDSN,
+		path:       dbPath,
+		wal:        wal,
+		rwDB:       rwDB,
+		roDB:       roDB,
+		rwDSN:      rwDSN,
+		roDSN:      roDSN,
+		statements: newStatementRegistry(),
 	}, nil
 }
 
@@ -126,7 +159,7 @@ func OpenInMemory(fkEnabled bool) (*DB, error) {
 	}
 
 	rwDSN := fmt.Sprintf("%s?%s", inMemPath, strings.Join(rwOpts, "&"))
-	rwDB, err := sql.Open("sqlite3", rwDSN)
+	rwDB, err := sql.Open(driver(), rwDSN)
 	if err != nil {
 		return nil, err
 	}
@@ -146,7 +179,7 @@ func OpenInMemory(fkEnabled bool) (*DB, error) {
 	}
 
 	roDSN := fmt.Sprintf("%s?%s", inMemPath, strings.Join(roOpts, "&"))
-	roDB, err := sql.Open("sqlite3", roDSN)
+	roDB, err := sql.Open(driver(), roDSN)
 	if err != nil {
 		return nil, err
 	}
@@ -157,11 +190,12 @@ func OpenInMemory(fkEnabled bool) (*DB, error) {
 	}
 
 	return &DB{
-		memory: true,
-		rwDB:   rwDB,
-		roDB:   roDB,
-		rwDSN:  rwDSN,
-		roDSN:  roDSN,
+		memory:     true,
+		rwDB:       rwDB,
+		roDB:       roDB,
+		rwDSN:      rwDSN,
+		roDSN:      roDSN,
+		statements: newStatementRegistry(),
 	}, nil
 }
 
@@ -174,7 +208,7 @@ func LoadIntoMemory(dbPath string, fkEnabled bool) (*DB, error) {
 		return nil, err
 	}
 
-	srcDB, err := Open(dbPath, false)
+	srcDB, err := Open(dbPath, false, false)
 	if err != nil {
 		return nil, err
 	}
@@ -194,8 +228,16 @@ func LoadIntoMemory(dbPath string, fkEnabled bool) (*DB, error) {
 // in the byte slide. The byte slice must not be changed or garbage-collected
 // until after this function returns.
 func DeserializeIntoMemory(b []byte, fkEnabled bool) (retDB *DB, retErr error) {
+	// SQLite cannot open an in-memory database whose header records WAL
+	// mode, so deserialize a copy which records rollback mode instead. The
+	// caller's slice may be shared, so must not be modified.
+	if isWALHeader(b) {
+		b = append([]byte(nil), b...)
+		b[walHeaderOffset], b[walHeaderOffset+1] = 1, 1
+	}
+
 	// Get a plain-ol' in-memory database.
-	tmpDB, err := sql.Open("sqlite3", ":memory:")
+	tmpDB, err := sql.Open(driver(), ":memory:")
 	if err != nil {
 		return nil, fmt.Errorf("DeserializeIntoMemory: %s", err.Error())
 	}
@@ -280,6 +322,8 @@ func (db *DB) Stats() (map[string]interface{}, error) {
 		"rw_dsn":          string(db.rwDSN),
 		"ro_dsn":          db.roDSN,
 		"conn_pool_stats": connPoolStats,
+		"statements":      db.statements.count(),
+		"extensions":      Extensions(),
 	}
 
 	if db.memory {
@@ -290,13 +334,18 @@ func (db *DB) Stats() (map[string]interface{}, error) {
 			return nil, err
 		}
 	}
+	if db.wal {
+		if stats["wal"], err = db.walStats(); err != nil {
+			return nil, err
+		}
+	}
 	return stats, nil
 }
 
 // Size returns the size of the database in bytes. "Size" is defined as
 // page_count * schema.page_size.
 func (db *DB) Size() (int64, error) {
-	rows, err := db.QueryStringStmt(`SELECT page_count * page_size as size FROM pragma_page_count(), pragma_page_size()`)
+	rows, err := db.queryInternal(`SELECT page_count * page_size as size FROM pragma_page_count(), pragma_page_size()`)
 	if err != nil {
 		return 0, err
 	}
@@ -319,7 +368,7 @@ func (db *DB) FileSize() (int64, error) {
 
 // CompileOptions returns the SQLite compilation options.
 func (db *DB) CompileOptions() ([]string, error) {
-	res, err := db.QueryStringStmt("PRAGMA compile_options")
+	res, err := db.queryInternal("PRAGMA compile_options")
 	if err != nil {
 		return nil, err
 	}
@@ -367,27 +416,35 @@ func (db *DB) ExecuteStringStmt(query string) ([]*command.ExecuteResult, error)
 	return db.Execute(r, false)
 }
 
-// Execute executes queries that modify the database.
+// Execute executes queries that modify the database. If the request sets
+// a timeout, any statement still running when it expires is interrupted.
+// If the request sets ReadRows, the rows returned by each read-only
+// statement are set on its result, as they would be by a query.
 func (db *DB) Execute(req *command.Request, xTime bool) ([]*command.ExecuteResult, error) {
 	stats.Add(numExecutions, int64(len(req.Statements)))
 
-	conn, err := db.rwDB.Conn(context.Background())
+	ctx, cancel := timeoutContext(req.DbTimeout)
+	defer cancel()
+
+	conn, err := db.rwDB.Conn(ctx)
 	if err != nil {
-		return nil, err
+		return nil, timeoutError(ctx, err)
 	}
 	defer conn.Close()
 
 	type Execer interface {
 		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 	}
 
 	var execer Execer
 	var tx *sql.Tx
 	if req.Transaction {
 		stats.Add(numETx, 1)
-		tx, err = conn.BeginTx(context.Background(), nil)
+		tx, err = conn.BeginTx(ctx, nil)
 		if err != nil {
-			return nil, err
+			return nil, timeoutError(ctx, err)
 		}
 		defer func() {
 			if tx != nil {
@@ -403,9 +460,13 @@ func (db *DB) Execute(req *command.Request, xTime bool) ([]*command.ExecuteResul
 
 	// handleError sets the error field on the given result. It returns
 	// whether the caller should continue processing or break.
-	handleError := func(result *command.ExecuteResult, err error) bool {
+	handleError := func(result *command.ExecuteResult, sql string, start time.Time, err error) bool {
 		stats.Add(numExecutionErrors, 1)
-		result.Error = err.Error()
+		db.statements.record(sql, time.Since(start), 0, true)
+		if xTime {
+			result.Time = time.Since(start).Seconds()
+		}
+		result.Error = timeoutError(ctx, err).Error()
 		allResults = append(allResults, result)
 		if tx != nil {
 			tx.Rollback()
@@ -427,15 +488,56 @@ func (db *DB) Execute(req *command.Request, xTime bool) ([]*command.ExecuteResul
 
 		parameters, err := parametersToValues(stmt.Parameters)
 		if err != nil {
-			if handleError(result, err) {
+			if handleError(result, ss, start, err) {
 				continue
 			}
 			break
 		}
 
-		r, err := execer.ExecContext(context.Background(), ss, parameters...)
+		if hasReturning(ss) {
+			if err := executeReturning(ctx, execer, ss, parameters, result); err != nil {
+				if handleError(result, ss, start, err) {
+					continue
+				}
+				break
+			}
+			db.statements.record(ss, time.Since(start), int64(len(result.Values)), false)
+			if xTime {
+				result.Time = time.Now().Sub(start).Seconds()
+			}
+			allResults = append(allResults, result)
+			continue
+		}
+
+		if req.ReadRows {
+			// Earlier statements in the request may have changed the
+			// schema, so the statement is checked on this connection.
+			ro, err := stmtReadOnly(conn, ss)
+			if err != nil {
+				if handleError(result, ss, start, err) {
+					continue
+				}
+				break
+			}
+			if ro {
+				if err := executeQuery(ctx, execer, ss, parameters, result); err != nil {
+					if handleError(result, ss, start, err) {
+						continue
+					}
+					break
+				}
+				db.statements.record(ss, time.Since(start), int64(len(result.Values)), false)
+				if xTime {
+					result.Time = time.Now().Sub(start).Seconds()
+				}
+				allResults = append(allResults, result)
+				continue
+			}
+		}
+
+		r, err := execer.ExecContext(ctx, ss, parameters...)
 		if err != nil {
-			if handleError(result, err) {
+			if handleError(result, ss, start, err) {
 				continue
 			}
 			break
@@ -447,7 +549,7 @@ func (db *DB) Execute(req *command.Request, xTime bool) ([]*command.ExecuteResul
 
 		lid, err := r.LastInsertId()
 		if err != nil {
-			if handleError(result, err) {
+			if handleError(result, ss, start, err) {
 				continue
 			}
 			break
@@ -456,12 +558,13 @@ func (db *DB) Execute(req *command.Request, xTime bool) ([]*command.ExecuteResul
 
 		ra, err := r.RowsAffected()
 		if err != nil {
-			if handleError(result, err) {
+			if handleError(result, ss, start, err) {
 				continue
 			}
 			break
 		}
 		result.RowsAffected = ra
+		db.statements.record(ss, time.Since(start), ra, false)
 		if xTime {
 			result.Time = time.Now().Sub(start).Seconds()
 		}
@@ -469,11 +572,97 @@ func (db *DB) Execute(req *command.Request, xTime bool) ([]*command.ExecuteResul
 	}
 
 	if tx != nil {
-		err = tx.Commit()
+		err = timeoutError(ctx, tx.Commit())
 	}
 	return allResults, err
 }
 
+// StmtReadOnly returns whether the given SQL statement makes no changes to
+// the database, as determined by SQLite. SQL which cannot be prepared, which
+// contains more than one statement, or which controls transactions or
+// attached databases, is reported as not read-only.
+func (db *DB) StmtReadOnly(sql string) (bool, error) {
+	conn, err := db.roDB.Conn(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	return stmtReadOnly(conn, sql)
+}
+
+// stmtReadOnly returns whether the given SQL statement makes no changes to
+// the database, as determined by SQLite using the given connection.
+func stmtReadOnly(conn *sql.Conn, query string) (bool, error) {
+	if countStatements(query) != 1 {
+		return false, nil
+	}
+	switch firstWord(query) {
+	case "BEGIN", "COMMIT", "END", "ROLLBACK", "SAVEPOINT", "RELEASE", "ATTACH", "DETACH":
+		return false, nil
+	}
+
+	var readOnly bool
+	f := func(driverConn interface{}) error {
+		c := driverConn.(*sqlite3.SQLiteConn)
+		stmt, err := c.Prepare(query)
+		if err != nil {
+			// Possibly refers to a table which is created earlier in the
+			// same request, so assume the worst.
+			return nil
+		}
+		defer stmt.Close()
+		readOnly = stmt.(*sqlite3.SQLiteStmt).Readonly()
+		return nil
+	}
+	if err := conn.Raw(f); err != nil {
+		return false, err
+	}
+	return readOnly, nil
+}
+
+// executeReturning executes a statement with a RETURNING clause, setting the
+// rows it returns, the last insert ID, and the rows affected, on the given
+// result.
+func executeReturning(ctx context.Context, queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, query string, parameters []interface{}, result *command.ExecuteResult) error {
+	rs, err := queryer.QueryContext(ctx, query, parameters...)
+	if err != nil {
+		return err
+	}
+	columns, types, values, err := scanRows(rs)
+	rs.Close()
+	if err != nil {
+		return err
+	}
+	result.Columns = columns
+	result.Types = types
+	result.Values = values
+	result.RowsAffected = int64(len(values))
+	return queryer.QueryRowContext(ctx, "SELECT last_insert_rowid()").Scan(&result.LastInsertId)
+}
+
+// executeQuery executes a read-only statement, setting the rows it returns
+// on the given result.
+func executeQuery(ctx context.Context, queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, query string, parameters []interface{}, result *command.ExecuteResult) error {
+	rs, err := queryer.QueryContext(ctx, query, parameters...)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+	columns, types, values, err := scanRows(rs)
+	if err != nil {
+		return err
+	}
+	result.Columns = columns
+	result.Types = types
+	result.Values = values
+	return nil
+}
+
 // QueryStringStmt executes a single query that return rows, but don't modify database.
 func (db *DB) QueryStringStmt(query string) ([]*command.QueryRows, error) {
 	r := &command.Request{
@@ -487,17 +676,37 @@ func (db *DB) QueryStringStmt(query string) ([]*command.QueryRows, error) {
 }
 
 // Query executes queries that return rows, but don't modify the database.
+// If the request sets a timeout, any statement still running when it expires
+// is interrupted.
 func (db *DB) Query(req *command.Request, xTime bool) ([]*command.QueryRows, error) {
 	stats.Add(numQueries, int64(len(req.Statements)))
+
+	ctx, cancel := timeoutContext(req.DbTimeout)
+	defer cancel()
+
+	conn, err := db.roDB.Conn(ctx)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer conn.Close()
+	return db.queryWithConn(ctx, req, xTime, true, conn)
+}
+
+// queryInternal executes a single query issued by the database layer itself,
+// which is not included in statement statistics.
+func (db *DB) queryInternal(query string) ([]*command.QueryRows, error) {
 	conn, err := db.roDB.Conn(context.Background())
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
-	return db.queryWithConn(req, xTime, conn)
+	return db.queryWithConn(context.Background(), commandRequest(query), false, false, conn)
 }
 
-func (db *DB) queryWithConn(req *command.Request, xTime bool, conn *sql.Conn) ([]*command.QueryRows, error) {
+// queryWithConn executes the queries in req using the given connection. If
+// track is set, execution statistics are recorded for each statement.
+func (db *DB) queryWithConn(ctx context.Context, req *command.Request, xTime, track bool,
+	conn *sql.Conn) ([]*command.QueryRows, error) {
 	var err error
 	type Queryer interface {
 		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
@@ -507,9 +716,9 @@ func (db *DB) queryWithConn(req *command.Request, xTime bool, conn *sql.Conn) ([
 	var tx *sql.Tx
 	if req.Transaction {
 		stats.Add(numQTx, 1)
-		tx, err = conn.BeginTx(context.Background(), nil)
+		tx, err = conn.BeginTx(ctx, nil)
 		if err != nil {
-			return nil, err
+			return nil, timeoutError(ctx, err)
 		}
 		defer tx.Rollback() // Will be ignored if tx is committed
 		queryer = tx
@@ -527,81 +736,108 @@ func (db *DB) queryWithConn(req *command.Request, xTime bool, conn *sql.Conn) ([
 		rows := &command.QueryRows{}
 		start := time.Now()
 
+		record := func(failed bool) {
+			if track {
+				db.statements.record(sql, time.Since(start), int64(len(rows.Values)), failed)
+			}
+			if failed && xTime {
+				rows.Time = time.Since(start).Seconds()
+			}
+		}
+
 		parameters, err := parametersToValues(stmt.Parameters)
 		if err != nil {
 			stats.Add(numQueryErrors, 1)
+			record(true)
 			rows.Error = err.Error()
 			allRows = append(allRows, rows)
 			continue
 		}
 
-		rs, err := queryer.QueryContext(context.Background(), sql, parameters...)
+		rs, err := queryer.QueryContext(ctx, sql, parameters...)
 		if err != nil {
 			stats.Add(numQueryErrors, 1)
-			rows.Error = err.Error()
+			record(true)
+			rows.Error = timeoutError(ctx, err).Error()
 			allRows = append(allRows, rows)
 			continue
 		}
 		defer rs.Close()
 
-		columns, err := rs.Columns()
+		columns, types, values, err := scanRows(rs)
+		rows.Values = values
 		if err != nil {
-			return nil, err
-		}
-
-		types, err := rs.ColumnTypes()
-		if err != nil {
-			return nil, err
-		}
-		xTypes := make([]string, len(types))
-		for i := range types {
-			xTypes[i] = strings.ToLower(types[i].DatabaseTypeName())
-		}
-
-		for rs.Next() {
-			dest := make([]interface{}, len(columns))
-			ptrs := make([]interface{}, len(dest))
-			for i := range ptrs {
-				ptrs[i] = &dest[i]
-			}
-			if err := rs.Scan(ptrs...); err != nil {
-				return nil, err
-			}
-			rows.Values = append(rows.Values, &command.Values{
-				Parameters: normalizeRowValues(dest, xTypes),
-			})
-		}
-
-		// Check for errors from iterating over rows.
-		if err := rs.Err(); err != nil {
 			stats.Add(numQueryErrors, 1)
-			rows.Error = err.Error()
+			record(true)
+			rows.Error = timeoutError(ctx, err).Error()
 			allRows = append(allRows, rows)
 			continue
 		}
 
+		record(false)
 		if xTime {
 			rows.Time = time.Now().Sub(start).Seconds()
 		}
 
 		rows.Columns = columns
-		rows.Types = xTypes
+		rows.Types = types
 		allRows = append(allRows, rows)
 	}
 
 	if tx != nil {
-		err = tx.Commit()
+		err = timeoutError(ctx, tx.Commit())
 	}
 	return allRows, err
 }
 
+// scanRows reads every row from rs. It returns the column names, the declared
+// column types, and the values of each row. If an error occurs, the values of
+// any rows read before the error are returned.
+func scanRows(rs *sql.Rows) ([]string, []string, []*command.Values, error) {
+	columns, err := rs.Columns()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	types, err := rs.ColumnTypes()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	xTypes := make([]string, len(types))
+	for i := range types {
+		xTypes[i] = strings.ToLower(types[i].DatabaseTypeName())
+	}
+
+	var values []*command.Values
+	for rs.Next() {
+		dest := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(dest))
+		for i := range ptrs {
+			ptrs[i] = &dest[i]
+		}
+		if err := rs.Scan(ptrs...); err != nil {
+			return nil, nil, values, err
+		}
+		values = append(values, &command.Values{
+			Parameters: normalizeRowValues(dest, xTypes),
+		})
+	}
+
+	// Check for errors from iterating over rows.
+	if err := rs.Err(); err != nil {
+		return nil, nil, values, err
+	}
+	return columns, xTypes, values, nil
+}
+
 // Backup writes a consistent snapshot of the database to the given file.
 // This function can be called when changes to the database are in flight.
 func (db *DB) Backup(path string) error {
-	dstDB, err := Open(path, false)
+	dstDB, err := Open(path, false, false)
 	if err != nil {
 		return err
 	}
+	defer dstDB.Close()
 
 	if err := copyDatabase(dstDB, db); err != nil {
 		return fmt.Errorf("backup database: %s", err)
@@ -645,6 +881,12 @@ func (db *DB) Serialize() ([]byte, error) {
 	if err := conn.Raw(f); err != nil {
 		return nil, err
 	}
+
+	// The database is serialized as if in rollback mode, as SQLite cannot
+	// open an in-memory database whose header records WAL mode.
+	if isWALHeader(b) {
+		b[walHeaderOffset], b[walHeaderOffset+1] = 1, 1
+	}
 	return b, nil
 }
 
@@ -657,17 +899,6 @@ func (db *DB) Dump(w io.Writer) error {
 	}
 	defer conn.Close()
 
-	// Convenience function to convert string query to protobuf.
-	commReq := func(query string) *command.Request {
-		return &command.Request{
-			Statements: []*command.Statement{
-				{
-					Sql: query,
-				},
-			},
-		}
-	}
-
 	if _, err := w.Write([]byte("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")); err != nil {
 		return err
 	}
@@ -675,7 +906,7 @@ func (db *DB) Dump(w io.Writer) error {
 	// Get the schema.
 	query := `SELECT "name", "type", "sql" FROM "sqlite_master"
               WHERE "sql" NOT NULL AND "type" == 'table' ORDER BY "name"`
-	rows, err := db.queryWithConn(commReq(query), false, conn)
+	rows, err := db.queryWithConn(context.Background(), commandRequest(query), false, false, conn)
 	if err != nil {
 		return err
 	}
@@ -699,8 +930,8 @@ func (db *DB) Dump(w io.Writer) error {
 		}
 
 		tableIndent := strings.Replace(table, `"`, `""`, -1)
-		r, err := db.queryWithConn(commReq(fmt.Sprintf(`PRAGMA table_info("%s")`, tableIndent)),
-			false, conn)
+		r, err := db.queryWithConn(context.Background(),
+			commandRequest(fmt.Sprintf(`PRAGMA table_info("%s")`, tableIndent)), false, false, conn)
 		if err != nil {
 			return err
 		}
@@ -713,7 +944,7 @@ func (db *DB) Dump(w io.Writer) error {
 			tableIndent,
 			strings.Join(columnNames, ","),
 			tableIndent)
-		r, err = db.queryWithConn(commReq(query), false, conn)
+		r, err = db.queryWithConn(context.Background(), commandRequest(query), false, false, conn)
 
 		if err != nil {
 			return err
@@ -729,7 +960,7 @@ func (db *DB) Dump(w io.Writer) error {
 	// Do indexes, triggers, and views.
 	query = `SELECT "name", "type", "sql" FROM "sqlite_master"
 			  WHERE "sql" NOT NULL AND "type" IN ('index', 'trigger', 'view')`
-	rows, err = db.queryWithConn(commReq(query), false, conn)
+	rows, err = db.queryWithConn(context.Background(), commandRequest(query), false, false, conn)
 	if err != nil {
 		return err
 	}
@@ -758,7 +989,7 @@ func (db *DB) memStats() (map[string]int64, error) {
 		"cache_size",
 		"freelist_count",
 	} {
-		res, err := db.QueryStringStmt(fmt.Sprintf("PRAGMA %s", p))
+		res, err := db.queryInternal(fmt.Sprintf("PRAGMA %s", p))
 		if err != nil {
 			return nil, err
 		}
@@ -767,6 +998,36 @@ func (db *DB) memStats() (map[string]int64, error) {
 	return ms, nil
 }
 
+// commandRequest converts a single SQL string to a Request.
+func commandRequest(query string) *command.Request {
+	return &command.Request{
+		Statements: []*command.Statement{
+			{
+				Sql: query,
+			},
+		},
+	}
+}
+
+// timeoutContext returns a context which expires after timeout nanoseconds.
+// A timeout of zero means the context never expires.
+func timeoutContext(timeout int64) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(timeout))
+}
+
+// timeoutError returns ErrQueryTimeout if err occurred because ctx expired,
+// otherwise it returns err unchanged.
+func timeoutError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	stats.Add(numTimeouts, 1)
+	return ErrQueryTimeout
+}
+
 func copyDatabase(dst *DB, src *DB) error {
 	dstConn, err := dst.rwDB.Conn(context.Background())
 	if err != nil {
@@ -833,6 +1094,10 @@ func parametersToValues(parameters []*command.Parameter) ([]interface{}, error)
 			values[i] = w.Y
 		case *command.Parameter_S:
 			values[i] = w.S
+		case *command.Parameter_N:
+			values[i] = nil
+		case *command.Parameter_T:
+			values[i] = time.Unix(0, w.T).UTC()
 		default:
 			return nil, fmt.Errorf("unsupported type: %T", w)
 		}
@@ -843,11 +1108,18 @@ func parametersToValues(parameters []*command.Parameter) ([]interface{}, error)
 // normalizeRowValues performs some normalization of values in the returned rows.
 // Text values come over (from sqlite-go) as []byte instead of strings
 // for some reason, so we have explicitly convert (but only when type
-// is "text" so we don't affect BLOB types)
+// is "text" so we don't affect BLOB types). NULL values are explicitly
+// flagged, so clients need not infer them from missing values.
 func normalizeRowValues(row []interface{}, types []string) []*command.Parameter {
 	values := make([]*command.Parameter, len(types))
 	for i, v := range row {
 		switch val := v.(type) {
+		case nil:
+			values[i] = &command.Parameter{
+				Value: &command.Parameter_N{
+					N: true,
+				},
+			}
 		case int:
 		case int64:
 			values[i] = &command.Parameter{
@@ -873,10 +1145,18 @@ func normalizeRowValues(row []interface{}, types []string) []*command.Parameter
 					S: val,
 				},
 			}
+		case time.Time:
+			values[i] = &command.Parameter{
+				Value: &command.Parameter_T{
+					T: val.UnixNano(),
+				},
+			}
 		case []byte:
 			if isTextType(types[i]) {
-				values[i].Value = &command.Parameter_S{
-					S: string(val),
+				values[i] = &command.Parameter{
+					Value: &command.Parameter_S{
+						S: string(val),
+					},
 				}
 			} else {
 				values[i] = &command.Parameter{
@@ -1,10 +1,12 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
@@ -25,7 +27,7 @@ func Test_DbFileCreation(t *testing.T) {
 	defer os.RemoveAll(dir)
 	dbPath := path.Join(dir, "test_db")
 
-	db, err := Open(dbPath, false)
+	db, err := Open(dbPath, false, false)
 	if err != nil {
 		t.Fatalf("failed to open new database: %s", err.Error())
 	}
@@ -883,6 +885,200 @@ func Test_SimpleParameterizedStatements(t *testing.T) {
 	}
 }
 
+func Test_NullAndTimestampParameters(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	_, err := db.ExecuteStringStmt("CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT, ts DATETIME)")
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+
+	ts := time.Date(2021, time.September, 1, 12, 30, 45, 0, time.UTC)
+	req := &command.Request{
+		Statements: []*command.Statement{
+			{
+				Sql: "INSERT INTO foo(name, ts) VALUES(?, ?)",
+				Parameters: []*command.Parameter{
+					{
+						Value: &command.Parameter_N{
+							N: true,
+						},
+					},
+					{
+						Value: &command.Parameter_T{
+							T: ts.UnixNano(),
+						},
+					},
+				},
+			},
+		},
+	}
+	r, err := db.Execute(req, false)
+	if err != nil {
+		t.Fatalf("failed to insert record: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":1,"rows_affected":1}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for execute\nexp: %s\ngot: %s", exp, got)
+	}
+
+	q, err := db.QueryStringStmt(`SELECT * FROM foo`)
+	if err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if _, ok := q[0].Values[0].Parameters[1].GetValue().(*command.Parameter_N); !ok {
+		t.Fatalf("expected explicit NULL value, got %T", q[0].Values[0].Parameters[1].GetValue())
+	}
+	if exp, got := ts.UnixNano(), q[0].Values[0].Parameters[2].GetT(); exp != got {
+		t.Fatalf("unexpected timestamp, exp %d, got %d", exp, got)
+	}
+	if exp, got := `[{"columns":["id","name","ts"],"types":["integer","text","datetime"],"values":[[1,null,"2021-09-01T12:30:45Z"]]}]`, asJSON(q); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_QueryTimeout(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	slow := `WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c) SELECT count(*) FROM c`
+	req := &command.Request{
+		Statements: []*command.Statement{
+			{
+				Sql: slow,
+			},
+		},
+		DbTimeout: (100 * time.Millisecond).Nanoseconds(),
+	}
+
+	r, err := db.Query(req, false)
+	if err != nil {
+		t.Fatalf("failed to query: %s", err.Error())
+	}
+	if exp, got := `[{"error":"query timeout"}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	req.Statements[0].Sql = "CREATE TABLE foo AS " + slow
+	e, err := db.Execute(req, false)
+	if err != nil {
+		t.Fatalf("failed to execute: %s", err.Error())
+	}
+	if exp, got := `[{"error":"query timeout"}]`, asJSON(e); exp != got {
+		t.Fatalf("unexpected results for execute\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Database should still be usable after interruption.
+	r, err = db.QueryStringStmt(`SELECT count(*) FROM sqlite_master`)
+	if err != nil {
+		t.Fatalf("failed to query: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["count(*)"],"types":[""],"values":[[0]]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_Fingerprint(t *testing.T) {
+	tests := []struct {
+		sql string
+		exp string
+	}{
+		{
+			sql: `SELECT * FROM foo`,
+			exp: `select * from foo`,
+		},
+		{
+			sql: "select *\n  FROM   foo  ;",
+			exp: `select * from foo`,
+		},
+		{
+			sql: `SELECT * FROM foo WHERE id=1 AND name='fiona'`,
+			exp: `select * from foo where id=? and name=?`,
+		},
+		{
+			sql: `INSERT INTO foo(name, age) VALUES('it''s', -3.5e10)`,
+			exp: `insert into foo(name, age) values(?, -?)`,
+		},
+		{
+			sql: `SELECT x FROM t1 WHERE y > 0x1F -- trailing comment`,
+			exp: `select x from t1 where y > ?`,
+		},
+		{
+			sql: `SELECT /* hint */ "Name 1", [Col 2] FROM foo`,
+			exp: `select "Name 1", [Col 2] from foo`,
+		},
+	}
+
+	for i, tt := range tests {
+		if got := Fingerprint(tt.sql); got != tt.exp {
+			t.Fatalf("test %d: incorrect fingerprint, exp %s, got %s", i, tt.exp, got)
+		}
+	}
+}
+
+func Test_StatementStats(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	if _, err := db.ExecuteStringStmt(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	for _, n := range []string{"fiona", "declan", "dana"} {
+		if _, err := db.ExecuteStringStmt(fmt.Sprintf(`INSERT INTO foo(name) VALUES('%s')`, n)); err != nil {
+			t.Fatalf("failed to insert record: %s", err.Error())
+		}
+	}
+	if _, err := db.QueryStringStmt(`SELECT * FROM foo WHERE id > 1`); err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if _, err := db.QueryStringStmt(`SELECT * FROM foo WHERE id > 0`); err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if _, err := db.QueryStringStmt(`SELECT * FROM bar`); err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+
+	// Internal queries should not be tracked.
+	if _, err := db.Stats(); err != nil {
+		t.Fatalf("failed to get database stats: %s", err.Error())
+	}
+
+	stats := make(map[string]*StatementStat)
+	for _, s := range db.StatementStats() {
+		stats[s.Fingerprint] = s
+	}
+	if len(stats) != 4 {
+		t.Fatalf("wrong number of fingerprints, exp 4, got %d", len(stats))
+	}
+
+	s := stats[`insert into foo(name) values(?)`]
+	if s == nil || s.Calls != 3 || s.Rows != 3 {
+		t.Fatalf("wrong stats for insert: %s", asJSON(s))
+	}
+	s = stats[`select * from foo where id > ?`]
+	if s == nil {
+		t.Fatalf("query fingerprint not found")
+	}
+	if s.Calls != 2 || s.Rows != 5 || s.Errors != 0 {
+		t.Fatalf("wrong query stats, calls %d, rows %d, errors %d", s.Calls, s.Rows, s.Errors)
+	}
+	if s.MinTime > s.MaxTime || s.MeanTime > s.MaxTime || s.P99Time > s.MaxTime {
+		t.Fatalf("inconsistent query times: %s", asJSON(s))
+	}
+	s = stats[`select * from bar`]
+	if s == nil || s.Calls != 1 || s.Errors != 1 {
+		t.Fatalf("wrong stats for failed query: %s", asJSON(s))
+	}
+
+	db.ResetStatementStats()
+	if n := len(db.StatementStats()); n != 0 {
+		t.Fatalf("statement stats not reset, got %d fingerprints", n)
+	}
+}
+
 func Test_CommonTableExpressions(t *testing.T) {
 	db, path := mustCreateDatabase()
 	defer db.Close()
@@ -1217,7 +1413,7 @@ func Test_Backup(t *testing.T) {
 		t.Fatalf("failed to backup database: %s", err.Error())
 	}
 
-	newDB, err := Open(dstDB, false)
+	newDB, err := Open(dstDB, false, false)
 	if err != nil {
 		t.Fatalf("failed to open backup database: %s", err.Error())
 	}
@@ -1266,7 +1462,7 @@ func Test_Copy(t *testing.T) {
 
 	dstFile := mustTempFile()
 	defer os.Remove(dstFile)
-	dstDB, err := Open(dstFile, false)
+	dstDB, err := Open(dstFile, false, false)
 	if err != nil {
 		t.Fatalf("failed to open destination database: %s", err)
 	}
@@ -1335,7 +1531,7 @@ func Test_Serialize(t *testing.T) {
 		t.Fatalf("failed to write serialized database to file: %s", err.Error())
 	}
 
-	newDB, err := Open(dstDB.Name(), false)
+	newDB, err := Open(dstDB.Name(), false, false)
 	if err != nil {
 		t.Fatalf("failed to open on-disk serialized database: %s", err.Error())
 	}
@@ -1599,7 +1795,7 @@ func Test_JSON1(t *testing.T) {
 func mustCreateDatabase() (*DB, string) {
 	var err error
 	f := mustTempFile()
-	db, err := Open(f, false)
+	db, err := Open(f, false, false)
 	if err != nil {
 		panic("failed to open database")
 	}
@@ -1631,7 +1827,7 @@ func mustWriteAndOpenDatabase(b []byte) (*DB, string) {
 		panic("failed to write file")
 	}
 
-	db, err := Open(f, false)
+	db, err := Open(f, false, false)
 	if err != nil {
 		panic("failed to open database")
 	}
@@ -1674,3 +1870,623 @@ func mustTempFile() string {
 	tmpfile.Close()
 	return tmpfile.Name()
 }
+
+func Test_Explain(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	if _, err := db.ExecuteStringStmt(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT, age INTEGER)`); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	if _, err := db.ExecuteStringStmt(`CREATE INDEX foo_name ON foo(name)`); err != nil {
+		t.Fatalf("failed to create index: %s", err.Error())
+	}
+
+	req := &command.Request{
+		Statements: []*command.Statement{
+			{
+				Sql: `SELECT * FROM foo WHERE age > 10 ORDER BY age`,
+			},
+			{
+				Sql: `SELECT * FROM foo WHERE name = ?`,
+				Parameters: []*command.Parameter{
+					{
+						Value: &command.Parameter_S{
+							S: "fiona",
+						},
+					},
+				},
+			},
+			{
+				Sql: `SELECT * FROM foo WHERE id IN (SELECT id FROM foo WHERE name = 'fiona')`,
+			},
+			{
+				Sql: `SELECT * FROM bar`,
+			},
+		},
+	}
+	plans, err := db.Explain(req)
+	if err != nil {
+		t.Fatalf("failed to explain: %s", err.Error())
+	}
+	if len(plans) != 4 {
+		t.Fatalf("wrong number of plans, exp 4, got %d", len(plans))
+	}
+
+	if !plans[0].FullScan || !plans[0].TempBTree {
+		t.Fatalf("full scan and temp b-tree not flagged: %s", asJSON(plans[0]))
+	}
+	if plans[1].FullScan || plans[1].TempBTree || len(plans[1].Plan) != 1 {
+		t.Fatalf("unexpected plan for indexed query: %s", asJSON(plans[1]))
+	}
+	if exp, got := "SEARCH foo USING INDEX foo_name (name=?)", plans[1].Plan[0].Detail; exp != got {
+		t.Fatalf("unexpected plan detail, exp %s, got %s", exp, got)
+	}
+	if plans[2].FullScan {
+		t.Fatalf("full scan incorrectly flagged: %s", asJSON(plans[2]))
+	}
+	var nested bool
+	for _, n := range plans[2].Plan {
+		nested = nested || len(n.Children) > 0
+	}
+	if !nested {
+		t.Fatalf("subquery plan not nested: %s", asJSON(plans[2]))
+	}
+	if exp, got := "no such table: bar", plans[3].Error; exp != got {
+		t.Fatalf("unexpected error, exp %s, got %s", exp, got)
+	}
+}
+
+func Test_RewriteNonDeterministic(t *testing.T) {
+	now := time.Date(2021, 9, 1, 14, 30, 15, 123000000, time.UTC)
+	tests := []struct {
+		sql string
+		exp string
+	}{
+		{
+			sql: `INSERT INTO foo(name) VALUES("fiona")`,
+			exp: `INSERT INTO foo(name) VALUES("fiona")`,
+		},
+		{
+			sql: `INSERT INTO foo(t) VALUES(datetime('now'))`,
+			exp: `INSERT INTO foo(t) VALUES(datetime('2021-09-01 14:30:15.123'))`,
+		},
+		{
+			sql: `INSERT INTO foo(t) VALUES(date('NOW', '+1 day'), time(), julianday ( ))`,
+			exp: `INSERT INTO foo(t) VALUES(date('2021-09-01 14:30:15.123', '+1 day'), time('2021-09-01 14:30:15.123'), julianday ( '2021-09-01 14:30:15.123'))`,
+		},
+		{
+			sql: `INSERT INTO foo(t) VALUES(strftime('%s'), strftime('%s', 'now'), strftime('%s', '2020-01-01'))`,
+			exp: `INSERT INTO foo(t) VALUES(strftime('%s', '2021-09-01 14:30:15.123'), strftime('%s', '2021-09-01 14:30:15.123'), strftime('%s', '2020-01-01'))`,
+		},
+		{
+			sql: `UPDATE foo SET t=CURRENT_TIMESTAMP, d=current_date, c=CURRENT_TIME WHERE name='now'`,
+			exp: `UPDATE foo SET t='2021-09-01 14:30:15', d='2021-09-01', c='14:30:15' WHERE name='now'`,
+		},
+		{
+			sql: `INSERT INTO foo(d) VALUES(date(date('now')))`,
+			exp: `INSERT INTO foo(d) VALUES(date(date('2021-09-01 14:30:15.123')))`,
+		},
+		{
+			sql: `INSERT INTO "random"(x) VALUES('random()') -- random()`,
+			exp: `INSERT INTO "random"(x) VALUES('random()') -- random()`,
+		},
+		{
+			sql: `CREATE TABLE foo (id INTEGER PRIMARY KEY, t TEXT DEFAULT CURRENT_TIMESTAMP)`,
+			exp: `CREATE TABLE foo (id INTEGER PRIMARY KEY, t TEXT DEFAULT CURRENT_TIMESTAMP)`,
+		},
+		{
+			sql: `CREATE TABLE foo (id INTEGER, CHECK (date(id) < date('now'))); INSERT INTO foo VALUES(CURRENT_DATE)`,
+			exp: `CREATE TABLE foo (id INTEGER, CHECK (date(id) < date('now'))); INSERT INTO foo VALUES('2021-09-01')`,
+		},
+		{
+			sql: `CREATE TEMP TABLE IF NOT EXISTS bar AS SELECT id, CAST(datetime('now') AS TEXT) AS t FROM foo`,
+			exp: `CREATE TEMP TABLE IF NOT EXISTS bar AS SELECT id, CAST(datetime('2021-09-01 14:30:15.123') AS TEXT) AS t FROM foo`,
+		},
+		{
+			sql: `CREATE VIEW v AS SELECT date('now', 'localtime'); ALTER TABLE foo ADD COLUMN d TEXT DEFAULT 'now'`,
+			exp: `CREATE VIEW v AS SELECT date('now', 'localtime'); ALTER TABLE foo ADD COLUMN d TEXT DEFAULT 'now'`,
+		},
+		{
+			sql: `CREATE TRIGGER t AFTER INSERT ON foo BEGIN UPDATE foo SET t = CASE WHEN 1 THEN CURRENT_TIMESTAMP END; END; UPDATE foo SET t = CURRENT_TIME`,
+			exp: `CREATE TRIGGER t AFTER INSERT ON foo BEGIN UPDATE foo SET t = CASE WHEN 1 THEN CURRENT_TIMESTAMP END; END; UPDATE foo SET t = '14:30:15'`,
+		},
+	}
+
+	for i, tt := range tests {
+		got, err := RewriteNonDeterministic(tt.sql, now)
+		if err != nil {
+			t.Fatalf("test %d: failed to rewrite: %s", i, err.Error())
+		}
+		if got != tt.exp {
+			t.Fatalf("test %d: incorrect rewrite\nexp: %s\ngot: %s", i, tt.exp, got)
+		}
+	}
+
+	got, err := RewriteNonDeterministic(`INSERT INTO foo VALUES(1-random(), randomblob(4), randomblob(010), randomblob(0x2))`, now)
+	if err != nil {
+		t.Fatalf("failed to rewrite: %s", err.Error())
+	}
+	if !regexp.MustCompile(`^INSERT INTO foo VALUES\(1-\(-?[0-9]+\), X'[0-9A-F]{8}', X'[0-9A-F]{20}', X'[0-9A-F]{4}'\)$`).MatchString(got) {
+		t.Fatalf("incorrect rewrite of random functions: %s", got)
+	}
+
+	// Calls which cannot be rewritten are rejected.
+	for _, sql := range []string{
+		`INSERT INTO foo VALUES(randomblob(n))`,
+		`INSERT INTO foo VALUES(randomblob(?))`,
+		`INSERT INTO foo VALUES(randomblob(1.5))`,
+		`INSERT INTO foo VALUES(randomblob(65537))`,
+		`INSERT INTO foo VALUES(datetime('now', 'localtime'))`,
+		`UPDATE foo SET d=date(d, 'UTC')`,
+		`CREATE TABLE bar AS SELECT time('now', 'localtime')`,
+	} {
+		if _, err := RewriteNonDeterministic(sql, now); err == nil {
+			t.Fatalf("no error rewriting %s", sql)
+		}
+	}
+}
+
+func Test_StmtReadOnly(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	if _, err := db.ExecuteStringStmt(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`); err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+
+	tests := []struct {
+		sql string
+		ro  bool
+	}{
+		{sql: `SELECT * FROM foo`, ro: true},
+		{sql: `WITH c AS (SELECT id FROM foo) SELECT * FROM c;`, ro: true},
+		{sql: `PRAGMA table_info(foo)`, ro: true},
+		{sql: `INSERT INTO foo(name) VALUES('fiona')`, ro: false},
+		{sql: `INSERT INTO foo(name) VALUES('fiona') RETURNING id`, ro: false},
+		{sql: `DELETE FROM foo`, ro: false},
+		{sql: `CREATE TABLE bar (id INTEGER)`, ro: false},
+		{sql: `INSERT INTO bar(id) VALUES(1)`, ro: false},
+		{sql: `SELECT * FROM foo; DELETE FROM foo`, ro: false},
+		{sql: `BEGIN`, ro: false},
+		{sql: `nonsense`, ro: false},
+	}
+	for i, tt := range tests {
+		ro, err := db.StmtReadOnly(tt.sql)
+		if err != nil {
+			t.Fatalf("test %d: failed to check statement: %s", i, err.Error())
+		}
+		if ro != tt.ro {
+			t.Fatalf("test %d: wrong read-only status for %s, exp %v, got %v", i, tt.sql, tt.ro, ro)
+		}
+	}
+}
+
+func Test_ExecuteReturningRows(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	r, err := db.ExecuteStringStmt(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`)
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err.Error())
+	}
+	if exp, got := `[{}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for create, expected %s, got %s", exp, got)
+	}
+
+	r, err = db.ExecuteStringStmt(`INSERT INTO foo(name) VALUES('fiona'), ('declan') RETURNING id, name`)
+	if err != nil {
+		t.Fatalf("failed to insert records: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":2,"rows_affected":2,"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"],[2,"declan"]]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for insert, expected %s, got %s", exp, got)
+	}
+
+	r, err = db.ExecuteStringStmt(`UPDATE foo SET name='aoife' WHERE id=2 RETURNING *`)
+	if err != nil {
+		t.Fatalf("failed to update record: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":2,"rows_affected":1,"columns":["id","name"],"types":["integer","text"],"values":[[2,"aoife"]]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for update, expected %s, got %s", exp, got)
+	}
+
+	r, err = db.ExecuteStringStmt(`DELETE FROM foo WHERE id=3 RETURNING id`)
+	if err != nil {
+		t.Fatalf("failed to delete record: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":2,"columns":["id"],"types":["integer"]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for delete, expected %s, got %s", exp, got)
+	}
+
+	// Only statements with a RETURNING clause return rows.
+	r, err = db.ExecuteStringStmt(`SELECT COUNT(*) FROM foo`)
+	if err != nil {
+		t.Fatalf("failed to execute select: %s", err.Error())
+	}
+	if len(r) != 1 || r[0].Columns != nil || r[0].Values != nil {
+		t.Fatalf("unexpected results for select, got %s", asJSON(r))
+	}
+
+	// A failing RETURNING statement must not modify the database.
+	r, err = db.ExecuteStringStmt(`INSERT INTO foo(id, name) VALUES(1, 'fiona') RETURNING id`)
+	if err != nil {
+		t.Fatalf("failed to execute insert: %s", err.Error())
+	}
+	if exp, got := `[{"error":"UNIQUE constraint failed: foo.id"}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for failed insert, expected %s, got %s", exp, got)
+	}
+
+	q, err := db.QueryStringStmt(`SELECT * FROM foo`)
+	if err != nil {
+		t.Fatalf("failed to query table: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"],[2,"aoife"]]}]`, asJSON(q); exp != got {
+		t.Fatalf("unexpected results for query, expected %s, got %s", exp, got)
+	}
+}
+
+func Test_ExecuteReadRows(t *testing.T) {
+	for _, tx := range []bool{false, true} {
+		db, path := mustCreateDatabase()
+		defer db.Close()
+		defer os.Remove(path)
+
+		// The table read is created earlier in the same request.
+		req := &command.Request{
+			Transaction: tx,
+			Statements: []*command.Statement{
+				{Sql: `CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`},
+				{Sql: `INSERT INTO foo(name) VALUES('fiona')`},
+				{Sql: `SELECT * FROM foo WHERE name=?`, Parameters: []*command.Parameter{
+					{Value: &command.Parameter_S{S: "fiona"}},
+				}},
+				{Sql: `INSERT INTO foo(name) VALUES('declan')`},
+			},
+			ReadRows: true,
+		}
+		r, err := db.Execute(req, false)
+		if err != nil {
+			t.Fatalf("failed to execute request: %s", err.Error())
+		}
+		if exp, got := `[{},{"last_insert_id":1,"rows_affected":1},{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"]]},{"last_insert_id":2,"rows_affected":1}]`, asJSON(r); exp != got {
+			t.Fatalf("unexpected results for request (tx %v), expected %s, got %s", tx, exp, got)
+		}
+
+		// Without ReadRows, read-only statements do not return rows.
+		req = &command.Request{
+			Statements: []*command.Statement{{Sql: `SELECT * FROM foo`}},
+		}
+		r, err = db.Execute(req, false)
+		if err != nil {
+			t.Fatalf("failed to execute request: %s", err.Error())
+		}
+		if len(r) != 1 || r[0].Columns != nil || r[0].Values != nil {
+			t.Fatalf("unexpected results for select, got %s", asJSON(r))
+		}
+	}
+}
+
+func Test_HasReturning(t *testing.T) {
+	tests := []struct {
+		sql       string
+		returning bool
+	}{
+		{sql: `SELECT * FROM foo`},
+		{sql: ` values(1, 2)`},
+		{sql: `WITH c AS (SELECT 1) SELECT * FROM c`},
+		{sql: `SELECT returning FROM foo`},
+		{sql: `WITH c AS (SELECT 1) INSERT INTO foo SELECT * FROM c`},
+		{sql: `WITH c AS (SELECT 1) INSERT INTO foo SELECT * FROM c RETURNING *`, returning: true},
+		{sql: `INSERT INTO foo VALUES(1)`},
+		{sql: `INSERT INTO foo VALUES('returning')`},
+		{sql: `INSERT INTO foo VALUES(1) RETURNING id`, returning: true},
+		{sql: `-- comment
+UPDATE foo SET id = 2 RETURNING id`, returning: true},
+		{sql: `delete from foo returning *;`, returning: true},
+		{sql: `CREATE TABLE bar AS SELECT * FROM foo`},
+		{sql: `INSERT INTO foo VALUES(1) RETURNING id; SELECT 2`},
+	}
+	for i, tt := range tests {
+		if got := hasReturning(tt.sql); got != tt.returning {
+			t.Fatalf("test %d: wrong result for %s, exp %v, got %v", i, tt.sql, tt.returning, got)
+		}
+	}
+}
+
+func Test_LoadExtensionsBadPath(t *testing.T) {
+	if err := LoadExtensions([]string{"/does/not/exist.so"}); err == nil {
+		t.Fatalf("loaded extension which does not exist")
+	}
+	if exts := Extensions(); len(exts) != 0 {
+		t.Fatalf("extensions recorded after failed load: %v", exts)
+	}
+
+	// A file which is not a shared object must also fail to load.
+	f := mustTempFile()
+	defer os.Remove(f)
+	if err := ioutil.WriteFile(f, []byte("not an extension"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err.Error())
+	}
+	if err := LoadExtensions([]string{f}); err == nil {
+		t.Fatalf("loaded file which is not an extension")
+	}
+	if exts := Extensions(); len(exts) != 0 {
+		t.Fatalf("extensions recorded after failed load: %v", exts)
+	}
+
+	// Databases must still open normally.
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+}
+
+func Test_CheckExtensions(t *testing.T) {
+	f := mustTempFile()
+	defer os.Remove(f)
+	if err := ioutil.WriteFile(f, []byte("extension"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err.Error())
+	}
+	e, err := newExtension(f)
+	if err != nil {
+		t.Fatalf("failed to create extension: %s", err.Error())
+	}
+	if exp, got := "26f1de33979d065ba8d86789de634228e3540fee2f6e5a66eebf93f78d83077d", e.SHA256; exp != got {
+		t.Fatalf("wrong digest for extension, exp %s, got %s", exp, got)
+	}
+
+	if err := CheckExtensions(nil); err != nil {
+		t.Fatalf("no extensions failed check: %s", err.Error())
+	}
+	err = CheckExtensions([]Extension{e})
+	if err == nil {
+		t.Fatalf("extension not loaded by this node passed check")
+	}
+	if !strings.Contains(err.Error(), "is not loaded by this node") {
+		t.Fatalf("unexpected error for extension not loaded: %s", err.Error())
+	}
+}
+
+func Test_Schema(t *testing.T) {
+	db, path := mustCreateDatabase()
+	defer db.Close()
+	defer os.Remove(path)
+
+	s, err := db.Schema()
+	if err != nil {
+		t.Fatalf("failed to get schema of empty database: %s", err.Error())
+	}
+	if exp, got := `{"tables":[],"views":[],"triggers":[]}`, asJSON(s); exp != got {
+		t.Fatalf("unexpected schema for empty database, expected %s, got %s", exp, got)
+	}
+
+	for _, stmt := range []string{
+		`CREATE TABLE bar (id INTEGER PRIMARY KEY AUTOINCREMENT, code TEXT UNIQUE)`,
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT DEFAULT 'none', bar_id INTEGER REFERENCES bar(id) ON DELETE CASCADE)`,
+		`CREATE INDEX foo_name ON foo(name, lower(name)) WHERE name IS NOT NULL`,
+		`CREATE VIEW foo_names AS SELECT name FROM foo`,
+		`CREATE TRIGGER foo_trigger AFTER INSERT ON foo BEGIN UPDATE foo SET name = 'x' WHERE id = new.id; END`,
+		`INSERT INTO bar(code) VALUES('a')`,
+	} {
+		if _, err := db.ExecuteStringStmt(stmt); err != nil {
+			t.Fatalf("failed to execute %s: %s", stmt, err.Error())
+		}
+	}
+
+	s, err = db.Schema()
+	if err != nil {
+		t.Fatalf("failed to get schema: %s", err.Error())
+	}
+	if exp, got := 2, len(s.Tables); exp != got {
+		t.Fatalf("wrong number of tables, sqlite_sequence included? exp %d, got %d", exp, got)
+	}
+
+	bar := s.Tables[0]
+	if exp, got := `[{"name":"sqlite_autoindex_bar_1","unique":true,"origin":"u","partial":false,"columns":["code"]}]`, asJSON(bar.Indexes); exp != got {
+		t.Fatalf("unexpected indexes for bar, expected %s, got %s", exp, got)
+	}
+
+	foo := s.Tables[1]
+	if exp, got := `[{"name":"id","type":"INTEGER","not_null":true,"primary_key":1},{"name":"name","type":"TEXT","not_null":false,"default":"'none'"},{"name":"bar_id","type":"INTEGER","not_null":false}]`, asJSON(foo.Columns); exp != got {
+		t.Fatalf("unexpected columns for foo, expected %s, got %s", exp, got)
+	}
+	if exp, got := `[{"name":"foo_name","unique":false,"origin":"c","partial":true,"columns":["name",""],"sql":"CREATE INDEX foo_name ON foo(name, lower(name)) WHERE name IS NOT NULL"}]`, asJSON(foo.Indexes); exp != got {
+		t.Fatalf("unexpected indexes for foo, expected %s, got %s", exp, got)
+	}
+	if exp, got := `[{"table":"bar","from":["bar_id"],"to":["id"],"on_update":"NO ACTION","on_delete":"CASCADE","match":"NONE"}]`, asJSON(foo.ForeignKeys); exp != got {
+		t.Fatalf("unexpected foreign keys for foo, expected %s, got %s", exp, got)
+	}
+	if exp, got := `[{"name":"foo_names","sql":"CREATE VIEW foo_names AS SELECT name FROM foo","columns":[{"name":"name","type":"TEXT","not_null":false}]}]`, asJSON(s.Views); exp != got {
+		t.Fatalf("unexpected views, expected %s, got %s", exp, got)
+	}
+	if exp, got := `[{"name":"foo_trigger","table":"foo","sql":"CREATE TRIGGER foo_trigger AFTER INSERT ON foo BEGIN UPDATE foo SET name = 'x' WHERE id = new.id; END"}]`, asJSON(s.Triggers); exp != got {
+		t.Fatalf("unexpected triggers, expected %s, got %s", exp, got)
+	}
+}
+
+func Test_WALDatabase(t *testing.T) {
+	path := mustTempFile()
+	defer RemoveFiles(path)
+	db, err := Open(path, false, true)
+	if err != nil {
+		t.Fatalf("failed to open database in WAL mode: %s", err.Error())
+	}
+	defer db.Close()
+	if !db.WAL() {
+		t.Fatalf("database not in WAL mode")
+	}
+
+	r, err := db.QueryStringStmt(`PRAGMA journal_mode`)
+	if err != nil {
+		t.Fatalf("failed to query journal mode: %s", err.Error())
+	}
+	if exp, got := `[["wal"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("wrong journal mode, exp %s, got %s", exp, got)
+	}
+
+	for _, stmt := range []string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	} {
+		if _, err := db.ExecuteStringStmt(stmt); err != nil {
+			t.Fatalf("failed to execute %s: %s", stmt, err.Error())
+		}
+	}
+	sz, err := db.WALSize()
+	if err != nil {
+		t.Fatalf("failed to get WAL size: %s", err.Error())
+	}
+	if sz == 0 {
+		t.Fatalf("WAL empty after writes")
+	}
+
+	if err := db.Checkpoint(); err != nil {
+		t.Fatalf("failed to checkpoint: %s", err.Error())
+	}
+	sz, err = db.WALSize()
+	if err != nil {
+		t.Fatalf("failed to get WAL size: %s", err.Error())
+	}
+	if sz != 0 {
+		t.Fatalf("WAL not truncated by checkpoint, size %d", sz)
+	}
+	st, err := db.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err.Error())
+	}
+	ws := st["wal"].(map[string]interface{})
+	if ws["checkpoints"] != 1 || ws["checkpoint_errors"] != 0 || ws["size"] != int64(0) {
+		t.Fatalf("wrong WAL stats after checkpoint: %v", ws)
+	}
+
+	// A database in WAL mode can be loaded into memory from its serialization.
+	b, err := db.Serialize()
+	if err != nil {
+		t.Fatalf("failed to serialize database: %s", err.Error())
+	}
+	orig := append([]byte(nil), b...)
+	inmem, err := DeserializeIntoMemory(b, false)
+	if err != nil {
+		t.Fatalf("failed to deserialize database: %s", err.Error())
+	}
+	defer inmem.Close()
+	if !bytes.Equal(b, orig) {
+		t.Fatalf("serialization modified by deserializing it")
+	}
+	r, err = inmem.QueryStringStmt(`SELECT * FROM foo`)
+	if err != nil {
+		t.Fatalf("failed to query deserialized database: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("wrong results from deserialized database, exp %s, got %s", exp, got)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err.Error())
+	}
+	if err := RemoveFiles(path); err != nil {
+		t.Fatalf("failed to remove database files: %s", err.Error())
+	}
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s exists after removing database files", p)
+		}
+	}
+}
+
+func Test_Checksum(t *testing.T) {
+	db1, path := mustCreateDatabase()
+	defer db1.Close()
+	defer os.Remove(path)
+	db2 := mustCreateInMemoryDatabase()
+	defer db2.Close()
+
+	checksums := func() (string, string) {
+		sum1, err := db1.Checksum()
+		if err != nil {
+			t.Fatalf("failed to get checksum: %s", err.Error())
+		}
+		sum2, err := db2.Checksum()
+		if err != nil {
+			t.Fatalf("failed to get checksum: %s", err.Error())
+		}
+		return sum1, sum2
+	}
+	if sum1, sum2 := checksums(); sum1 != sum2 {
+		t.Fatalf("checksums of empty databases differ: %s, %s", sum1, sum2)
+	}
+
+	create := `CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT, data BLOB, score REAL)`
+	rows := []string{
+		`INSERT INTO foo VALUES(1, 'fiona', x'0102', 1.5)`,
+		`INSERT INTO foo VALUES(2, NULL, NULL, 2)`,
+		`INSERT INTO foo VALUES(3, '', x'', NULL)`,
+	}
+	stmts1 := append([]string{create}, rows...)
+	stmts2 := []string{create, rows[2], rows[0], `INSERT INTO foo VALUES(4, 'deleted', NULL, NULL)`, rows[1], `DELETE FROM foo WHERE id = 4`, `VACUUM`}
+	for _, stmt := range stmts1 {
+		if _, err := db1.ExecuteStringStmt(stmt); err != nil {
+			t.Fatalf("failed to execute %s: %s", stmt, err.Error())
+		}
+	}
+	for _, stmt := range stmts2 {
+		if _, err := db2.ExecuteStringStmt(stmt); err != nil {
+			t.Fatalf("failed to execute %s: %s", stmt, err.Error())
+		}
+	}
+
+	sum1, sum2 := checksums()
+	if sum1 != sum2 {
+		t.Fatalf("checksums of databases with the same contents differ: %s, %s", sum1, sum2)
+	}
+	if len(sum1) != 64 {
+		t.Fatalf("checksum is not a hex-encoded SHA-256 digest: %s", sum1)
+	}
+
+	// A change to a single value, or to its type, changes the checksum.
+	for _, stmt := range []string{
+		`UPDATE foo SET name = 'fionA' WHERE id = 1`,
+		`UPDATE foo SET name = 'fiona', score = 2 WHERE id = 1`,
+		`UPDATE foo SET score = 1.5, data = '12' WHERE id = 1`,
+	} {
+		if _, err := db2.ExecuteStringStmt(stmt); err != nil {
+			t.Fatalf("failed to execute %s: %s", stmt, err.Error())
+		}
+		if _, sum := checksums(); sum == sum1 {
+			t.Fatalf("checksum unchanged after %s", stmt)
+		}
+	}
+	if _, err := db2.ExecuteStringStmt(`UPDATE foo SET data = x'0102' WHERE id = 1`); err != nil {
+		t.Fatalf("failed to execute update: %s", err.Error())
+	}
+	if _, sum := checksums(); sum != sum1 {
+		t.Fatalf("checksum differs after restoring contents: %s, %s", sum1, sum)
+	}
+
+	// Tables without a rowid are read in primary key order.
+	for _, d := range []*DB{db1, db2} {
+		for _, stmt := range []string{
+			`CREATE TABLE bar (k TEXT PRIMARY KEY, v INTEGER) WITHOUT ROWID`,
+			`INSERT INTO bar VALUES('b', 2)`,
+			`INSERT INTO bar VALUES('a', 1)`,
+		} {
+			if _, err := d.ExecuteStringStmt(stmt); err != nil {
+				t.Fatalf("failed to execute %s: %s", stmt, err.Error())
+			}
+		}
+	}
+	sum1, sum2 = checksums()
+	if sum1 != sum2 {
+		t.Fatalf("checksums of databases with the same contents differ: %s, %s", sum1, sum2)
+	}
+
+	// A change to the schema alone changes the checksum.
+	if _, err := db2.ExecuteStringStmt(`CREATE INDEX foo_name ON foo(name)`); err != nil {
+		t.Fatalf("failed to create index: %s", err.Error())
+	}
+	if _, sum := checksums(); sum == sum1 {
+		t.Fatalf("checksum unchanged after creating index")
+	}
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/rqlite/rqlite/command"
+)
+
+// PlanNode is a single step of a query plan, as generated by EXPLAIN QUERY PLAN.
+type PlanNode struct {
+	ID        int64       `json:"id"`
+	Parent    int64       `json:"parent"`
+	Detail    string      `json:"detail"`
+	FullScan  bool        `json:"full_scan,omitempty"`
+	TempBTree bool        `json:"temp_btree,omitempty"`
+	Children  []*PlanNode `json:"children,omitempty"`
+}
+
+// QueryPlan is the query plan for a single statement. Plan contains the
+// top-level steps of the plan, each of which may contain child steps.
+type QueryPlan struct {
+	SQL       string      `json:"sql"`
+	Plan      []*PlanNode `json:"plan,omitempty"`
+	FullScan  bool        `json:"full_scan,omitempty"`
+	TempBTree bool        `json:"temp_btree,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// Explain returns the query plan for each statement in the request. The
+// statements themselves are not executed.
+func (db *DB) Explain(req *command.Request) ([]*QueryPlan, error) {
+	ctx, cancel := timeoutContext(req.DbTimeout)
+	defer cancel()
+
+	conn, err := db.roDB.Conn(ctx)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer conn.Close()
+
+	var plans []*QueryPlan
+	for _, stmt := range req.Statements {
+		if stmt.Sql == "" {
+			continue
+		}
+		plan := &QueryPlan{SQL: stmt.Sql}
+		plans = append(plans, plan)
+
+		parameters, err := parametersToValues(stmt.Parameters)
+		if err != nil {
+			plan.Error = err.Error()
+			continue
+		}
+
+		rs, err := conn.QueryContext(ctx, "EXPLAIN QUERY PLAN "+stmt.Sql, parameters...)
+		if err != nil {
+			plan.Error = timeoutError(ctx, err).Error()
+			continue
+		}
+
+		var nodes []*PlanNode
+		for rs.Next() {
+			var notUsed int64
+			n := &PlanNode{}
+			if err := rs.Scan(&n.ID, &n.Parent, &notUsed, &n.Detail); err != nil {
+				rs.Close()
+				return nil, timeoutError(ctx, err)
+			}
+			n.FullScan = isFullScan(n.Detail)
+			n.TempBTree = strings.Contains(n.Detail, "TEMP B-TREE")
+			plan.FullScan = plan.FullScan || n.FullScan
+			plan.TempBTree = plan.TempBTree || n.TempBTree
+			nodes = append(nodes, n)
+		}
+		err = rs.Err()
+		rs.Close()
+		if err != nil {
+			plan.Error = timeoutError(ctx, err).Error()
+			continue
+		}
+		plan.Plan = planTree(nodes)
+	}
+	return plans, nil
+}
+
+// planTree arranges plan nodes into a tree, using the parent ID of each.
+// Nodes whose parent is not present are returned at the top level.
+func planTree(nodes []*PlanNode) []*PlanNode {
+	byID := make(map[int64]*PlanNode, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+
+	var roots []*PlanNode
+	for _, n := range nodes {
+		if p, ok := byID[n.Parent]; ok && n.Parent != n.ID {
+			p.Children = append(p.Children, n)
+		} else {
+			roots = append(roots, n)
+		}
+	}
+	return roots
+}
+
+// isFullScan returns whether the given plan detail describes a scan of an
+// entire table. Scans which use an index, including covering indexes, and
+// scans of subqueries, CTEs, and table-valued functions are not included.
+func isFullScan(detail string) bool {
+	if !strings.HasPrefix(detail, "SCAN ") {
+		return false
+	}
+	if strings.Contains(detail, " USING ") {
+		return false
+	}
+	for _, p := range []string{"SCAN SUBQUERY", "SCAN CONSTANT ROW"} {
+		if strings.HasPrefix(detail, p) {
+			return false
+		}
+	}
+	return !strings.Contains(detail, " VIRTUAL TABLE ")
+}
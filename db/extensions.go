@@ -0,0 +1,136 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rqlite/go-sqlite3"
+)
+
+// Extension describes a SQLite extension loaded into every connection. As
+// SQLite extensions have no standard way to report their version, the
+// extension is identified by the SHA-256 digest of its shared object.
+type Extension struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+func (e Extension) String() string {
+	return fmt.Sprintf("%s (sha256 %s)", e.Name, e.SHA256)
+}
+
+var (
+	extMu      sync.RWMutex
+	extensions []Extension
+	driverName = "sqlite3"
+	numDrivers int
+)
+
+// LoadExtensions arranges for the SQLite extensions, at the given paths to
+// shared objects, to be loaded into every connection of every database
+// subsequently opened. It checks that each extension can be loaded. It must
+// be called before any database is opened.
+func LoadExtensions(paths []string) error {
+	exts := make([]Extension, len(paths))
+	for i, p := range paths {
+		e, err := newExtension(p)
+		if err != nil {
+			return fmt.Errorf("extension %s: %s", p, err)
+		}
+		exts[i] = e
+	}
+	sort.Slice(exts, func(i, j int) bool { return exts[i].Name < exts[j].Name })
+
+	extMu.Lock()
+	defer extMu.Unlock()
+	name := fmt.Sprintf("sqlite3_extensions_%d", numDrivers)
+	sql.Register(name, &sqlite3.SQLiteDriver{Extensions: paths})
+	numDrivers++
+
+	// Extensions are only loaded when a connection is made, so check they
+	// can be loaded now, rather than when the first database is opened.
+	db, err := sql.Open(name, ":memory:")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("load extensions: %s", err)
+	}
+
+	driverName = name
+	extensions = exts
+	return nil
+}
+
+// Extensions returns the SQLite extensions loaded into every connection,
+// sorted by name.
+func Extensions() []Extension {
+	extMu.RLock()
+	defer extMu.RUnlock()
+	return extensions
+}
+
+// CheckExtensions returns an error describing any difference between the
+// given extensions and those loaded into every connection.
+func CheckExtensions(exts []Extension) error {
+	loaded := make(map[string]Extension)
+	for _, e := range Extensions() {
+		loaded[e.Name] = e
+	}
+
+	var diffs []string
+	for _, e := range exts {
+		l, ok := loaded[e.Name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s is not loaded by this node", e))
+			continue
+		}
+		if l.SHA256 != e.SHA256 {
+			diffs = append(diffs, fmt.Sprintf("%s differs from %s loaded by this node", e, l))
+		}
+		delete(loaded, e.Name)
+	}
+	for _, l := range loaded {
+		diffs = append(diffs, fmt.Sprintf("%s is loaded only by this node", l))
+	}
+	if len(diffs) > 0 {
+		sort.Strings(diffs)
+		return fmt.Errorf("extensions do not match: %s", strings.Join(diffs, ", "))
+	}
+	return nil
+}
+
+// driver returns the name of the database/sql driver with which to open
+// databases.
+func driver() string {
+	extMu.RLock()
+	defer extMu.RUnlock()
+	return driverName
+}
+
+// newExtension returns the Extension for the shared object at path.
+func newExtension(path string) (Extension, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Extension{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return Extension{}, err
+	}
+	return Extension{
+		Name:   filepath.Base(path),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"strings"
+	"unicode"
+)
+
+// tokenKind is the kind of a lexical SQL token.
+type tokenKind int
+
+const (
+	tokSpace   tokenKind = iota // Whitespace.
+	tokComment                  // A -- or /* */ comment.
+	tokString                   // A single-quoted string literal.
+	tokBlob                     // An X'...' blob literal.
+	tokNumber                   // A numeric literal.
+	tokIdent                    // A quoted identifier.
+	tokWord                     // A keyword or unquoted identifier.
+	tokPunct                    // Any other single character.
+)
+
+// token is a lexical SQL token. The text of a token is exactly as it
+// appears in the source SQL.
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// isTrivia returns whether the token has no effect on the meaning of a
+// statement.
+func (t token) isTrivia() bool {
+	return t.kind == tokSpace || t.kind == tokComment
+}
+
+// tokenize splits the given SQL into tokens. It is not a full SQLite lexer,
+// but it is sufficient to reliably distinguish literals, identifiers, and
+// comments from the rest of a statement. Concatenating the text of every
+// token returns the original SQL.
+func tokenize(sql string) []token {
+	var tokens []token
+	rs := []rune(sql)
+
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		start := i
+		var kind tokenKind
+
+		switch {
+		case unicode.IsSpace(c):
+			kind = tokSpace
+			for i < len(rs) && unicode.IsSpace(rs[i]) {
+				i++
+			}
+		case c == '-' && i+1 < len(rs) && rs[i+1] == '-':
+			kind = tokComment
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(rs) && rs[i+1] == '*':
+			kind = tokComment
+			i += 2
+			for i < len(rs) && !(rs[i] == '*' && i+1 < len(rs) && rs[i+1] == '/') {
+				i++
+			}
+			i = min(i+2, len(rs))
+		case c == '\'':
+			kind = tokString
+			i = scanString(rs, i)
+		case (c == 'x' || c == 'X') && i+1 < len(rs) && rs[i+1] == '\'':
+			kind = tokBlob
+			i = scanString(rs, i+1)
+		case c == '"' || c == '`' || c == '[':
+			kind = tokIdent
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			for i++; i < len(rs) && rs[i] != end; i++ {
+			}
+			i = min(i+1, len(rs))
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			kind = tokNumber
+			for i++; i < len(rs); i++ {
+				if unicode.IsDigit(rs[i]) || unicode.IsLetter(rs[i]) || rs[i] == '.' {
+					continue
+				}
+				if (rs[i] == '+' || rs[i] == '-') && (rs[i-1] == 'e' || rs[i-1] == 'E') {
+					continue
+				}
+				break
+			}
+		case isWordRune(c):
+			kind = tokWord
+			for i < len(rs) && (isWordRune(rs[i]) || unicode.IsDigit(rs[i])) {
+				i++
+			}
+		default:
+			kind = tokPunct
+			i++
+		}
+		tokens = append(tokens, token{kind: kind, text: string(rs[start:i])})
+	}
+	return tokens
+}
+
+// countStatements returns the number of statements in the given SQL, as
+// separated by semicolons.
+func countStatements(sql string) int {
+	n, pending := 0, false
+	for _, t := range tokenize(sql) {
+		if t.isTrivia() {
+			continue
+		}
+		if t.kind == tokPunct && t.text == ";" {
+			if pending {
+				n++
+			}
+			pending = false
+			continue
+		}
+		pending = true
+	}
+	if pending {
+		n++
+	}
+	return n
+}
+
+// firstWord returns the first keyword or identifier in the given SQL, in
+// upper case, or the empty string if the SQL does not start with one.
+func firstWord(sql string) string {
+	for _, t := range tokenize(sql) {
+		if t.isTrivia() {
+			continue
+		}
+		if t.kind == tokWord {
+			return strings.ToUpper(t.text)
+		}
+		return ""
+	}
+	return ""
+}
+
+// hasReturning returns whether the given SQL is a single INSERT, REPLACE,
+// UPDATE, or DELETE statement, possibly with a WITH clause, which has a
+// RETURNING clause.
+func hasReturning(sql string) bool {
+	// Avoid tokenizing the vast majority of statements, which cannot have
+	// a RETURNING clause.
+	if !strings.Contains(strings.ToLower(sql), "returning") {
+		return false
+	}
+
+	var first, main string
+	returning := false
+	depth, nStmts, pending := 0, 0, false
+	for _, t := range tokenize(sql) {
+		if t.isTrivia() {
+			continue
+		}
+		switch {
+		case t.kind == tokPunct && t.text == ";":
+			if pending {
+				nStmts++
+			}
+			pending = false
+			continue
+		case t.kind == tokPunct && t.text == "(":
+			depth++
+		case t.kind == tokPunct && t.text == ")":
+			depth--
+		case t.kind == tokWord:
+			w := strings.ToUpper(t.text)
+			if first == "" && nStmts == 0 && !pending {
+				first = w
+				if w != "WITH" {
+					main = w
+				}
+			}
+			if w == "RETURNING" && depth == 0 {
+				returning = true
+			}
+			// The main statement of a WITH clause is the first SELECT,
+			// VALUES, or data-modifying keyword outside of parentheses.
+			if main == "" && depth == 0 && nStmts == 0 {
+				switch w {
+				case "SELECT", "VALUES", "INSERT", "REPLACE", "UPDATE", "DELETE":
+					main = w
+				}
+			}
+		}
+		pending = true
+	}
+	if pending {
+		nStmts++
+	}
+	if nStmts != 1 {
+		return false
+	}
+	switch main {
+	case "INSERT", "REPLACE", "UPDATE", "DELETE":
+		return returning
+	}
+	return false
+}
+
+// scanString returns the index just past the single-quoted string starting
+// at index i, treating a doubled quote as an escaped quote.
+func scanString(rs []rune, i int) int {
+	for i++; i < len(rs); i++ {
+		if rs[i] == '\'' {
+			if i+1 < len(rs) && rs[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(rs)
+}
+
+// isWordRune returns whether the rune may start an unquoted identifier.
+func isWordRune(c rune) bool {
+	return c == '_' || c == '$' || unicode.IsLetter(c)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
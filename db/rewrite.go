@@ -0,0 +1,287 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRewriteBlobSize is the largest randomblob() which can be rewritten to
+// a literal value.
+const maxRewriteBlobSize = 64 * 1024
+
+// timeFunctions are the SQLite date and time functions which accept a
+// time-value, and which use the current time if it is 'now' or omitted.
+var timeFunctions = map[string]bool{
+	"date":      true,
+	"time":      true,
+	"datetime":  true,
+	"julianday": true,
+	"unixepoch": true,
+	"strftime":  true,
+}
+
+// RewriteNonDeterministic returns the given SQL statement, with calls to
+// non-deterministic functions replaced by literal values. This allows the
+// statement to be executed on multiple nodes with identical results.
+// The following are rewritten:
+//
+//   - random() is replaced with a random integer.
+//   - randomblob(N) is replaced with a random blob of N bytes. N must be an
+//     integer literal no greater than 64 KiB, otherwise an error is returned.
+//   - 'now' passed to a date and time function is replaced with the given time.
+//   - Date and time functions without a time-value are passed the given time.
+//   - CURRENT_TIMESTAMP, CURRENT_DATE, and CURRENT_TIME are replaced with the
+//     given time.
+//
+// The 'localtime' and 'utc' modifiers depend on the time zone of each node,
+// so a date and time function passed either returns an error.
+//
+// Each statement in the SQL is rewritten separately. Schema definitions,
+// such as column defaults, CHECK constraints, views, and trigger bodies, are
+// evaluated later, so are left unchanged, but the SELECT of a CREATE TABLE
+// ... AS statement is rewritten. A 'now' bound as a parameter is not
+// rewritten. Times are in UTC.
+func RewriteNonDeterministic(sql string, now time.Time) (string, error) {
+	now = now.UTC()
+	var b strings.Builder
+	for _, stmt := range splitStatements(tokenize(sql)) {
+		from := rewriteFrom(stmt)
+		for _, t := range stmt[:from] {
+			b.WriteString(t.text)
+		}
+		if err := rewriteTokens(&b, stmt[from:], now); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// splitStatements splits the given tokens into statements, each including
+// its terminating semicolon, if any. Semicolons within the body of a CREATE
+// TRIGGER statement do not end it.
+func splitStatements(tokens []token) [][]token {
+	var stmts [][]token
+	start, depth := 0, 0
+	first, body := "", false
+	for i, t := range tokens {
+		switch {
+		case t.kind == tokWord:
+			w := strings.ToUpper(t.text)
+			if first == "" {
+				first = w
+			}
+			switch {
+			case first == "CREATE" && w == "BEGIN":
+				body = true
+				depth++
+			case body && w == "CASE":
+				depth++
+			case body && w == "END":
+				depth--
+			}
+		case t.kind == tokPunct && t.text == ";" && depth <= 0:
+			stmts = append(stmts, tokens[start:i+1])
+			start, depth = i+1, 0
+			first, body = "", false
+		}
+	}
+	if start < len(tokens) {
+		stmts = append(stmts, tokens[start:])
+	}
+	return stmts
+}
+
+// rewriteFrom returns the index of the first of the given statement's
+// tokens which is evaluated when the statement is executed, and so should be
+// rewritten, or len(stmt) if there is none.
+func rewriteFrom(stmt []token) int {
+	var words []string
+	depth := 0
+	for i, t := range stmt {
+		switch {
+		case t.kind == tokPunct && t.text == "(":
+			depth++
+		case t.kind == tokPunct && t.text == ")":
+			depth--
+		case t.kind == tokWord && depth == 0:
+			w := strings.ToUpper(t.text)
+			words = append(words, w)
+			switch words[0] {
+			case "CREATE":
+				// Only CREATE [TEMP] TABLE ... AS SELECT is evaluated now.
+				if w == "AS" && (words[1] == "TABLE" || (len(words) > 2 && words[2] == "TABLE")) {
+					return i + 1
+				}
+			case "ALTER":
+			default:
+				return 0
+			}
+		}
+	}
+	if len(words) == 0 {
+		return 0
+	}
+	return len(stmt)
+}
+
+// rewriteTokens writes the given tokens to b, with calls to non-deterministic
+// functions replaced by literal values.
+func rewriteTokens(b *strings.Builder, tokens []token, now time.Time) error {
+	// next returns the index of the next significant token after i, or
+	// len(tokens) if there is none.
+	next := func(i int) int {
+		for i++; i < len(tokens) && tokens[i].isTrivia(); i++ {
+		}
+		return i
+	}
+	isPunct := func(i int, p string) bool {
+		return i < len(tokens) && tokens[i].kind == tokPunct && tokens[i].text == p
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind != tokWord {
+			b.WriteString(t.text)
+			continue
+		}
+		name := strings.ToLower(t.text)
+
+		switch name {
+		case "current_timestamp":
+			b.WriteString(quoteString(now.Format("2006-01-02 15:04:05")))
+			continue
+		case "current_date":
+			b.WriteString(quoteString(now.Format("2006-01-02")))
+			continue
+		case "current_time":
+			b.WriteString(quoteString(now.Format("15:04:05")))
+			continue
+		}
+
+		open := next(i)
+		if !isPunct(open, "(") {
+			b.WriteString(t.text)
+			continue
+		}
+
+		switch {
+		case name == "random":
+			if close := next(open); isPunct(close, ")") {
+				v, err := randomInt64()
+				if err != nil {
+					return err
+				}
+				b.WriteString(fmt.Sprintf("(%d)", v))
+				i = close
+				continue
+			}
+		case name == "randomblob":
+			// A call which cannot be rewritten would be evaluated differently
+			// on every node, so is rejected.
+			arg := next(open)
+			close := next(arg)
+			if arg >= len(tokens) || tokens[arg].kind != tokNumber || !isPunct(close, ")") {
+				return fmt.Errorf("randomblob() argument must be an integer literal")
+			}
+			n, err := parseIntLiteral(tokens[arg].text)
+			if err != nil {
+				return fmt.Errorf("randomblob() argument must be an integer literal, got %s", tokens[arg].text)
+			}
+			if n > maxRewriteBlobSize {
+				return fmt.Errorf("randomblob() of %d bytes exceeds maximum of %d bytes", n, maxRewriteBlobSize)
+			}
+			if n < 1 {
+				n = 1
+			}
+			blob := make([]byte, n)
+			if _, err := rand.Read(blob); err != nil {
+				return err
+			}
+			b.WriteString(fmt.Sprintf("X'%s'", strings.ToUpper(hex.EncodeToString(blob))))
+			i = close
+			continue
+		case timeFunctions[name]:
+			if err := rewriteTimeArgs(tokens, name, open, now); err != nil {
+				return err
+			}
+		}
+		b.WriteString(t.text)
+	}
+	return nil
+}
+
+// parseIntLiteral returns the value of the SQLite integer literal s, which
+// is decimal, or hexadecimal if prefixed with 0x. Unlike in Go, a leading
+// zero does not denote octal.
+func parseIntLiteral(s string) (int64, error) {
+	if len(s) > 2 && (s[:2] == "0x" || s[:2] == "0X") {
+		return strconv.ParseInt(s[2:], 16, 64)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// rewriteTimeArgs modifies, in place, the arguments of the call to the date
+// and time function fn whose opening parenthesis is at index open. 'now' is
+// replaced with the given time, which is also added if the time-value is
+// omitted. An error is returned if the call has a modifier which depends on
+// the time zone.
+func rewriteTimeArgs(tokens []token, fn string, open int, now time.Time) error {
+	ts := quoteString(now.Format("2006-01-02 15:04:05.000"))
+
+	depth, nArgs, empty := 0, 0, true
+	for j := open; j < len(tokens); j++ {
+		t := &tokens[j]
+		switch {
+		case t.kind == tokPunct && t.text == "(":
+			depth++
+		case t.kind == tokPunct && t.text == ")":
+			depth--
+			if depth > 0 {
+				break
+			}
+			if !empty {
+				nArgs++
+			}
+			// A time-value is the first argument, except for strftime(), whose
+			// first argument is the format.
+			if nArgs == 0 || (fn == "strftime" && nArgs == 1) {
+				if nArgs == 1 {
+					t.text = ", " + ts + t.text
+				} else {
+					t.text = ts + t.text
+				}
+			}
+			return nil
+		case depth == 1 && t.kind == tokPunct && t.text == ",":
+			nArgs++
+		case depth == 1 && t.kind == tokString && strings.EqualFold(t.text, "'now'"):
+			t.text = ts
+		case depth == 1 && t.kind == tokString && (strings.EqualFold(t.text, "'localtime'") || strings.EqualFold(t.text, "'utc'")):
+			return fmt.Errorf("%s() modifier %s depends on the time zone of each node", fn, t.text)
+		}
+		if depth >= 1 && j > open && !t.isTrivia() {
+			empty = false
+		}
+	}
+	return nil
+}
+
+// randomInt64 returns a random 64-bit integer, in the same range as that
+// returned by the SQLite random() function.
+func randomInt64() (int64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b[:])), nil
+}
+
+// quoteString returns s as an SQL string literal.
+func quoteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
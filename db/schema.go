@@ -0,0 +1,230 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Column describes a column of a table or view.
+type Column struct {
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	NotNull    bool    `json:"not_null"`
+	Default    *string `json:"default,omitempty"`     // Default value, as SQL text.
+	PrimaryKey int     `json:"primary_key,omitempty"` // Position within the primary key, starting at 1.
+}
+
+// Index describes an index of a table.
+type Index struct {
+	Name    string   `json:"name"`
+	Unique  bool     `json:"unique"`
+	Origin  string   `json:"origin"` // "c" if created by CREATE INDEX, "u" if by UNIQUE, "pk" if by PRIMARY KEY.
+	Partial bool     `json:"partial"`
+	Columns []string `json:"columns"` // An empty name is an expression.
+	SQL     string   `json:"sql,omitempty"`
+}
+
+// ForeignKey describes a foreign key constraint of a table.
+type ForeignKey struct {
+	Table    string   `json:"table"`
+	From     []string `json:"from"`
+	To       []string `json:"to"` // An empty name refers to the primary key.
+	OnUpdate string   `json:"on_update"`
+	OnDelete string   `json:"on_delete"`
+	Match    string   `json:"match"`
+}
+
+// Table describes a table.
+type Table struct {
+	Name        string        `json:"name"`
+	SQL         string        `json:"sql"`
+	Columns     []*Column     `json:"columns"`
+	Indexes     []*Index      `json:"indexes"`
+	ForeignKeys []*ForeignKey `json:"foreign_keys"`
+}
+
+// View describes a view.
+type View struct {
+	Name    string    `json:"name"`
+	SQL     string    `json:"sql"`
+	Columns []*Column `json:"columns"`
+}
+
+// Trigger describes a trigger.
+type Trigger struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	SQL   string `json:"sql"`
+}
+
+// Schema describes the schema of a database. Tables, views, and triggers
+// are each sorted by name. SQLite's internal tables are not included.
+type Schema struct {
+	Tables   []*Table   `json:"tables"`
+	Views    []*View    `json:"views"`
+	Triggers []*Trigger `json:"triggers"`
+}
+
+// Schema returns the schema of the database.
+func (db *DB) Schema() (*Schema, error) {
+	ctx := context.Background()
+	conn, err := db.roDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rs, err := conn.QueryContext(ctx, `SELECT type, name, tbl_name, sql FROM sqlite_master
+		WHERE type IN ('table', 'view', 'trigger') AND name NOT LIKE 'sqlite\_%' ESCAPE '\'
+		ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	schema := &Schema{
+		Tables:   []*Table{},
+		Views:    []*View{},
+		Triggers: []*Trigger{},
+	}
+	for rs.Next() {
+		var typ, name, tblName string
+		var ddl sql.NullString
+		if err := rs.Scan(&typ, &name, &tblName, &ddl); err != nil {
+			rs.Close()
+			return nil, err
+		}
+		switch typ {
+		case "table":
+			schema.Tables = append(schema.Tables, &Table{Name: name, SQL: ddl.String})
+		case "view":
+			schema.Views = append(schema.Views, &View{Name: name, SQL: ddl.String})
+		case "trigger":
+			schema.Triggers = append(schema.Triggers, &Trigger{Name: name, Table: tblName, SQL: ddl.String})
+		}
+	}
+	err = rs.Err()
+	rs.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range schema.Tables {
+		if t.Columns, err = columns(ctx, conn, t.Name); err != nil {
+			return nil, err
+		}
+		if t.Indexes, err = indexes(ctx, conn, t.Name); err != nil {
+			return nil, err
+		}
+		if t.ForeignKeys, err = foreignKeys(ctx, conn, t.Name); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range schema.Views {
+		if v.Columns, err = columns(ctx, conn, v.Name); err != nil {
+			return nil, err
+		}
+	}
+	return schema, nil
+}
+
+// columns returns the columns of the given table or view.
+func columns(ctx context.Context, conn *sql.Conn, table string) ([]*Column, error) {
+	rs, err := conn.QueryContext(ctx, `SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	cols := []*Column{}
+	for rs.Next() {
+		c := &Column{}
+		var dflt sql.NullString
+		if err := rs.Scan(&c.Name, &c.Type, &c.NotNull, &dflt, &c.PrimaryKey); err != nil {
+			return nil, err
+		}
+		if dflt.Valid {
+			c.Default = &dflt.String
+		}
+		cols = append(cols, c)
+	}
+	return cols, rs.Err()
+}
+
+// indexes returns the indexes of the given table, including those created
+// automatically for UNIQUE and PRIMARY KEY constraints.
+func indexes(ctx context.Context, conn *sql.Conn, table string) ([]*Index, error) {
+	rs, err := conn.QueryContext(ctx, `SELECT il.name, il."unique", il.origin, il.partial, m.sql
+		FROM pragma_index_list(?) AS il LEFT JOIN sqlite_master AS m ON m.type = 'index' AND m.name = il.name
+		ORDER BY il.name`, table)
+	if err != nil {
+		return nil, err
+	}
+	idxs := []*Index{}
+	for rs.Next() {
+		i := &Index{}
+		var ddl sql.NullString
+		if err := rs.Scan(&i.Name, &i.Unique, &i.Origin, &i.Partial, &ddl); err != nil {
+			rs.Close()
+			return nil, err
+		}
+		i.SQL = ddl.String
+		idxs = append(idxs, i)
+	}
+	err = rs.Err()
+	rs.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range idxs {
+		rs, err := conn.QueryContext(ctx, `SELECT name FROM pragma_index_info(?) ORDER BY seqno`, i.Name)
+		if err != nil {
+			return nil, err
+		}
+		i.Columns = []string{}
+		for rs.Next() {
+			var name sql.NullString
+			if err := rs.Scan(&name); err != nil {
+				rs.Close()
+				return nil, err
+			}
+			i.Columns = append(i.Columns, name.String)
+		}
+		err = rs.Err()
+		rs.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return idxs, nil
+}
+
+// foreignKeys returns the foreign key constraints of the given table.
+func foreignKeys(ctx context.Context, conn *sql.Conn, table string) ([]*ForeignKey, error) {
+	rs, err := conn.QueryContext(ctx, `SELECT id, "table", "from", "to", on_update, on_delete, match
+		FROM pragma_foreign_key_list(?) ORDER BY id, seq`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	// Each constraint is listed once for each of its columns.
+	fks := []*ForeignKey{}
+	lastID := int64(-1)
+	for rs.Next() {
+		var id int64
+		var from string
+		var to sql.NullString
+		fk := &ForeignKey{}
+		if err := rs.Scan(&id, &fk.Table, &from, &to, &fk.OnUpdate, &fk.OnDelete, &fk.Match); err != nil {
+			return nil, err
+		}
+		if id != lastID {
+			fks = append(fks, fk)
+			lastID = id
+		}
+		fk = fks[len(fks)-1]
+		fk.From = append(fk.From, from)
+		fk.To = append(fk.To, to.String)
+	}
+	return fks, rs.Err()
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxStatementFingerprints is the maximum number of distinct statement
+	// fingerprints for which statistics are kept. Statements with new
+	// fingerprints are not tracked once this limit is reached.
+	maxStatementFingerprints = 1000
+
+	// maxFingerprintCache is the maximum number of SQL strings for which
+	// the fingerprint is cached.
+	maxFingerprintCache = 4 * maxStatementFingerprints
+
+	// numStatementSamples is the number of most-recent execution times kept
+	// for each fingerprint, from which percentiles are calculated.
+	numStatementSamples = 512
+)
+
+// StatementStat represents execution statistics for all statements sharing
+// a fingerprint. Times are in seconds.
+type StatementStat struct {
+	Database    string  `json:"database,omitempty"` // Set by the caller, if a named database.
+	Fingerprint string  `json:"fingerprint"`
+	Calls       int64   `json:"calls"`
+	Errors      int64   `json:"errors"`
+	Rows        int64   `json:"rows"`
+	TotalTime   float64 `json:"total_time"`
+	MinTime     float64 `json:"min_time"`
+	MaxTime     float64 `json:"max_time"`
+	MeanTime    float64 `json:"mean_time"`
+	P50Time     float64 `json:"p50_time"`
+	P95Time     float64 `json:"p95_time"`
+	P99Time     float64 `json:"p99_time"`
+}
+
+// statementEntry holds the running statistics for a single fingerprint.
+type statementEntry struct {
+	calls   int64
+	errors  int64
+	rows    int64
+	total   time.Duration
+	min     time.Duration
+	max     time.Duration
+	samples []time.Duration
+	next    int
+}
+
+// statementRegistry records statistics for executed statements, keyed
+// by fingerprint.
+type statementRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*statementEntry
+	dropped int64
+
+	// fingerprints caches the fingerprint of recently-executed SQL, since
+	// the same SQL is often executed many times, with differing parameters.
+	fingerprints map[string]string
+}
+
+func newStatementRegistry() *statementRegistry {
+	return &statementRegistry{
+		entries:      make(map[string]*statementEntry),
+		fingerprints: make(map[string]string),
+	}
+}
+
+// record records the execution of the given SQL statement.
+func (r *statementRegistry) record(sql string, d time.Duration, rows int64, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fp, ok := r.fingerprints[sql]
+	if !ok {
+		fp = Fingerprint(sql)
+		if len(r.fingerprints) >= maxFingerprintCache {
+			r.fingerprints = make(map[string]string)
+		}
+		r.fingerprints[sql] = fp
+	}
+
+	e, ok := r.entries[fp]
+	if !ok {
+		if len(r.entries) >= maxStatementFingerprints {
+			r.dropped++
+			return
+		}
+		e = &statementEntry{min: d}
+		r.entries[fp] = e
+	}
+
+	e.calls++
+	e.rows += rows
+	if failed {
+		e.errors++
+	}
+	e.total += d
+	if d < e.min {
+		e.min = d
+	}
+	if d > e.max {
+		e.max = d
+	}
+	if len(e.samples) < numStatementSamples {
+		e.samples = append(e.samples, d)
+	} else {
+		e.samples[e.next] = d
+		e.next = (e.next + 1) % numStatementSamples
+	}
+}
+
+// stats returns the statistics for every fingerprint, ordered by total
+// execution time, descending.
+func (r *statementRegistry) stats() []*StatementStat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make([]*StatementStat, 0, len(r.entries))
+	for fp, e := range r.entries {
+		sorted := make([]time.Duration, len(e.samples))
+		copy(sorted, e.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		stats = append(stats, &StatementStat{
+			Fingerprint: fp,
+			Calls:       e.calls,
+			Errors:      e.errors,
+			Rows:        e.rows,
+			TotalTime:   e.total.Seconds(),
+			MinTime:     e.min.Seconds(),
+			MaxTime:     e.max.Seconds(),
+			MeanTime:    (e.total / time.Duration(e.calls)).Seconds(),
+			P50Time:     percentile(sorted, 0.50).Seconds(),
+			P95Time:     percentile(sorted, 0.95).Seconds(),
+			P99Time:     percentile(sorted, 0.99).Seconds(),
+		})
+	}
+	SortStatementStats(stats)
+	return stats
+}
+
+// SortStatementStats sorts the given statistics by total execution time,
+// descending, and then by database and fingerprint.
+func SortStatementStats(stats []*StatementStat) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].TotalTime != stats[j].TotalTime {
+			return stats[i].TotalTime > stats[j].TotalTime
+		}
+		if stats[i].Database != stats[j].Database {
+			return stats[i].Database < stats[j].Database
+		}
+		return stats[i].Fingerprint < stats[j].Fingerprint
+	})
+}
+
+// count returns the number of fingerprints being tracked, and the number of
+// executions which were not tracked because the fingerprint limit was reached.
+func (r *statementRegistry) count() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return map[string]int64{
+		"fingerprints": int64(len(r.entries)),
+		"dropped":      r.dropped,
+	}
+}
+
+// reset discards all recorded statistics.
+func (r *statementRegistry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = make(map[string]*statementEntry)
+	r.dropped = 0
+}
+
+// StatementStats returns execution statistics for every distinct statement
+// fingerprint executed by the database, ordered by total execution time.
+func (db *DB) StatementStats() []*StatementStat {
+	return db.statements.stats()
+}
+
+// ResetStatementStats discards all statement execution statistics.
+func (db *DB) ResetStatementStats() {
+	db.statements.reset()
+}
+
+// Fingerprint returns a normalized form of the given SQL statement, so that
+// statements differing only in literal values, comments, whitespace, or
+// keyword case share a fingerprint. String and numeric literals are replaced
+// with "?".
+func Fingerprint(sql string) string {
+	var b strings.Builder
+	space := false
+	for _, t := range tokenize(strings.TrimRight(sql, " \t\r\n;")) {
+		if t.isTrivia() {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+
+		switch t.kind {
+		case tokString, tokBlob, tokNumber:
+			b.WriteByte('?')
+		case tokWord:
+			b.WriteString(strings.ToLower(t.text))
+		default:
+			b.WriteString(t.text)
+		}
+	}
+	return b.String()
+}
+
+// percentile returns the value at the given percentile of the sorted slice.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
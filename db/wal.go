@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// walHeaderOffset is the offset, in the database header, of the file format
+// read and write versions. Each is 2 for a database in WAL mode, and 1 for a
+// database in rollback mode.
+const walHeaderOffset = 18
+
+// ErrCheckpointBusy is returned when a checkpoint could not copy every frame
+// of the WAL into the database, because of concurrent readers or writers.
+var ErrCheckpointBusy = errors.New("checkpoint busy")
+
+// checkpointStats records the outcome of checkpoints of a database.
+type checkpointStats struct {
+	n        int
+	errors   int
+	last     time.Time
+	duration time.Duration
+	pages    int64
+}
+
+// RemoveFiles removes the database file at path, along with any WAL and
+// shared-memory files belonging to it. Files which do not exist are ignored.
+func RemoveFiles(path string) error {
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isWALHeader returns whether b begins with the header of a database in WAL
+// mode.
+func isWALHeader(b []byte) bool {
+	return len(b) > walHeaderOffset+1 && b[walHeaderOffset] == 2 && b[walHeaderOffset+1] == 2
+}
+
+// WAL returns whether the database is in WAL mode.
+func (db *DB) WAL() bool {
+	return db.wal
+}
+
+// Checkpoint copies every frame in the WAL into the database file, and
+// truncates the WAL. It waits for any readers of frames in the WAL to finish,
+// but does not block readers, which read from the database file once the
+// frames are copied. It is a no-op if the database is not in WAL mode.
+func (db *DB) Checkpoint() error {
+	if !db.wal {
+		return nil
+	}
+	start := time.Now()
+	err := db.checkpoint()
+
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+	stats.Add(numCheckpoints, 1)
+	db.checkpoints.n++
+	db.checkpoints.last = start
+	db.checkpoints.duration = time.Since(start)
+	if err != nil {
+		stats.Add(numCheckpointErrors, 1)
+		if err == ErrCheckpointBusy {
+			stats.Add(numCheckpointsBusy, 1)
+		}
+		db.checkpoints.errors++
+	}
+	return err
+}
+
+func (db *DB) checkpoint() error {
+	ctx := context.Background()
+	conn, err := db.rwDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var busy int
+	var pages, checkpointed int64
+	if err := conn.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &pages, &checkpointed); err != nil {
+		return fmt.Errorf("checkpoint: %s", err)
+	}
+	if busy != 0 {
+		return ErrCheckpointBusy
+	}
+	db.checkpointMu.Lock()
+	db.checkpoints.pages = checkpointed
+	db.checkpointMu.Unlock()
+	return nil
+}
+
+// WALSize returns the size of the WAL file on disk. If the database is not
+// in WAL mode, it returns 0.
+func (db *DB) WALSize() (int64, error) {
+	if !db.wal {
+		return 0, nil
+	}
+	fi, err := os.Stat(db.path + "-wal")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// walStats returns the size of the WAL, and statistics on checkpoints.
+func (db *DB) walStats() (map[string]interface{}, error) {
+	sz, err := db.WALSize()
+	if err != nil {
+		return nil, err
+	}
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+	st := map[string]interface{}{
+		"size":              sz,
+		"checkpoints":       db.checkpoints.n,
+		"checkpoint_errors": db.checkpoints.errors,
+	}
+	if !db.checkpoints.last.IsZero() {
+		st["last_checkpoint"] = db.checkpoints.last
+		st["last_checkpoint_duration"] = db.checkpoints.duration.String()
+		st["last_checkpoint_pages"] = db.checkpoints.pages
+	}
+	return st, nil
+}
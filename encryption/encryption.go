@@ -0,0 +1,336 @@
+// Package encryption provides authenticated encryption, using AES-GCM, of
+// data written to disk. Every record of encrypted data carries the ID of the
+// key which encrypted it, so keys can be rotated while data encrypted with
+// earlier keys remains readable.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	formatRecord = 1 // A single sealed record.
+	formatStream = 2 // A sequence of sealed chunks.
+
+	nonceSize = 12
+
+	// chunkSize is the maximum size of the plaintext of each chunk of a
+	// stream.
+	chunkSize = 64 * 1024
+)
+
+// magic begins all encrypted data. A zero byte is never the first byte of
+// a marshaled Protocol Buffer, so encrypted log entries cannot be mistaken
+// for unencrypted ones.
+var magic = []byte{0x00, 'r', 'q', 'e'}
+
+var (
+	// ErrNotEncrypted is returned when data to be decrypted was not written
+	// by this package.
+	ErrNotEncrypted = errors.New("data is not encrypted")
+
+	// ErrUnknownKey is returned when data was encrypted with a key which the
+	// key provider does not hold.
+	ErrUnknownKey = errors.New("unknown encryption key")
+
+	// ErrTruncated is returned when an encrypted stream ends before its
+	// final chunk.
+	ErrTruncated = errors.New("encrypted stream truncated")
+)
+
+// KeyProvider is the interface an object must support to supply encryption
+// keys. Each key must be 16, 24, or 32 bytes long, selecting AES-128,
+// AES-192, or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the ID and value of the key with which data is
+	// encrypted.
+	CurrentKey() (string, []byte, error)
+
+	// Key returns the value of the key with the given ID, or ErrUnknownKey.
+	Key(id string) ([]byte, error)
+}
+
+// IsEncrypted returns whether b begins with data written by this package.
+func IsEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, magic)
+}
+
+// Encrypt encrypts b with the current key of kp.
+func Encrypt(kp KeyProvider, b []byte) ([]byte, error) {
+	header, aead, err := newHeader(kp, formatRecord)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(header)+nonceSize+len(b)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, b, header), nil
+}
+
+// Decrypt decrypts b, which must have been returned by Encrypt, with the key
+// of kp under which it was encrypted.
+func Decrypt(kp KeyProvider, b []byte) ([]byte, error) {
+	header, aead, err := readHeader(kp, bytes.NewReader(b), formatRecord)
+	if err != nil {
+		return nil, err
+	}
+	b = b[len(header):]
+	if len(b) < nonceSize {
+		return nil, ErrTruncated
+	}
+	out, err := aead.Open(nil, b[:nonceSize], b[nonceSize:], header)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %s", err)
+	}
+	return out, nil
+}
+
+// Writer encrypts data written to it, with the current key of a
+// KeyProvider, as a stream of chunks. It must be closed to write the final
+// chunk, without which the stream cannot be read.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	n      uint64 // Number of chunks written.
+	buf    []byte
+	closed bool
+}
+
+// NewWriter returns a Writer which writes data encrypted with the current
+// key of kp to w.
+func NewWriter(w io.Writer, kp KeyProvider) (*Writer, error) {
+	header, aead, err := newHeader(kp, formatStream)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(nonce); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  nonce,
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+	n := 0
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+		// Only flush a full chunk once more data arrives, so the final
+		// chunk is never empty unless the stream is.
+		if len(w.buf) == cap(w.buf) && len(p) > 0 {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the final chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+func (w *Writer) flush(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.nonce, w.n), w.buf, chunkAD(w.header, final))
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(sealed)))
+	if _, err := w.w.Write(b[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(sealed); err != nil {
+		return err
+	}
+	w.n++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Reader decrypts a stream written by a Writer.
+type Reader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	n      uint64 // Number of chunks read.
+	buf    []byte
+	final  bool
+}
+
+// NewReader returns a Reader which decrypts the stream read from r, with
+// the key of kp under which it was encrypted. It reads nothing from r
+// beyond the end of the stream.
+func NewReader(r io.Reader, kp KeyProvider) (*Reader, error) {
+	header, aead, err := readHeader(kp, r, formatStream)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, ErrTruncated
+	}
+	return &Reader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		nonce:  nonce,
+	}, nil
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *Reader) next() error {
+	var b [4]byte
+	if _, err := io.ReadFull(r.r, b[:]); err != nil {
+		return ErrTruncated
+	}
+	sz := binary.BigEndian.Uint32(b[:])
+	if sz > chunkSize+uint32(r.aead.Overhead()) {
+		return fmt.Errorf("encrypted chunk too large: %d bytes", sz)
+	}
+	sealed := make([]byte, sz)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return ErrTruncated
+	}
+
+	// Whether this chunk is the final one is authenticated, so an attacker
+	// cannot truncate the stream at a chunk boundary.
+	nonce := chunkNonce(r.nonce, r.n)
+	out, err := r.aead.Open(nil, nonce, sealed, chunkAD(r.header, false))
+	if err != nil {
+		out, err = r.aead.Open(nil, nonce, sealed, chunkAD(r.header, true))
+		if err != nil {
+			return fmt.Errorf("decrypt chunk %d: %s", r.n, err)
+		}
+		r.final = true
+	}
+	r.n++
+	r.buf = out
+	return nil
+}
+
+// newHeader returns the header of data in the given format, encrypted with
+// the current key of kp, and the cipher for that key.
+func newHeader(kp KeyProvider, format byte) ([]byte, cipher.AEAD, error) {
+	id, key, err := kp.CurrentKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(id) == 0 || len(id) > 255 {
+		return nil, nil, fmt.Errorf("invalid key ID %q", id)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key %s: %s", id, err)
+	}
+	header := make([]byte, 0, len(magic)+2+len(id))
+	header = append(header, magic...)
+	header = append(header, format, byte(len(id)))
+	header = append(header, id...)
+	return header, aead, nil
+}
+
+// readHeader reads the header of data in the given format from r, and
+// returns it and the cipher for the key it names.
+func readHeader(kp KeyProvider, r io.Reader, format byte) ([]byte, cipher.AEAD, error) {
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, magic) {
+		return nil, nil, ErrNotEncrypted
+	}
+	if header[len(magic)] != format {
+		return nil, nil, fmt.Errorf("unsupported encryption format %d", header[len(magic)])
+	}
+	id := make([]byte, header[len(magic)+1])
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, nil, ErrTruncated
+	}
+	key, err := kp.Key(string(id))
+	if err != nil {
+		return nil, nil, fmt.Errorf("key %s: %s", id, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key %s: %s", id, err)
+	}
+	return append(header, id...), aead, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk n of a stream, derived from the
+// random nonce of the stream so that no two chunks share a nonce.
+func chunkNonce(nonce []byte, n uint64) []byte {
+	out := make([]byte, nonceSize)
+	copy(out, nonce)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	for i := range b {
+		out[nonceSize-8+i] ^= b[i]
+	}
+	return out
+}
+
+// chunkAD returns the additional data authenticated with a chunk of a
+// stream.
+func chunkAD(header []byte, final bool) []byte {
+	ad := make([]byte, len(header)+1)
+	copy(ad, header)
+	if final {
+		ad[len(header)] = 1
+	}
+	return ad
+}
@@ -0,0 +1,180 @@
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func mustNewKeyring(t *testing.T, current string, ids ...string) *Keyring {
+	keys := make(map[string][]byte)
+	for i, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	k, err := NewKeyring(current, keys)
+	if err != nil {
+		t.Fatalf("failed to create keyring: %s", err.Error())
+	}
+	return k
+}
+
+func Test_EncryptDecrypt(t *testing.T) {
+	k := mustNewKeyring(t, "k1", "k1")
+	plain := []byte("INSERT INTO foo(name) VALUES('fiona')")
+
+	b, err := Encrypt(k, plain)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err.Error())
+	}
+	if !IsEncrypted(b) {
+		t.Fatalf("encrypted data not recognized as encrypted")
+	}
+	if bytes.Contains(b, plain) {
+		t.Fatalf("encrypted data contains plaintext")
+	}
+	out, err := Decrypt(k, b)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %s", err.Error())
+	}
+	if !bytes.Equal(out, plain) {
+		t.Fatalf("decrypted data is wrong, got %q", out)
+	}
+
+	b[len(b)-1] ^= 0xff
+	if _, err := Decrypt(k, b); err == nil {
+		t.Fatalf("decrypted tampered data")
+	}
+	if _, err := Decrypt(k, plain); err != ErrNotEncrypted {
+		t.Fatalf("wrong error decrypting plaintext: %v", err)
+	}
+}
+
+func Test_KeyRotation(t *testing.T) {
+	k1 := mustNewKeyring(t, "k1", "k1")
+	b, err := Encrypt(k1, []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err.Error())
+	}
+
+	// Data encrypted with an earlier key can be read once the key is no
+	// longer current, but not once the key is removed.
+	k2 := mustNewKeyring(t, "k2", "k1", "k2")
+	out, err := Decrypt(k2, b)
+	if err != nil {
+		t.Fatalf("failed to decrypt with rotated keyring: %s", err.Error())
+	}
+	if string(out) != "hello" {
+		t.Fatalf("decrypted data is wrong, got %q", out)
+	}
+	b2, err := Encrypt(k2, []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err.Error())
+	}
+	if _, err := Decrypt(k1, b2); err == nil {
+		t.Fatalf("decrypted data encrypted with unknown key")
+	}
+}
+
+func Test_Stream(t *testing.T) {
+	k := mustNewKeyring(t, "k1", "k1")
+	for _, sz := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := make([]byte, sz)
+		for i := range plain {
+			plain[i] = byte(i)
+		}
+
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, k)
+		if err != nil {
+			t.Fatalf("failed to create writer: %s", err.Error())
+		}
+		// Write in uneven pieces, to cross chunk boundaries.
+		for p := plain; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatalf("failed to write: %s", err.Error())
+			}
+			p = p[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to close writer: %s", err.Error())
+		}
+		buf.WriteString("trailer")
+		enc := buf.Bytes()
+
+		r, err := NewReader(bytes.NewReader(enc), k)
+		if err != nil {
+			t.Fatalf("failed to create reader: %s", err.Error())
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to read stream of %d bytes: %s", sz, err.Error())
+		}
+		if !bytes.Equal(out, plain) {
+			t.Fatalf("stream of %d bytes decrypted wrongly", sz)
+		}
+
+		// Data after the stream is not consumed.
+		br := bytes.NewReader(enc)
+		r, _ = NewReader(br, k)
+		ioutil.ReadAll(r)
+		if rest, _ := ioutil.ReadAll(br); string(rest) != "trailer" {
+			t.Fatalf("reader consumed data after stream, got %q", rest)
+		}
+
+		// Truncation is detected, even at a chunk boundary.
+		enc = enc[:len(enc)-len("trailer")]
+		for _, n := range []int{len(enc) - 1, len(enc) - chunkSize - 4 - 16 - 1} {
+			if n < 0 || sz <= chunkSize && n != len(enc)-1 {
+				continue
+			}
+			r, err := NewReader(bytes.NewReader(enc[:n]), k)
+			if err != nil {
+				continue
+			}
+			if _, err := ioutil.ReadAll(r); err == nil {
+				t.Fatalf("truncated stream of %d bytes read without error", sz)
+			}
+		}
+	}
+}
+
+func Test_LoadKeyring(t *testing.T) {
+	k, err := LoadKeyring(strings.NewReader(`{
+		"current": "b",
+		"keys": {
+			"a": "tvzyGVBVaKUmsKXU3QHuZQ==",
+			"b": "Jbp5Ce4KHHmdyZvMGhHNBV3bfS6DjCg0wVPZoERyTCY="
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("failed to load keyring: %s", err.Error())
+	}
+	id, key, err := k.CurrentKey()
+	if err != nil {
+		t.Fatalf("failed to get current key: %s", err.Error())
+	}
+	if id != "b" || len(key) != 32 {
+		t.Fatalf("wrong current key, got %s of %d bytes", id, len(key))
+	}
+	if key, err := k.Key("a"); err != nil || len(key) != 16 {
+		t.Fatalf("failed to get key a: %v", err)
+	}
+	if _, err := k.Key("c"); err != ErrUnknownKey {
+		t.Fatalf("wrong error for unknown key: %v", err)
+	}
+
+	for _, s := range []string{
+		`{"current": "c", "keys": {"a": "tvzyGVBVaKUmsKXU3QHuZQ=="}}`,
+		`{"current": "a", "keys": {"a": "dG9vIHNob3J0"}}`,
+		`{"current": "a", "keys": {"a": "not base64"}}`,
+	} {
+		if _, err := LoadKeyring(strings.NewReader(s)); err == nil {
+			t.Fatalf("loaded invalid keyring %s", s)
+		}
+	}
+}
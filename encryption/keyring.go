@@ -0,0 +1,96 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Keyring is a KeyProvider holding a fixed set of keys, one of which is
+// current. To rotate keys, add a new key and make it current, retaining the
+// earlier keys for as long as data encrypted with them may be read.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// keyringFile is the format of a key file. Keys are base64-encoded.
+type keyringFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// NewKeyring returns a Keyring holding the given keys, by ID, with current
+// the ID of the current key.
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{
+		current: current,
+		keys:    make(map[string][]byte, len(keys)),
+	}
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key ID %q", id)
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("key %s is %d bytes, must be 16, 24, or 32", id, len(key))
+		}
+		k.keys[id] = key
+	}
+	if _, ok := k.keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q not found", current)
+	}
+	return k, nil
+}
+
+// LoadKeyring loads a Keyring from a reader. For example:
+//
+//	{
+//	  "current": "2022-01",
+//	  "keys": {
+//	    "2021-06": "tvzyGVBVaKUmsKXU3QHuZQ==",
+//	    "2022-01": "Jbp5Ce4KHHmdyZvMGhHNBV3bfS6DjCg0wVPZoERyTCY="
+//	  }
+//	}
+func LoadKeyring(r io.Reader) (*Keyring, error) {
+	var kf keyringFile
+	if err := json.NewDecoder(r).Decode(&kf); err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte, len(kf.Keys))
+	for id, s := range kf.Keys {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", id, err)
+		}
+		keys[id] = key
+	}
+	return NewKeyring(kf.Current, keys)
+}
+
+// LoadKeyringFile loads a Keyring from the file at path.
+func LoadKeyringFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadKeyring(f)
+}
+
+// CurrentKey implements KeyProvider.
+func (k *Keyring) CurrentKey() (string, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+// Key implements KeyProvider.
+func (k *Keyring) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
@@ -9,7 +9,7 @@ require (
 	github.com/fatih/color v1.12.0 // indirect
 	github.com/go-xorm/xorm v0.7.9 // indirect
 	github.com/golang/protobuf v1.5.2
-	github.com/hashicorp/go-hclog v0.16.2 // indirect
+	github.com/hashicorp/go-hclog v0.16.2
 	github.com/hashicorp/go-immutable-radix v1.3.1 // indirect
 	github.com/hashicorp/go-msgpack v1.1.5 // indirect
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
@@ -0,0 +1,220 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rqlite/rqlite/command"
+)
+
+// Audit log event types.
+const (
+	auditExecute = "execute"
+	auditLoad    = "load"
+	auditJoin    = "join"
+	auditRemove  = "remove"
+	auditBackup  = "backup"
+)
+
+const (
+	// redacted replaces parameter values in the audit log, when redaction
+	// is enabled.
+	redacted = "[REDACTED]"
+
+	// errUnauthorized is recorded for requests refused for lack of
+	// permission.
+	errUnauthorized = "unauthorized"
+)
+
+// auditRecord is a single entry in the audit log.
+type auditRecord struct {
+	Time       string            `json:"time"`
+	Event      string            `json:"event"`
+	RequestID  string            `json:"request_id,omitempty"`
+	User       string            `json:"user,omitempty"`
+	RemoteAddr string            `json:"remote_addr"`
+	Database   string            `json:"database,omitempty"`
+	Statements []*auditStatement `json:"statements,omitempty"`
+	Bytes      int               `json:"bytes,omitempty"` // Size of a loaded dump.
+	NodeID     string            `json:"node_id,omitempty"`
+	NodeAddr   string            `json:"node_addr,omitempty"`
+	Format     string            `json:"format,omitempty"` // Format of a backup.
+	Sequence   uint64            `json:"sequence_number,omitempty"`
+	Results    []*auditResult    `json:"results,omitempty"`
+	RaftIndex  uint64            `json:"raft_index,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// auditStatement is a statement, and its parameters, in the audit log.
+type auditStatement struct {
+	SQL        string        `json:"sql"`
+	Parameters []interface{} `json:"parameters,omitempty"`
+}
+
+// auditResult is the outcome of a single statement in the audit log.
+type auditResult struct {
+	LastInsertID int64  `json:"last_insert_id,omitempty"`
+	RowsAffected int64  `json:"rows_affected,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// auditLog writes a record of each audited request to a file, one JSON
+// object per line. The file is rotated once it reaches a maximum size,
+// retaining a number of earlier files, named path.1, path.2, and so on,
+// from newest to oldest.
+type auditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	redact     bool
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// newAuditLog returns an audit log which appends to the file at path. If
+// maxSize is zero the file is never rotated. If redact is set, parameter
+// values are not recorded.
+func newAuditLog(path string, maxSize int64, maxBackups int, redact bool) (*auditLog, error) {
+	l := &auditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		redact:     redact,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	return nil
+}
+
+// Log writes rec to the audit log.
+func (l *auditLog) Log(rec *auditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate audit log: %s", err)
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside, and opens a new one. It must be
+// called with mu held.
+func (l *auditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if l.maxBackups == 0 {
+		if err := os.Remove(l.path); err != nil {
+			return err
+		}
+		return l.open()
+	}
+
+	os.Remove(backupPath(l.path, l.maxBackups))
+	for i := l.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(backupPath(l.path, i), backupPath(l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, backupPath(l.path, 1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the audit log.
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// statements returns the statements of req for recording in the audit log.
+func (l *auditLog) statements(req *command.Request) []*auditStatement {
+	stmts := make([]*auditStatement, len(req.GetStatements()))
+	for i, s := range req.GetStatements() {
+		stmts[i] = &auditStatement{SQL: s.Sql}
+		if len(s.Parameters) == 0 {
+			continue
+		}
+		stmts[i].Parameters = make([]interface{}, len(s.Parameters))
+		for j, p := range s.Parameters {
+			if l.redact {
+				stmts[i].Parameters[j] = redacted
+				continue
+			}
+			switch v := p.GetValue().(type) {
+			case *command.Parameter_I:
+				stmts[i].Parameters[j] = v.I
+			case *command.Parameter_D:
+				stmts[i].Parameters[j] = v.D
+			case *command.Parameter_B:
+				stmts[i].Parameters[j] = v.B
+			case *command.Parameter_Y:
+				stmts[i].Parameters[j] = v.Y
+			case *command.Parameter_S:
+				stmts[i].Parameters[j] = v.S
+			case *command.Parameter_T:
+				stmts[i].Parameters[j] = time.Unix(0, v.T).UTC().Format(time.RFC3339Nano)
+			default:
+				stmts[i].Parameters[j] = nil
+			}
+		}
+	}
+	return stmts
+}
+
+// setResults records the outcome of an execute request in rec, including
+// the index of the Raft log entry which executed it.
+func (rec *auditRecord) setResults(results []*command.ExecuteResult, err error) {
+	if err != nil {
+		rec.Error = err.Error()
+		return
+	}
+	rec.Results = make([]*auditResult, len(results))
+	for i, r := range results {
+		rec.Results[i] = &auditResult{
+			LastInsertID: r.LastInsertId,
+			RowsAffected: r.RowsAffected,
+			Error:        r.Error,
+		}
+		if r.RaftIndex != 0 {
+			rec.RaftIndex = r.RaftIndex
+		}
+	}
+}
+
+// backupPath returns the path of the nth earlier file of the log at path.
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
@@ -0,0 +1,87 @@
+package http
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rqlite/rqlite/command"
+)
+
+func Test_AuditLogRotate(t *testing.T) {
+	dir := mustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := newAuditLog(path, 200, 2, false)
+	if err != nil {
+		t.Fatalf("failed to create audit log: %s", err)
+	}
+	defer l.Close()
+
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7"} {
+		if err := l.Log(&auditRecord{Event: auditRemove, NodeID: id, RemoteAddr: "127.0.0.1:1234"}); err != nil {
+			t.Fatalf("failed to write audit record: %s", err)
+		}
+	}
+
+	// Each record is about 75 bytes, so each file holds two, and the oldest
+	// records have been dropped.
+	for p, exp := range map[string]string{
+		path:                `"node_id":"7"`,
+		backupPath(path, 1): `"node_id":"5"`,
+		backupPath(path, 2): `"node_id":"3"`,
+	} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", p, err)
+		}
+		if !strings.Contains(string(b), exp) {
+			t.Fatalf("%s does not contain %s: %s", p, exp, b)
+		}
+	}
+	b, err := ioutil.ReadFile(backupPath(path, 2))
+	if err != nil {
+		t.Fatalf("failed to read oldest audit log: %s", err)
+	}
+	if strings.Contains(string(b), `"node_id":"2"`) {
+		t.Fatalf("oldest audit records not dropped: %s", b)
+	}
+	if _, err := os.Stat(backupPath(path, 3)); !os.IsNotExist(err) {
+		t.Fatalf("too many audit log files retained")
+	}
+}
+
+func Test_AuditLogStatements(t *testing.T) {
+	req := &command.Request{
+		Statements: []*command.Statement{
+			{Sql: "SELECT 1"},
+			{
+				Sql: "INSERT INTO foo(id, name) VALUES(?, ?)",
+				Parameters: []*command.Parameter{
+					{Value: &command.Parameter_I{I: 5}},
+					{Value: &command.Parameter_S{S: "fiona"}},
+				},
+			},
+		},
+	}
+
+	l := &auditLog{}
+	stmts := l.statements(req)
+	if len(stmts) != 2 || stmts[0].Parameters != nil {
+		t.Fatalf("wrong statements: %v", stmts)
+	}
+	if stmts[1].Parameters[0] != int64(5) || stmts[1].Parameters[1] != "fiona" {
+		t.Fatalf("wrong parameters: %v", stmts[1].Parameters)
+	}
+
+	l.redact = true
+	stmts = l.statements(req)
+	for _, p := range stmts[1].Parameters {
+		if p != redacted {
+			t.Fatalf("parameter not redacted: %v", p)
+		}
+	}
+}
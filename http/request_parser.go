@@ -102,6 +102,12 @@ func ParseRequest(b []byte) ([]*command.Statement, error) {
 						S: v,
 					},
 				}
+			case nil:
+				stmts[i].Parameters[j] = &command.Parameter{
+					Value: &command.Parameter_N{
+						N: true,
+					},
+				}
 			default:
 				return nil, ErrUnsupportedType
 			}
@@ -3,6 +3,8 @@ package http
 import (
 	"fmt"
 	"testing"
+
+	"github.com/rqlite/rqlite/command"
 )
 
 func Test_NilRequest(t *testing.T) {
@@ -186,6 +188,22 @@ func Test_SingleSimpleParameterizedRequest(t *testing.T) {
 	}
 }
 
+func Test_SingleParameterizedRequestNull(t *testing.T) {
+	s := "INSERT INTO foo(name, age) VALUES(?, ?)"
+	b := []byte(fmt.Sprintf(`[["%s", "fiona", null]]`, s))
+
+	stmts, err := ParseRequest(b)
+	if err != nil {
+		t.Fatalf("failed to parse request: %s", err.Error())
+	}
+	if len(stmts[0].Parameters) != 2 {
+		t.Fatalf("incorrect number of parameters returned: %d", len(stmts[0].Parameters))
+	}
+	if _, ok := stmts[0].Parameters[1].GetValue().(*command.Parameter_N); !ok {
+		t.Fatalf("expected NULL parameter, got %T", stmts[0].Parameters[1].GetValue())
+	}
+}
+
 func Test_SingleInvalidParameterizedRequest(t *testing.T) {
 	s := "SELECT * FROM ? ?"
 	p0 := "FOO"
@@ -3,32 +3,40 @@
 package http
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"net/http/pprof"
-	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/rqlite/rqlite/command"
 	"github.com/rqlite/rqlite/command/encoding"
+	sql "github.com/rqlite/rqlite/db"
+	"github.com/rqlite/rqlite/logging"
+	"github.com/rqlite/rqlite/rtls"
 	"github.com/rqlite/rqlite/store"
+	"github.com/rqlite/rqlite/tracing"
 )
 
 var (
 	// ErrLeaderNotFound is returned when a node cannot locate a leader
 	ErrLeaderNotFound = errors.New("leader not found")
+
+	// ErrDBTimeoutNotAllowed is returned when db_timeout is set on a write,
+	// or a read with strong consistency.
+	ErrDBTimeoutNotAllowed = errors.New("db_timeout is not supported for writes or reads with strong consistency")
 )
 
 // Database is the interface any queryable system must implement
@@ -67,6 +75,50 @@ type Store interface {
 
 	// Backup wites backup of the node state to dst
 	Backup(leader bool, f store.BackupFormat, dst io.Writer) error
+
+	// StatementStats returns execution statistics for each distinct
+	// statement executed by this node.
+	StatementStats() []*sql.StatementStat
+
+	// ResetStatementStats discards all statement execution statistics.
+	ResetStatementStats()
+
+	// Explain returns the query plan for each statement in the request.
+	Explain(req *command.Request) ([]*sql.QueryPlan, error)
+
+	// ReadOnly returns whether every statement in the request is read-only.
+	ReadOnly(req *command.Request) (bool, error)
+
+	// ExecuteQueued adds the request to the write queue, returning its
+	// sequence number without waiting for it to be committed.
+	ExecuteQueued(er *command.ExecuteRequest) (uint64, error)
+
+	// WaitForQueued waits until the queued write with the given sequence
+	// number has been committed.
+	WaitForQueued(seq uint64, timeout time.Duration) error
+
+	// CreateDatabase creates a new, empty, named database.
+	CreateDatabase(name string) error
+
+	// DropDatabase drops the named database.
+	DropDatabase(name string) error
+
+	// Databases returns the names of every named database.
+	Databases() []string
+
+	// Migrate applies every migration in the request not already applied.
+	Migrate(mr *command.MigrateRequest) ([]*store.Migration, error)
+
+	// Migrations returns the migrations applied to the named database.
+	Migrations(database string) ([]*store.Migration, error)
+
+	// Schema returns the schema of the named database.
+	Schema(database string) (*sql.Schema, error)
+
+	// Checksum instructs every node to compute the checksum of its
+	// databases at the same index, returning the index and the checksum
+	// computed by this node.
+	Checksum() (uint64, string, error)
 }
 
 // Cluster is the interface node API services must provide
@@ -80,6 +132,17 @@ type Cluster interface {
 	// Query performs an Query Request on a remote node.
 	Query(qr *command.QueryRequest, nodeAddr string, timeout time.Duration) ([]*command.QueryRows, error)
 
+	// Checksum returns the checksum a remote node computed at the given index.
+	Checksum(idx uint64, nodeAddr string, timeout time.Duration) (string, error)
+
+	// ExecuteQueued adds an Execute Request to the write queue of a remote
+	// node, and, if wait is set, waits for it to be committed.
+	ExecuteQueued(er *command.ExecuteRequest, wait bool, nodeAddr string, timeout time.Duration) (uint64, error)
+
+	// NodeBuildVersion returns the version of rqlite running on the node at
+	// the given Raft address, or an empty string if it is not known.
+	NodeBuildVersion(nodeAddr string) string
+
 	// Stats returns stats on the Cluster.
 	Stats() (map[string]interface{}, error)
 }
@@ -94,6 +157,10 @@ type CredentialStore interface {
 
 	// HasAnyPerm returns whether username has any of the given perms.
 	HasAnyPerm(username string, perm ...string) bool
+
+	// Exists returns whether username is known, whether or not it has a
+	// password.
+	Exists(username string) bool
 }
 
 // Statuser is the interface status providers must implement.
@@ -105,23 +172,26 @@ type Statuser interface {
 type DBResults struct {
 	ExecuteResult []*command.ExecuteResult
 	QueryRows     []*command.QueryRows
+
+	encoder encoding.Encoder
 }
 
 // MarshalJSON implements the JSON Marshaler interface.
 func (d *DBResults) MarshalJSON() ([]byte, error) {
 	if d.ExecuteResult != nil {
-		return encoding.JSONMarshal(d.ExecuteResult)
+		return d.encoder.JSONMarshal(d.ExecuteResult)
 	} else if d.QueryRows != nil {
-		return encoding.JSONMarshal(d.QueryRows)
+		return d.encoder.JSONMarshal(d.QueryRows)
 	}
 	return nil, fmt.Errorf("no DB results set")
 }
 
 // Response represents a response from the HTTP service.
 type Response struct {
-	Results *DBResults `json:"results,omitempty"`
-	Error   string     `json:"error,omitempty"`
-	Time    float64    `json:"time,omitempty"`
+	Results        *DBResults `json:"results,omitempty"`
+	SequenceNumber uint64     `json:"sequence_number,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	Time           float64    `json:"time,omitempty"`
 
 	start time.Time
 	end   time.Time
@@ -134,6 +204,7 @@ const (
 	numLeaderNotFound   = "leader_not_found"
 	numExecutions       = "executions"
 	numQueries          = "queries"
+	numRequests         = "requests"
 	numRemoteExecutions = "remote_executions"
 	numRemoteQueries    = "remote_queries"
 	numBackups          = "backups"
@@ -141,6 +212,9 @@ const (
 	numJoins            = "joins"
 	numAuthOK           = "authOK"
 	numAuthFail         = "authFail"
+	numVerifications    = "verifications"
+	numVerifyDiverged   = "verify_diverged"
+	numAuditLogErrors   = "audit_log_errors"
 
 	// Default timeout for cluster communications.
 	defaulTimeout = 30 * time.Second
@@ -161,6 +235,10 @@ const (
 	PermBackup = "backup"
 	// PermLoad means user can load a SQLite dump into a node.
 	PermLoad = "load"
+	// PermDatabases means user can create and drop named databases.
+	PermDatabases = "databases"
+	// PermLogLevel means user can change log levels.
+	PermLogLevel = "loglevel"
 
 	// VersionHTTPHeader is the HTTP header key for the version.
 	VersionHTTPHeader = "X-RQLITE-VERSION"
@@ -169,6 +247,18 @@ const (
 	// node (by node Raft address) actually served the request if
 	// it wasn't served by this node.
 	ServedByHTTPHeader = "X-RQLITE-SERVED-BY"
+
+	// IdempotencyKeyHTTPHeader is the HTTP header used by clients to
+	// identify retries of the same write request.
+	IdempotencyKeyHTTPHeader = "Idempotency-Key"
+
+	// RequestIDHTTPHeader is the HTTP header used to identify a request. It
+	// may be set by the client, and is always set in the response.
+	RequestIDHTTPHeader = "X-RQLITE-REQUEST-ID"
+
+	// maxRequestIDLength is the longest request ID accepted from a client.
+	// Longer IDs are replaced with a generated ID.
+	maxRequestIDLength = 128
 )
 
 func init() {
@@ -176,6 +266,7 @@ func init() {
 	stats.Add(numLeaderNotFound, 0)
 	stats.Add(numExecutions, 0)
 	stats.Add(numQueries, 0)
+	stats.Add(numRequests, 0)
 	stats.Add(numRemoteExecutions, 0)
 	stats.Add(numRemoteQueries, 0)
 	stats.Add(numBackups, 0)
@@ -183,6 +274,9 @@ func init() {
 	stats.Add(numJoins, 0)
 	stats.Add(numAuthOK, 0)
 	stats.Add(numAuthFail, 0)
+	stats.Add(numVerifications, 0)
+	stats.Add(numVerifyDiverged, 0)
+	stats.Add(numAuditLogErrors, 0)
 }
 
 // SetTime sets the Time attribute of the response. This way it will be present
@@ -219,14 +313,44 @@ type Service struct {
 	KeyFile    string // Path to SSL private key.
 	TLS1011    bool   // Whether older, deprecated TLS should be supported.
 
+	// ClientCertAuth controls whether clients must present a certificate,
+	// signed by the root certificate in CACertFile. The subject common name,
+	// or a subject alternative name, of the certificate identifies the user,
+	// who need not then supply a password.
+	ClientCertAuth bool
+
+	certs   *rtls.CertReloader
+	caCerts *rtls.CAReloader
+
 	credentialStore CredentialStore
 
+	DBTimeout time.Duration // Default timeout for statement execution, zero means none.
+
+	VerifyInterval time.Duration // How often the leader verifies node checksums, zero means never.
+
+	verifyMu   sync.RWMutex
+	lastVerify *verifyResult // Result of the last periodic verification.
+
+	// AuditLogPath, if set, is the path of a file to which a record of every
+	// execute, load, join, remove, and backup request is written.
+	AuditLogPath       string
+	AuditLogMaxSize    int64 // Size in bytes at which the audit log is rotated, zero means never.
+	AuditLogMaxBackups int   // Number of rotated audit log files retained.
+	AuditRedactParams  bool  // Whether parameter values are left out of the audit log.
+
+	auditLog *auditLog
+
+	// Tracer, if set, records spans for each request.
+	Tracer *tracing.Tracer
+
+	done chan struct{}
+
 	Expvar bool
 	Pprof  bool
 
 	BuildInfo map[string]interface{}
 
-	logger *log.Logger
+	logger *logging.Logger
 }
 
 // New returns an uninitialized HTTP service. If credentials is nil, then
@@ -239,7 +363,7 @@ func New(addr string, store Store, cluster Cluster, credentials CredentialStore)
 		start:           time.Now(),
 		statuses:        make(map[string]Statuser),
 		credentialStore: credentials,
-		logger:          log.New(os.Stderr, "[http] ", log.LstdFlags),
+		logger:          logging.New("http"),
 	}
 }
 
@@ -257,7 +381,7 @@ func (s *Service) Start() error {
 			return err
 		}
 	} else {
-		config, err := createTLSConfig(s.CertFile, s.KeyFile, s.CACertFile, s.TLS1011)
+		config, err := s.createTLSConfig()
 		if err != nil {
 			return err
 		}
@@ -265,60 +389,136 @@ func (s *Service) Start() error {
 		if err != nil {
 			return err
 		}
-		s.logger.Printf("secure HTTPS server enabled with cert %s, key %s", s.CertFile, s.KeyFile)
+		s.logger.Infof("secure HTTPS server enabled with cert %s, key %s", s.CertFile, s.KeyFile)
+		if s.ClientCertAuth {
+			s.logger.Infof("client certificates required, verified with %s", s.CACertFile)
+		}
 	}
 	s.ln = ln
 
+	if s.AuditLogPath != "" {
+		s.auditLog, err = newAuditLog(s.AuditLogPath, s.AuditLogMaxSize, s.AuditLogMaxBackups, s.AuditRedactParams)
+		if err != nil {
+			s.ln.Close()
+			return fmt.Errorf("open audit log: %s", err)
+		}
+		s.logger.Infof("audit log enabled at %s", s.AuditLogPath)
+	}
+
 	go func() {
 		err := server.Serve(s.ln)
 		if err != nil {
-			s.logger.Println("HTTP service Serve() returned:", err.Error())
+			s.logger.Infof("HTTP service Serve() returned: %s", err.Error())
 		}
 	}()
-	s.logger.Println("service listening on", s.Addr())
+	s.logger.Infof("service listening on %s", s.Addr())
 
+	if s.VerifyInterval > 0 {
+		s.done = make(chan struct{})
+		go s.runVerify(s.done)
+	}
 	return nil
 }
 
 // Close closes the service.
 func (s *Service) Close() {
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
 	s.ln.Close()
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
 	return
 }
 
+// ReloadCertificates loads the certificate, key, and root certificate from
+// their files again. Connections already established are unaffected.
+func (s *Service) ReloadCertificates() error {
+	if s.certs == nil {
+		return nil
+	}
+	if err := s.certs.Reload(); err != nil {
+		return err
+	}
+	if s.caCerts != nil {
+		return s.caCerts.Reload()
+	}
+	return nil
+}
+
 // ServeHTTP allows Service to serve HTTP requests.
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.addBuildVersion(w)
+
+	// Requests for a named database, such as /db/<name>/query, are routed
+	// as the equivalent request for the default database.
+	_, path := parseDatabasePath(r.URL.Path)
+
+	id := r.Header.Get(RequestIDHTTPHeader)
+	if !validRequestID(id) {
+		id = tracing.NewRequestID()
+	}
+	w.Header().Set(RequestIDHTTPHeader, id)
+	span := s.Tracer.Start(r.Method+" "+path, tracing.TraceIDFromRequestID(id), tracing.SpanID{})
+	span.SetKind(tracing.KindServer)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.Path)
+	span.SetAttribute("request_id", id)
+	defer span.End()
+	r = r.WithContext(tracing.NewContext(context.WithValue(r.Context(), requestIDKey{}, id), span))
+	s.logger.Debugf("request %s: %s %s from %s", id, r.Method, r.URL.Path, r.RemoteAddr)
+
 	if !s.checkCredentials(r) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
 	switch {
-	case strings.HasPrefix(r.URL.Path, "/db/execute"):
+	case strings.HasPrefix(path, "/db/execute"):
 		stats.Add(numExecutions, 1)
 		s.handleExecute(w, r)
-	case strings.HasPrefix(r.URL.Path, "/db/query"):
+	case strings.HasPrefix(path, "/db/query"):
 		stats.Add(numQueries, 1)
 		s.handleQuery(w, r)
-	case strings.HasPrefix(r.URL.Path, "/db/backup"):
+	case strings.HasPrefix(path, "/db/backup"):
 		stats.Add(numBackups, 1)
 		s.handleBackup(w, r)
-	case strings.HasPrefix(r.URL.Path, "/db/load"):
+	case strings.HasPrefix(path, "/db/load"):
 		stats.Add(numLoad, 1)
 		s.handleLoad(w, r)
-	case strings.HasPrefix(r.URL.Path, "/join"):
+	case strings.HasPrefix(path, "/db/request"):
+		stats.Add(numRequests, 1)
+		s.handleRequest(w, r)
+	case strings.HasPrefix(path, "/db/queue"):
+		s.handleQueue(w, r)
+	case strings.HasPrefix(path, "/db/statements"):
+		s.handleStatements(w, r)
+	case strings.HasPrefix(path, "/db/explain"):
+		s.handleExplain(w, r)
+	case strings.HasPrefix(path, "/db/migrations"):
+		s.handleMigrations(w, r)
+	case strings.HasPrefix(path, "/db/schema"):
+		s.handleSchema(w, r)
+	case strings.HasPrefix(path, "/db/verify"):
+		s.handleVerify(w, r)
+	case strings.HasPrefix(path, "/databases"):
+		s.handleDatabases(w, r)
+	case strings.HasPrefix(path, "/join"):
 		stats.Add(numJoins, 1)
 		s.handleJoin(w, r)
-	case strings.HasPrefix(r.URL.Path, "/remove"):
+	case strings.HasPrefix(path, "/remove"):
 		s.handleRemove(w, r)
-	case strings.HasPrefix(r.URL.Path, "/status"):
+	case strings.HasPrefix(path, "/status"):
 		s.handleStatus(w, r)
-	case strings.HasPrefix(r.URL.Path, "/nodes"):
+	case strings.HasPrefix(path, "/nodes"):
 		s.handleNodes(w, r)
-	case r.URL.Path == "/debug/vars" && s.Expvar:
+	case strings.HasPrefix(path, "/loglevel"):
+		s.handleLogLevel(w, r)
+	case path == "/debug/vars" && s.Expvar:
 		s.handleExpvar(w, r)
-	case strings.HasPrefix(r.URL.Path, "/debug/pprof") && s.Pprof:
+	case strings.HasPrefix(path, "/debug/pprof") && s.Pprof:
 		s.handlePprof(w, r)
 	default:
 		w.WriteHeader(http.StatusNotFound)
@@ -341,6 +541,7 @@ func (s *Service) RegisterStatus(key string, stat Statuser) error {
 // handleJoin handles cluster-join requests from other nodes.
 func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
 	if !s.CheckRequestPerm(r, PermJoin) {
+		s.audit(r, &auditRecord{Event: auditJoin, Error: errUnauthorized})
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -378,6 +579,21 @@ func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
 		voter = true
 	}
 
+	// A joining node must load the same SQLite extensions as this node, or
+	// the nodes could diverge.
+	exts := struct {
+		Extensions []sql.Extension `json:"extensions"`
+	}{}
+	if err := json.Unmarshal(b, &exts); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := sql.CheckExtensions(exts.Extensions); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	rec := &auditRecord{Event: auditJoin, NodeID: remoteID.(string), NodeAddr: remoteAddr.(string)}
 	if err := s.store.Join(remoteID.(string), remoteAddr.(string), voter.(bool)); err != nil {
 		if err == store.ErrNotLeader {
 			leaderAPIAddr := s.LeaderAPIAddr()
@@ -392,14 +608,18 @@ func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		rec.Error = err.Error()
+		s.audit(r, rec)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.audit(r, rec)
 }
 
 // handleRemove handles cluster-remove requests.
 func (s *Service) handleRemove(w http.ResponseWriter, r *http.Request) {
 	if !s.CheckRequestPerm(r, PermRemove) {
+		s.audit(r, &auditRecord{Event: auditRemove, Error: errUnauthorized})
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -431,6 +651,7 @@ func (s *Service) handleRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rec := &auditRecord{Event: auditRemove, NodeID: remoteID}
 	if err := s.store.Remove(remoteID); err != nil {
 		if err == store.ErrNotLeader {
 			leaderAPIAddr := s.LeaderAPIAddr()
@@ -445,14 +666,18 @@ func (s *Service) handleRemove(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		rec.Error = err.Error()
+		s.audit(r, rec)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.audit(r, rec)
 }
 
 // handleBackup returns the consistent database snapshot.
 func (s *Service) handleBackup(w http.ResponseWriter, r *http.Request) {
 	if !s.CheckRequestPerm(r, PermBackup) {
+		s.audit(r, &auditRecord{Event: auditBackup, Error: errUnauthorized})
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -474,6 +699,10 @@ func (s *Service) handleBackup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rec := &auditRecord{Event: auditBackup, Format: "binary"}
+	if bf == store.BackupSQL {
+		rec.Format = "sql"
+	}
 	err = s.store.Backup(!noLeader, bf, w)
 	if err != nil {
 		if err == store.ErrNotLeader {
@@ -488,9 +717,12 @@ func (s *Service) handleBackup(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, redirect, http.StatusMovedPermanently)
 			return
 		}
+		rec.Error = err.Error()
+		s.audit(r, rec)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.audit(r, rec)
 
 	s.lastBackup = time.Now()
 }
@@ -499,6 +731,7 @@ func (s *Service) handleBackup(w http.ResponseWriter, r *http.Request) {
 // from others in that it expects a raw file, not wrapped in any kind of JSON.
 func (s *Service) handleLoad(w http.ResponseWriter, r *http.Request) {
 	if !s.CheckRequestPerm(r, PermLoad) {
+		s.audit(r, &auditRecord{Event: auditLoad, Error: errUnauthorized})
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -526,6 +759,8 @@ func (s *Service) handleLoad(w http.ResponseWriter, r *http.Request) {
 	// No JSON structure expected for this API.
 	queries := []string{string(b)}
 	er := executeRequestFromStrings(queries, timings, false)
+	er.Request.RequestId = requestID(r)
+	er.Request.ParentSpanId = requestSpan(r).ID().Bytes()
 
 	results, err := s.store.Execute(er)
 	if err != nil {
@@ -545,6 +780,11 @@ func (s *Service) handleLoad(w http.ResponseWriter, r *http.Request) {
 	} else {
 		resp.Results.ExecuteResult = results
 	}
+	// A dump may be very large, so only its size is recorded.
+	rec := &auditRecord{Event: auditLoad, Bytes: len(b)}
+	rec.setResults(results, err)
+	s.audit(r, rec)
+
 	resp.end = time.Now()
 	s.writeResponse(w, r, resp)
 }
@@ -585,9 +825,21 @@ func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	httpStatus := map[string]interface{}{
-		"bind_addr": s.Addr().String(),
-		"auth":      prettyEnabled(s.credentialStore != nil),
-		"cluster":   clusterStatus,
+		"bind_addr":  s.Addr().String(),
+		"auth":       prettyEnabled(s.credentialStore != nil),
+		"cluster":    clusterStatus,
+		"db_timeout": s.DBTimeout.String(),
+	}
+	if s.certs != nil {
+		httpStatus["tls"] = s.certs.Stats()
+	}
+	if s.VerifyInterval > 0 {
+		httpStatus["verify_interval"] = s.VerifyInterval.String()
+		s.verifyMu.RLock()
+		if s.lastVerify != nil {
+			httpStatus["last_verify"] = s.lastVerify
+		}
+		s.verifyMu.RUnlock()
 	}
 
 	nodeStatus := map[string]interface{}{
@@ -701,6 +953,7 @@ func (s *Service) handleNodes(w http.ResponseWriter, r *http.Request) {
 		Addr      string  `json:"addr,omitempty"`
 		Reachable bool    `json:"reachable"`
 		Leader    bool    `json:"leader"`
+		Version   string  `json:"version,omitempty"`
 		Time      float64 `json:"time,omitempty"`
 		Error     string  `json:"error,omitempty"`
 	})
@@ -711,6 +964,7 @@ func (s *Service) handleNodes(w http.ResponseWriter, r *http.Request) {
 		nn.Leader = nn.Addr == lAddr
 		nn.APIAddr = nodesResp[n.ID].apiAddr
 		nn.Reachable = nodesResp[n.ID].reachable
+		nn.Version = nodesResp[n.ID].version
 		nn.Time = nodesResp[n.ID].time.Seconds()
 		nn.Error = nodesResp[n.ID].error
 		resp[n.ID] = nn
@@ -734,11 +988,114 @@ func (s *Service) handleNodes(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleStatements returns execution statistics for each distinct statement
+// executed by this node. A DELETE request resets the statistics.
+func (s *Service) handleStatements(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if !s.CheckRequestPerm(r, PermStatus) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		s.store.ResetStatementStats()
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"statements": s.store.StatementStats(),
+	}
+
+	pretty, _ := isPretty(r)
+	var b []byte
+	var err error
+	if pretty {
+		b, err = json.MarshalIndent(resp, "", "    ")
+	} else {
+		b, err = json.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleExplain returns the query plan for each statement in the request,
+// as generated by this node. The statements are not executed.
+func (s *Service) handleExplain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if !s.CheckRequestPerm(r, databasePerm(r, PermQuery)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	dbTimeout, err := dbTimeoutParam(r, s.DBTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queries, err := requestQueries(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp := struct {
+		Results []*sql.QueryPlan `json:"results,omitempty"`
+		Error   string           `json:"error,omitempty"`
+	}{}
+	resp.Results, err = s.store.Explain(&command.Request{
+		Statements: queries,
+		DbTimeout:  dbTimeout.Nanoseconds(),
+		User:       s.requestUser(r),
+		Database:   databaseName(r),
+	})
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	pretty, _ := isPretty(r)
+	var b []byte
+	if pretty {
+		b, err = json.MarshalIndent(resp, "", "    ")
+	} else {
+		b, err = json.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 // handleExecute handles queries that modify the database.
 func (s *Service) handleExecute(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
-	if !s.CheckRequestPerm(r, PermExecute) {
+	if !s.CheckRequestPerm(r, databasePerm(r, PermExecute)) {
+		s.audit(r, &auditRecord{Event: auditExecute, Error: errUnauthorized})
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -756,6 +1113,11 @@ func (s *Service) handleExecute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if hasDBTimeout(r) {
+		http.Error(w, ErrDBTimeoutNotAllowed.Error(), http.StatusBadRequest)
+		return
+	}
+
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -771,12 +1133,176 @@ func (s *Service) handleExecute(w http.ResponseWriter, r *http.Request) {
 
 	er := &command.ExecuteRequest{
 		Request: &command.Request{
-			Transaction: isTx,
-			Statements:  stmts,
+			Transaction:  isTx,
+			Statements:   stmts,
+			User:         s.requestUser(r),
+			Database:     databaseName(r),
+			RequestId:    requestID(r),
+			ParentSpanId: requestSpan(r).ID().Bytes(),
 		},
-		Timings: timings,
+		Timings:        timings,
+		IdempotencyKey: r.Header.Get(IdempotencyKeyHTTPHeader),
+	}
+
+	queue, err := isQueue(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if queue {
+		s.executeQueuedAndRespond(w, r, resp, er, timeout, redirect)
+		return
+	}
+	s.executeAndRespond(w, r, resp, er, timeout, redirect)
+}
+
+// executeQueuedAndRespond adds the given execute request to the write queue
+// of the leader, forwarding it to the leader if necessary, and writes the
+// response, which contains the sequence number of the request. If requested,
+// it waits for the request to be committed.
+func (s *Service) executeQueuedAndRespond(w http.ResponseWriter, r *http.Request, resp *Response,
+	er *command.ExecuteRequest, timeout time.Duration, redirect bool) {
+	wait, err := queryParam(r, "wait")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seq, err := s.store.ExecuteQueued(er)
+	var waitErr error
+	forwarded := false
+	if err == store.ErrNotLeader && !redirect {
+		addr, err := s.store.LeaderAddr()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if addr == "" {
+			stats.Add(numLeaderNotFound, 1)
+			http.Error(w, ErrLeaderNotFound.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		span := s.startForwardSpan(r, er.Request, addr)
+		seq, waitErr = s.cluster.ExecuteQueued(er, wait, addr, timeout)
+		span.SetError(waitErr)
+		span.End()
+		forwarded = !isUnsupportedCommand(waitErr)
+		if forwarded {
+			stats.Add(numRemoteExecutions, 1)
+			w.Header().Add(ServedByHTTPHeader, addr)
+		}
+	}
+	if forwarded {
+		// The leader returns a sequence number only if the write was queued,
+		// in which case any error is the result of waiting for it.
+		err = nil
+		if seq == 0 {
+			err, waitErr = waitErr, nil
+		}
+	} else if err == store.ErrNotLeader {
+		// The client asked to be redirected, or the leader predates
+		// forwarded writes to its queue.
+		leaderAPIAddr := s.LeaderAPIAddr()
+		if leaderAPIAddr == "" {
+			stats.Add(numLeaderNotFound, 1)
+			http.Error(w, ErrLeaderNotFound.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		loc := s.FormRedirect(r, leaderAPIAddr)
+		http.Redirect(w, r, loc, http.StatusMovedPermanently)
+		return
+	}
+	rec := s.auditExecuteRecord(er)
+	if err != nil && err.Error() == store.ErrQueueFull.Error() {
+		rec.Error = err.Error()
+		s.audit(r, rec)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// The Raft index of a queued request is not known until the queue is
+	// flushed, so the sequence number is recorded instead.
+	rec.Sequence = seq
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	s.audit(r, rec)
+
+	resp.Results = nil
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.SequenceNumber = seq
+		if wait && !forwarded {
+			waitErr = s.store.WaitForQueued(seq, timeout)
+		}
+		if waitErr != nil {
+			resp.Error = waitErr.Error()
+		}
+	}
+	resp.end = time.Now()
+	s.writeResponse(w, r, resp)
+}
+
+// isUnsupportedCommand returns whether err reports that a remote node does
+// not support the request sent to it. The cluster package imports this one,
+// so its error is identified by its message.
+func isUnsupportedCommand(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "command not supported by node")
+}
+
+// handleQueue waits for the queued write with the sequence number given by
+// the seq parameter to be committed. If the write was not queued by this
+// node, and this node is not the leader, the client is redirected to the
+// leader.
+func (s *Service) handleQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if !s.CheckRequestPerm(r, PermExecute) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout, err := timeoutParam(r, defaulTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad sequence number", http.StatusBadRequest)
+		return
+	}
+
+	resp := NewResponse()
+	resp.Results = nil
+	resp.SequenceNumber = seq
+	if err := s.store.WaitForQueued(seq, timeout); err == store.ErrNotLeader {
+		leaderAPIAddr := s.LeaderAPIAddr()
+		if leaderAPIAddr == "" {
+			stats.Add(numLeaderNotFound, 1)
+			http.Error(w, ErrLeaderNotFound.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		loc := s.FormRedirect(r, leaderAPIAddr)
+		http.Redirect(w, r, loc, http.StatusMovedPermanently)
+		return
+	} else if err != nil {
+		resp.Error = err.Error()
 	}
+	resp.end = time.Now()
+	s.writeResponse(w, r, resp)
+}
 
+// executeAndRespond performs the given execute request, forwarding it to the
+// leader if necessary, and writes the response.
+func (s *Service) executeAndRespond(w http.ResponseWriter, r *http.Request, resp *Response,
+	er *command.ExecuteRequest, timeout time.Duration, redirect bool) {
 	results, resultsErr := s.store.Execute(er)
 	if resultsErr != nil && resultsErr == store.ErrNotLeader {
 		if redirect {
@@ -799,11 +1325,24 @@ func (s *Service) handleExecute(w http.ResponseWriter, r *http.Request) {
 			stats.Add(numLeaderNotFound, 1)
 			http.Error(w, ErrLeaderNotFound.Error(), http.StatusServiceUnavailable)
 		}
+		span := s.startForwardSpan(r, er.Request, addr)
 		results, resultsErr = s.cluster.Execute(er, addr, timeout)
+		span.SetError(resultsErr)
+		span.End()
 		stats.Add(numRemoteExecutions, 1)
 		w.Header().Add(ServedByHTTPHeader, addr)
 	}
 
+	rec := s.auditExecuteRecord(er)
+	rec.setResults(results, resultsErr)
+	s.audit(r, rec)
+
+	// A forwarded request's error is received as a message, so errors are
+	// compared by message.
+	if resultsErr != nil && resultsErr.Error() == store.ErrIdempotencyKeyReused.Error() {
+		http.Error(w, resultsErr.Error(), http.StatusUnprocessableEntity)
+		return
+	}
 	if resultsErr != nil {
 		resp.Error = resultsErr.Error()
 	} else {
@@ -817,7 +1356,7 @@ func (s *Service) handleExecute(w http.ResponseWriter, r *http.Request) {
 func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
-	if !s.CheckRequestPerm(r, PermQuery) {
+	if !s.CheckRequestPerm(r, databasePerm(r, PermQuery)) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -847,6 +1386,12 @@ func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	dbTimeout, err := readDBTimeout(r, lvl, s.DBTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Get the query statement(s), and do tx if necessary.
 	queries, err := requestQueries(r)
 	if err != nil {
@@ -856,14 +1401,25 @@ func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
 
 	qr := &command.QueryRequest{
 		Request: &command.Request{
-			Transaction: isTx,
-			Statements:  queries,
+			Transaction:  isTx,
+			Statements:   queries,
+			DbTimeout:    dbTimeout.Nanoseconds(),
+			User:         s.requestUser(r),
+			Database:     databaseName(r),
+			RequestId:    requestID(r),
+			ParentSpanId: requestSpan(r).ID().Bytes(),
 		},
 		Timings:   timings,
 		Level:     lvl,
 		Freshness: frsh.Nanoseconds(),
 	}
+	s.queryAndRespond(w, r, resp, qr, timeout, redirect)
+}
 
+// queryAndRespond performs the given query request, forwarding it to the
+// leader if necessary, and writes the response.
+func (s *Service) queryAndRespond(w http.ResponseWriter, r *http.Request, resp *Response,
+	qr *command.QueryRequest, timeout time.Duration, redirect bool) {
 	results, resultsErr := s.store.Query(qr)
 	if resultsErr != nil && resultsErr == store.ErrNotLeader {
 		if redirect {
@@ -886,7 +1442,10 @@ func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
 			stats.Add(numLeaderNotFound, 1)
 			http.Error(w, ErrLeaderNotFound.Error(), http.StatusServiceUnavailable)
 		}
+		span := s.startForwardSpan(r, qr.Request, addr)
 		results, resultsErr = s.cluster.Query(qr, addr, timeout)
+		span.SetError(resultsErr)
+		span.End()
 		stats.Add(numRemoteQueries, 1)
 		w.Header().Add(ServedByHTTPHeader, addr)
 	}
@@ -900,29 +1459,474 @@ func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
 	s.writeResponse(w, r, resp)
 }
 
-// handleExpvar serves registered expvar information over HTTP.
-func (s *Service) handleExpvar(w http.ResponseWriter, r *http.Request) {
+// handleRequest handles requests containing any mix of statements. If every
+// statement is read-only, the request is performed as a query. Otherwise it
+// is performed as an execute, which returns the rows read by any read-only
+// statements.
+func (s *Service) handleRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	if !s.CheckRequestPerm(r, PermStatus) {
-		w.WriteHeader(http.StatusUnauthorized)
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	fmt.Fprintf(w, "{\n")
-	first := true
-	expvar.Do(func(kv expvar.KeyValue) {
-		if !first {
-			fmt.Fprintf(w, ",\n")
-		}
-		first = false
-		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
-	})
-	fmt.Fprintf(w, "\n}\n")
-}
+	resp := NewResponse()
 
-// handlePprof serves pprof information over HTTP.
-func (s *Service) handlePprof(w http.ResponseWriter, r *http.Request) {
-	if !s.CheckRequestPerm(r, PermStatus) {
+	timeout, isTx, timings, redirect, err := reqParams(r, defaulTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lvl, err := level(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	frsh, err := freshness(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	stmts, err := ParseRequest(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &command.Request{
+		Transaction:  isTx,
+		Statements:   stmts,
+		User:         s.requestUser(r),
+		Database:     databaseName(r),
+		RequestId:    requestID(r),
+		ParentSpanId: requestSpan(r).ID().Bytes(),
+	}
+
+	readOnly, err := s.store.ReadOnly(req)
+	if err != nil {
+		if err == store.ErrDatabaseNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if readOnly {
+		if !s.CheckRequestPerm(r, databasePerm(r, PermQuery)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		dbTimeout, err := readDBTimeout(r, lvl, s.DBTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.DbTimeout = dbTimeout.Nanoseconds()
+		stats.Add(numQueries, 1)
+		s.queryAndRespond(w, r, resp, &command.QueryRequest{
+			Request:   req,
+			Timings:   timings,
+			Level:     lvl,
+			Freshness: frsh.Nanoseconds(),
+		}, timeout, redirect)
+		return
+	}
+
+	if !s.CheckRequestPerm(r, databasePerm(r, PermExecute)) {
+		s.audit(r, &auditRecord{Event: auditExecute, Error: errUnauthorized})
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if hasDBTimeout(r) {
+		http.Error(w, ErrDBTimeoutNotAllowed.Error(), http.StatusBadRequest)
+		return
+	}
+	stats.Add(numExecutions, 1)
+	req.ReadRows = true
+	s.executeAndRespond(w, r, resp, &command.ExecuteRequest{
+		Request:        req,
+		Timings:        timings,
+		IdempotencyKey: r.Header.Get(IdempotencyKeyHTTPHeader),
+	}, timeout, redirect)
+}
+
+// handleSchema returns the schema of the database, as structured JSON.
+func (s *Service) handleSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if !s.CheckRequestPerm(r, databasePerm(r, PermQuery)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := struct {
+		*sql.Schema
+		Error string `json:"error,omitempty"`
+	}{}
+	var err error
+	resp.Schema, err = s.store.Schema(databaseName(r))
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	pretty, _ := isPretty(r)
+	var b []byte
+	if pretty {
+		b, err = json.MarshalIndent(resp, "", "    ")
+	} else {
+		b, err = json.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleVerify handles requests to verify that every node holds the same
+// data as the leader.
+func (s *Service) handleVerify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if !s.CheckRequestPerm(r, PermStatus) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	t, err := timeout(r, defaulTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.verify(t)
+	if err == store.ErrNotLeader {
+		leaderAPIAddr := s.LeaderAPIAddr()
+		if leaderAPIAddr == "" {
+			stats.Add(numLeaderNotFound, 1)
+			http.Error(w, ErrLeaderNotFound.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		redirect := s.FormRedirect(r, leaderAPIAddr)
+		http.Redirect(w, r, redirect, http.StatusMovedPermanently)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pretty, _ := isPretty(r)
+	var b []byte
+	if pretty {
+		b, err = json.MarshalIndent(result, "", "    ")
+	} else {
+		b, err = json.Marshal(result)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleMigrations handles requests to apply schema migrations, and to list
+// the migrations already applied.
+func (s *Service) handleMigrations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	var resp interface{}
+	switch r.Method {
+	case "GET":
+		if !s.CheckRequestPerm(r, databasePerm(r, PermQuery)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		status := struct {
+			Migrations []*store.Migration `json:"migrations"`
+			Error      string             `json:"error,omitempty"`
+		}{}
+		migrations, err := s.store.Migrations(databaseName(r))
+		if err != nil {
+			status.Error = err.Error()
+		}
+		status.Migrations = migrations
+		if status.Migrations == nil {
+			status.Migrations = []*store.Migration{}
+		}
+		resp = status
+	case "POST":
+		if !s.CheckRequestPerm(r, databasePerm(r, PermExecute)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		var migrations []*command.Migration
+		if err := json.Unmarshal(b, &migrations); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result := struct {
+			Applied []*store.Migration `json:"applied"`
+			Error   string             `json:"error,omitempty"`
+		}{}
+		applied, err := s.store.Migrate(&command.MigrateRequest{
+			Migrations: migrations,
+			Database:   databaseName(r),
+		})
+		if err == store.ErrNotLeader {
+			leaderAPIAddr := s.LeaderAPIAddr()
+			if leaderAPIAddr == "" {
+				stats.Add(numLeaderNotFound, 1)
+				http.Error(w, ErrLeaderNotFound.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			redirect := s.FormRedirect(r, leaderAPIAddr)
+			http.Redirect(w, r, redirect, http.StatusMovedPermanently)
+			return
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Applied = applied
+		if result.Applied == nil {
+			result.Applied = []*store.Migration{}
+		}
+		resp = result
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	pretty, _ := isPretty(r)
+	var b []byte
+	var err error
+	if pretty {
+		b, err = json.MarshalIndent(resp, "", "    ")
+	} else {
+		b, err = json.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleDatabases handles requests to list, create, and drop named databases.
+func (s *Service) handleDatabases(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/databases"), "/")
+	if r.Method == "GET" && name == "" {
+		if !s.CheckRequestPerm(r, PermStatus) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		resp := struct {
+			Databases []string `json:"databases"`
+		}{s.store.Databases()}
+		pretty, _ := isPretty(r)
+		var b []byte
+		var err error
+		if pretty {
+			b, err = json.MarshalIndent(resp, "", "    ")
+		} else {
+			b, err = json.Marshal(resp)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = w.Write(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	if !s.CheckRequestPerm(r, PermDatabases) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var f func(string) error
+	switch r.Method {
+	case "PUT":
+		f = s.store.CreateDatabase
+	case "DELETE":
+		f = s.store.DropDatabase
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !store.ValidDatabaseName(name) || reservedDatabaseNames[name] {
+		http.Error(w, store.ErrInvalidDatabaseName.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := f(name); err != nil {
+		switch err {
+		case store.ErrNotLeader:
+			leaderAPIAddr := s.LeaderAPIAddr()
+			if leaderAPIAddr == "" {
+				stats.Add(numLeaderNotFound, 1)
+				http.Error(w, ErrLeaderNotFound.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			redirect := s.FormRedirect(r, leaderAPIAddr)
+			http.Redirect(w, r, redirect, http.StatusMovedPermanently)
+		case store.ErrDatabaseExists:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case store.ErrDatabaseNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+}
+
+// handleLogLevel returns the log level of every subsystem, or, for a PUT
+// request, first sets the levels given in the body. The level of "default"
+// applies to subsystems whose level has not been set.
+func (s *Service) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	switch r.Method {
+	case "GET":
+		if !s.CheckRequestPerm(r, PermStatus) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	case "PUT":
+		if !s.CheckRequestPerm(r, PermLogLevel) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := map[string]string{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		levels := make(map[string]logging.Level, len(m))
+		for name, l := range m {
+			lvl, err := logging.ParseLevel(l)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			levels[name] = lvl
+		}
+		for name, lvl := range levels {
+			if name == "default" {
+				logging.SetDefaultLevel(lvl)
+			} else {
+				logging.SetLevel(name, lvl)
+			}
+			s.logger.Infof("log level of %s set to %s by %s", name, lvl, s.requestUser(r))
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := struct {
+		Default    logging.Level            `json:"default"`
+		Subsystems map[string]logging.Level `json:"subsystems"`
+	}{logging.DefaultLevel(), logging.Levels()}
+	pretty, _ := isPretty(r)
+	var b []byte
+	var err error
+	if pretty {
+		b, err = json.MarshalIndent(resp, "", "    ")
+	} else {
+		b, err = json.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleExpvar serves registered expvar information over HTTP.
+func (s *Service) handleExpvar(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !s.CheckRequestPerm(r, PermStatus) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// handlePprof serves pprof information over HTTP.
+func (s *Service) handlePprof(w http.ResponseWriter, r *http.Request) {
+	if !s.CheckRequestPerm(r, PermStatus) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -953,8 +1957,9 @@ func (s *Service) FormRedirect(r *http.Request, url string) string {
 	return fmt.Sprintf("%s%s%s", url, r.URL.Path, rq)
 }
 
-// CheckRequestPerm returns true if authentication is enabled and the user contained
-// in the BasicAuth request has either PermAll, or the given perm.
+// CheckRequestPerm returns true if authentication is enabled and the user making
+// the request has either PermAll, or the given perm. The user is the one contained
+// in the BasicAuth request or, failing that, identified by the client certificate.
 func (s *Service) CheckRequestPerm(r *http.Request, perm string) (b bool) {
 	defer func() {
 		if b {
@@ -967,8 +1972,8 @@ func (s *Service) CheckRequestPerm(r *http.Request, perm string) (b bool) {
 		return true
 	}
 
-	username, _, ok := r.BasicAuth()
-	if !ok {
+	username := s.requestUser(r)
+	if username == "" {
 		return false
 	}
 	return s.credentialStore.HasAnyPerm(username, perm, PermAll)
@@ -992,6 +1997,7 @@ func (s *Service) LeaderAPIAddr() string {
 type checkNodesResponse struct {
 	apiAddr   string
 	reachable bool
+	version   string
 	time      time.Duration
 	error     string
 }
@@ -1024,6 +2030,7 @@ func (s *Service) checkNodes(nodes []*store.Server, timeout time.Duration) (map[
 			resp[id].reachable = true
 			resp[id].apiAddr = apiAddr
 			resp[id].time = time.Since(start)
+			resp[id].version = s.cluster.NodeBuildVersion(raftAddr)
 		}(n.ID, n.Addr)
 	}
 	wg.Wait()
@@ -1031,6 +2038,121 @@ func (s *Service) checkNodes(nodes []*store.Server, timeout time.Duration) (map[
 	return resp, nil
 }
 
+// verifyNode is the outcome of checking the checksum of a single node.
+type verifyNode struct {
+	Addr     string `json:"addr"`
+	Checksum string `json:"checksum,omitempty"`
+	Match    bool   `json:"match"`
+	Error    string `json:"error,omitempty"`
+}
+
+// verifyResult is the outcome of checking the checksum of every node
+// against that of the leader.
+type verifyResult struct {
+	Index    uint64                 `json:"index"`
+	Checksum string                 `json:"checksum"`
+	Nodes    map[string]*verifyNode `json:"nodes"`
+	Diverged []string               `json:"diverged"` // IDs of nodes whose checksum differs.
+	Time     time.Time              `json:"time"`
+}
+
+// verify has every node compute the checksum of its databases at the same
+// index, and compares each to the checksum computed by this node, which
+// must be the leader. Nodes which cannot be reached are reported, but are
+// not considered to have diverged.
+func (s *Service) verify(timeout time.Duration) (*verifyResult, error) {
+	idx, sum, err := s.store.Checksum()
+	if err != nil {
+		return nil, err
+	}
+	leaderAddr, err := s.store.LeaderAddr()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := s.store.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	stats.Add(numVerifications, 1)
+
+	result := &verifyResult{
+		Index:    idx,
+		Checksum: sum,
+		Nodes:    make(map[string]*verifyNode, len(nodes)),
+		Diverged: []string{},
+		Time:     time.Now(),
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, n := range nodes {
+		if n.Addr == leaderAddr {
+			result.Nodes[n.ID] = &verifyNode{Addr: n.Addr, Checksum: sum, Match: true}
+			continue
+		}
+		wg.Add(1)
+		go func(id, raftAddr string) {
+			defer wg.Done()
+			vn := &verifyNode{Addr: raftAddr}
+			nodeSum, err := s.cluster.Checksum(idx, raftAddr, timeout)
+			if err != nil {
+				vn.Error = err.Error()
+			} else {
+				vn.Checksum = nodeSum
+				vn.Match = nodeSum == sum
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Nodes[id] = vn
+			if err == nil && !vn.Match {
+				result.Diverged = append(result.Diverged, id)
+			}
+		}(n.ID, n.Addr)
+	}
+	wg.Wait()
+
+	sort.Strings(result.Diverged)
+	if len(result.Diverged) > 0 {
+		stats.Add(numVerifyDiverged, 1)
+	}
+	return result, nil
+}
+
+// runVerify periodically verifies, while this node is the leader, that
+// every node holds the same data, logging any node which does not.
+func (s *Service) runVerify(done <-chan struct{}) {
+	ticker := time.NewTicker(s.VerifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			result, err := s.verify(defaulTimeout)
+			if err == store.ErrNotLeader {
+				continue
+			}
+			if err != nil {
+				s.logger.Errorf("failed to verify checksums: %s", err.Error())
+				continue
+			}
+			for _, id := range result.Diverged {
+				s.logger.Errorf("node %s has diverged from the leader at index %d, checksum %s, expected %s",
+					id, result.Index, result.Nodes[id].Checksum, result.Checksum)
+			}
+			for id, n := range result.Nodes {
+				if n.Error != "" {
+					s.logger.Warnf("failed to verify checksum of node %s: %s", id, n.Error)
+				}
+			}
+
+			s.verifyMu.Lock()
+			s.lastVerify = result
+			s.verifyMu.Unlock()
+		}
+	}
+}
+
 // addBuildVersion adds the build version to the HTTP response.
 func (s *Service) addBuildVersion(w http.ResponseWriter) {
 	// Add version header to every response, if available.
@@ -1041,6 +2163,76 @@ func (s *Service) addBuildVersion(w http.ResponseWriter) {
 	w.Header().Add(VersionHTTPHeader, version)
 }
 
+// requestIDKey is the context key for the ID of a request.
+type requestIDKey struct{}
+
+// requestID returns the ID of the request r.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestSpan returns the span of the request r, or nil if r is not traced.
+func requestSpan(r *http.Request) *tracing.Span {
+	return tracing.FromContext(r.Context())
+}
+
+// validRequestID returns whether id is acceptable as a request ID supplied by
+// a client. It must be printable ASCII, without spaces, so that it can be
+// logged safely.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// startForwardSpan starts a span for forwarding req, part of the request r,
+// to the leader at addr. req is then traced under that span.
+func (s *Service) startForwardSpan(r *http.Request, req *command.Request, addr string) *tracing.Span {
+	s.logger.Debugf("request %s: forwarding to leader at %s", requestID(r), addr)
+	span := requestSpan(r).Child("cluster.forward")
+	span.SetKind(tracing.KindClient)
+	span.SetAttribute("leader", addr)
+	if span != nil {
+		req.ParentSpanId = span.ID().Bytes()
+	}
+	return span
+}
+
+// audit completes rec with the details of the request r, and writes it to
+// the audit log, if enabled.
+func (s *Service) audit(r *http.Request, rec *auditRecord) {
+	if s.auditLog == nil {
+		return
+	}
+	rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	rec.RequestID = requestID(r)
+	rec.User = s.requestUser(r)
+	rec.RemoteAddr = r.RemoteAddr
+	rec.Database = databaseName(r)
+	if err := s.auditLog.Log(rec); err != nil {
+		stats.Add(numAuditLogErrors, 1)
+		s.logger.Errorf("failed to write audit log: %s", err)
+	}
+}
+
+// auditExecuteRecord returns an audit record of the execute request er.
+func (s *Service) auditExecuteRecord(er *command.ExecuteRequest) *auditRecord {
+	if s.auditLog == nil {
+		return &auditRecord{}
+	}
+	return &auditRecord{
+		Event:      auditExecute,
+		Statements: s.auditLog.statements(er.Request),
+	}
+}
+
 // checkCredentials returns if any authentication requirements
 // have been successfully met.
 func (s *Service) checkCredentials(r *http.Request) bool {
@@ -1049,7 +2241,56 @@ func (s *Service) checkCredentials(r *http.Request) bool {
 	}
 
 	username, password, ok := r.BasicAuth()
-	return ok && s.credentialStore.Check(username, password)
+	if ok {
+		return s.credentialStore.Check(username, password)
+	}
+	_, ok = s.certUser(r)
+	return ok
+}
+
+// requestUser returns the user making the request, if known. The user is
+// the one contained in the BasicAuth request if present, otherwise the one
+// identified by the client certificate.
+func (s *Service) requestUser(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	username, _ := s.certUser(r)
+	return username
+}
+
+// certUser returns the user identified by the verified client certificate
+// of the request, if any. The names of the certificate are examined in order
+// of precedence: URI subject alternative names, then email addresses, then
+// DNS names, and finally the subject common name. A certificate whose names
+// identify more than one user in the credential store identifies none, since
+// the user it was issued to cannot be known.
+func (s *Service) certUser(r *http.Request) (string, bool) {
+	if s.credentialStore == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	var names []string
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	names = append(names, cert.EmailAddresses...)
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.Subject.CommonName)
+
+	var user string
+	for _, n := range names {
+		if n == "" || n == user || !s.credentialStore.Exists(n) {
+			continue
+		}
+		if user != "" {
+			s.logger.Warnf("client certificate %s identifies both user %s and user %s, rejecting",
+				cert.Subject, user, n)
+			return "", false
+		}
+		user = n
+	}
+	return user, user != ""
 }
 
 // writeResponse writes the given response to the given writer.
@@ -1058,10 +2299,14 @@ func (s *Service) writeResponse(w http.ResponseWriter, r *http.Request, j *Respo
 	var err error
 	pretty, _ := isPretty(r)
 	timings, _ := isTimings(r)
+	int64AsString, _ := isInt64AsString(r)
 
 	if timings {
 		j.SetTime()
 	}
+	if j.Results != nil {
+		j.Results.encoder.Int64AsString = int64AsString
+	}
 
 	if pretty {
 		b, err = json.MarshalIndent(j, "", "    ")
@@ -1075,7 +2320,7 @@ func (s *Service) writeResponse(w http.ResponseWriter, r *http.Request, j *Respo
 	}
 	_, err = w.Write(b)
 	if err != nil {
-		s.logger.Println("writing response failed:", err.Error())
+		s.logger.Warnf("writing response failed: %s", err.Error())
 	}
 }
 
@@ -1101,33 +2346,45 @@ func requestQueries(r *http.Request) ([]*command.Statement, error) {
 	return ParseRequest(b)
 }
 
-// createTLSConfig returns a TLS config from the given cert and key.
-func createTLSConfig(certFile, keyFile, caCertFile string, tls1011 bool) (*tls.Config, error) {
+// createTLSConfig returns a TLS config for the service. The service presents
+// the certificate in CertFile, and, when client certificate authentication
+// is enabled, requires clients to present a certificate signed by the root
+// certificate in CACertFile. Each file is reloaded when it changes.
+func (s *Service) createTLSConfig() (*tls.Config, error) {
 	var err error
 
 	var minTls = uint16(tls.VersionTLS12)
-	if tls1011 {
+	if s.TLS1011 {
 		minTls = tls.VersionTLS10
 	}
 
-	config := &tls.Config{
-		NextProtos: []string{"h2", "http/1.1"},
-		MinVersion: minTls,
-	}
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	s.certs, err = rtls.NewCertReloader(s.CertFile, s.KeyFile)
 	if err != nil {
 		return nil, err
 	}
-	if caCertFile != "" {
-		asn1Data, err := ioutil.ReadFile(caCertFile)
+	config := &tls.Config{
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     minTls,
+		GetCertificate: s.certs.GetCertificate,
+	}
+	if s.CACertFile != "" {
+		s.caCerts, err = rtls.NewCAReloader(s.CACertFile)
 		if err != nil {
 			return nil, err
 		}
-		config.RootCAs = x509.NewCertPool()
-		ok := config.RootCAs.AppendCertsFromPEM([]byte(asn1Data))
-		if !ok {
-			return nil, fmt.Errorf("failed to parse root certificate(s) in %q", caCertFile)
+		config.RootCAs = s.caCerts.Pool()
+	}
+	if s.ClientCertAuth {
+		if s.caCerts == nil {
+			return nil, fmt.Errorf("client certificate authentication requires a root certificate")
+		}
+		config.ClientCAs = s.caCerts.Pool()
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		// Pick up any change to the root certificate on each handshake.
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := config.Clone()
+			c.ClientCAs = s.caCerts.Pool()
+			return c, nil
 		}
 	}
 	return config, nil
@@ -1184,6 +2441,41 @@ func timeoutParam(req *http.Request, def time.Duration) (time.Duration, error) {
 	return d, nil
 }
 
+// dbTimeoutParam returns the value, if any, set for db_timeout. This is
+// the time statements may run before being interrupted. If not set, it
+// returns the value passed in as a default.
+func dbTimeoutParam(req *http.Request, def time.Duration) (time.Duration, error) {
+	q := req.URL.Query()
+	timeout := strings.TrimSpace(q.Get("db_timeout"))
+	if timeout == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, err
+	}
+	return d, nil
+}
+
+// readDBTimeout returns the timeout for a read at the given consistency
+// level. A read at strong consistency is applied by every node through the
+// Raft log, so the default timeout does not apply, and setting db_timeout is
+// an error.
+func readDBTimeout(req *http.Request, lvl command.QueryRequest_Level, def time.Duration) (time.Duration, error) {
+	if lvl != command.QueryRequest_QUERY_REQUEST_LEVEL_STRONG {
+		return dbTimeoutParam(req, def)
+	}
+	if hasDBTimeout(req) {
+		return 0, ErrDBTimeoutNotAllowed
+	}
+	return 0, nil
+}
+
+// hasDBTimeout returns whether db_timeout is set on the request.
+func hasDBTimeout(req *http.Request) bool {
+	return strings.TrimSpace(req.URL.Query().Get("db_timeout")) != ""
+}
+
 // isTx returns whether the HTTP request is requesting a transaction.
 func isTx(req *http.Request) (bool, error) {
 	return queryParam(req, "transaction")
@@ -1221,11 +2513,80 @@ func nonVoters(req *http.Request) (bool, error) {
 	return queryParam(req, "nonvoters")
 }
 
+// isQueue returns whether a write should be queued, rather than waiting
+// for it to be committed.
+func isQueue(req *http.Request) (bool, error) {
+	return queryParam(req, "queue")
+}
+
 // isTimings returns whether timings are requested.
 func isTimings(req *http.Request) (bool, error) {
 	return queryParam(req, "timings")
 }
 
+// reservedDatabaseNames are the endpoints under /db, which may not be used
+// as the names of named databases.
+var reservedDatabaseNames = map[string]bool{
+	"execute":    true,
+	"query":      true,
+	"request":    true,
+	"explain":    true,
+	"statements": true,
+	"queue":      true,
+	"backup":     true,
+	"load":       true,
+	"migrations": true,
+	"schema":     true,
+}
+
+// namedDatabaseEndpoints are the endpoints which may be addressed to a named
+// database.
+var namedDatabaseEndpoints = map[string]bool{
+	"execute":    true,
+	"query":      true,
+	"request":    true,
+	"explain":    true,
+	"migrations": true,
+	"schema":     true,
+}
+
+// parseDatabasePath parses a path of the form /db/<name>/<endpoint>, returning
+// the database name and the path of the endpoint for the default database. Any
+// other path is returned unchanged, with an empty database name.
+func parseDatabasePath(path string) (string, string) {
+	if !strings.HasPrefix(path, "/db/") {
+		return "", path
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/db/"), "/", 2)
+	if len(parts) != 2 || reservedDatabaseNames[parts[0]] || !namedDatabaseEndpoints[strings.TrimSuffix(parts[1], "/")] {
+		return "", path
+	}
+	return parts[0], "/db/" + parts[1]
+}
+
+// databaseName returns the name of the database addressed by the request, or
+// the empty string for the default database.
+func databaseName(req *http.Request) string {
+	name, _ := parseDatabasePath(req.URL.Path)
+	return name
+}
+
+// databasePerm returns the permission needed to perform an action, requiring
+// perm, against the database addressed by the request. Access to a named
+// database requires a permission of the form <perm>:<name>.
+func databasePerm(req *http.Request, perm string) string {
+	if name := databaseName(req); name != "" {
+		return perm + ":" + name
+	}
+	return perm
+}
+
+// isInt64AsString returns whether 64-bit integers in results should be
+// encoded as JSON strings.
+func isInt64AsString(req *http.Request) (bool, error) {
+	return queryParam(req, "int64_as_string")
+}
+
 // timeout returns the timeout included in the query, or the given default
 func timeout(req *http.Request, d time.Duration) (time.Duration, error) {
 	q := req.URL.Query()
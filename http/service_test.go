@@ -1,20 +1,35 @@
 package http
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/rqlite/rqlite/auth"
 	"github.com/rqlite/rqlite/command"
+	sql "github.com/rqlite/rqlite/db"
+	"github.com/rqlite/rqlite/logging"
 	"github.com/rqlite/rqlite/store"
 	"github.com/rqlite/rqlite/testdata/x509"
+	"github.com/rqlite/rqlite/tracing"
 
 	"golang.org/x/net/http2"
 )
@@ -411,6 +426,7 @@ func Test_401Routes_NoBasicAuth(t *testing.T) {
 		"/join",
 		"/delete",
 		"/status",
+		"/loglevel",
 		"/nodes",
 		"/debug/vars",
 		"/debug/pprof/cmdline",
@@ -450,6 +466,7 @@ func Test_401Routes_BasicAuthBadPassword(t *testing.T) {
 		"/db/load",
 		"/join",
 		"/status",
+		"/loglevel",
 		"/nodes",
 		"/debug/vars",
 		"/debug/pprof/cmdline",
@@ -472,6 +489,126 @@ func Test_401Routes_BasicAuthBadPassword(t *testing.T) {
 	}
 }
 
+func Test_AuditLog(t *testing.T) {
+	dir := mustTempDir()
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	m := &MockStore{}
+	m.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		return []*command.ExecuteResult{{LastInsertId: 1, RowsAffected: 1, RaftIndex: 7}}, nil
+	}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	s.AuditLogPath = path
+	s.AuditRedactParams = true
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	if _, err := http.Post(host+"/db/execute", "application/json",
+		strings.NewReader(`[["INSERT INTO foo(name) VALUES(?)", "fiona"]]`)); err != nil {
+		t.Fatalf("failed to make execute request: %s", err)
+	}
+	if _, err := http.Post(host+"/join", "application/json",
+		strings.NewReader(`{"id": "2", "addr": "127.0.0.1:4002"}`)); err != nil {
+		t.Fatalf("failed to make join request: %s", err)
+	}
+	if _, err := http.Get(host + "/db/query?q=SELECT%20*%20FROM%20foo"); err != nil {
+		t.Fatalf("failed to make query request: %s", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrong number of audit records, exp 2, got %d: %s", len(lines), b)
+	}
+
+	var rec auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("failed to unmarshal audit record: %s", err)
+	}
+	if rec.Event != auditExecute || rec.RaftIndex != 7 || rec.RemoteAddr == "" || rec.RequestID == "" {
+		t.Fatalf("wrong execute audit record: %s", lines[0])
+	}
+	if len(rec.Statements) != 1 || rec.Statements[0].SQL != "INSERT INTO foo(name) VALUES(?)" {
+		t.Fatalf("wrong statements in audit record: %s", lines[0])
+	}
+	if strings.Contains(lines[0], "fiona") || rec.Statements[0].Parameters[0] != redacted {
+		t.Fatalf("parameters not redacted in audit record: %s", lines[0])
+	}
+	if len(rec.Results) != 1 || rec.Results[0].RowsAffected != 1 {
+		t.Fatalf("wrong results in audit record: %s", lines[0])
+	}
+
+	rec = auditRecord{}
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatalf("failed to unmarshal audit record: %s", err)
+	}
+	if rec.Event != auditJoin || rec.NodeID != "2" || rec.NodeAddr != "127.0.0.1:4002" || rec.Error != "" {
+		t.Fatalf("wrong join audit record: %s", lines[1])
+	}
+}
+
+func Test_LogLevel(t *testing.T) {
+	m := &MockStore{}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+	defer logging.SetLevel("http", logging.LevelInfo)
+
+	resp, err := http.Get(host + "/loglevel")
+	if err != nil {
+		t.Fatalf("failed to get log levels: %s", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(b), `"http":"info"`) {
+		t.Fatalf("http log level not reported: %s", b)
+	}
+
+	req, err := http.NewRequest("PUT", host+"/loglevel", strings.NewReader(`{"http": "debug"}`))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to set log levels: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to set log levels, got status %d", resp.StatusCode)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(b), `"http":"debug"`) {
+		t.Fatalf("http log level not set: %s", b)
+	}
+	if exp, got := logging.LevelDebug, logging.Levels()["http"]; exp != got {
+		t.Fatalf("wrong http log level, exp %s, got %s", exp, got)
+	}
+
+	req, err = http.NewRequest("PUT", host+"/loglevel", strings.NewReader(`{"http": "loud"}`))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid log level accepted, got status %d", resp.StatusCode)
+	}
+}
+
 func Test_401Routes_BasicAuthBadPerm(t *testing.T) {
 	c := &mockCredentialStore{CheckOK: true, HasPermOK: false}
 
@@ -495,6 +632,7 @@ func Test_401Routes_BasicAuthBadPerm(t *testing.T) {
 		"/db/load",
 		"/join",
 		"/status",
+		"/loglevel",
 		"/debug/vars",
 		"/debug/pprof/cmdline",
 		"/debug/pprof/profile",
@@ -656,9 +794,13 @@ func Test_FormRedirectHTTPS(t *testing.T) {
 func Test_Nodes(t *testing.T) {
 	m := &MockStore{
 		leaderAddr: "foo:1234",
+		nodes: []*store.Server{
+			{ID: "1", Addr: "foo:1234", Suffrage: "Voter"},
+		},
 	}
 	c := &mockClusterService{
-		apiAddr: "https://bar:5678",
+		apiAddr:      "https://bar:5678",
+		buildVersion: "v1.2.3",
 	}
 	s := New("127.0.0.1:0", m, c, nil)
 	if err := s.Start(); err != nil {
@@ -675,6 +817,14 @@ func Test_Nodes(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("failed to get expected StatusOK for nodes, got %d", resp.StatusCode)
 	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read nodes response: %s", err)
+	}
+	exp := `{"1":{"api_addr":"https://bar:5678","addr":"foo:1234","reachable":true,"leader":true,"version":"v1.2.3"`
+	if !strings.HasPrefix(string(b), exp) {
+		t.Fatalf("wrong nodes response, exp prefix %s, got %s", exp, b)
+	}
 }
 
 func Test_ForwardingRedirectQuery(t *testing.T) {
@@ -797,6 +947,203 @@ func Test_ForwardingRedirectExecute(t *testing.T) {
 	}
 }
 
+func Test_ForwardingRedirectQueuedExecute(t *testing.T) {
+	m := &MockStore{
+		leaderAddr: "foo:1234",
+	}
+	m.queuedFn = func(er *command.ExecuteRequest) (uint64, error) {
+		return 0, store.ErrNotLeader
+	}
+	m.waitFn = func(seq uint64, timeout time.Duration) error {
+		return store.ErrNotLeader
+	}
+
+	var forwardedWait bool
+	c := &mockClusterService{
+		apiAddr: "https://bar:5678",
+	}
+	c.queuedFn = func(er *command.ExecuteRequest, wait bool, addr string, timeout time.Duration) (uint64, error) {
+		if addr != "foo:1234" {
+			t.Fatalf("write forwarded to wrong node: %s", addr)
+		}
+		forwardedWait = wait
+		if wait {
+			return 7, store.ErrQueuedWriteDropped
+		}
+		return 7, nil
+	}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	for _, tt := range []struct {
+		url  string
+		wait bool
+		exp  string
+	}{
+		{url: "/db/execute?queue", wait: false, exp: `{"sequence_number":7}`},
+		{url: "/db/execute?queue&wait", wait: true, exp: `{"sequence_number":7,"error":"queued write dropped"}`},
+	} {
+		resp, err := client.Post(host+tt.url, "application/json", strings.NewReader(`["Some SQL"]`))
+		if err != nil {
+			t.Fatalf("failed to make queued execute request: %s", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to get expected StatusOK for %s, got %d", tt.url, resp.StatusCode)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response: %s", err)
+		}
+		if got := string(body); tt.exp != got {
+			t.Fatalf("incorrect response for %s, exp %s, got %s", tt.url, tt.exp, got)
+		}
+		if forwardedWait != tt.wait {
+			t.Fatalf("incorrect wait forwarded for %s", tt.url)
+		}
+	}
+
+	c.queuedFn = func(er *command.ExecuteRequest, wait bool, addr string, timeout time.Duration) (uint64, error) {
+		return 0, store.ErrQueueFull
+	}
+	resp, err := client.Post(host+"/db/execute?queue", "application/json", strings.NewReader(`["Some SQL"]`))
+	if err != nil {
+		t.Fatalf("failed to make queued execute request: %s", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("failed to get expected StatusServiceUnavailable for full queue, got %d", resp.StatusCode)
+	}
+
+	// A leader which predates forwarded queued writes, or a request to be
+	// redirected, results in a redirect.
+	c.queuedFn = func(er *command.ExecuteRequest, wait bool, addr string, timeout time.Duration) (uint64, error) {
+		return 0, fmt.Errorf("command not supported by node: node %s does not support COMMAND_TYPE_EXECUTE_QUEUED", addr)
+	}
+	for _, url := range []string{"/db/execute?queue", "/db/execute?queue&redirect"} {
+		resp, err := client.Post(host+url, "application/json", strings.NewReader(`["Some SQL"]`))
+		if err != nil {
+			t.Fatalf("failed to make queued execute request: %s", err)
+		}
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Fatalf("failed to get expected StatusMovedPermanently for %s, got %d", url, resp.StatusCode)
+		}
+	}
+
+	// A sequence number not issued by a follower is looked up on the leader.
+	resp, err = client.Get(host + "/db/queue?seq=7")
+	if err != nil {
+		t.Fatalf("failed to make queue request: %s", err)
+	}
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("failed to get expected StatusMovedPermanently for queue, got %d", resp.StatusCode)
+	}
+}
+
+func Test_RequestID(t *testing.T) {
+	tempDir := mustTempDir()
+	defer os.RemoveAll(tempDir)
+	tracePath := filepath.Join(tempDir, "traces.json")
+
+	m := &MockStore{
+		leaderAddr: "foo:1234",
+	}
+	m.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		return nil, store.ErrNotLeader
+	}
+
+	var forwarded *command.Request
+	c := &mockClusterService{}
+	c.executeFn = func(er *command.ExecuteRequest, addr string, timeout time.Duration) ([]*command.ExecuteResult, error) {
+		forwarded = er.Request
+		return []*command.ExecuteResult{}, nil
+	}
+
+	e, err := tracing.NewFileExporter(tracePath)
+	if err != nil {
+		t.Fatalf("failed to create trace exporter: %s", err)
+	}
+	tracer := tracing.NewTracer("rqlite", "node1", e)
+
+	s := New("127.0.0.1:0", m, c, nil)
+	s.Tracer = tracer
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	execute := func(id string) *http.Response {
+		req, err := http.NewRequest("POST", host+"/db/execute", strings.NewReader(`["Some SQL"]`))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		if id != "" {
+			req.Header.Set(RequestIDHTTPHeader, id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make execute request: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to get expected StatusOK for execute, got %d", resp.StatusCode)
+		}
+		return resp
+	}
+
+	// A request ID supplied by the client is returned, and forwarded.
+	resp := execute("my-request-1")
+	if exp, got := "my-request-1", resp.Header.Get(RequestIDHTTPHeader); exp != got {
+		t.Fatalf("wrong request ID returned, exp %s, got %s", exp, got)
+	}
+	if forwarded == nil || forwarded.RequestId != "my-request-1" {
+		t.Fatalf("request ID not forwarded: %v", forwarded)
+	}
+	if len(forwarded.ParentSpanId) != 8 {
+		t.Fatalf("parent span not forwarded: %v", forwarded.ParentSpanId)
+	}
+
+	// Otherwise a request ID is generated.
+	resp = execute("")
+	id := resp.Header.Get(RequestIDHTTPHeader)
+	if len(id) != 32 {
+		t.Fatalf("wrong request ID generated: %s", id)
+	}
+	if forwarded.RequestId != id {
+		t.Fatalf("generated request ID not forwarded, exp %s, got %s", id, forwarded.RequestId)
+	}
+
+	// Invalid request IDs are replaced.
+	resp = execute("bad id")
+	if id := resp.Header.Get(RequestIDHTTPHeader); id == "bad id" || len(id) != 32 {
+		t.Fatalf("invalid request ID not replaced: %s", id)
+	}
+
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("failed to close tracer: %s", err)
+	}
+	b, err := ioutil.ReadFile(tracePath)
+	if err != nil {
+		t.Fatalf("failed to read trace file: %s", err)
+	}
+	traceID := tracing.TraceIDFromRequestID("my-request-1").String()
+	for _, exp := range []string{`"name":"POST /db/execute"`, `"name":"cluster.forward"`, traceID} {
+		if !strings.Contains(string(b), exp) {
+			t.Fatalf("trace file does not contain %s: %s", exp, b)
+		}
+	}
+}
+
 func Test_TLSServce(t *testing.T) {
 	m := &MockStore{}
 	c := &mockClusterService{}
@@ -846,6 +1193,116 @@ func Test_TLSServce(t *testing.T) {
 	}
 }
 
+func Test_ClientCertAuth(t *testing.T) {
+	m := &MockStore{}
+	m.queryFn = func(qr *command.QueryRequest) ([]*command.QueryRows, error) {
+		return []*command.QueryRows{}, nil
+	}
+	c := &mockClusterService{}
+	cs := auth.NewCredentialsStore()
+	if err := cs.Load(strings.NewReader(`[
+		{"username": "reporting", "perms": ["query"]},
+		{"username": "spiffe://example.org/ingest", "perms": ["execute"]},
+		{"username": "admin", "password": "admin", "perms": ["all"]}
+	]`)); err != nil {
+		t.Fatalf("failed to load credentials: %s", err)
+	}
+
+	tempDir := mustTempDir()
+	defer os.RemoveAll(tempDir)
+	ca, caKey, caFile := mustCreateCA(tempDir)
+	serverCert := mustCreateCert(ca, caKey, &stdx509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth},
+	})
+
+	s := New("127.0.0.1:0", m, c, cs)
+	s.CertFile, s.KeyFile = mustWriteCert(tempDir, serverCert)
+	s.CACertFile = caFile
+	s.ClientCertAuth = true
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service: %s", err)
+	}
+	defer s.Close()
+	host := fmt.Sprintf("https://%s", s.Addr().String())
+
+	do := func(cert *tls.Certificate, path string, basicAuth bool) (int, error) {
+		config := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		req, err := http.NewRequest("GET", host+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		if basicAuth {
+			req.SetBasicAuth("admin", "admin")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	clientCert := func(tmpl *stdx509.Certificate) *tls.Certificate {
+		tmpl.ExtKeyUsage = []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageClientAuth}
+		cert := mustCreateCert(ca, caKey, tmpl)
+		return &cert
+	}
+
+	// Clients without a certificate cannot connect.
+	if _, err := do(nil, "/db/query?q=SELECT%201", true); err == nil {
+		t.Fatalf("connected without client certificate")
+	}
+
+	reporting := clientCert(&stdx509.Certificate{Subject: pkix.Name{CommonName: "reporting"}})
+	ingest := clientCert(&stdx509.Certificate{
+		Subject: pkix.Name{CommonName: "ingest-7"},
+		URIs:    []*url.URL{mustURLParse("spiffe://example.org/ingest")},
+	})
+	unknown := clientCert(&stdx509.Certificate{Subject: pkix.Name{CommonName: "unknown"}})
+	ambiguous := clientCert(&stdx509.Certificate{
+		Subject: pkix.Name{CommonName: "reporting"},
+		URIs:    []*url.URL{mustURLParse("spiffe://example.org/ingest")},
+	})
+	same := clientCert(&stdx509.Certificate{
+		Subject:  pkix.Name{CommonName: "reporting"},
+		DNSNames: []string{"reporting"},
+	})
+
+	for i, tt := range []struct {
+		cert      *tls.Certificate
+		path      string
+		basicAuth bool
+		exp       int
+	}{
+		{reporting, "/db/query?q=SELECT%201", false, http.StatusOK},
+		{reporting, "/db/execute?q=SELECT%201", false, http.StatusUnauthorized},
+		{ingest, "/db/query?q=SELECT%201", false, http.StatusUnauthorized},
+		{unknown, "/db/query?q=SELECT%201", false, http.StatusUnauthorized},
+		{unknown, "/db/query?q=SELECT%201", true, http.StatusOK},
+		{ambiguous, "/db/query?q=SELECT%201", false, http.StatusUnauthorized},
+		{ambiguous, "/db/execute?q=SELECT%201", false, http.StatusUnauthorized},
+		{same, "/db/query?q=SELECT%201", false, http.StatusOK},
+	} {
+		got, err := do(tt.cert, tt.path, tt.basicAuth)
+		if err != nil {
+			t.Fatalf("test %d failed to make request: %s", i, err)
+		}
+		if got != tt.exp {
+			t.Fatalf("test %d received wrong status for %s, exp %d, got %d", i, tt.path, tt.exp, got)
+		}
+	}
+	if user, _ := s.certUser(&http.Request{TLS: &tls.ConnectionState{
+		VerifiedChains: [][]*stdx509.Certificate{{ingest.Leaf}},
+	}}); user != "spiffe://example.org/ingest" {
+		t.Fatalf("wrong user for certificate with URI SAN, got %q", user)
+	}
+}
+
 func Test_timeoutQueryParam(t *testing.T) {
 	var req http.Request
 
@@ -889,45 +1346,886 @@ func Test_timeoutQueryParam(t *testing.T) {
 	}
 }
 
-type MockStore struct {
-	executeFn  func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error)
-	queryFn    func(qr *command.QueryRequest) ([]*command.QueryRows, error)
-	backupFn   func(leader bool, f store.BackupFormat, dst io.Writer) error
-	leaderAddr string
-}
-
-func (m *MockStore) Execute(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
-	if m.executeFn != nil {
-		return m.executeFn(er)
+func Test_DBTimeoutPropagated(t *testing.T) {
+	m := &MockStore{}
+	var got int64
+	m.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		got = er.Request.DbTimeout
+		return nil, nil
 	}
-	return nil, nil
-}
+	m.queryFn = func(qr *command.QueryRequest) ([]*command.QueryRows, error) {
+		got = qr.Request.DbTimeout
+		return nil, nil
+	}
+	c := &mockClusterService{}
 
-func (m *MockStore) Query(qr *command.QueryRequest) ([]*command.QueryRows, error) {
-	if m.queryFn != nil {
-		return m.queryFn(qr)
+	s := New("127.0.0.1:0", m, c, nil)
+	s.DBTimeout = 5 * time.Second
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
 	}
-	return nil, nil
-}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
 
-func (m *MockStore) Join(id, addr string, voter bool) error {
-	return nil
-}
+	_, err := http.Get(host + "/db/query?q=SELECT%20%2A%20FROM%20foo")
+	if err != nil {
+		t.Fatalf("failed to make query request: %s", err)
+	}
+	if exp := (5 * time.Second).Nanoseconds(); got != exp {
+		t.Fatalf("default timeout not propagated, exp %d, got %d", exp, got)
+	}
 
-func (m *MockStore) Remove(id string) error {
-	return nil
-}
+	// Writes, and strong reads, are applied through the Raft log, so the
+	// default does not apply, and a timeout may not be requested.
+	_, err = http.Post(host+"/db/execute", "application/json", strings.NewReader(`["INSERT INTO foo VALUES(1)"]`))
+	if err != nil {
+		t.Fatalf("failed to make execute request: %s", err)
+	}
+	if got != 0 {
+		t.Fatalf("default timeout propagated to execute, got %d", got)
+	}
+	_, err = http.Get(host + "/db/query?level=strong&q=SELECT%20%2A%20FROM%20foo")
+	if err != nil {
+		t.Fatalf("failed to make query request: %s", err)
+	}
+	if got != 0 {
+		t.Fatalf("default timeout propagated to strong query, got %d", got)
+	}
+	for _, tt := range []struct {
+		method string
+		url    string
+	}{
+		{"POST", "/db/execute?db_timeout=1s"},
+		{"POST", "/db/request?db_timeout=1s"},
+		{"GET", "/db/query?level=strong&db_timeout=1s&q=SELECT%20%2A%20FROM%20foo"},
+	} {
+		req, err := http.NewRequest(tt.method, host+tt.url, strings.NewReader(`["INSERT INTO foo VALUES(1)"]`))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("failed to get expected StatusBadRequest for %s, got %d", tt.url, resp.StatusCode)
+		}
+	}
 
-func (m *MockStore) LeaderAddr() (string, error) {
-	return m.leaderAddr, nil
-}
+	_, err = http.Get(host + "/db/query?db_timeout=250ms&q=SELECT%20%2A%20FROM%20foo")
+	if err != nil {
+		t.Fatalf("failed to make query request: %s", err)
+	}
+	if exp := (250 * time.Millisecond).Nanoseconds(); got != exp {
+		t.Fatalf("requested timeout not propagated, exp %d, got %d", exp, got)
+	}
 
-func (m *MockStore) Stats() (map[string]interface{}, error) {
-	return nil, nil
+	resp, err := http.Get(host + "/db/query?db_timeout=zdfjkh&q=SELECT%20%2A%20FROM%20foo")
+	if err != nil {
+		t.Fatalf("failed to make query request: %s", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("failed to get expected StatusBadRequest for invalid timeout, got %d", resp.StatusCode)
+	}
 }
 
-func (m *MockStore) Nodes() ([]*store.Server, error) {
-	return nil, nil
+func Test_StatementsEndpoint(t *testing.T) {
+	m := &MockStore{
+		statementStats: []*sql.StatementStat{
+			{Fingerprint: "select * from foo where id=?", Calls: 2, Rows: 5},
+		},
+	}
+	var user string
+	m.queryFn = func(qr *command.QueryRequest) ([]*command.QueryRows, error) {
+		user = qr.Request.User
+		return nil, nil
+	}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	resp, err := http.Get(host + "/db/statements")
+	if err != nil {
+		t.Fatalf("failed to make statements request: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read statements response: %s", err)
+	}
+	if exp, got := `{"statements":[{"fingerprint":"select * from foo where id=?","calls":2,"errors":0,"rows":5,"total_time":0,"min_time":0,"max_time":0,"mean_time":0,"p50_time":0,"p95_time":0,"p99_time":0}]}`, string(body); exp != got {
+		t.Fatalf("incorrect statements response, exp %s, got %s", exp, got)
+	}
+
+	req, err := http.NewRequest("DELETE", host+"/db/statements", nil)
+	if err != nil {
+		t.Fatalf("failed to create reset request: %s", err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to make reset request: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to get expected StatusOK for reset, got %d", resp.StatusCode)
+	}
+	if m.statementStats != nil {
+		t.Fatalf("statement stats not reset")
+	}
+
+	req, err = http.NewRequest("GET", host+"/db/query?q=SELECT%20%2A%20FROM%20foo", nil)
+	if err != nil {
+		t.Fatalf("failed to create query request: %s", err)
+	}
+	req.SetBasicAuth("fiona", "secret")
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("failed to make query request: %s", err)
+	}
+	if user != "fiona" {
+		t.Fatalf("user not propagated, exp fiona, got %s", user)
+	}
+}
+
+func Test_ExplainEndpoint(t *testing.T) {
+	m := &MockStore{}
+	m.explainFn = func(req *command.Request) ([]*sql.QueryPlan, error) {
+		if len(req.Statements) != 1 {
+			t.Fatalf("wrong number of statements, exp 1, got %d", len(req.Statements))
+		}
+		return []*sql.QueryPlan{
+			{
+				SQL:      req.Statements[0].Sql,
+				FullScan: true,
+				Plan: []*sql.PlanNode{
+					{ID: 2, Detail: "SCAN foo", FullScan: true},
+				},
+			},
+		}, nil
+	}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	resp, err := http.Get(host + "/db/explain?q=SELECT%20%2A%20FROM%20foo")
+	if err != nil {
+		t.Fatalf("failed to make explain request: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read explain response: %s", err)
+	}
+	if exp, got := `{"results":[{"sql":"SELECT * FROM foo","plan":[{"id":2,"parent":0,"detail":"SCAN foo","full_scan":true}],"full_scan":true}]}`, string(body); exp != got {
+		t.Fatalf("incorrect explain response, exp %s, got %s", exp, got)
+	}
+
+	resp, err = http.Get(host + "/db/explain")
+	if err != nil {
+		t.Fatalf("failed to make explain request: %s", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("failed to get expected StatusBadRequest for missing query, got %d", resp.StatusCode)
+	}
+}
+
+func Test_RequestEndpoint(t *testing.T) {
+	m := &MockStore{}
+	var executed, queried bool
+	m.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		executed = true
+		if !er.Request.ReadRows {
+			t.Fatalf("rows of read-only statements not requested")
+		}
+		return []*command.ExecuteResult{
+			{
+				Columns: []string{"id"},
+				Types:   []string{"integer"},
+				Values: []*command.Values{
+					{Parameters: []*command.Parameter{{Value: &command.Parameter_I{I: 2}}}},
+				},
+			},
+			{LastInsertId: 1, RowsAffected: 1},
+		}, nil
+	}
+	m.queryFn = func(qr *command.QueryRequest) ([]*command.QueryRows, error) {
+		queried = true
+		if qr.Level != command.QueryRequest_QUERY_REQUEST_LEVEL_STRONG {
+			t.Fatalf("query level not propagated")
+		}
+		return []*command.QueryRows{{Columns: []string{"id"}, Types: []string{"integer"}}}, nil
+	}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	resp, err := http.Post(host+"/db/request?level=strong", "application/json", strings.NewReader(`["SELECT id FROM foo", "SELECT * FROM bar"]`))
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if !queried || executed {
+		t.Fatalf("read-only request not performed as a query")
+	}
+	if exp, got := `{"results":[{"columns":["id"],"types":["integer"]}]}`, string(body); exp != got {
+		t.Fatalf("incorrect response, exp %s, got %s", exp, got)
+	}
+
+	queried = false
+	resp, err = http.Post(host+"/db/request", "application/json", strings.NewReader(`["SELECT id FROM foo", "INSERT INTO foo(id) VALUES(1)"]`))
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if queried || !executed {
+		t.Fatalf("request containing a write not performed as an execute")
+	}
+	if exp, got := `{"results":[{"columns":["id"],"types":["integer"],"values":[[2]]},{"last_insert_id":1,"rows_affected":1}]}`, string(body); exp != got {
+		t.Fatalf("incorrect response, exp %s, got %s", exp, got)
+	}
+
+	resp, err = http.Get(host + "/db/request")
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("failed to get expected StatusMethodNotAllowed, got %d", resp.StatusCode)
+	}
+}
+
+func Test_QueuedExecute(t *testing.T) {
+	m := &MockStore{}
+	var waitedFor uint64
+	m.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		t.Fatalf("queued write executed synchronously")
+		return nil, nil
+	}
+	m.queuedFn = func(er *command.ExecuteRequest) (uint64, error) {
+		if exp, got := "INSERT INTO foo(id) VALUES(1)", er.Request.Statements[0].Sql; exp != got {
+			t.Fatalf("incorrect statement queued, exp %s, got %s", exp, got)
+		}
+		return 7, nil
+	}
+	m.waitFn = func(seq uint64, timeout time.Duration) error {
+		waitedFor = seq
+		if seq == 8 {
+			return store.ErrQueuedWriteDropped
+		}
+		return nil
+	}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	for _, tt := range []struct {
+		url  string
+		wait bool
+	}{
+		{url: "/db/execute?queue", wait: false},
+		{url: "/db/execute?queue&wait", wait: true},
+	} {
+		waitedFor = 0
+		resp, err := http.Post(host+tt.url, "application/json", strings.NewReader(`["INSERT INTO foo(id) VALUES(1)"]`))
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response: %s", err)
+		}
+		if exp, got := `{"sequence_number":7}`, string(body); exp != got {
+			t.Fatalf("incorrect response for %s, exp %s, got %s", tt.url, exp, got)
+		}
+		if tt.wait != (waitedFor == 7) {
+			t.Fatalf("incorrect wait behavior for %s", tt.url)
+		}
+	}
+
+	m.queuedFn = func(er *command.ExecuteRequest) (uint64, error) {
+		return 0, store.ErrQueueFull
+	}
+	resp, err := http.Post(host+"/db/execute?queue", "application/json", strings.NewReader(`["INSERT INTO foo(id) VALUES(1)"]`))
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("failed to get expected StatusServiceUnavailable, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(host + "/db/queue?seq=8")
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if exp, got := `{"sequence_number":8,"error":"queued write dropped"}`, string(body); exp != got {
+		t.Fatalf("incorrect response, exp %s, got %s", exp, got)
+	}
+
+	resp, err = http.Get(host + "/db/queue?seq=nonsense")
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("failed to get expected StatusBadRequest, got %d", resp.StatusCode)
+	}
+}
+
+func Test_IdempotencyKeyHeader(t *testing.T) {
+	m := &MockStore{}
+	var key string
+	m.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		key = er.IdempotencyKey
+		return nil, nil
+	}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	for _, path := range []string{"/db/execute", "/db/request"} {
+		key = ""
+		req, err := http.NewRequest("POST", host+path, strings.NewReader(`["INSERT INTO foo(id) VALUES(1)"]`))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		req.Header.Set("Idempotency-Key", "abc123")
+		if _, err := http.DefaultClient.Do(req); err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		if exp, got := "abc123", key; exp != got {
+			t.Fatalf("idempotency key not passed to store for %s, exp %s, got %s", path, exp, got)
+		}
+	}
+
+	// A key reused for a different request is rejected, whether the error
+	// is returned locally, or by the leader.
+	for _, reusedErr := range []error{store.ErrIdempotencyKeyReused, errors.New(store.ErrIdempotencyKeyReused.Error())} {
+		m.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+			return nil, reusedErr
+		}
+		for _, path := range []string{"/db/execute", "/db/request"} {
+			req, err := http.NewRequest("POST", host+path, strings.NewReader(`["INSERT INTO foo(id) VALUES(2)"]`))
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			req.Header.Set("Idempotency-Key", "abc123")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to make request: %s", err)
+			}
+			if resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("failed to get expected StatusUnprocessableEntity for %s, got %d", path, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func Test_JoinExtensions(t *testing.T) {
+	m := &MockStore{}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	for body, exp := range map[string]int{
+		`{"id": "1", "addr": "127.0.0.1:4002"}`:                                                   http.StatusOK,
+		`{"id": "1", "addr": "127.0.0.1:4002", "extensions": []}`:                                 http.StatusOK,
+		`{"id": "1", "addr": "127.0.0.1:4002", "extensions": [{"name": "x.so", "sha256": "ab"}]}`: http.StatusConflict,
+	} {
+		resp, err := http.Post(host+"/join", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to make join request: %s", err)
+		}
+		if resp.StatusCode != exp {
+			t.Fatalf("wrong status for join request %s, exp %d, got %d", body, exp, resp.StatusCode)
+		}
+	}
+}
+
+func Test_NamedDatabaseRouting(t *testing.T) {
+	m := &MockStore{}
+	var db string
+	m.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		db = er.Request.Database
+		return []*command.ExecuteResult{}, nil
+	}
+	m.queryFn = func(qr *command.QueryRequest) ([]*command.QueryRows, error) {
+		db = qr.Request.Database
+		return []*command.QueryRows{}, nil
+	}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	for path, exp := range map[string]string{
+		"/db/execute":        "",
+		"/db/orders/execute": "orders",
+		"/db/orders/query":   "orders",
+		"/db/orders/request": "orders",
+		"/db/query":          "",
+	} {
+		db = "unset"
+		resp, err := http.Post(host+path, "application/json", strings.NewReader(`["INSERT INTO foo(id) VALUES(1)"]`))
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to get expected StatusOK for %s, got %d", path, resp.StatusCode)
+		}
+		if exp != db {
+			t.Fatalf("wrong database for %s, exp %s, got %s", path, exp, db)
+		}
+	}
+
+	resp, err := http.Post(host+"/db/orders/backup", "application/json", nil)
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("failed to get expected StatusNotFound for backup of named database, got %d", resp.StatusCode)
+	}
+}
+
+func Test_NamedDatabasePerms(t *testing.T) {
+	m := &MockStore{}
+	m.executeFn = func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+		return []*command.ExecuteResult{}, nil
+	}
+	m.queryFn = func(qr *command.QueryRequest) ([]*command.QueryRows, error) {
+		return []*command.QueryRows{}, nil
+	}
+	c := &mockClusterService{}
+	cs := auth.NewCredentialsStore()
+	if err := cs.Load(strings.NewReader(`[
+		{"username": "admin", "password": "admin", "perms": ["databases", "status"]},
+		{"username": "orders", "password": "orders", "perms": ["execute:orders", "query:orders"]},
+		{"username": "default", "password": "default", "perms": ["execute", "query"]}
+	]`)); err != nil {
+		t.Fatalf("failed to load credentials: %s", err)
+	}
+
+	s := New("127.0.0.1:0", m, c, cs)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	do := func(method, user, path string) int {
+		req, err := http.NewRequest(method, host+path, strings.NewReader(`["SELECT 1"]`))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		req.SetBasicAuth(user, user)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, tt := range []struct {
+		method string
+		user   string
+		path   string
+		exp    int
+	}{
+		{"POST", "orders", "/db/orders/execute", http.StatusOK},
+		{"GET", "orders", "/db/orders/query?q=SELECT%201", http.StatusOK},
+		{"POST", "orders", "/db/execute", http.StatusUnauthorized},
+		{"POST", "orders", "/db/other/execute", http.StatusUnauthorized},
+		{"POST", "default", "/db/execute", http.StatusOK},
+		{"POST", "default", "/db/orders/execute", http.StatusUnauthorized},
+		{"PUT", "orders", "/databases/orders", http.StatusUnauthorized},
+		{"PUT", "admin", "/databases/orders", http.StatusOK},
+		{"PUT", "admin", "/databases/query", http.StatusBadRequest},
+		{"PUT", "admin", "/databases/1bad", http.StatusBadRequest},
+		{"DELETE", "admin", "/databases/orders", http.StatusOK},
+		{"GET", "admin", "/databases", http.StatusOK},
+	} {
+		if got := do(tt.method, tt.user, tt.path); got != tt.exp {
+			t.Fatalf("wrong status for %s %s as %s, exp %d, got %d", tt.method, tt.path, tt.user, tt.exp, got)
+		}
+	}
+}
+
+func Test_DatabasesEndpoint(t *testing.T) {
+	m := &MockStore{databases: []string{"a", "b"}}
+	c := &mockClusterService{}
+	m.createDBFn = func(name string) error {
+		if name == "a" {
+			return store.ErrDatabaseExists
+		}
+		return nil
+	}
+	m.dropDBFn = func(name string) error {
+		return store.ErrDatabaseNotFound
+	}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	resp, err := http.Get(host + "/databases")
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if exp, got := `{"databases":["a","b"]}`, string(b); exp != got {
+		t.Fatalf("wrong databases list, exp %s, got %s", exp, got)
+	}
+
+	for _, tt := range []struct {
+		method string
+		name   string
+		exp    int
+	}{
+		{"PUT", "a", http.StatusConflict},
+		{"PUT", "c", http.StatusOK},
+		{"DELETE", "c", http.StatusNotFound},
+		{"POST", "c", http.StatusMethodNotAllowed},
+	} {
+		req, err := http.NewRequest(tt.method, host+"/databases/"+tt.name, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		if resp.StatusCode != tt.exp {
+			t.Fatalf("wrong status for %s %s, exp %d, got %d", tt.method, tt.name, tt.exp, resp.StatusCode)
+		}
+	}
+}
+
+func Test_MigrationsEndpoint(t *testing.T) {
+	m := &MockStore{
+		migrations: []*store.Migration{{Version: 1, Name: "create foo", Checksum: "abc"}},
+	}
+	var mr *command.MigrateRequest
+	m.migrateFn = func(r *command.MigrateRequest) ([]*store.Migration, error) {
+		mr = r
+		return []*store.Migration{{Version: 2, Checksum: "def"}}, nil
+	}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	resp, err := http.Get(host + "/db/migrations")
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if exp, got := `{"migrations":[{"version":1,"name":"create foo","checksum":"abc"}]}`, string(b); exp != got {
+		t.Fatalf("wrong migrations status, exp %s, got %s", exp, got)
+	}
+
+	resp, err = http.Post(host+"/db/orders/migrations", "application/json",
+		strings.NewReader(`[{"version": 1, "name": "create foo", "sql": "CREATE TABLE foo (id INTEGER)"}, {"version": 2, "sql": "CREATE TABLE bar (id INTEGER)"}]`))
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if exp, got := `{"applied":[{"version":2,"checksum":"def"}]}`, string(b); exp != got {
+		t.Fatalf("wrong migrate response, exp %s, got %s", exp, got)
+	}
+	if exp, got := "orders", mr.Database; exp != got {
+		t.Fatalf("wrong database passed to store, exp %s, got %s", exp, got)
+	}
+	if len(mr.Migrations) != 2 || mr.Migrations[0].Version != 1 || mr.Migrations[1].Sql != "CREATE TABLE bar (id INTEGER)" {
+		t.Fatalf("wrong migrations passed to store: %v", mr.Migrations)
+	}
+
+	resp, err = http.Post(host+"/db/migrations", "application/json", strings.NewReader(`{"version": 1}`))
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("failed to get expected StatusBadRequest for malformed migrations, got %d", resp.StatusCode)
+	}
+}
+
+func Test_SchemaEndpoint(t *testing.T) {
+	m := &MockStore{}
+	m.schemaFn = func(database string) (*sql.Schema, error) {
+		if database != "" {
+			return nil, store.ErrDatabaseNotFound
+		}
+		return &sql.Schema{
+			Tables: []*sql.Table{{
+				Name:    "foo",
+				SQL:     "CREATE TABLE foo (id INTEGER)",
+				Columns: []*sql.Column{{Name: "id", Type: "INTEGER"}},
+			}},
+		}, nil
+	}
+	c := &mockClusterService{}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	for path, exp := range map[string]string{
+		"/db/schema":       `{"tables":[{"name":"foo","sql":"CREATE TABLE foo (id INTEGER)","columns":[{"name":"id","type":"INTEGER","not_null":false}],"indexes":null,"foreign_keys":null}],"views":null,"triggers":null}`,
+		"/db/other/schema": `{"error":"database not found"}`,
+	} {
+		resp, err := http.Get(host + path)
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response: %s", err)
+		}
+		if got := string(b); exp != got {
+			t.Fatalf("wrong schema response for %s, exp %s, got %s", path, exp, got)
+		}
+	}
+
+	resp, err := http.Post(host+"/db/schema", "application/json", nil)
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("failed to get expected StatusMethodNotAllowed, got %d", resp.StatusCode)
+	}
+}
+
+func Test_VerifyEndpoint(t *testing.T) {
+	m := &MockStore{
+		leaderAddr: "localhost:4002",
+		nodes: []*store.Server{
+			{ID: "1", Addr: "localhost:4002"},
+			{ID: "2", Addr: "localhost:4004"},
+			{ID: "3", Addr: "localhost:4006"},
+			{ID: "4", Addr: "localhost:4008"},
+		},
+	}
+	m.checksumFn = func() (uint64, string, error) {
+		return 123, "aaaa", nil
+	}
+	c := &mockClusterService{
+		apiAddr: "http://1.2.3.4:999",
+	}
+	c.checksumFn = func(idx uint64, addr string, timeout time.Duration) (string, error) {
+		if idx != 123 {
+			t.Fatalf("wrong index requested, got %d", idx)
+		}
+		switch addr {
+		case "localhost:4004":
+			return "aaaa", nil
+		case "localhost:4006":
+			return "bbbb", nil
+		}
+		return "", fmt.Errorf("unreachable")
+	}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+	host := fmt.Sprintf("http://%s", s.Addr().String())
+
+	resp, err := http.Get(host + "/db/verify")
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to get expected StatusOK, got %d", resp.StatusCode)
+	}
+	result := &verifyResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if result.Index != 123 || result.Checksum != "aaaa" {
+		t.Fatalf("wrong index or checksum, got %d %s", result.Index, result.Checksum)
+	}
+	if exp, got := "3", strings.Join(result.Diverged, ","); exp != got {
+		t.Fatalf("wrong diverged nodes, exp %s, got %s", exp, got)
+	}
+	for id, exp := range map[string]string{
+		"1": `{"addr":"localhost:4002","checksum":"aaaa","match":true}`,
+		"2": `{"addr":"localhost:4004","checksum":"aaaa","match":true}`,
+		"3": `{"addr":"localhost:4006","checksum":"bbbb","match":false}`,
+		"4": `{"addr":"localhost:4008","match":false,"error":"unreachable"}`,
+	} {
+		b, err := json.Marshal(result.Nodes[id])
+		if err != nil {
+			t.Fatalf("failed to marshal result for node %s: %s", id, err)
+		}
+		if got := string(b); exp != got {
+			t.Fatalf("wrong result for node %s, exp %s, got %s", id, exp, got)
+		}
+	}
+
+	m.checksumFn = func() (uint64, string, error) {
+		return 0, "", store.ErrNotLeader
+	}
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err = client.Get(host + "/db/verify")
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("failed to get expected StatusMovedPermanently, got %d", resp.StatusCode)
+	}
+}
+
+func Test_VerifyPeriodic(t *testing.T) {
+	m := &MockStore{
+		leaderAddr: "localhost:4002",
+		nodes: []*store.Server{
+			{ID: "1", Addr: "localhost:4002"},
+			{ID: "2", Addr: "localhost:4004"},
+		},
+	}
+	m.checksumFn = func() (uint64, string, error) {
+		return 123, "aaaa", nil
+	}
+	c := &mockClusterService{}
+	c.checksumFn = func(idx uint64, addr string, timeout time.Duration) (string, error) {
+		return "bbbb", nil
+	}
+
+	s := New("127.0.0.1:0", m, c, nil)
+	s.VerifyInterval = 10 * time.Millisecond
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start service")
+	}
+	defer s.Close()
+
+	for i := 0; ; i++ {
+		s.verifyMu.RLock()
+		result := s.lastVerify
+		s.verifyMu.RUnlock()
+		if result != nil {
+			if exp, got := "2", strings.Join(result.Diverged, ","); exp != got {
+				t.Fatalf("wrong diverged nodes, exp %s, got %s", exp, got)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatalf("timed out waiting for periodic verification")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type MockStore struct {
+	executeFn      func(er *command.ExecuteRequest) ([]*command.ExecuteResult, error)
+	queryFn        func(qr *command.QueryRequest) ([]*command.QueryRows, error)
+	backupFn       func(leader bool, f store.BackupFormat, dst io.Writer) error
+	leaderAddr     string
+	statementStats []*sql.StatementStat
+	explainFn      func(req *command.Request) ([]*sql.QueryPlan, error)
+	queuedFn       func(er *command.ExecuteRequest) (uint64, error)
+	waitFn         func(seq uint64, timeout time.Duration) error
+	createDBFn     func(name string) error
+	dropDBFn       func(name string) error
+	databases      []string
+	migrateFn      func(mr *command.MigrateRequest) ([]*store.Migration, error)
+	migrations     []*store.Migration
+	schemaFn       func(database string) (*sql.Schema, error)
+	checksumFn     func() (uint64, string, error)
+	nodes          []*store.Server
+}
+
+func (m *MockStore) Execute(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+	if m.executeFn != nil {
+		return m.executeFn(er)
+	}
+	return nil, nil
+}
+
+func (m *MockStore) Query(qr *command.QueryRequest) ([]*command.QueryRows, error) {
+	if m.queryFn != nil {
+		return m.queryFn(qr)
+	}
+	return nil, nil
+}
+
+func (m *MockStore) Join(id, addr string, voter bool) error {
+	return nil
+}
+
+func (m *MockStore) Remove(id string) error {
+	return nil
+}
+
+func (m *MockStore) LeaderAddr() (string, error) {
+	return m.leaderAddr, nil
+}
+
+func (m *MockStore) Stats() (map[string]interface{}, error) {
+	return nil, nil
+}
+
+func (m *MockStore) Nodes() ([]*store.Server, error) {
+	return m.nodes, nil
 }
 
 func (m *MockStore) Backup(leader bool, f store.BackupFormat, w io.Writer) error {
@@ -937,10 +2235,94 @@ func (m *MockStore) Backup(leader bool, f store.BackupFormat, w io.Writer) error
 	return m.backupFn(leader, f, w)
 }
 
+func (m *MockStore) StatementStats() []*sql.StatementStat {
+	return m.statementStats
+}
+
+func (m *MockStore) ResetStatementStats() {
+	m.statementStats = nil
+}
+
+func (m *MockStore) ReadOnly(req *command.Request) (bool, error) {
+	for _, stmt := range req.Statements {
+		if !strings.HasPrefix(strings.ToUpper(stmt.Sql), "SELECT") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *MockStore) Explain(req *command.Request) ([]*sql.QueryPlan, error) {
+	if m.explainFn != nil {
+		return m.explainFn(req)
+	}
+	return nil, nil
+}
+
+func (m *MockStore) ExecuteQueued(er *command.ExecuteRequest) (uint64, error) {
+	if m.queuedFn != nil {
+		return m.queuedFn(er)
+	}
+	return 0, nil
+}
+
+func (m *MockStore) WaitForQueued(seq uint64, timeout time.Duration) error {
+	if m.waitFn != nil {
+		return m.waitFn(seq, timeout)
+	}
+	return nil
+}
+
+func (m *MockStore) CreateDatabase(name string) error {
+	if m.createDBFn != nil {
+		return m.createDBFn(name)
+	}
+	return nil
+}
+
+func (m *MockStore) DropDatabase(name string) error {
+	if m.dropDBFn != nil {
+		return m.dropDBFn(name)
+	}
+	return nil
+}
+
+func (m *MockStore) Databases() []string {
+	return m.databases
+}
+
+func (m *MockStore) Migrate(mr *command.MigrateRequest) ([]*store.Migration, error) {
+	if m.migrateFn != nil {
+		return m.migrateFn(mr)
+	}
+	return nil, nil
+}
+
+func (m *MockStore) Migrations(database string) ([]*store.Migration, error) {
+	return m.migrations, nil
+}
+
+func (m *MockStore) Schema(database string) (*sql.Schema, error) {
+	if m.schemaFn != nil {
+		return m.schemaFn(database)
+	}
+	return nil, nil
+}
+
+func (m *MockStore) Checksum() (uint64, string, error) {
+	if m.checksumFn != nil {
+		return m.checksumFn()
+	}
+	return 0, "", nil
+}
+
 type mockClusterService struct {
-	apiAddr   string
-	executeFn func(er *command.ExecuteRequest, addr string, t time.Duration) ([]*command.ExecuteResult, error)
-	queryFn   func(qr *command.QueryRequest, addr string, t time.Duration) ([]*command.QueryRows, error)
+	apiAddr      string
+	buildVersion string
+	executeFn    func(er *command.ExecuteRequest, addr string, t time.Duration) ([]*command.ExecuteResult, error)
+	queryFn      func(qr *command.QueryRequest, addr string, t time.Duration) ([]*command.QueryRows, error)
+	checksumFn   func(idx uint64, addr string, t time.Duration) (string, error)
+	queuedFn     func(er *command.ExecuteRequest, wait bool, addr string, t time.Duration) (uint64, error)
 }
 
 func (m *mockClusterService) GetNodeAPIAddr(a string, t time.Duration) (string, error) {
@@ -961,6 +2343,24 @@ func (m *mockClusterService) Query(qr *command.QueryRequest, addr string, t time
 	return nil, nil
 }
 
+func (m *mockClusterService) Checksum(idx uint64, addr string, t time.Duration) (string, error) {
+	if m.checksumFn != nil {
+		return m.checksumFn(idx, addr, t)
+	}
+	return "", nil
+}
+
+func (m *mockClusterService) ExecuteQueued(er *command.ExecuteRequest, wait bool, addr string, t time.Duration) (uint64, error) {
+	if m.queuedFn != nil {
+		return m.queuedFn(er, wait, addr, t)
+	}
+	return 0, nil
+}
+
+func (m *mockClusterService) NodeBuildVersion(addr string) string {
+	return m.buildVersion
+}
+
 type mockCredentialStore struct {
 	CheckOK   bool
 	HasPermOK bool
@@ -982,6 +2382,10 @@ func (m *mockCredentialStore) HasAnyPerm(username string, perm ...string) bool {
 	return m.HasPermOK
 }
 
+func (m *mockCredentialStore) Exists(username string) bool {
+	return m.CheckOK
+}
+
 type mockStatuser struct {
 }
 
@@ -1006,6 +2410,73 @@ func mustTempDir() string {
 	return path
 }
 
+// mustCreateCA creates a root certificate, writing it to a file in dir.
+func mustCreateCA(dir string) (*stdx509.Certificate, *ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("failed to generate key")
+	}
+	tmpl := &stdx509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rqlite test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              stdx509.KeyUsageCertSign,
+	}
+	der, err := stdx509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic("failed to create CA certificate")
+	}
+	ca, err := stdx509.ParseCertificate(der)
+	if err != nil {
+		panic("failed to parse CA certificate")
+	}
+	path := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		panic("failed to write CA certificate")
+	}
+	return ca, key, path
+}
+
+// mustCreateCert creates a certificate from tmpl, signed by ca.
+func mustCreateCert(ca *stdx509.Certificate, caKey *ecdsa.PrivateKey, tmpl *stdx509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("failed to generate key")
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage = stdx509.KeyUsageDigitalSignature
+	der, err := stdx509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		panic("failed to create certificate")
+	}
+	leaf, err := stdx509.ParseCertificate(der)
+	if err != nil {
+		panic("failed to parse certificate")
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// mustWriteCert writes cert, and its key, to files in dir.
+func mustWriteCert(dir string, cert tls.Certificate) (string, string) {
+	b, err := stdx509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		panic("failed to marshal key")
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		panic("failed to write certificate")
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		panic("failed to write key")
+	}
+	return certFile, keyFile
+}
+
 func mustURLParse(s string) *url.URL {
 	u, err := url.Parse(s)
 	if err != nil {
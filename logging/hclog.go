@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Hclog returns an hclog.Logger which logs through l, for use by Raft.
+func (l *Logger) Hclog() hclog.Logger {
+	return &hclogLogger{l: l}
+}
+
+// hclogLogger adapts a Logger to the hclog.Logger interface. Its level is
+// that of the subsystem of the Logger.
+type hclogLogger struct {
+	l    *Logger
+	name string
+	args []interface{}
+}
+
+func fromHclogLevel(level hclog.Level) Level {
+	switch level {
+	case hclog.Trace, hclog.Debug:
+		return LevelDebug
+	case hclog.Warn:
+		return LevelWarn
+	case hclog.Error:
+		return LevelError
+	}
+	return LevelInfo
+}
+
+func (h *hclogLogger) Log(level hclog.Level, msg string, args ...interface{}) {
+	if level == hclog.Off {
+		return
+	}
+	lvl := fromHclogLevel(level)
+	if !h.l.Enabled(lvl) {
+		return
+	}
+
+	var fields []interface{}
+	if h.name != "" {
+		fields = append(fields, "name", h.name)
+	}
+	fields = append(fields, h.args...)
+	if len(args)%2 != 0 {
+		args = append(args[:len(args)-1], "EXTRA_VALUE_AT_END", args[len(args)-1])
+	}
+	fields = append(fields, args...)
+	h.l.log(lvl, msg, fields)
+}
+
+func (h *hclogLogger) Trace(msg string, args ...interface{}) { h.Log(hclog.Trace, msg, args...) }
+func (h *hclogLogger) Debug(msg string, args ...interface{}) { h.Log(hclog.Debug, msg, args...) }
+func (h *hclogLogger) Info(msg string, args ...interface{})  { h.Log(hclog.Info, msg, args...) }
+func (h *hclogLogger) Warn(msg string, args ...interface{})  { h.Log(hclog.Warn, msg, args...) }
+func (h *hclogLogger) Error(msg string, args ...interface{}) { h.Log(hclog.Error, msg, args...) }
+
+func (h *hclogLogger) IsTrace() bool { return h.l.Enabled(LevelDebug) }
+func (h *hclogLogger) IsDebug() bool { return h.l.Enabled(LevelDebug) }
+func (h *hclogLogger) IsInfo() bool  { return h.l.Enabled(LevelInfo) }
+func (h *hclogLogger) IsWarn() bool  { return h.l.Enabled(LevelWarn) }
+func (h *hclogLogger) IsError() bool { return h.l.Enabled(LevelError) }
+
+func (h *hclogLogger) ImpliedArgs() []interface{} {
+	return h.args
+}
+
+func (h *hclogLogger) With(args ...interface{}) hclog.Logger {
+	c := *h
+	c.args = append(append([]interface{}{}, h.args...), args...)
+	return &c
+}
+
+func (h *hclogLogger) Name() string {
+	return h.name
+}
+
+func (h *hclogLogger) Named(name string) hclog.Logger {
+	if h.name != "" {
+		name = h.name + "." + name
+	}
+	return h.ResetNamed(name)
+}
+
+func (h *hclogLogger) ResetNamed(name string) hclog.Logger {
+	c := *h
+	c.name = name
+	return &c
+}
+
+// SetLevel sets the level of the subsystem of the underlying Logger.
+func (h *hclogLogger) SetLevel(level hclog.Level) {
+	SetLevel(h.l.sub.name, fromHclogLevel(level))
+}
+
+func (h *hclogLogger) StandardLogger(opts *hclog.StandardLoggerOptions) *log.Logger {
+	return log.New(h.StandardWriter(opts), "", 0)
+}
+
+func (h *hclogLogger) StandardWriter(opts *hclog.StandardLoggerOptions) io.Writer {
+	return &hclogWriter{h: h, infer: opts != nil && opts.InferLevels}
+}
+
+// hclogWriter logs each line written to it, inferring the level from a
+// prefix such as "[WARN]" if requested.
+type hclogWriter struct {
+	h     *hclogLogger
+	infer bool
+}
+
+func (w *hclogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(string(bytes.TrimRight(p, "\n")), "\n") {
+		level := hclog.Info
+		if w.infer {
+			for prefix, l := range map[string]hclog.Level{
+				"[TRACE]": hclog.Trace,
+				"[DEBUG]": hclog.Debug,
+				"[INFO]":  hclog.Info,
+				"[WARN]":  hclog.Warn,
+				"[ERR]":   hclog.Error,
+				"[ERROR]": hclog.Error,
+			} {
+				if strings.HasPrefix(line, prefix) {
+					level = l
+					line = strings.TrimSpace(strings.TrimPrefix(line, prefix))
+					break
+				}
+			}
+		}
+		w.h.Log(level, line)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,345 @@
+// Package logging provides leveled logging for the subsystems of rqlite.
+// Each subsystem, such as the store or the HTTP service, has its own
+// minimum level, which may be changed at any time. All subsystems write to
+// the same output, as either text or JSON.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int32
+
+// Log levels, in increasing order of severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LEVEL(%d)", l)
+	}
+	return levelNames[l]
+}
+
+// MarshalJSON implements json.Marshaler.
+func (l Level) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strings.ToLower(l.String()))
+}
+
+// ParseLevel returns the level with the given name, ignoring case. The
+// names used by Raft, such as TRACE and ERR, are also accepted.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "TRACE", "DEBUG":
+		return LevelDebug, nil
+	case "INFO":
+		return LevelInfo, nil
+	case "WARN", "WARNING":
+		return LevelWarn, nil
+	case "ERR", "ERROR":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("invalid log level %q", s)
+}
+
+// Format is the format in which log messages are written.
+type Format int
+
+const (
+	// FormatText writes each message as a line of text, prefixed with its
+	// subsystem, time, and level.
+	FormatText Format = iota
+
+	// FormatJSON writes each message as a JSON object on a single line.
+	FormatJSON
+)
+
+// ParseFormat returns the format with the given name, "text" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("invalid log format %q", s)
+}
+
+// subsystem holds the level of a subsystem.
+type subsystem struct {
+	name  string
+	level int32 // Accessed atomically.
+	set   bool  // Whether the level was set explicitly. Guarded by mu.
+}
+
+var (
+	mu           sync.RWMutex
+	output       io.Writer = os.Stderr
+	format                 = FormatText
+	defaultLevel           = LevelInfo
+	subsystems             = make(map[string]*subsystem)
+
+	// writeMu serializes writes, so messages are not interleaved.
+	writeMu sync.Mutex
+)
+
+// lookup returns the named subsystem, creating it if necessary.
+func lookup(name string) *subsystem {
+	mu.Lock()
+	defer mu.Unlock()
+	s, ok := subsystems[name]
+	if !ok {
+		s = &subsystem{name: name, level: int32(defaultLevel)}
+		subsystems[name] = s
+	}
+	return s
+}
+
+// SetOutput sets the destination of all log messages.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	output = w
+}
+
+// SetFormat sets the format of all log messages.
+func SetFormat(f Format) {
+	mu.Lock()
+	defer mu.Unlock()
+	format = f
+}
+
+// SetDefaultLevel sets the level of every subsystem whose level has not
+// been set by SetLevel, including those not yet created.
+func SetDefaultLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLevel = l
+	for _, s := range subsystems {
+		if !s.set {
+			atomic.StoreInt32(&s.level, int32(l))
+		}
+	}
+}
+
+// DefaultLevel returns the level of subsystems whose level has not been set.
+func DefaultLevel() Level {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultLevel
+}
+
+// SetLevel sets the level of the named subsystem.
+func SetLevel(name string, l Level) {
+	s := lookup(name)
+	mu.Lock()
+	defer mu.Unlock()
+	s.set = true
+	atomic.StoreInt32(&s.level, int32(l))
+}
+
+// SetLevels sets the levels of subsystems from a comma-delimited list of
+// subsystem=level pairs, such as "store=debug,raft=warn".
+func SetLevels(s string) error {
+	levels := make(map[string]Level)
+	for _, p := range strings.Split(s, ",") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("invalid subsystem log level %q", p)
+		}
+		l, err := ParseLevel(kv[1])
+		if err != nil {
+			return err
+		}
+		levels[strings.TrimSpace(kv[0])] = l
+	}
+	for name, l := range levels {
+		SetLevel(name, l)
+	}
+	return nil
+}
+
+// Levels returns the level of every subsystem, by name.
+func Levels() map[string]Level {
+	mu.RLock()
+	defer mu.RUnlock()
+	m := make(map[string]Level, len(subsystems))
+	for name, s := range subsystems {
+		m[name] = Level(atomic.LoadInt32(&s.level))
+	}
+	return m
+}
+
+// Subsystems returns the names of all subsystems, sorted.
+func Subsystems() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Logger logs messages for a subsystem.
+type Logger struct {
+	sub *subsystem
+	out io.Writer // If set, overrides the shared output.
+}
+
+// New returns a Logger for the named subsystem. All Loggers for the same
+// subsystem share its level.
+func New(name string) *Logger {
+	return &Logger{sub: lookup(name)}
+}
+
+// Name returns the name of the subsystem of the Logger.
+func (l *Logger) Name() string {
+	return l.sub.name
+}
+
+// SetOutput sets the destination of the messages of this Logger alone.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.out = w
+}
+
+// Enabled returns whether messages at the given level are logged.
+func (l *Logger) Enabled(lvl Level) bool {
+	return int32(lvl) >= atomic.LoadInt32(&l.sub.level)
+}
+
+// Debugf logs a message at debug level.
+func (l *Logger) Debugf(f string, v ...interface{}) {
+	l.logf(LevelDebug, f, v...)
+}
+
+// Infof logs a message at info level.
+func (l *Logger) Infof(f string, v ...interface{}) {
+	l.logf(LevelInfo, f, v...)
+}
+
+// Warnf logs a message at warn level.
+func (l *Logger) Warnf(f string, v ...interface{}) {
+	l.logf(LevelWarn, f, v...)
+}
+
+// Errorf logs a message at error level.
+func (l *Logger) Errorf(f string, v ...interface{}) {
+	l.logf(LevelError, f, v...)
+}
+
+func (l *Logger) logf(lvl Level, f string, v ...interface{}) {
+	if !l.Enabled(lvl) {
+		return
+	}
+	l.log(lvl, fmt.Sprintf(f, v...), nil)
+}
+
+// log writes msg, followed by fields, which are alternating keys and
+// values.
+func (l *Logger) log(lvl Level, msg string, fields []interface{}) {
+	mu.RLock()
+	out, f := output, format
+	mu.RUnlock()
+	if l.out != nil {
+		out = l.out
+	}
+
+	var b []byte
+	if f == FormatJSON {
+		b = l.formatJSON(lvl, msg, fields)
+	} else {
+		b = l.formatText(lvl, msg, fields)
+	}
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	out.Write(b)
+}
+
+func (l *Logger) formatText(lvl Level, msg string, fields []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[" + l.sub.name + "] ")
+	buf.WriteString(time.Now().Format("2006/01/02 15:04:05") + " ")
+	buf.WriteString("[" + lvl.String() + "] ")
+	buf.WriteString(strings.TrimSuffix(msg, "\n"))
+	for i := 0; i+1 < len(fields); i += 2 {
+		buf.WriteString(fmt.Sprintf(" %v=%v", fields[i], fields[i+1]))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func (l *Logger) formatJSON(lvl Level, msg string, fields []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, lvl)
+	buf.WriteString(`,"subsystem":`)
+	writeJSON(&buf, l.sub.name)
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, strings.TrimSuffix(msg, "\n"))
+	for i := 0; i+1 < len(fields); i += 2 {
+		buf.WriteByte(',')
+		writeJSON(&buf, fmt.Sprint(fields[i]))
+		buf.WriteByte(':')
+		writeJSON(&buf, fields[i+1])
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// writeJSON writes v to buf as JSON, or as a JSON string if v cannot be
+// marshaled.
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// Writer returns an io.Writer which logs each line written to it as a
+// message at the given level, so that the Logger can be the output of a
+// standard library log.Logger.
+func (l *Logger) Writer(lvl Level) io.Writer {
+	return &writer{l: l, lvl: lvl}
+}
+
+type writer struct {
+	l   *Logger
+	lvl Level
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.l.Enabled(w.lvl) {
+		for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+			w.l.log(w.lvl, line, nil)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func Test_ParseLevel(t *testing.T) {
+	for s, exp := range map[string]Level{
+		"debug":   LevelDebug,
+		"TRACE":   LevelDebug,
+		"Info":    LevelInfo,
+		"warning": LevelWarn,
+		"ERR":     LevelError,
+	} {
+		l, err := ParseLevel(s)
+		if err != nil {
+			t.Fatalf("failed to parse level %s: %s", s, err.Error())
+		}
+		if l != exp {
+			t.Fatalf("wrong level for %s, exp %s, got %s", s, exp, l)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatalf("parsed invalid level")
+	}
+}
+
+func Test_Levels(t *testing.T) {
+	defer SetDefaultLevel(LevelInfo)
+
+	var buf bytes.Buffer
+	l := New("test-levels")
+	l.SetOutput(&buf)
+
+	l.Debugf("hidden")
+	l.Infof("shown %d", 1)
+	if exp, got := 1, strings.Count(buf.String(), "\n"); exp != got {
+		t.Fatalf("wrong number of lines logged, exp %d, got %d: %s", exp, got, buf.String())
+	}
+	if !strings.HasPrefix(buf.String(), "[test-levels] ") || !strings.HasSuffix(buf.String(), " [INFO] shown 1\n") {
+		t.Fatalf("wrong text output: %s", buf.String())
+	}
+
+	// A subsystem whose level is set is unaffected by the default level.
+	other := New("test-levels-other")
+	if err := SetLevels("test-levels=warn"); err != nil {
+		t.Fatalf("failed to set levels: %s", err.Error())
+	}
+	SetDefaultLevel(LevelDebug)
+	if l.Enabled(LevelInfo) {
+		t.Fatalf("info enabled for subsystem at warn level")
+	}
+	if !other.Enabled(LevelDebug) {
+		t.Fatalf("debug not enabled for subsystem at default level")
+	}
+	if exp, got := LevelWarn, Levels()["test-levels"]; exp != got {
+		t.Fatalf("wrong level reported, exp %s, got %s", exp, got)
+	}
+
+	if err := SetLevels("test-levels"); err == nil {
+		t.Fatalf("set levels without level")
+	}
+	if err := SetLevels("test-levels=loud"); err == nil {
+		t.Fatalf("set levels with invalid level")
+	}
+}
+
+func Test_JSON(t *testing.T) {
+	SetFormat(FormatJSON)
+	defer SetFormat(FormatText)
+
+	var buf bytes.Buffer
+	l := New("test-json")
+	l.SetOutput(&buf)
+	l.Errorf("failed to open %s", `"file"`)
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("failed to unmarshal JSON output %s: %s", buf.String(), err.Error())
+	}
+	if m["level"] != "error" || m["subsystem"] != "test-json" || m["msg"] != `failed to open "file"` {
+		t.Fatalf("wrong JSON output: %s", buf.String())
+	}
+	if _, ok := m["time"]; !ok {
+		t.Fatalf("no time in JSON output: %s", buf.String())
+	}
+}
+
+func Test_Hclog(t *testing.T) {
+	SetFormat(FormatJSON)
+	defer SetFormat(FormatText)
+
+	var buf bytes.Buffer
+	l := New("test-hclog")
+	l.SetOutput(&buf)
+	h := l.Hclog().Named("net").With("node", "1")
+
+	h.Debug("hidden")
+	if h.IsDebug() || !h.IsInfo() {
+		t.Fatalf("wrong levels enabled")
+	}
+	h.Warn("connection failed", "addr", "localhost:4002")
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("failed to unmarshal JSON output %s: %s", buf.String(), err.Error())
+	}
+	if m["level"] != "warn" || m["msg"] != "connection failed" || m["name"] != "net" ||
+		m["node"] != "1" || m["addr"] != "localhost:4002" {
+		t.Fatalf("wrong JSON output: %s", buf.String())
+	}
+
+	// Setting the level through hclog sets the level of the subsystem.
+	h.SetLevel(hclog.Trace)
+	defer SetLevel("test-hclog", LevelInfo)
+	if !l.Enabled(LevelDebug) {
+		t.Fatalf("level not set through hclog")
+	}
+
+	buf.Reset()
+	h.StandardLogger(&hclog.StandardLoggerOptions{InferLevels: true}).Print("[ERR] disk full")
+	m = nil
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("failed to unmarshal JSON output %s: %s", buf.String(), err.Error())
+	}
+	if m["level"] != "error" || m["msg"] != "disk full" {
+		t.Fatalf("wrong JSON output from standard logger: %s", buf.String())
+	}
+}
@@ -0,0 +1,220 @@
+// Package rtls provides TLS certificates, and pools of root certificates,
+// which are reloaded from disk when their files change, so that renewed
+// certificates are used without restarting, or dropping connections.
+package rtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rqlite/rqlite/logging"
+)
+
+// checkInterval is the minimum time between checks of whether files have
+// changed.
+const checkInterval = time.Second
+
+// CertReloader holds a certificate and private key, loaded from files. The
+// files are loaded again when either changes, or when Reload is called.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time // Latest modification time of the files, when loaded.
+	lastCheck time.Time
+	loadedAt  time.Time
+
+	logger *logging.Logger
+}
+
+// NewCertReloader returns a CertReloader for the given certificate and key
+// files, which must be loadable.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logging.New("rtls"),
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate and key from their files. If they cannot be
+// loaded, the previously loaded certificate remains in use.
+func (c *CertReloader) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.load()
+}
+
+// load loads the certificate and key. It must be called with mu held.
+func (c *CertReloader) load() error {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load X.509 key pair from %s and %s: %s", c.certFile, c.keyFile, err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.loadedAt = time.Now()
+	return nil
+}
+
+// Certificate returns the certificate, first loading it again if either of
+// its files has changed since it was loaded.
+func (c *CertReloader) Certificate() *tls.Certificate {
+	c.mu.RLock()
+	if time.Since(c.lastCheck) < checkInterval {
+		defer c.mu.RUnlock()
+		return c.cert
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastCheck) >= checkInterval {
+		c.lastCheck = time.Now()
+		if modTime, err := latestModTime(c.certFile, c.keyFile); err == nil && !modTime.Equal(c.modTime) {
+			// A certificate and key which do not match, most likely because
+			// only one has been written so far, are tried again later.
+			if err := c.load(); err != nil {
+				c.logger.Warnf("failed to reload certificate, continuing with previous: %s", err)
+			} else {
+				c.logger.Infof("reloaded certificate %s", c.certFile)
+			}
+		}
+	}
+	return c.cert
+}
+
+// GetCertificate returns the certificate, for use as tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// GetClientCertificate returns the certificate, for use as
+// tls.Config.GetClientCertificate.
+func (c *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// Stats returns diagnostic information on the certificate.
+func (c *CertReloader) Stats() map[string]interface{} {
+	cert := c.Certificate()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s := map[string]interface{}{
+		"certificate": c.certFile,
+		"key":         c.keyFile,
+		"loaded_at":   c.loadedAt,
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		s["not_after"] = leaf.NotAfter
+	}
+	return s
+}
+
+// CAReloader holds a pool of root certificates, loaded from a file. The
+// file is loaded again when it changes, or when Reload is called.
+type CAReloader struct {
+	caFile string
+
+	mu        sync.RWMutex
+	pool      *x509.CertPool
+	modTime   time.Time
+	lastCheck time.Time
+
+	logger *logging.Logger
+}
+
+// NewCAReloader returns a CAReloader for the given file of PEM-encoded
+// certificates, which must be loadable.
+func NewCAReloader(caFile string) (*CAReloader, error) {
+	c := &CAReloader{
+		caFile: caFile,
+		logger: logging.New("rtls"),
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificates from the file. If they cannot be loaded,
+// the previously loaded certificates remain in use.
+func (c *CAReloader) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.load()
+}
+
+// load loads the certificates. It must be called with mu held.
+func (c *CAReloader) load() error {
+	modTime, err := latestModTime(c.caFile)
+	if err != nil {
+		return err
+	}
+	asn1Data, err := ioutil.ReadFile(c.caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(asn1Data) {
+		return fmt.Errorf("failed to parse root certificate(s) in %q", c.caFile)
+	}
+	c.pool = pool
+	c.modTime = modTime
+	return nil
+}
+
+// Pool returns the pool of certificates, first loading it again if the
+// file has changed since it was loaded.
+func (c *CAReloader) Pool() *x509.CertPool {
+	c.mu.RLock()
+	if time.Since(c.lastCheck) < checkInterval {
+		defer c.mu.RUnlock()
+		return c.pool
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastCheck) >= checkInterval {
+		c.lastCheck = time.Now()
+		if modTime, err := latestModTime(c.caFile); err == nil && !modTime.Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				c.logger.Warnf("failed to reload root certificates, continuing with previous: %s", err)
+			} else {
+				c.logger.Infof("reloaded root certificates %s", c.caFile)
+			}
+		}
+	}
+	return c.pool
+}
+
+// latestModTime returns the latest modification time of the given files.
+func latestModTime(paths ...string) (time.Time, error) {
+	var t time.Time
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
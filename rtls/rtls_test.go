@@ -0,0 +1,166 @@
+package rtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_CertReloader(t *testing.T) {
+	dir := mustTempDir()
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	mustWriteCert(certFile, keyFile, "first")
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to create cert reloader: %s", err.Error())
+	}
+	if exp, got := "first", commonName(t, c); exp != got {
+		t.Fatalf("wrong certificate, exp %s, got %s", exp, got)
+	}
+
+	// A changed certificate is picked up without an explicit reload.
+	mustWriteCert(certFile, keyFile, "second")
+	mustTouch(time.Now().Add(time.Minute), certFile, keyFile)
+	time.Sleep(checkInterval + 100*time.Millisecond)
+	if exp, got := "second", commonName(t, c); exp != got {
+		t.Fatalf("wrong certificate after change, exp %s, got %s", exp, got)
+	}
+
+	// A certificate which does not match its key is not used.
+	if err := ioutil.WriteFile(keyFile, mustGenerateKey(), 0600); err != nil {
+		t.Fatalf("failed to write key: %s", err.Error())
+	}
+	if err := c.Reload(); err == nil {
+		t.Fatalf("reloaded certificate which does not match key")
+	}
+	if exp, got := "second", commonName(t, c); exp != got {
+		t.Fatalf("wrong certificate after failed reload, exp %s, got %s", exp, got)
+	}
+
+	mustWriteCert(certFile, keyFile, "third")
+	if err := c.Reload(); err != nil {
+		t.Fatalf("failed to reload certificate: %s", err.Error())
+	}
+	if exp, got := "third", commonName(t, c); exp != got {
+		t.Fatalf("wrong certificate after reload, exp %s, got %s", exp, got)
+	}
+
+	if _, err := NewCertReloader(certFile, filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatalf("created cert reloader with missing key")
+	}
+}
+
+func Test_CAReloader(t *testing.T) {
+	dir := mustTempDir()
+	defer os.RemoveAll(dir)
+	caFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "key.pem")
+
+	mustWriteCert(caFile, keyFile, "first")
+	c, err := NewCAReloader(caFile)
+	if err != nil {
+		t.Fatalf("failed to create CA reloader: %s", err.Error())
+	}
+	first := c.Pool()
+
+	mustWriteCert(caFile, keyFile, "second")
+	mustTouch(time.Now().Add(time.Minute), caFile)
+	time.Sleep(checkInterval + 100*time.Millisecond)
+	if c.Pool() == first {
+		t.Fatalf("changed root certificates not reloaded")
+	}
+
+	if err := ioutil.WriteFile(caFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("failed to write CA file: %s", err.Error())
+	}
+	second := c.Pool()
+	if err := c.Reload(); err == nil {
+		t.Fatalf("reloaded invalid root certificates")
+	}
+	if c.Pool() != second {
+		t.Fatalf("root certificates replaced after failed reload")
+	}
+}
+
+func commonName(t *testing.T, c *CertReloader) string {
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("failed to get certificate: %s", err.Error())
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err.Error())
+	}
+	return leaf.Subject.CommonName
+}
+
+// mustWriteCert writes a self-signed certificate with the given common name,
+// and its key, to the given files.
+func mustWriteCert(certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("failed to generate key")
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic("failed to create certificate")
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		panic("failed to marshal key")
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		panic("failed to write certificate")
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		panic("failed to write key")
+	}
+}
+
+func mustGenerateKey() []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("failed to generate key")
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		panic("failed to marshal key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+}
+
+// mustTouch sets the modification time of the given files, so that changes
+// are detected even on file systems with coarse timestamps.
+func mustTouch(t time.Time, paths ...string) {
+	for _, p := range paths {
+		if err := os.Chtimes(p, t, t); err != nil {
+			panic("failed to set file times")
+		}
+	}
+}
+
+func mustTempDir() string {
+	path, err := ioutil.TempDir("", "rqlite-rtls-test-")
+	if err != nil {
+		panic("failed to create temp dir")
+	}
+	return path
+}
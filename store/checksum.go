@@ -0,0 +1,157 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rqlite/rqlite/command"
+	sql "github.com/rqlite/rqlite/db"
+)
+
+// maxChecksums is the number of checksums retained by each node.
+const maxChecksums = 16
+
+// ErrChecksumNotFound is returned when this node did not compute a checksum
+// at the requested index, or no longer retains it.
+var ErrChecksumNotFound = errors.New("checksum not found")
+
+// Checksum instructs every node to compute the checksum of its databases
+// at the same point in the Raft log. It returns the index of that point, and
+// the checksum computed by this node. It must be called on the leader.
+func (s *Store) Checksum() (uint64, string, error) {
+	if s.raft.State() != raft.Leader {
+		return 0, "", ErrNotLeader
+	}
+	af, err := s.applyCommand(&command.Command{
+		Type: command.Command_COMMAND_TYPE_CHECKSUM,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	r := af.Response().(*fsmChecksumResponse)
+	if r.error != nil {
+		return 0, "", r.error
+	}
+	<-r.checksum.done
+	return af.Index(), r.checksum.sum, r.checksum.err
+}
+
+// ChecksumAt returns the checksum this node computed at the given index,
+// waiting until timeout for the index to be applied, and the checksum to
+// be computed.
+func (s *Store) ChecksumAt(idx uint64, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	if _, err := s.WaitForFSMIndex(idx, timeout); err != nil {
+		return "", err
+	}
+	s.checksumsMu.Lock()
+	c, ok := s.checksums[idx]
+	s.checksumsMu.Unlock()
+	if !ok {
+		return "", ErrChecksumNotFound
+	}
+
+	tmr := time.NewTimer(time.Until(deadline))
+	defer tmr.Stop()
+	select {
+	case <-c.done:
+		return c.sum, c.err
+	case <-tmr.C:
+		return "", fmt.Errorf("timeout expired")
+	}
+}
+
+// checksum is the checksum of every database at an index of the Raft log.
+type checksum struct {
+	done chan struct{} // Closed once sum or err is set.
+	sum  string
+	err  error
+}
+
+type fsmChecksumResponse struct {
+	checksum *checksum
+	error    error
+}
+
+// applyChecksum starts computing the checksum of every database, and
+// retains it under the given index. It must only be called by Apply.
+//
+// Apply only backs up each database to a file, as Snapshot does, so no
+// database is held in memory. Reading every row of every table is done in
+// the background, from the copies, so it does not hold up the application
+// of later entries.
+func (s *Store) applyChecksum(idx uint64) *checksum {
+	c := &checksum{done: make(chan struct{})}
+	dir, err := ioutil.TempDir(s.raftDir, checksumTmpPrefix)
+	if err != nil {
+		c.err = fmt.Errorf("create checksum directory: %s", err)
+		close(c.done)
+	} else if copies, err := s.backupDatabases(dir); err != nil {
+		os.RemoveAll(dir)
+		c.err = fmt.Errorf("checksum: %s", err)
+		close(c.done)
+	} else {
+		go func() {
+			defer close(c.done)
+			defer os.RemoveAll(dir)
+			c.sum, c.err = s.computeChecksum(copies)
+		}()
+	}
+
+	s.checksumsMu.Lock()
+	defer s.checksumsMu.Unlock()
+	s.checksums[idx] = c
+	if len(s.checksums) > maxChecksums {
+		idxs := make([]uint64, 0, len(s.checksums))
+		for i := range s.checksums {
+			idxs = append(idxs, i)
+		}
+		sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+		for _, i := range idxs[:len(idxs)-maxChecksums] {
+			delete(s.checksums, i)
+		}
+	}
+	return c
+}
+
+// computeChecksum returns the checksum of the copies of the databases, as
+// returned by backupDatabases. Only one checksum is computed at a time, so
+// verification does not compete with requests for more than one core.
+func (s *Store) computeChecksum(copies []databaseCopy) (string, error) {
+	s.checksumWorkMu.Lock()
+	defer s.checksumWorkMu.Unlock()
+
+	h := sha256.New()
+	for _, c := range copies {
+		sum, err := checksumCopy(c.path)
+		if err != nil {
+			if c.name == "" {
+				return "", fmt.Errorf("checksum: %s", err)
+			}
+			return "", fmt.Errorf("checksum database %s: %s", c.name, err)
+		}
+		if c.name == "" {
+			h.Write([]byte(sum))
+		} else {
+			h.Write([]byte(c.name + "\x00" + sum))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumCopy returns the checksum of the copy of a database at path.
+func checksumCopy(path string) (string, error) {
+	db, err := sql.Open(path, false, false)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	return db.Checksum()
+}
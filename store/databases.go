@@ -0,0 +1,293 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+	"github.com/rqlite/rqlite/command"
+	sql "github.com/rqlite/rqlite/db"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	// ErrDatabaseNotFound is returned when a request refers to a named
+	// database which does not exist.
+	ErrDatabaseNotFound = errors.New("database not found")
+
+	// ErrDatabaseExists is returned when creating a named database which
+	// already exists.
+	ErrDatabaseExists = errors.New("database exists")
+
+	// ErrInvalidDatabaseName is returned when a database name is not valid.
+	ErrInvalidDatabaseName = errors.New("invalid database name")
+)
+
+// databaseNameRegexp matches valid names for named databases.
+var databaseNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// ValidDatabaseName returns whether name is a valid name for a named database.
+func ValidDatabaseName(name string) bool {
+	return databaseNameRegexp.MatchString(name)
+}
+
+// CreateDatabase creates a new, empty, named database.
+func (s *Store) CreateDatabase(name string) error {
+	return s.databaseCommand(command.Command_COMMAND_TYPE_CREATE_DATABASE, name)
+}
+
+// DropDatabase drops the named database, discarding its contents.
+func (s *Store) DropDatabase(name string) error {
+	return s.databaseCommand(command.Command_COMMAND_TYPE_DROP_DATABASE, name)
+}
+
+// Databases returns the names of every named database, in sorted order.
+func (s *Store) Databases() []string {
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	return s.sortedNames()
+}
+
+// namedStats returns the status of every named database, keyed by name.
+func (s *Store) namedStats() (map[string]interface{}, error) {
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	stats := make(map[string]interface{}, len(s.dbs))
+	for name, db := range s.dbs {
+		st, err := db.Stats()
+		if err != nil {
+			return nil, fmt.Errorf("database %s: %s", name, err)
+		}
+		stats[name] = st
+	}
+	return stats, nil
+}
+
+func (s *Store) databaseCommand(typ command.Command_Type, name string) error {
+	if !ValidDatabaseName(name) {
+		return ErrInvalidDatabaseName
+	}
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	b, err := command.MarshalDatabaseRequest(&command.DatabaseRequest{Name: name})
+	if err != nil {
+		return err
+	}
+	af, err := s.applyCommand(&command.Command{
+		Type:       typ,
+		SubCommand: b,
+	})
+	if err != nil {
+		return err
+	}
+	return af.Response().(*fsmGenericResponse).error
+}
+
+// namedDB returns the database with the given name, or the default database
+// if the name is empty.
+func (s *Store) namedDB(name string) (*sql.DB, error) {
+	if name == "" {
+		return s.db, nil
+	}
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	db, ok := s.dbs[name]
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	return db, nil
+}
+
+// applyCreateDatabase creates the named database. It must only be called
+// by Apply.
+func (s *Store) applyCreateDatabase(name string) error {
+	s.dbsMu.Lock()
+	defer s.dbsMu.Unlock()
+	if _, ok := s.dbs[name]; ok {
+		return ErrDatabaseExists
+	}
+	db, err := s.createNamed(name, nil)
+	if err != nil {
+		return fmt.Errorf("create database %s: %s", name, err)
+	}
+	s.dbs[name] = db
+	return nil
+}
+
+// applyDropDatabase drops the named database. It must only be called by
+// Apply.
+func (s *Store) applyDropDatabase(name string) error {
+	s.dbsMu.Lock()
+	defer s.dbsMu.Unlock()
+	db, ok := s.dbs[name]
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+	delete(s.dbs, name)
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("close database %s: %s", name, err)
+	}
+	if !s.dbConf.Memory {
+		if err := sql.RemoveFiles(s.namedDBPath(name)); err != nil {
+			return fmt.Errorf("remove database %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// createNamed creates the named database, with the contents of b, if b is
+// non-nil. Named databases are stored in memory, or on disk alongside the
+// default database, matching the default database.
+func (s *Store) createNamed(name string, b []byte) (*sql.DB, error) {
+	if s.dbConf.Memory {
+		return s.createInMemory(b)
+	}
+	path := s.namedDBPath(name)
+	if err := sql.RemoveFiles(path); err != nil {
+		return nil, err
+	}
+	if b != nil {
+		if err := ioutil.WriteFile(path, b, 0660); err != nil {
+			return nil, err
+		}
+	}
+	return sql.Open(path, s.dbConf.FKConstraints, true)
+}
+
+// namedDBPath returns the path of the on-disk file for the named database.
+func (s *Store) namedDBPath(name string) string {
+	return filepath.Join(filepath.Dir(s.dbPath), fmt.Sprintf("db.%s.sqlite", name))
+}
+
+// closeNamed closes every named database.
+func (s *Store) closeNamed() error {
+	s.dbsMu.Lock()
+	defer s.dbsMu.Unlock()
+	for name, db := range s.dbs {
+		if err := db.Close(); err != nil {
+			return fmt.Errorf("close database %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// writeNamed writes the copies of the named databases to a file at path,
+// compressed, for inclusion in a snapshot. The file holds a marshaled
+// command.NamedDatabases, which is encoded here so that the contents of each
+// database can be streamed from its copy, rather than held in memory.
+func writeNamed(path string, copies []databaseCopy) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range copies {
+		fi, err := os.Stat(c.path)
+		if err != nil {
+			return err
+		}
+		sz := fi.Size()
+
+		// A command.NamedDatabase, holding the name and, unless empty, the
+		// contents of the database, as field 1 of command.NamedDatabases.
+		var hdr []byte
+		n := protowire.SizeTag(1) + protowire.SizeBytes(len(c.name))
+		if sz > 0 {
+			n += protowire.SizeTag(2) + protowire.SizeBytes(int(sz))
+		}
+		hdr = protowire.AppendTag(hdr, 1, protowire.BytesType)
+		hdr = protowire.AppendVarint(hdr, uint64(n))
+		hdr = protowire.AppendTag(hdr, 1, protowire.BytesType)
+		hdr = protowire.AppendString(hdr, c.name)
+		if sz > 0 {
+			hdr = protowire.AppendTag(hdr, 2, protowire.BytesType)
+			hdr = protowire.AppendVarint(hdr, uint64(sz))
+		}
+		if _, err := gz.Write(hdr); err != nil {
+			return err
+		}
+		if err := copyFile(gz, c.path); err != nil {
+			return err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// unmarshalNamed returns the named databases in b, as written by writeNamed.
+// If b is nil, there are no named databases.
+func unmarshalNamed(b []byte) (*command.NamedDatabases, error) {
+	dbs := &command.NamedDatabases{}
+	if b == nil {
+		return dbs, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	ub, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("decompress databases: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	if err := proto.Unmarshal(ub, dbs); err != nil {
+		return nil, fmt.Errorf("unmarshal databases: %s", err)
+	}
+	return dbs, nil
+}
+
+// restoreNamed replaces every named database with those in dbs, as returned
+// by unmarshalNamed. The snapshot must be decoded before calling, so that a
+// snapshot which cannot be decoded leaves the existing databases open.
+func (s *Store) restoreNamed(dbs *command.NamedDatabases) error {
+	if err := s.closeNamed(); err != nil {
+		return err
+	}
+
+	s.dbsMu.Lock()
+	defer s.dbsMu.Unlock()
+	s.dbs = make(map[string]*sql.DB, len(dbs.Databases))
+	for _, d := range dbs.Databases {
+		var data []byte
+		if len(d.Data) > 0 {
+			data = d.Data
+		}
+		db, err := s.createNamed(d.Name, data)
+		if err != nil {
+			return fmt.Errorf("restore database %s: %s", d.Name, err)
+		}
+		s.dbs[d.Name] = db
+	}
+	return nil
+}
+
+// sortedNames returns the names of the named databases in sorted order. The
+// caller must hold dbsMu.
+func (s *Store) sortedNames() []string {
+	names := make([]string, 0, len(s.dbs))
+	for name := range s.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
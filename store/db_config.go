@@ -8,6 +8,11 @@ type DBConfig struct {
 	// SQLite on-disk path
 	OnDiskPath string `json:"on_disk_path,omitempty"`
 
+	// Whether an on-disk database is built directly on disk at startup,
+	// rather than first in memory. Startup is slower, but the database
+	// need not fit in memory.
+	OnDiskStartup bool `json:"on_disk_startup,omitempty"`
+
 	// Enforce Foreign Key constraints
 	FKConstraints bool `json:"fk_constraints"`
 }
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rqlite/rqlite/command"
+)
+
+// ErrIdempotencyKeyReused is returned when an execute request carries an
+// idempotency key already used by a different request.
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused for a different request")
+
+// idempotencyCache records the outcome of execute requests which carry an
+// idempotency key, so that a retried request returns the original outcome
+// rather than being executed again. It is part of the replicated state of
+// the Store, and so must only be modified by Apply and Restore. Entries
+// expire at a time set by the leader, and are compared with the time at
+// which the leader appended each log entry, so every node expires entries
+// identically. Likewise the number of entries is limited by the leader, and
+// the oldest entries, in log order, are evicted first.
+type idempotencyCache struct {
+	mu      sync.RWMutex
+	entries map[string]*command.IdempotencyEntry
+	order   []*command.IdempotencyEntry // In the order entries were added.
+}
+
+// newIdempotencyCache returns an empty idempotencyCache.
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		entries: make(map[string]*command.IdempotencyEntry),
+	}
+}
+
+// Get returns the entry for the given key, if it exists and has not expired
+// at time now, in Unix nanoseconds. If now is zero, no entry is considered
+// expired.
+func (c *idempotencyCache) Get(key string, now int64) (*command.IdempotencyEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.entries[key]
+	if !ok || (now != 0 && e.Expires <= now) {
+		return nil, false
+	}
+	return e, true
+}
+
+// Add records the outcome of the request with the given key and hash. If
+// maxKeys is greater than zero, the oldest entries are then evicted until
+// no more than maxKeys remain.
+func (c *idempotencyCache) Add(key string, expires int64, hash []byte, maxKeys int,
+	results []*command.ExecuteResult, err error) {
+	e := &command.IdempotencyEntry{
+		Key:         key,
+		Expires:     expires,
+		Results:     results,
+		RequestHash: hash,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+	c.order = append(c.order, e)
+	if maxKeys <= 0 {
+		return
+	}
+	n := 0
+	for ; n < len(c.order) && len(c.entries) > maxKeys; n++ {
+		e := c.order[n]
+		if c.entries[e.Key] == e {
+			delete(c.entries, e.Key)
+		}
+	}
+	c.order = c.order[n:]
+}
+
+// Prune removes entries which have expired at time now, in Unix nanoseconds.
+// Entries are examined in the order they were added, stopping at the first
+// unexpired entry.
+func (c *idempotencyCache) Prune(now int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for ; n < len(c.order) && c.order[n].Expires <= now; n++ {
+		e := c.order[n]
+		if c.entries[e.Key] == e {
+			delete(c.entries, e.Key)
+		}
+	}
+	c.order = c.order[n:]
+}
+
+// Len returns the number of entries in the cache.
+func (c *idempotencyCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+// Marshal returns the contents of the cache, in the order entries were added.
+func (c *idempotencyCache) Marshal() ([]byte, error) {
+	c.mu.RLock()
+	state := &command.IdempotencyState{}
+	for _, e := range c.order {
+		if c.entries[e.Key] == e {
+			state.Entries = append(state.Entries, e)
+		}
+	}
+	c.mu.RUnlock()
+	return proto.Marshal(state)
+}
+
+// Unmarshal replaces the contents of the cache with the given state.
+func (c *idempotencyCache) Unmarshal(b []byte) error {
+	state, err := unmarshalIdempotencyState(b)
+	if err != nil {
+		return err
+	}
+	c.Set(state)
+	return nil
+}
+
+// unmarshalIdempotencyState returns the state marshaled as b by Marshal.
+func unmarshalIdempotencyState(b []byte) (*command.IdempotencyState, error) {
+	state := &command.IdempotencyState{}
+	if err := proto.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Set replaces the contents of the cache with the given state.
+func (c *idempotencyCache) Set(state *command.IdempotencyState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*command.IdempotencyEntry, len(state.Entries))
+	c.order = nil
+	for _, e := range state.Entries {
+		c.entries[e.Key] = e
+		c.order = append(c.order, e)
+	}
+}
+
+// Reset removes every entry from the cache.
+func (c *idempotencyCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*command.IdempotencyEntry)
+	c.order = nil
+}
+
+// requestHash returns the hash of the statements of the request, which
+// identifies a retry of the request. The user and database are not included,
+// since idempotency keys are already scoped by them.
+func requestHash(req *command.Request) ([]byte, error) {
+	b, err := proto.Marshal(&command.Request{
+		Transaction: req.GetTransaction(),
+		Statements:  req.GetStatements(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// sameRequest returns whether the entry was recorded for a request with the
+// given hash. Entries and requests written by earlier versions have no hash,
+// and match any request.
+func sameRequest(e *command.IdempotencyEntry, hash []byte) bool {
+	return len(e.RequestHash) == 0 || len(hash) == 0 || bytes.Equal(e.RequestHash, hash)
+}
+
+// entryError returns the error recorded in the entry, if any.
+func entryError(e *command.IdempotencyEntry) error {
+	if e.Error == "" {
+		return nil
+	}
+	return errors.New(e.Error)
+}
@@ -0,0 +1,259 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rqlite/rqlite/command"
+	sql "github.com/rqlite/rqlite/db"
+)
+
+// migrationsTable is the reserved table recording the migrations applied to
+// a database.
+const migrationsTable = "rqlite_migrations"
+
+var (
+	// ErrMigrationOutOfOrder is returned when a migration has not been
+	// applied, but a later migration has, or when migrations are not
+	// listed in increasing order of version.
+	ErrMigrationOutOfOrder = errors.New("migration out of order")
+
+	// ErrMigrationModified is returned when a migration has been applied,
+	// but its script has since changed.
+	ErrMigrationModified = errors.New("migration modified")
+
+	// ErrMigrationInvalid is returned when a migration has no script, or
+	// a version less than 1.
+	ErrMigrationInvalid = errors.New("invalid migration")
+)
+
+// Migration is a record of a migration applied to a database.
+type Migration struct {
+	Version   int64  `json:"version"`
+	Name      string `json:"name,omitempty"`
+	Checksum  string `json:"checksum"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+// Migrate applies, in a single transaction, every migration in the request
+// which has not already been applied to the database. The migrations must
+// be in increasing order of version. It returns the migrations applied by
+// this request. If any migration fails, none are applied.
+func (s *Store) Migrate(mr *command.MigrateRequest) ([]*Migration, error) {
+	if s.raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+	if _, err := s.namedDB(mr.Database); err != nil {
+		return nil, err
+	}
+	mr, err := s.prepareMigrate(mr)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := command.MarshalMigrateRequest(mr)
+	if err != nil {
+		return nil, err
+	}
+	af, err := s.applyCommand(&command.Command{
+		Type:       command.Command_COMMAND_TYPE_MIGRATE,
+		SubCommand: b,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := af.Response().(*fsmMigrateResponse)
+	return r.applied, r.error
+}
+
+// prepareMigrate readies a migrate request for writing to the log. It
+// returns a copy of the request in which each migration records the
+// checksum of its script as submitted, and non-deterministic functions in
+// the scripts are replaced, if enabled. The checksum is taken before the
+// rewrite so that resubmitting a script does not appear to modify it.
+func (s *Store) prepareMigrate(mr *command.MigrateRequest) (*command.MigrateRequest, error) {
+	now := time.Now()
+	prepared := &command.MigrateRequest{
+		Database:   mr.Database,
+		Migrations: make([]*command.Migration, len(mr.Migrations)),
+	}
+	for i, m := range mr.Migrations {
+		p := &command.Migration{
+			Version:  m.Version,
+			Name:     m.Name,
+			Sql:      m.Sql,
+			Checksum: scriptChecksum(m.Sql),
+		}
+		if s.RewriteNonDeterministic {
+			rewritten, err := sql.RewriteNonDeterministic(m.Sql, now)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite migration %d: %s", m.Version, err)
+			}
+			p.Sql = rewritten
+		}
+		prepared.Migrations[i] = p
+	}
+	return prepared, nil
+}
+
+// Migrations returns the migrations applied to the named database, in order
+// of version. No read consistency guarantees are made.
+func (s *Store) Migrations(database string) ([]*Migration, error) {
+	db, err := s.namedDB(database)
+	if err != nil {
+		return nil, err
+	}
+	return appliedMigrations(db)
+}
+
+type fsmMigrateResponse struct {
+	applied []*Migration
+	error   error
+}
+
+// applyMigrate applies the migrate request contained in the given log entry.
+// Whether each migration has been applied is determined from the database
+// itself, so that concurrent requests are serialized by the Raft log.
+func (s *Store) applyMigrate(mr *command.MigrateRequest, l *raft.Log) ([]*Migration, error) {
+	db, err := s.namedDB(mr.Database)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingMigrations(mr.Migrations, applied)
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	var appliedAt string
+	if !l.AppendedAt.IsZero() {
+		appliedAt = l.AppendedAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	// Each migration is followed by the statement recording it, so the
+	// failing migration can be identified from the results.
+	stmts := []*command.Statement{{
+		Sql: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (version INTEGER NOT NULL PRIMARY KEY, name TEXT, checksum TEXT NOT NULL, applied_at TEXT)`, migrationsTable),
+	}}
+	records := make([]*Migration, len(pending))
+	for i, m := range pending {
+		records[i] = &Migration{
+			Version:   m.Version,
+			Name:      m.Name,
+			Checksum:  migrationChecksum(m),
+			AppliedAt: appliedAt,
+		}
+		stmts = append(stmts, &command.Statement{Sql: m.Sql}, &command.Statement{
+			Sql: fmt.Sprintf(`INSERT INTO %s(version, name, checksum, applied_at) VALUES(?, ?, ?, ?)`, migrationsTable),
+			Parameters: []*command.Parameter{
+				{Value: &command.Parameter_I{I: m.Version}},
+				{Value: &command.Parameter_S{S: m.Name}},
+				{Value: &command.Parameter_S{S: records[i].Checksum}},
+				{Value: &command.Parameter_S{S: appliedAt}},
+			},
+		})
+	}
+
+	results, err := db.Execute(&command.Request{Transaction: true, Statements: stmts}, false)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range results {
+		if r.Error == "" {
+			continue
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("create %s table: %s", migrationsTable, r.Error)
+		}
+		return nil, fmt.Errorf("migration %d: %s", pending[(i-1)/2].Version, r.Error)
+	}
+	return records, nil
+}
+
+// appliedMigrations returns the migrations recorded as applied to the
+// database, in order of version.
+func appliedMigrations(db *sql.DB) ([]*Migration, error) {
+	rows, err := db.QueryStringStmt(fmt.Sprintf(`SELECT version, name, checksum, applied_at FROM %s ORDER BY version`, migrationsTable))
+	if err != nil {
+		return nil, err
+	}
+	if rows[0].Error != "" {
+		if strings.HasPrefix(rows[0].Error, "no such table") {
+			return nil, nil
+		}
+		return nil, errors.New(rows[0].Error)
+	}
+
+	migrations := make([]*Migration, len(rows[0].Values))
+	for i, v := range rows[0].Values {
+		p := v.GetParameters()
+		migrations[i] = &Migration{
+			Version:   p[0].GetI(),
+			Name:      p[1].GetS(),
+			Checksum:  p[2].GetS(),
+			AppliedAt: p[3].GetS(),
+		}
+	}
+	return migrations, nil
+}
+
+// pendingMigrations checks the requested migrations against those already
+// applied, and returns those which remain to be applied.
+func pendingMigrations(requested []*command.Migration, applied []*Migration) ([]*command.Migration, error) {
+	byVersion := make(map[int64]*Migration, len(applied))
+	var current int64
+	for _, m := range applied {
+		byVersion[m.Version] = m
+		if m.Version > current {
+			current = m.Version
+		}
+	}
+
+	var pending []*command.Migration
+	var prev int64
+	for _, m := range requested {
+		if m.Version < 1 || strings.TrimSpace(m.Sql) == "" {
+			return nil, fmt.Errorf("%s: version %d", ErrMigrationInvalid, m.Version)
+		}
+		if m.Version <= prev {
+			return nil, fmt.Errorf("%s: version %d follows version %d", ErrMigrationOutOfOrder, m.Version, prev)
+		}
+		prev = m.Version
+
+		if a, ok := byVersion[m.Version]; ok {
+			if a.Checksum != migrationChecksum(m) {
+				return nil, fmt.Errorf("%s: version %d", ErrMigrationModified, m.Version)
+			}
+			continue
+		}
+		if m.Version < current {
+			return nil, fmt.Errorf("%s: version %d is not applied, but version %d is", ErrMigrationOutOfOrder, m.Version, current)
+		}
+		pending = append(pending, m)
+	}
+	return pending, nil
+}
+
+// migrationChecksum returns the checksum of the migration's script. The
+// checksum recorded by the leader is used if present, since the script may
+// since have been rewritten.
+func migrationChecksum(m *command.Migration) string {
+	if m.Checksum != "" {
+		return m.Checksum
+	}
+	return scriptChecksum(m.Sql)
+}
+
+// scriptChecksum returns the checksum of a migration script.
+func scriptChecksum(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
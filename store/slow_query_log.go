@@ -0,0 +1,106 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rqlite/rqlite/command"
+)
+
+// slowQueryRecord is a single entry in the slow query log.
+type slowQueryRecord struct {
+	Time      string  `json:"time"`
+	Duration  float64 `json:"duration"`
+	SQL       string  `json:"sql"`
+	User      string  `json:"user,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+	Level     string  `json:"level,omitempty"`
+	Index     uint64  `json:"raft_index"`
+	Rows      int64   `json:"rows"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// slowQueryLog writes statements which take longer than a threshold to
+// execute to a file, one JSON object per line.
+type slowQueryLog struct {
+	threshold time.Duration
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// newSlowQueryLog returns a slow query log which appends to the file at path.
+func newSlowQueryLog(path string, threshold time.Duration) (*slowQueryLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &slowQueryLog{
+		threshold: threshold,
+		f:         f,
+		enc:       json.NewEncoder(f),
+	}, nil
+}
+
+// logExecute logs each statement in req which exceeded the threshold. The
+// results must have been generated with timings enabled.
+func (l *slowQueryLog) logExecute(req *command.Request, results []*command.ExecuteResult, idx uint64) {
+	stmts := nonEmptyStatements(req)
+	for i := 0; i < len(results) && i < len(stmts); i++ {
+		l.log(req, stmts[i].Sql, "", results[i].Time, results[i].RowsAffected, results[i].Error, idx)
+	}
+}
+
+// logQuery logs each statement in req which exceeded the threshold. The
+// rows must have been generated with timings enabled.
+func (l *slowQueryLog) logQuery(req *command.Request, level command.QueryRequest_Level,
+	rows []*command.QueryRows, idx uint64) {
+	lvl := strings.ToLower(strings.TrimPrefix(level.String(), "QUERY_REQUEST_LEVEL_"))
+	stmts := nonEmptyStatements(req)
+	for i := 0; i < len(rows) && i < len(stmts); i++ {
+		l.log(req, stmts[i].Sql, lvl, rows[i].Time, int64(len(rows[i].Values)), rows[i].Error, idx)
+	}
+}
+
+func (l *slowQueryLog) log(req *command.Request, sql, level string, d float64, rows int64, e string, idx uint64) {
+	if d < l.threshold.Seconds() {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(&slowQueryRecord{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Duration:  d,
+		SQL:       sql,
+		User:      req.User,
+		RequestID: req.RequestId,
+		Level:     level,
+		Index:     idx,
+		Rows:      rows,
+		Error:     e,
+	})
+}
+
+// Close closes the slow query log.
+func (l *slowQueryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// nonEmptyStatements returns the statements in req which the database layer
+// generates a result for.
+func nonEmptyStatements(req *command.Request) []*command.Statement {
+	stmts := make([]*command.Statement, 0, len(req.Statements))
+	for _, s := range req.Statements {
+		if s.Sql != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
@@ -12,7 +12,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math"
 	"os"
 	"path/filepath"
@@ -22,10 +21,14 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 	"github.com/rqlite/rqlite/command"
 	sql "github.com/rqlite/rqlite/db"
+	"github.com/rqlite/rqlite/encryption"
 	rlog "github.com/rqlite/rqlite/log"
+	"github.com/rqlite/rqlite/logging"
+	"github.com/rqlite/rqlite/tracing"
 )
 
 var (
@@ -44,6 +47,12 @@ var (
 	// ErrInvalidBackupFormat is returned when the requested backup format
 	// is not valid.
 	ErrInvalidBackupFormat = errors.New("invalid backup format")
+
+	// ErrDBTimeoutNotAllowed is returned when a timeout is set on a request
+	// applied through the Raft log. Every node applies the request, so it
+	// must not be interrupted by a timeout, which could expire on some nodes
+	// and not others.
+	ErrDBTimeoutNotAllowed = errors.New("database timeout not supported for writes or strong reads")
 )
 
 const (
@@ -52,12 +61,31 @@ const (
 	applyTimeout        = 10 * time.Second
 	openTimeout         = 120 * time.Second
 	sqliteFile          = "db.sqlite"
+	restoreSuffix       = ".restore"      // Database file being restored from a snapshot.
+	snapshotTmpPrefix   = "snapshot-tmp-" // Directories of copies of databases being snapshotted.
+	checksumTmpPrefix   = "checksum-tmp-" // Directories of copies of databases being checksummed.
+	slowQueryLogFile    = "slow_queries.log"
 	leaderWaitDelay     = 100 * time.Millisecond
 	appliedWaitDelay    = 100 * time.Millisecond
 	connectionPoolCount = 5
 	connectionTimeout   = 10 * time.Second
 	raftLogCacheSize    = 512
+	writeQueueInterval  = 50 * time.Millisecond
+	idempotencyTTL      = 10 * time.Minute
+	idempotencyMaxKeys  = 10000
 	trailingScale       = 1.25
+
+	// idempotencyMagic marks the idempotency keys section of a snapshot, to
+	// distinguish it from any data written after the database by earlier
+	// versions.
+	idempotencyMagic = 0x69646d706f74656e
+
+	// databasesMagic marks the named databases section of a snapshot.
+	databasesMagic = 0x6e616d6564646273
+
+	// encryptedMagic is written first to an encrypted snapshot, in place of
+	// the size of the database. No database will have this as a size.
+	encryptedMagic = math.MaxUint64 - 1
 )
 
 const (
@@ -69,6 +97,14 @@ const (
 	numJoins                  = "num_joins"
 	numIgnoredJoins           = "num_ignored_joins"
 	numRemovedBeforeJoins     = "num_removed_before_joins"
+	numWriteBatches           = "num_write_batches"
+	numBatchedWrites          = "num_batched_writes"
+	numQueuedWrites           = "num_queued_writes"
+	numQueuedWritesDropped    = "num_queued_writes_dropped"
+	numQueuedWriteErrors      = "num_queued_write_errors"
+	numQueueFull              = "num_queue_full"
+	numIdempotentReplays      = "num_idempotent_replays"
+	numIdempotencyKeyReused   = "num_idempotency_key_reused"
 	snapshot_create_duration  = "snapshot_create_duration"
 	snapshot_persist_duration = "snapshot_persist_duration"
 )
@@ -97,6 +133,14 @@ func init() {
 	stats.Add(numJoins, 0)
 	stats.Add(numIgnoredJoins, 0)
 	stats.Add(numRemovedBeforeJoins, 0)
+	stats.Add(numWriteBatches, 0)
+	stats.Add(numBatchedWrites, 0)
+	stats.Add(numQueuedWrites, 0)
+	stats.Add(numQueuedWritesDropped, 0)
+	stats.Add(numQueuedWriteErrors, 0)
+	stats.Add(numQueueFull, 0)
+	stats.Add(numIdempotentReplays, 0)
+	stats.Add(numIdempotencyKeyReused, 0)
 	stats.Add(snapshot_create_duration, 0)
 	stats.Add(snapshot_persist_duration, 0)
 }
@@ -147,7 +191,8 @@ type Store struct {
 
 	numNoops int // For whitebox testing
 
-	logger *log.Logger
+	logger     *logging.Logger
+	raftLogger hclog.Logger // Logger used by Raft.
 
 	ShutdownOnRemove   bool
 	SnapshotThreshold  uint64
@@ -156,7 +201,60 @@ type Store struct {
 	HeartbeatTimeout   time.Duration
 	ElectionTimeout    time.Duration
 	ApplyTimeout       time.Duration
-	RaftLogLevel       string
+
+	// RewriteNonDeterministic controls whether non-deterministic functions,
+	// such as random() and datetime('now'), in statements which modify the
+	// database are replaced with values computed by the leader, before the
+	// statements are written to the Raft log.
+	RewriteNonDeterministic bool
+
+	// SlowQueryThreshold is the execution time above which a statement is
+	// written to the slow query log. Zero disables the slow query log.
+	SlowQueryThreshold time.Duration
+	SlowQueryLogPath   string
+
+	slowLog *slowQueryLog
+
+	// WriteBatchWindow is how long the leader waits for further execute
+	// requests, after receiving one, so that concurrent requests can be
+	// committed as a single log entry. Zero disables batching.
+	WriteBatchWindow  time.Duration
+	WriteBatchMaxSize int // Maximum number of requests in a batch.
+
+	batcher *writeBatcher
+
+	// WriteQueueCapacity is the maximum number of queued writes awaiting
+	// commit. Zero disables the write queue.
+	WriteQueueCapacity int
+	WriteQueueInterval time.Duration // How often queued writes are committed.
+
+	queue *writeQueue
+
+	// IdempotencyTTL is how long the outcome of an execute request with an
+	// idempotency key is retained, so that retries of it are not executed
+	// again. Zero disables recording of new outcomes.
+	IdempotencyTTL time.Duration
+
+	// IdempotencyMaxKeys is the maximum number of idempotency keys retained.
+	// Once exceeded, the oldest keys are discarded. Zero means no limit.
+	IdempotencyMaxKeys int
+
+	idempotency *idempotencyCache // Part of the replicated state.
+
+	// Encryption, if set, supplies the keys with which log entries and
+	// snapshots are encrypted before being written to disk. Every node of
+	// a cluster must hold every key in use.
+	Encryption encryption.KeyProvider
+
+	// Tracer, if set, records spans for requests which carry a request ID.
+	Tracer *tracing.Tracer
+
+	dbsMu sync.RWMutex
+	dbs   map[string]*sql.DB // Named databases, part of the replicated state.
+
+	checksumsMu    sync.Mutex
+	checksums      map[uint64]*checksum // Checksums computed by this node, by index.
+	checksumWorkMu sync.Mutex           // Held while computing a checksum.
 
 	numTrailingLogs uint64
 }
@@ -171,18 +269,18 @@ func IsNewNode(raftDir string) bool {
 
 // StoreConfig represents the configuration of the underlying Store.
 type StoreConfig struct {
-	DBConf *DBConfig   // The DBConfig object for this Store.
-	Dir    string      // The working directory for raft.
-	Tn     Transport   // The underlying Transport for raft.
-	ID     string      // Node ID.
-	Logger *log.Logger // The logger to use to log stuff.
+	DBConf *DBConfig       // The DBConfig object for this Store.
+	Dir    string          // The working directory for raft.
+	Tn     Transport       // The underlying Transport for raft.
+	ID     string          // Node ID.
+	Logger *logging.Logger // The logger to use to log stuff.
 }
 
 // New returns a new Store.
 func New(ln Listener, c *StoreConfig) *Store {
 	logger := c.Logger
 	if logger == nil {
-		logger = log.New(os.Stderr, "[store] ", log.LstdFlags)
+		logger = logging.New("store")
 	}
 
 	dbPath := filepath.Join(c.Dir, sqliteFile)
@@ -198,7 +296,15 @@ func New(ln Listener, c *StoreConfig) *Store {
 		dbPath:        dbPath,
 		reqMarshaller: command.NewRequestMarshaler(),
 		logger:        logger,
+		raftLogger:    logging.New("raft").Hclog(),
 		ApplyTimeout:  applyTimeout,
+
+		RewriteNonDeterministic: true,
+		IdempotencyTTL:          idempotencyTTL,
+		IdempotencyMaxKeys:      idempotencyMaxKeys,
+		idempotency:             newIdempotencyCache(),
+		dbs:                     make(map[string]*sql.DB),
+		checksums:               make(map[uint64]*checksum),
 	}
 }
 
@@ -208,22 +314,53 @@ func New(ln Listener, c *StoreConfig) *Store {
 // operation after opening the Store.
 func (s *Store) Open(enableBootstrap bool) error {
 	s.openT = time.Now()
-	s.logger.Printf("opening store with node ID %s", s.raftID)
+	s.logger.Infof("opening store with node ID %s", s.raftID)
 
 	dbType := "in-memory"
 	if !s.dbConf.Memory {
 		dbType = "on-disk"
 	}
-	s.logger.Printf("configured for an %s database at %s", dbType, s.dbPath)
+	s.logger.Infof("configured for an %s database at %s", dbType, s.dbPath)
 
-	s.logger.Printf("ensuring directory at %s exists", s.raftDir)
+	s.logger.Debugf("ensuring directory at %s exists", s.raftDir)
 	err := os.MkdirAll(s.raftDir, 0755)
 	if err != nil {
 		return err
 	}
 
+	// Remove the copies of any databases left by snapshots, or checksums,
+	// which were interrupted.
+	for _, prefix := range []string{snapshotTmpPrefix, checksumTmpPrefix} {
+		tmps, err := filepath.Glob(filepath.Join(s.raftDir, prefix+"*"))
+		if err != nil {
+			return err
+		}
+		for _, dir := range tmps {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.SlowQueryThreshold > 0 {
+		path := s.SlowQueryLogPath
+		if path == "" {
+			path = filepath.Join(s.raftDir, slowQueryLogFile)
+		}
+		s.slowLog, err = newSlowQueryLog(path, s.SlowQueryThreshold)
+		if err != nil {
+			return fmt.Errorf("open slow query log: %s", err)
+		}
+		s.logger.Infof("logging statements slower than %s to %s", s.SlowQueryThreshold, path)
+	}
+
 	// Create Raft-compatible network layer.
-	s.raftTn = raft.NewNetworkTransport(NewTransport(s.ln), connectionPoolCount, connectionTimeout, nil)
+	s.raftTn = raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		Stream:  NewTransport(s.ln),
+		MaxPool: connectionPoolCount,
+		Timeout: connectionTimeout,
+		Logger:  s.raftLogger.Named("net"),
+	})
 
 	// Don't allow control over trailing logs directly, just implement a policy.
 	s.numTrailingLogs = uint64(float64(s.SnapshotThreshold) * trailingScale)
@@ -232,7 +369,7 @@ func (s *Store) Open(enableBootstrap bool) error {
 	config.LocalID = raft.ServerID(s.raftID)
 
 	// Create the snapshot store. This allows Raft to truncate the log.
-	snapshots, err := raft.NewFileSnapshotStore(s.raftDir, retainSnapshotCount, os.Stderr)
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(s.raftDir, retainSnapshotCount, s.raftLogger.Named("snapshot"))
 	if err != nil {
 		return fmt.Errorf("file snapshot store: %s", err)
 	}
@@ -240,7 +377,7 @@ func (s *Store) Open(enableBootstrap bool) error {
 	if err != nil {
 		return fmt.Errorf("list snapshots: %s", err)
 	}
-	s.logger.Printf("%d preexisting snapshots present", len(snaps))
+	s.logger.Infof("%d preexisting snapshots present", len(snaps))
 	s.snapsExistOnOpen = len(snaps) > 0
 
 	// Create the log store and stable store.
@@ -258,26 +395,28 @@ func (s *Store) Open(enableBootstrap bool) error {
 	if err := s.setLogInfo(); err != nil {
 		return fmt.Errorf("set log info: %s", err)
 	}
-	s.logger.Printf("first log index: %d, last log index: %d, last command log index: %d:",
+	s.logger.Infof("first log index: %d, last log index: %d, last command log index: %d:",
 		s.firstIdxOnOpen, s.lastIdxOnOpen, s.lastCommandIdxOnOpen)
 
 	// If an on-disk database has been requested, and there are no snapshots, and
 	// there are no commands in the log, then this is the only opportunity to
-	// create that on-disk database file before Raft initializes.
-	if !s.dbConf.Memory && !s.snapsExistOnOpen && s.lastCommandIdxOnOpen == 0 {
+	// create that on-disk database file before Raft initializes. If instead it
+	// has been requested that the on-disk database be built on disk from the
+	// start, any snapshot is restored, and the log applied, directly to it.
+	if !s.dbConf.Memory && (s.dbConf.OnDiskStartup || (!s.snapsExistOnOpen && s.lastCommandIdxOnOpen == 0)) {
 		s.db, err = s.createOnDisk(nil)
 		if err != nil {
 			return fmt.Errorf("failed to create on-disk database")
 		}
 		s.onDiskCreated = true
-		s.logger.Printf("created on-disk database at open")
+		s.logger.Infof("created on-disk database at open")
 	} else {
 		// We need an in-memory database, at least for bootstrapping purposes.
 		s.db, err = s.createInMemory(nil)
 		if err != nil {
 			return fmt.Errorf("failed to create in-memory database")
 		}
-		s.logger.Printf("created in-memory database at open")
+		s.logger.Infof("created in-memory database at open")
 	}
 
 	// Instantiate the Raft system.
@@ -287,7 +426,7 @@ func (s *Store) Open(enableBootstrap bool) error {
 	}
 
 	if enableBootstrap {
-		s.logger.Printf("executing new cluster bootstrap")
+		s.logger.Infof("executing new cluster bootstrap")
 		configuration := raft.Configuration{
 			Servers: []raft.Server{
 				{
@@ -298,16 +437,36 @@ func (s *Store) Open(enableBootstrap bool) error {
 		}
 		ra.BootstrapCluster(configuration)
 	} else {
-		s.logger.Printf("no cluster bootstrap requested")
+		s.logger.Infof("no cluster bootstrap requested")
 	}
 
 	s.raft = ra
 
+	if s.WriteBatchWindow > 0 {
+		s.batcher = newWriteBatcher(s.WriteBatchWindow, s.WriteBatchMaxSize, s.executeBatch)
+		s.logger.Infof("batching writes with a window of %s and up to %d requests per batch",
+			s.WriteBatchWindow, s.batcher.maxSize)
+	}
+
+	if s.WriteQueueCapacity > 0 {
+		interval := s.WriteQueueInterval
+		if interval <= 0 {
+			interval = writeQueueInterval
+		}
+		s.queue = newWriteQueue(s.WriteQueueCapacity, s.WriteBatchMaxSize, interval, s.executeBatch, s.leaderTerm, s.logger)
+	}
+
 	return nil
 }
 
 // Close closes the store. If wait is true, waits for a graceful shutdown.
 func (s *Store) Close(wait bool) error {
+	if s.batcher != nil {
+		s.batcher.Close()
+	}
+	if s.queue != nil {
+		s.queue.Close()
+	}
 	f := s.raft.Shutdown()
 	if wait {
 		if e := f.(raft.Future); e.Error() != nil {
@@ -318,9 +477,17 @@ func (s *Store) Close(wait bool) error {
 	if err := s.db.Close(); err != nil {
 		return err
 	}
+	if err := s.closeNamed(); err != nil {
+		return err
+	}
 	if err := s.boltStore.Close(); err != nil {
 		return err
 	}
+	if s.slowLog != nil {
+		if err := s.slowLog.Close(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -339,7 +506,7 @@ func (s *Store) WaitForInitialLogs(timeout time.Duration) error {
 	if timeout == 0 {
 		return nil
 	}
-	s.logger.Printf("waiting for up to %s for application of initial logs (lcIdx=%d)",
+	s.logger.Infof("waiting for up to %s for application of initial logs (lcIdx=%d)",
 		timeout, s.lastCommandIdxOnOpen)
 	return s.WaitForApplied(timeout)
 }
@@ -350,7 +517,7 @@ func (s *Store) WaitForApplied(timeout time.Duration) error {
 	if timeout == 0 {
 		return nil
 	}
-	s.logger.Printf("waiting for up to %s for application of initial logs", timeout)
+	s.logger.Infof("waiting for up to %s for application of initial logs", timeout)
 	return s.WaitForAppliedIndex(s.raft.LastIndex(), timeout)
 }
 
@@ -426,7 +593,7 @@ func (s *Store) LeaderID() (string, error) {
 	}
 	configFuture := s.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
-		s.logger.Printf("failed to get raft configuration: %v", err)
+		s.logger.Errorf("failed to get raft configuration: %v", err)
 		return "", err
 	}
 
@@ -529,6 +696,10 @@ func (s *Store) Stats() (map[string]interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	namedStatus, err := s.namedStats()
+	if err != nil {
+		return nil, err
+	}
 
 	nodes, err := s.Nodes()
 	if err != nil {
@@ -562,6 +733,12 @@ func (s *Store) Stats() (map[string]interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	var queueStats map[string]interface{}
+	if s.queue != nil {
+		queueStats = s.queue.Stats()
+	}
+
 	status := map[string]interface{}{
 		"node_id":          s.raftID,
 		"raft":             raftStats,
@@ -572,18 +749,25 @@ func (s *Store) Stats() (map[string]interface{}, error) {
 			"node_id": leaderID,
 			"addr":    leaderAddr,
 		},
-		"apply_timeout":      s.ApplyTimeout.String(),
-		"heartbeat_timeout":  s.HeartbeatTimeout.String(),
-		"election_timeout":   s.ElectionTimeout.String(),
-		"snapshot_threshold": s.SnapshotThreshold,
-		"snapshot_interval":  s.SnapshotInterval,
-		"trailing_logs":      s.numTrailingLogs,
-		"request_marshaler":  s.reqMarshaller.Stats(),
-		"nodes":              nodes,
-		"dir":                s.raftDir,
-		"dir_size":           dirSz,
-		"sqlite3":            dbStatus,
-		"db_conf":            s.dbConf,
+		"apply_timeout":        s.ApplyTimeout.String(),
+		"write_batch_window":   s.WriteBatchWindow.String(),
+		"write_queue":          queueStats,
+		"idempotency_keys":     s.idempotency.Len(),
+		"idempotency_ttl":      s.IdempotencyTTL.String(),
+		"idempotency_max_keys": s.IdempotencyMaxKeys,
+		"databases":            s.Databases(),
+		"heartbeat_timeout":    s.HeartbeatTimeout.String(),
+		"election_timeout":     s.ElectionTimeout.String(),
+		"snapshot_threshold":   s.SnapshotThreshold,
+		"snapshot_interval":    s.SnapshotInterval,
+		"trailing_logs":        s.numTrailingLogs,
+		"request_marshaler":    s.reqMarshaller.Stats(),
+		"nodes":                nodes,
+		"dir":                  s.raftDir,
+		"dir_size":             dirSz,
+		"sqlite3":              dbStatus,
+		"sqlite3_databases":    namedStatus,
+		"db_conf":              s.dbConf,
 	}
 	return status, nil
 }
@@ -596,8 +780,203 @@ func (s *Store) Execute(ex *command.ExecuteRequest) ([]*command.ExecuteResult, e
 	return s.execute(ex)
 }
 
+// ExecuteQueued adds the request to the write queue, returning as soon as
+// it is queued. The returned sequence number can be passed to WaitForQueued.
+func (s *Store) ExecuteQueued(ex *command.ExecuteRequest) (uint64, error) {
+	if s.queue == nil {
+		return 0, ErrQueueDisabled
+	}
+	if s.raft.State() != raft.Leader {
+		return 0, ErrNotLeader
+	}
+	if err := s.prepareExecute(ex); err != nil {
+		return 0, err
+	}
+	return s.queue.Enqueue(ex, s.startRequestSpan("store.queue", ex.Request))
+}
+
+// WaitForQueued waits until the queued write with the given sequence number
+// has been committed, or the timeout expires. If the sequence number was not
+// issued by this node, and this node is not the leader, ErrNotLeader is
+// returned, since the write may have been queued by the leader.
+func (s *Store) WaitForQueued(seq uint64, timeout time.Duration) error {
+	if s.queue == nil {
+		return ErrQueueDisabled
+	}
+	err := s.queue.Wait(seq, timeout)
+	if err == ErrUnknownSequenceNumber && s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	return err
+}
+
+// leaderTerm returns the current Raft term, if this node is the leader in
+// that term. The term is read on either side of the check of leadership, so
+// that a term which changes during the check is not returned.
+func (s *Store) leaderTerm() (uint64, error) {
+	term := func() uint64 {
+		t, _ := strconv.ParseUint(s.raft.Stats()["term"], 10, 64)
+		return t
+	}
+	t := term()
+	if t == 0 || s.raft.State() != raft.Leader || term() != t {
+		return 0, ErrNotLeader
+	}
+	return t, nil
+}
+
+// prepareExecute readies an execute request for writing to the log. It
+// rejects requests which set a timeout, records the hash, expiry time and
+// key limit of any idempotency key, and replaces non-deterministic functions
+// in the statements of the request, if enabled.
+func (s *Store) prepareExecute(ex *command.ExecuteRequest) error {
+	if ex.Request.GetDbTimeout() != 0 {
+		return ErrDBTimeoutNotAllowed
+	}
+
+	now := time.Now()
+	if ex.IdempotencyKey != "" {
+		// The request is hashed before any rewrite, which would otherwise
+		// make a retry appear to be a different request.
+		hash, err := requestHash(ex.Request)
+		if err != nil {
+			return fmt.Errorf("hash request: %s", err)
+		}
+		ex.IdempotencyHash = hash
+		if s.IdempotencyTTL > 0 {
+			ex.IdempotencyExpires = now.Add(s.IdempotencyTTL).UnixNano()
+			ex.IdempotencyMaxKeys = int64(s.IdempotencyMaxKeys)
+		}
+	}
+
+	if !s.RewriteNonDeterministic {
+		return nil
+	}
+	// Every node must apply identical statements, so non-deterministic
+	// values are computed once, here on the leader.
+	for _, stmt := range ex.Request.Statements {
+		rewritten, err := sql.RewriteNonDeterministic(stmt.Sql, now)
+		if err != nil {
+			return fmt.Errorf("rewrite statement: %s", err)
+		}
+		stmt.Sql = rewritten
+	}
+	return nil
+}
+
 func (s *Store) execute(ex *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
-	b, compressed, err := s.reqMarshaller.Marshal(ex)
+	if err := s.prepareExecute(ex); err != nil {
+		return nil, err
+	}
+
+	if s.batcher != nil {
+		span := s.startRequestSpan("store.batch", ex.Request)
+		r, err := s.batcher.Execute(ex)
+		span.SetError(err)
+		span.End()
+		return r, err
+	}
+
+	start := time.Now()
+	trace := stripTrace(ex.Request)
+	af, err := s.applyRequest(command.Command_COMMAND_TYPE_EXECUTE, ex)
+	if err != nil {
+		s.recordApply(trace, start, 0, "sqlite.execute", execTiming{}, err)
+		return nil, err
+	}
+	r := af.Response().(*fsmExecuteResponse)
+	s.recordApply(trace, start, af.Index(), "sqlite.execute", r.timing, r.error)
+	return r.results, r.error
+}
+
+// executeBatch commits the given execute requests as a single log entry,
+// returning the response for each request.
+func (s *Store) executeBatch(ers []*command.ExecuteRequest) ([]*fsmExecuteResponse, error) {
+	start := time.Now()
+	traces := make([]*command.Request, len(ers))
+	for i, er := range ers {
+		traces[i] = stripTrace(er.Request)
+	}
+	af, err := s.applyRequest(command.Command_COMMAND_TYPE_EXECUTE_BATCH,
+		&command.ExecuteBatchRequest{Requests: ers})
+	if err != nil {
+		for _, t := range traces {
+			s.recordApply(t, start, 0, "sqlite.execute", execTiming{}, err)
+		}
+		return nil, err
+	}
+	r := af.Response().(*fsmExecuteBatchResponse)
+	for i, t := range traces {
+		if i < len(r.responses) {
+			s.recordApply(t, start, af.Index(), "sqlite.execute", r.responses[i].timing, r.responses[i].error)
+		}
+	}
+	return r.responses, r.error
+}
+
+// startRequestSpan starts a span under which the request req is traced, and
+// traces req under the new span in turn. It returns nil if tracing is not
+// enabled, or req carries no request ID.
+func (s *Store) startRequestSpan(name string, req *command.Request) *tracing.Span {
+	span := s.startSpanAt(name, req, time.Now())
+	if span != nil {
+		req.ParentSpanId = span.ID().Bytes()
+	}
+	return span
+}
+
+// startSpanAt starts a span, which began at start, under which the request
+// req is traced.
+func (s *Store) startSpanAt(name string, req *command.Request, start time.Time) *tracing.Span {
+	return s.Tracer.StartAt(name, tracing.TraceIDFromRequestID(req.GetRequestId()),
+		tracing.SpanIDFromBytes(req.GetParentSpanId()), start)
+}
+
+// stripTrace clears the request ID and parent span of req, so they are not
+// written to the Raft log. They are needed only by the node which handles the
+// request, so a request holding just those fields is returned for its use.
+func stripTrace(req *command.Request) *command.Request {
+	t := &command.Request{
+		RequestId:    req.GetRequestId(),
+		ParentSpanId: req.GetParentSpanId(),
+	}
+	req.RequestId = ""
+	req.ParentSpanId = nil
+	return t
+}
+
+// recordApply logs the application of the request req, at index idx, through
+// Raft. If tracing is enabled it also records a span for the application,
+// which began at start, and a child span with the given name for the
+// execution of the request against the database. err is the error, if any,
+// returned for the request.
+func (s *Store) recordApply(req *command.Request, start time.Time, idx uint64, name string, t execTiming, err error) {
+	if req.GetRequestId() != "" {
+		if err != nil {
+			s.logger.Debugf("request %s: failed at index %d: %s", req.GetRequestId(), idx, err)
+		} else {
+			s.logger.Debugf("request %s: applied at index %d", req.GetRequestId(), idx)
+		}
+	}
+
+	span := s.startSpanAt("raft.apply", req, start)
+	if span == nil {
+		return
+	}
+	span.SetAttribute("raft.index", idx)
+	if !t.start.IsZero() {
+		db := span.ChildAt(name, t.start)
+		db.SetError(err)
+		db.EndAt(t.end)
+	}
+	span.SetError(err)
+	span.End()
+}
+
+// applyRequest writes the given request to the Raft log as a command of the
+// given type, and waits for it to be applied.
+func (s *Store) applyRequest(typ command.Command_Type, req command.Requester) (raft.ApplyFuture, error) {
+	b, compressed, err := s.reqMarshaller.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
@@ -607,13 +986,21 @@ func (s *Store) execute(ex *command.ExecuteRequest) ([]*command.ExecuteResult, e
 		stats.Add(numUncompressedCommands, 1)
 	}
 
-	c := &command.Command{
-		Type:       command.Command_COMMAND_TYPE_EXECUTE,
+	return s.applyCommand(&command.Command{
+		Type:       typ,
 		SubCommand: b,
 		Compressed: compressed,
-	}
+	})
+}
 
-	b, err = command.Marshal(c)
+// applyCommand writes the given command to the Raft log, and waits for it
+// to be applied.
+func (s *Store) applyCommand(c *command.Command) (raft.ApplyFuture, error) {
+	b, err := command.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	b, err = s.encryptLogData(b)
 	if err != nil {
 		return nil, err
 	}
@@ -629,8 +1016,20 @@ func (s *Store) execute(ex *command.ExecuteRequest) ([]*command.ExecuteResult, e
 	s.dbAppliedIndexMu.Lock()
 	s.dbAppliedIndex = af.Index()
 	s.dbAppliedIndexMu.Unlock()
-	r := af.Response().(*fsmExecuteResponse)
-	return r.results, r.error
+	return af, nil
+}
+
+// encryptLogData returns b encrypted, if encryption is enabled, for writing
+// to the Raft log. Otherwise it returns b unchanged.
+func (s *Store) encryptLogData(b []byte) ([]byte, error) {
+	if s.Encryption == nil {
+		return b, nil
+	}
+	eb, err := encryption.Encrypt(s.Encryption, b)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt log entry: %s", err)
+	}
+	return eb, nil
 }
 
 // Query executes queries that return rows, and do not modify the database.
@@ -640,39 +1039,18 @@ func (s *Store) Query(qr *command.QueryRequest) ([]*command.QueryRows, error) {
 			return nil, ErrNotLeader
 		}
 
-		b, compressed, err := s.reqMarshaller.Marshal(qr)
-		if err != nil {
-			return nil, err
-		}
-		if compressed {
-			stats.Add(numCompressedCommands, 1)
-		} else {
-			stats.Add(numUncompressedCommands, 1)
-		}
-
-		c := &command.Command{
-			Type:       command.Command_COMMAND_TYPE_QUERY,
-			SubCommand: b,
-			Compressed: compressed,
+		if qr.Request.GetDbTimeout() != 0 {
+			return nil, ErrDBTimeoutNotAllowed
 		}
-
-		b, err = command.Marshal(c)
+		start := time.Now()
+		trace := stripTrace(qr.Request)
+		af, err := s.applyRequest(command.Command_COMMAND_TYPE_QUERY, qr)
 		if err != nil {
+			s.recordApply(trace, start, 0, "sqlite.query", execTiming{}, err)
 			return nil, err
 		}
-
-		af := s.raft.Apply(b, s.ApplyTimeout).(raft.ApplyFuture)
-		if af.Error() != nil {
-			if af.Error() == raft.ErrNotLeader {
-				return nil, ErrNotLeader
-			}
-			return nil, af.Error()
-		}
-
-		s.dbAppliedIndexMu.Lock()
-		s.dbAppliedIndex = af.Index()
-		s.dbAppliedIndexMu.Unlock()
 		r := af.Response().(*fsmQueryResponse)
+		s.recordApply(trace, start, af.Index(), "sqlite.query", r.timing, r.error)
 		return r.rows, r.error
 	}
 
@@ -685,7 +1063,78 @@ func (s *Store) Query(qr *command.QueryRequest) ([]*command.QueryRows, error) {
 		return nil, ErrStaleRead
 	}
 
-	return s.db.Query(qr.Request, qr.Timings)
+	span := s.startSpanAt("sqlite.query", qr.Request, time.Now())
+	r, err := s.query(qr, s.raft.AppliedIndex())
+	span.SetError(err)
+	span.End()
+	return r, err
+}
+
+// StatementStats returns execution statistics for each distinct statement
+// executed by the default database and by each named database, ordered by
+// total execution time. Statistics of a named database carry its name.
+func (s *Store) StatementStats() []*sql.StatementStat {
+	stats := s.db.StatementStats()
+	s.dbsMu.RLock()
+	for name, db := range s.dbs {
+		for _, st := range db.StatementStats() {
+			st.Database = name
+			stats = append(stats, st)
+		}
+	}
+	s.dbsMu.RUnlock()
+	sql.SortStatementStats(stats)
+	return stats
+}
+
+// ResetStatementStats discards the statement execution statistics of every
+// database.
+func (s *Store) ResetStatementStats() {
+	s.db.ResetStatementStats()
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	for _, db := range s.dbs {
+		db.ResetStatementStats()
+	}
+}
+
+// ReadOnly returns whether every statement in the request is read-only, as
+// determined by the underlying database.
+func (s *Store) ReadOnly(req *command.Request) (bool, error) {
+	db, err := s.namedDB(req.GetDatabase())
+	if err != nil {
+		return false, err
+	}
+	for _, stmt := range req.Statements {
+		if stmt.Sql == "" {
+			continue
+		}
+		ro, err := db.StmtReadOnly(stmt.Sql)
+		if err != nil || !ro {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Explain returns the query plan, as generated by the underlying database,
+// for each statement in the request. No read consistency guarantees are made.
+func (s *Store) Explain(req *command.Request) ([]*sql.QueryPlan, error) {
+	db, err := s.namedDB(req.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	return db.Explain(req)
+}
+
+// Schema returns the schema of the named database. No read consistency
+// guarantees are made.
+func (s *Store) Schema(database string) (*sql.Schema, error) {
+	db, err := s.namedDB(database)
+	if err != nil {
+		return nil, err
+	}
+	return db.Schema()
 }
 
 // Backup writes a snapshot of the underlying database to dst
@@ -717,14 +1166,14 @@ func (s *Store) Backup(leader bool, fmt BackupFormat, dst io.Writer) error {
 // Join joins a node, identified by id and located at addr, to this store.
 // The node must be ready to respond to Raft communications at that address.
 func (s *Store) Join(id, addr string, voter bool) error {
-	s.logger.Printf("received request from node with ID %s, at %s, to join this node", id, addr)
+	s.logger.Infof("received request from node with ID %s, at %s, to join this node", id, addr)
 	if s.raft.State() != raft.Leader {
 		return ErrNotLeader
 	}
 
 	configFuture := s.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
-		s.logger.Printf("failed to get raft configuration: %v", err)
+		s.logger.Errorf("failed to get raft configuration: %v", err)
 		return err
 	}
 
@@ -736,16 +1185,16 @@ func (s *Store) Join(id, addr string, voter bool) error {
 			// join is actually needed.
 			if srv.Address == raft.ServerAddress(addr) && srv.ID == raft.ServerID(id) {
 				stats.Add(numIgnoredJoins, 1)
-				s.logger.Printf("node %s at %s already member of cluster, ignoring join request", id, addr)
+				s.logger.Infof("node %s at %s already member of cluster, ignoring join request", id, addr)
 				return nil
 			}
 
 			if err := s.remove(id); err != nil {
-				s.logger.Printf("failed to remove node %s: %v", id, err)
+				s.logger.Errorf("failed to remove node %s: %v", id, err)
 				return err
 			}
 			stats.Add(numRemovedBeforeJoins, 1)
-			s.logger.Printf("removed node %s prior to rejoin with changed ID or address", id)
+			s.logger.Infof("removed node %s prior to rejoin with changed ID or address", id)
 		}
 	}
 
@@ -764,19 +1213,19 @@ func (s *Store) Join(id, addr string, voter bool) error {
 	}
 
 	stats.Add(numJoins, 1)
-	s.logger.Printf("node with ID %s, at %s, joined successfully as %s", id, addr, prettyVoter(voter))
+	s.logger.Infof("node with ID %s, at %s, joined successfully as %s", id, addr, prettyVoter(voter))
 	return nil
 }
 
 // Remove removes a node from the store, specified by ID.
 func (s *Store) Remove(id string) error {
-	s.logger.Printf("received request to remove node %s", id)
+	s.logger.Infof("received request to remove node %s", id)
 	if err := s.remove(id); err != nil {
-		s.logger.Printf("failed to remove node %s: %s", id, err.Error())
+		s.logger.Errorf("failed to remove node %s: %s", id, err.Error())
 		return err
 	}
 
-	s.logger.Printf("node %s removed successfully", id)
+	s.logger.Infof("node %s removed successfully", id)
 	return nil
 }
 
@@ -800,6 +1249,10 @@ func (s *Store) Noop(id string) error {
 	if err != nil {
 		return err
 	}
+	bc, err = s.encryptLogData(bc)
+	if err != nil {
+		return err
+	}
 
 	af := s.raft.Apply(bc, s.ApplyTimeout).(raft.ApplyFuture)
 	if af.Error() != nil {
@@ -826,7 +1279,7 @@ func (s *Store) createInMemory(b []byte) (db *sql.DB, err error) {
 // b is non-nil, any preexisting file will first be overwritten with those contents.
 // Otherwise any pre-existing file will be removed before the database is opened.
 func (s *Store) createOnDisk(b []byte) (*sql.DB, error) {
-	if err := os.Remove(s.dbPath); err != nil && !os.IsNotExist(err) {
+	if err := sql.RemoveFiles(s.dbPath); err != nil {
 		return nil, err
 	}
 	if b != nil {
@@ -834,7 +1287,68 @@ func (s *Store) createOnDisk(b []byte) (*sql.DB, error) {
 			return nil, err
 		}
 	}
-	return sql.Open(s.dbPath, s.dbConf.FKConstraints)
+	return sql.Open(s.dbPath, s.dbConf.FKConstraints, true)
+}
+
+// restoreToTemp writes the database read from r to a temporary file next to
+// the Store's configured path, and checks the file is a database. If size is
+// non-zero, exactly size bytes must be read. It returns the path of the file.
+func (s *Store) restoreToTemp(r io.Reader, size uint64) (path string, retErr error) {
+	path = s.dbPath + restoreSuffix
+	if err := sql.RemoveFiles(path); err != nil {
+		return "", err
+	}
+	defer func() {
+		if retErr != nil {
+			sql.RemoveFiles(path)
+		}
+	}()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if size > 0 && uint64(n) != size {
+		return "", fmt.Errorf("snapshot truncated, read %d of %d bytes", n, size)
+	}
+
+	db, err := sql.Open(path, false, false)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	rows, err := db.QueryStringStmt("SELECT count(*) FROM sqlite_master")
+	if err != nil {
+		return "", err
+	}
+	if rows[0].Error != "" {
+		return "", errors.New(rows[0].Error)
+	}
+	return path, nil
+}
+
+// openRestored replaces any preexisting database file at the Store's
+// configured path with the file at path, written by restoreToTemp, and
+// opens it. If path is empty, the database is empty.
+func (s *Store) openRestored(path string) (*sql.DB, error) {
+	if path == "" {
+		return s.createOnDisk(nil)
+	}
+	if err := sql.RemoveFiles(s.dbPath); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path, s.dbPath); err != nil {
+		return nil, err
+	}
+	return sql.Open(s.dbPath, s.dbConf.FKConstraints, true)
 }
 
 // setLogInfo records some key indexs about the log.
@@ -876,7 +1390,7 @@ func (s *Store) remove(id string) error {
 func (s *Store) raftConfig() *raft.Config {
 	config := raft.DefaultConfig()
 	config.ShutdownOnRemove = s.ShutdownOnRemove
-	config.LogLevel = s.RaftLogLevel
+	config.Logger = s.raftLogger
 	if s.SnapshotThreshold != 0 {
 		config.SnapshotThreshold = s.SnapshotThreshold
 		config.TrailingLogs = s.numTrailingLogs
@@ -896,14 +1410,26 @@ func (s *Store) raftConfig() *raft.Config {
 	return config
 }
 
+// execTiming records when a request was executed against the database.
+type execTiming struct {
+	start, end time.Time
+}
+
 type fsmExecuteResponse struct {
 	results []*command.ExecuteResult
 	error   error
+	timing  execTiming
+}
+
+type fsmExecuteBatchResponse struct {
+	responses []*fsmExecuteResponse
+	error     error
 }
 
 type fsmQueryResponse struct {
-	rows  []*command.QueryRows
-	error error
+	rows   []*command.QueryRows
+	error  error
+	timing execTiming
 }
 
 type fsmGenericResponse struct {
@@ -922,12 +1448,14 @@ func (s *Store) Apply(l *raft.Log) (e interface{}) {
 			// opened.
 			s.appliedOnOpen++
 			if l.Index == s.lastCommandIdxOnOpen {
-				s.logger.Printf("%d committed log entries applied in %s, took %s since open",
+				s.logger.Infof("%d committed log entries applied in %s, took %s since open",
 					s.appliedOnOpen, time.Since(s.firstLogAppliedT), time.Since(s.openT))
 
 				// Last command log applied. Time to switch to on-disk database?
 				if s.dbConf.Memory {
-					s.logger.Println("continuing use of in-memory database")
+					s.logger.Infof("continuing use of in-memory database")
+				} else if s.onDiskCreated {
+					s.logger.Infof("continuing use of on-disk database")
 				} else {
 					// Since we're here, it means that a) an on-disk database was requested
 					// *and* there were commands in the log. A snapshot may or may not have
@@ -947,7 +1475,7 @@ func (s *Store) Apply(l *raft.Log) (e interface{}) {
 						return
 					}
 					s.onDiskCreated = true
-					s.logger.Println("successfully switched to on-disk database")
+					s.logger.Infof("successfully switched to on-disk database")
 				}
 			}
 		}
@@ -957,9 +1485,20 @@ func (s *Store) Apply(l *raft.Log) (e interface{}) {
 		s.firstLogAppliedT = time.Now()
 	}
 
+	data := l.Data
+	if encryption.IsEncrypted(data) {
+		if s.Encryption == nil {
+			panic("failed to decrypt log entry: no encryption keys")
+		}
+		var err error
+		if data, err = encryption.Decrypt(s.Encryption, data); err != nil {
+			panic(fmt.Sprintf("failed to decrypt log entry: %s", err.Error()))
+		}
+	}
+
 	var c command.Command
 
-	if err := command.Unmarshal(l.Data, &c); err != nil {
+	if err := command.Unmarshal(data, &c); err != nil {
 		panic(fmt.Sprintf("failed to unmarshal cluster command: %s", err.Error()))
 	}
 
@@ -969,23 +1508,157 @@ func (s *Store) Apply(l *raft.Log) (e interface{}) {
 		if err := command.UnmarshalSubCommand(&c, &qr); err != nil {
 			panic(fmt.Sprintf("failed to unmarshal query subcommand: %s", err.Error()))
 		}
-		r, err := s.db.Query(qr.Request, qr.Timings)
-		return &fsmQueryResponse{rows: r, error: err}
+		start := time.Now()
+		r, err := s.query(&qr, l.Index)
+		return &fsmQueryResponse{rows: r, error: err, timing: execTiming{start, time.Now()}}
 	case command.Command_COMMAND_TYPE_EXECUTE:
 		var er command.ExecuteRequest
 		if err := command.UnmarshalSubCommand(&c, &er); err != nil {
 			panic(fmt.Sprintf("failed to unmarshal execute subcommand: %s", err.Error()))
 		}
-		r, err := s.db.Execute(er.Request, er.Timings)
-		return &fsmExecuteResponse{results: r, error: err}
+		start := time.Now()
+		r := s.applyExecute(&er, l)
+		r.timing = execTiming{start, time.Now()}
+		return r
+	case command.Command_COMMAND_TYPE_EXECUTE_BATCH:
+		var br command.ExecuteBatchRequest
+		if err := command.UnmarshalSubCommand(&c, &br); err != nil {
+			panic(fmt.Sprintf("failed to unmarshal execute batch subcommand: %s", err.Error()))
+		}
+		// Each request is executed independently, so a failure in one does
+		// not affect the others, and each keeps its own transaction.
+		resps := make([]*fsmExecuteResponse, len(br.Requests))
+		for i, er := range br.Requests {
+			start := time.Now()
+			resps[i] = s.applyExecute(er, l)
+			resps[i].timing = execTiming{start, time.Now()}
+		}
+		return &fsmExecuteBatchResponse{responses: resps}
 	case command.Command_COMMAND_TYPE_NOOP:
 		s.numNoops++
 		return &fsmGenericResponse{}
+	case command.Command_COMMAND_TYPE_CREATE_DATABASE:
+		var dr command.DatabaseRequest
+		if err := command.UnmarshalSubCommand(&c, &dr); err != nil {
+			panic(fmt.Sprintf("failed to unmarshal create database subcommand: %s", err.Error()))
+		}
+		return &fsmGenericResponse{error: s.applyCreateDatabase(dr.Name)}
+	case command.Command_COMMAND_TYPE_DROP_DATABASE:
+		var dr command.DatabaseRequest
+		if err := command.UnmarshalSubCommand(&c, &dr); err != nil {
+			panic(fmt.Sprintf("failed to unmarshal drop database subcommand: %s", err.Error()))
+		}
+		return &fsmGenericResponse{error: s.applyDropDatabase(dr.Name)}
+	case command.Command_COMMAND_TYPE_MIGRATE:
+		var mr command.MigrateRequest
+		if err := command.UnmarshalSubCommand(&c, &mr); err != nil {
+			panic(fmt.Sprintf("failed to unmarshal migrate subcommand: %s", err.Error()))
+		}
+		applied, err := s.applyMigrate(&mr, l)
+		return &fsmMigrateResponse{applied: applied, error: err}
+	case command.Command_COMMAND_TYPE_CHECKSUM:
+		// Checksums are only requested of a running cluster, so none is
+		// computed for entries replayed from the log at open.
+		if l.Index <= s.lastCommandIdxOnOpen {
+			return &fsmChecksumResponse{error: ErrChecksumNotFound}
+		}
+		return &fsmChecksumResponse{checksum: s.applyChecksum(l.Index)}
 	default:
 		return &fsmGenericResponse{error: fmt.Errorf("unhandled command: %v", c.Type)}
 	}
 }
 
+// applyExecute applies the execute request contained in the given log entry.
+// If the request carries an idempotency key which has already been applied,
+// and which has not expired, the recorded outcome is returned instead.
+func (s *Store) applyExecute(er *command.ExecuteRequest, l *raft.Log) *fsmExecuteResponse {
+	if er.IdempotencyKey == "" {
+		r, err := s.executeDB(er, l.Index)
+		return &fsmExecuteResponse{results: r, error: err}
+	}
+
+	// Keys are scoped to the requesting user, so one user cannot see the
+	// results of another, and to the database written.
+	key := er.Request.GetUser() + "\x00" + er.IdempotencyKey
+	if name := er.Request.GetDatabase(); name != "" {
+		key += "\x00" + name
+	}
+
+	var now int64
+	if !l.AppendedAt.IsZero() {
+		now = l.AppendedAt.UnixNano()
+		s.idempotency.Prune(now)
+	}
+	if e, ok := s.idempotency.Get(key, now); ok {
+		if !sameRequest(e, er.IdempotencyHash) {
+			stats.Add(numIdempotencyKeyReused, 1)
+			return &fsmExecuteResponse{error: ErrIdempotencyKeyReused}
+		}
+		stats.Add(numIdempotentReplays, 1)
+		return &fsmExecuteResponse{results: e.Results, error: entryError(e)}
+	}
+
+	r, err := s.executeDB(er, l.Index)
+	if er.IdempotencyExpires > 0 {
+		s.idempotency.Add(key, er.IdempotencyExpires, er.IdempotencyHash, int(er.IdempotencyMaxKeys), r, err)
+	}
+	return &fsmExecuteResponse{results: r, error: err}
+}
+
+// executeDB runs the given execute request against the database, logging
+// any slow statements. idx is the Raft index of the request.
+func (s *Store) executeDB(er *command.ExecuteRequest, idx uint64) ([]*command.ExecuteResult, error) {
+	db, err := s.namedDB(er.Request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	if s.slowLog == nil {
+		r, err := db.Execute(er.Request, er.Timings)
+		setRaftIndex(r, idx)
+		return r, err
+	}
+
+	r, err := db.Execute(er.Request, true)
+	s.slowLog.logExecute(er.Request, r, idx)
+	if !er.Timings {
+		for i := range r {
+			r[i].Time = 0
+		}
+	}
+	setRaftIndex(r, idx)
+	return r, err
+}
+
+// setRaftIndex records, in each result, the index of the Raft log entry
+// which generated it.
+func setRaftIndex(results []*command.ExecuteResult, idx uint64) {
+	for _, r := range results {
+		r.RaftIndex = idx
+	}
+}
+
+// query runs the given query request against the database, logging any slow
+// statements. idx is the Raft index reflected by the database at the time of
+// the query.
+func (s *Store) query(qr *command.QueryRequest, idx uint64) ([]*command.QueryRows, error) {
+	db, err := s.namedDB(qr.Request.GetDatabase())
+	if err != nil {
+		return nil, err
+	}
+	if s.slowLog == nil {
+		return db.Query(qr.Request, qr.Timings)
+	}
+
+	r, err := db.Query(qr.Request, true)
+	s.slowLog.logQuery(qr.Request, qr.Level, r, idx)
+	if !qr.Timings {
+		for i := range r {
+			r[i].Time = 0
+		}
+	}
+	return r, err
+}
+
 // Database returns a copy of the underlying database. The caller MUST
 // ensure that no transaction is taking place during this call, or an error may
 // be returned. If leader is true, this operation is performed with a read
@@ -1012,18 +1685,36 @@ func (s *Store) Database(leader bool) ([]byte, error) {
 // as long as no transaction is in progress.
 func (s *Store) Snapshot() (raft.FSMSnapshot, error) {
 	fsm := &fsmSnapshot{
-		startT: time.Now(),
-		logger: s.logger,
+		startT:     time.Now(),
+		logger:     s.logger,
+		encryption: s.Encryption,
 	}
 
-	fsm.database, _ = s.db.Serialize()
-	// The error code is not meaningful from Serialize(). The code needs to be able
-	// handle a nil byte slice being returned.
+	// Snapshot is not called concurrently with Apply, so the databases are
+	// copied to files here, which Persist then streams to the sink. No
+	// database is ever held in memory in its entirety.
+	var err error
+	fsm.dir, err = ioutil.TempDir(s.raftDir, snapshotTmpPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("create snapshot directory: %s", err)
+	}
+	copies, err := s.backupDatabases(fsm.dir)
+	if err != nil {
+		os.RemoveAll(fsm.dir)
+		return nil, err
+	}
+	fsm.database, fsm.databases = copies[0].path, copies[1:]
+
+	fsm.idempotency, err = s.idempotency.Marshal()
+	if err != nil {
+		os.RemoveAll(fsm.dir)
+		return nil, fmt.Errorf("marshal idempotency keys: %s", err)
+	}
 
 	dur := time.Since(fsm.startT)
 	stats.Add(numSnaphots, 1)
 	stats.Get(snapshot_create_duration).(*expvar.Int).Set(dur.Milliseconds())
-	s.logger.Printf("node snapshot created in %s", dur)
+	s.logger.Infof("node snapshot created in %s", dur)
 	return fsm, nil
 }
 
@@ -1031,95 +1722,179 @@ func (s *Store) Snapshot() (raft.FSMSnapshot, error) {
 // will not be called concurrently with Apply(), so synchronization with Execute()
 // is not necessary.To prevent problems during queries, which may not go through
 // the log, it blocks all query requests.
-func (s *Store) Restore(rc io.ReadCloser) error {
+//
+// The existing databases are replaced only once the whole snapshot has been
+// read and checked, so a snapshot which cannot be restored leaves them in
+// place.
+func (s *Store) Restore(rc io.ReadCloser) (retErr error) {
 	startT := time.Now()
 
-	var uint64Size uint64
-	inc := int64(unsafe.Sizeof(uint64Size))
-
-	// Read all the data into RAM, since we have to decode known-length
-	// chunks of various forms.
-	var offset int64
-	b, err := ioutil.ReadAll(rc)
-	if err != nil {
-		return fmt.Errorf("readall: %s", err)
-	}
-
-	// Get size of database, checking for compression.
+	// Get size of database, checking for encryption and compression.
+	var r io.Reader = rc
 	compressed := false
-	sz, err := readUint64(b[offset : offset+inc])
+	b := make([]byte, unsafe.Sizeof(uint64(0)))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return fmt.Errorf("read compression check: %s", err)
+	}
+	sz, err := readUint64(b)
 	if err != nil {
 		return fmt.Errorf("read compression check: %s", err)
 	}
-	offset = offset + inc
+
+	if sz == encryptedMagic {
+		// The remainder of the snapshot is encrypted, and begins again with
+		// the size of the database.
+		if s.Encryption == nil {
+			return errors.New("snapshot is encrypted, but no encryption keys are set")
+		}
+		r, err = encryption.NewReader(rc, s.Encryption)
+		if err != nil {
+			return fmt.Errorf("decrypt snapshot: %s", err)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return fmt.Errorf("read compression check: %s", err)
+		}
+		sz, err = readUint64(b)
+		if err != nil {
+			return fmt.Errorf("read compression check: %s", err)
+		}
+	}
 
 	if sz == math.MaxUint64 {
 		compressed = true
 		// Database is actually compressed, read actual size next.
-		sz, err = readUint64(b[offset : offset+inc])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return fmt.Errorf("read compressed size: %s", err)
+		}
+		sz, err = readUint64(b)
 		if err != nil {
 			return fmt.Errorf("read compressed size: %s", err)
 		}
-		offset = offset + inc
 	}
 
-	// Now read in the database file data, decompress if necessary, and restore.
-	var database []byte
+	// The database file data is read, and decompressed if necessary, from
+	// the snapshot as it is restored, rather than first being read into RAM.
+	dbr := io.LimitReader(r, int64(sz))
+	var database io.Reader
 	if sz > 0 {
+		database = dbr
 		if compressed {
-			buf := new(bytes.Buffer)
-			gz, err := gzip.NewReader(bytes.NewReader(b[offset : offset+int64(sz)]))
+			gz, err := gzip.NewReader(dbr)
 			if err != nil {
 				return err
 			}
-
-			if _, err := io.Copy(buf, gz); err != nil {
+			defer gz.Close()
+			database = gz
+		}
+	} else {
+		s.logger.Infof("no database data present in restored snapshot")
+	}
+
+	// The size of an uncompressed database is checked, since a truncated
+	// snapshot would otherwise yield a truncated database without error.
+	var wantSize uint64
+	if !compressed {
+		wantSize = sz
+	}
+
+	// Either the on-disk database already exists, or it has been requested
+	// that it be built on disk from the start, or a snapshot clearly exists
+	// (this function has been called) but there are no command entries in
+	// the log -- so Apply will not be called. In the last case this is the
+	// last opportunity to create the on-disk database before Raft starts.
+	//
+	// Otherwise deserialize into an in-memory database because a) an in-memory
+	// database has been requested, or b) while there was a snapshot, there are
+	// also command entries in the log. So by sticking with an in-memory database
+	// those entries will be applied in the fastest possible manner. We will
+	// defer creation of any database on disk until the Apply function.
+	onDisk := !s.dbConf.Memory && (s.onDiskCreated || s.dbConf.OnDiskStartup || s.lastCommandIdxOnOpen == 0)
+
+	var tmpPath string
+	var memDB *sql.DB
+	if onDisk {
+		if database != nil {
+			tmpPath, err = s.restoreToTemp(database, wantSize)
+			if err != nil {
+				return fmt.Errorf("write on-disk file during restore: %s", err)
+			}
+			defer sql.RemoveFiles(tmpPath) // Nothing to remove once renamed.
+		}
+	} else {
+		var data []byte
+		if database != nil {
+			data, err = ioutil.ReadAll(database)
+			if err != nil {
 				return fmt.Errorf("SQLite database decompress: %s", err)
 			}
-
-			if err := gz.Close(); err != nil {
-				return err
+			if wantSize > 0 && uint64(len(data)) != wantSize {
+				return fmt.Errorf("snapshot truncated, read %d of %d bytes", len(data), wantSize)
 			}
-			database = buf.Bytes()
-		} else {
-			database = b[offset : offset+int64(sz)]
 		}
-	} else {
-		s.logger.Println("no database data present in restored snapshot")
-		database = nil
+		memDB, err = s.createInMemory(data)
+		if err != nil {
+			return fmt.Errorf("createInMemory: %s", err)
+		}
+		defer func() {
+			if memDB != nil {
+				memDB.Close() // Not restored.
+			}
+		}()
+	}
+
+	// Read the remainder of the snapshot, which is small relative to the
+	// database.
+	if _, err := io.Copy(ioutil.Discard, dbr); err != nil {
+		return fmt.Errorf("read database: %s", err)
+	}
+	b, err = ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("readall: %s", err)
 	}
 
+	// Snapshots written by earlier versions contain no idempotency keys.
+	idempotency := &command.IdempotencyState{}
+	section, offset, err := readSection(b, 0, idempotencyMagic)
+	if err != nil {
+		return fmt.Errorf("read idempotency keys: %s", err)
+	}
+	if section != nil {
+		if idempotency, err = unmarshalIdempotencyState(section); err != nil {
+			return fmt.Errorf("unmarshal idempotency keys: %s", err)
+		}
+	}
+
+	// Named databases follow the idempotency keys, if present.
+	section, _, err = readSection(b, offset, databasesMagic)
+	if err != nil {
+		return fmt.Errorf("read named databases: %s", err)
+	}
+	named, err := unmarshalNamed(section)
+	if err != nil {
+		return fmt.Errorf("restore named databases: %s", err)
+	}
+
+	// The whole snapshot has been read, so replace the existing databases.
 	if err := s.db.Close(); err != nil {
 		return fmt.Errorf("failed to close pre-restore database: %s", err)
 	}
-
-	var db *sql.DB
-	if !s.dbConf.Memory && s.lastCommandIdxOnOpen == 0 {
-		// A snapshot clearly exists (this function has been called) but there
-		// are no command entries in the log -- so Apply will not be called.
-		// Therefore this is the last opportunity to create the on-disk database
-		// before Raft starts.
-		db, err = s.createOnDisk(database)
+	if onDisk {
+		s.db, err = s.openRestored(tmpPath)
 		if err != nil {
 			return fmt.Errorf("open on-disk file during restore: %s", err)
 		}
 		s.onDiskCreated = true
-		s.logger.Println("successfully switched to on-disk database due to restore")
+		s.logger.Infof("successfully restored on-disk database")
 	} else {
-		// Deserialize into an in-memory database because a) an in-memory database
-		// has been requested, or b) while there was a snapshot, there are also
-		// command entries in the log. So by sticking with an in-memory database
-		// those entries will be applied in the fastest possible manner. We will
-		// defer creation of any database on disk until the Apply function.
-		db, err = s.createInMemory(database)
-		if err != nil {
-			return fmt.Errorf("createInMemory: %s", err)
-		}
+		s.db, memDB = memDB, nil
+	}
+	s.idempotency.Set(idempotency)
+	if err := s.restoreNamed(named); err != nil {
+		return fmt.Errorf("restore named databases: %s", err)
 	}
-	s.db = db
 
 	stats.Add(numRestores, 1)
-	s.logger.Printf("node restored in %s", time.Since(startT))
+	s.logger.Infof("node restored in %s", time.Since(startT))
 	return nil
 }
 
@@ -1143,10 +1918,14 @@ func (s *Store) logSize() (int64, error) {
 }
 
 type fsmSnapshot struct {
-	startT time.Time
-	logger *log.Logger
-
-	database []byte
+	startT     time.Time
+	logger     *logging.Logger
+	encryption encryption.KeyProvider
+
+	dir         string         // Temporary directory holding the copies.
+	database    string         // Path of the copy of the default database.
+	idempotency []byte         // Marshaled idempotency keys.
+	databases   []databaseCopy // Copies of the named databases.
 }
 
 // Persist writes the snapshot to the given sink.
@@ -1154,12 +1933,32 @@ func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	defer func() {
 		dur := time.Since(f.startT)
 		stats.Get(snapshot_persist_duration).(*expvar.Int).Set(dur.Milliseconds())
-		f.logger.Printf("snapshot and persist took %s", dur)
+		f.logger.Infof("snapshot and persist took %s", dur)
 	}()
 
 	err := func() error {
 		b := new(bytes.Buffer)
 
+		// If encryption is enabled, flag it, and write the remainder of the
+		// snapshot through an encrypting writer.
+		var w io.Writer = sink
+		var ew *encryption.Writer
+		if f.encryption != nil {
+			if err := writeUint64(b, encryptedMagic); err != nil {
+				return err
+			}
+			if _, err := sink.Write(b.Bytes()); err != nil {
+				return err
+			}
+			b.Reset()
+			var err error
+			ew, err = encryption.NewWriter(sink, f.encryption)
+			if err != nil {
+				return fmt.Errorf("encrypt snapshot: %s", err)
+			}
+			w = ew
+		}
+
 		// Flag compressed database by writing max uint64 value first.
 		// No SQLite database written by earlier versions will have this
 		// as a size. *Surely*.
@@ -1167,38 +1966,51 @@ func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 		if err != nil {
 			return err
 		}
-		if _, err := sink.Write(b.Bytes()); err != nil {
+		if _, err := w.Write(b.Bytes()); err != nil {
 			return err
 		}
 		b.Reset() // Clear state of buffer for future use.
 
-		// Get compressed copy of database.
-		cdb, err := f.compressedDatabase()
+		// Compress the database to a file, as its compressed size must be
+		// written before it.
+		cdb, err := f.compressDatabase()
 		if err != nil {
 			return err
 		}
 
-		if cdb != nil {
-			// Write size of compressed database.
-			err = writeUint64(b, uint64(len(cdb)))
-			if err != nil {
-				return err
-			}
-			if _, err := sink.Write(b.Bytes()); err != nil {
-				return err
-			}
-
-			// Write compressed database to sink.
-			if _, err := sink.Write(cdb); err != nil {
+		if cdb != "" {
+			if err := writeFile(w, cdb); err != nil {
 				return err
 			}
 		} else {
-			f.logger.Println("no database data available for snapshot")
+			f.logger.Infof("no database data available for snapshot")
 			err = writeUint64(b, uint64(0))
 			if err != nil {
 				return err
 			}
-			if _, err := sink.Write(b.Bytes()); err != nil {
+			if _, err := w.Write(b.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		// Write the idempotency keys after the database, where earlier
+		// versions will ignore them.
+		if err := writeSection(w, idempotencyMagic, f.idempotency); err != nil {
+			return err
+		}
+		named := filepath.Join(f.dir, "databases.gz")
+		if err := writeNamed(named, f.databases); err != nil {
+			return fmt.Errorf("compress named databases: %s", err)
+		}
+		if err := writeUint64(w, databasesMagic); err != nil {
+			return err
+		}
+		if err := writeFile(w, named); err != nil {
+			return err
+		}
+
+		if ew != nil {
+			if err := ew.Close(); err != nil {
 				return err
 			}
 		}
@@ -1215,24 +2027,35 @@ func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	return nil
 }
 
-func (f *fsmSnapshot) compressedDatabase() ([]byte, error) {
-	if f.database == nil {
-		return nil, nil
+// compressDatabase compresses the copy of the default database to a file,
+// returning its path. If the database is empty, the empty string is
+// returned.
+func (f *fsmSnapshot) compressDatabase() (string, error) {
+	fi, err := os.Stat(f.database)
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() == 0 {
+		return "", nil
 	}
 
-	var buf bytes.Buffer
-	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	path := filepath.Join(f.dir, "db.gz")
+	out, err := os.Create(path)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-
-	if _, err := gz.Write(f.database); err != nil {
-		return nil, err
+	defer out.Close()
+	gz, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if err := copyFile(gz, f.database); err != nil {
+		return "", err
 	}
 	if err := gz.Close(); err != nil {
-		return nil, err
+		return "", err
 	}
-	return buf.Bytes(), nil
+	return path, out.Close()
 }
 
 // Database copies contents of the underlying SQLite database to dst
@@ -1270,8 +2093,112 @@ func (s *Store) databaseTypePretty() string {
 	return "on-disk"
 }
 
-// Release is a no-op.
-func (f *fsmSnapshot) Release() {}
+// Release removes the copies of the databases.
+func (f *fsmSnapshot) Release() {
+	if err := os.RemoveAll(f.dir); err != nil {
+		f.logger.Warnf("failed to remove snapshot directory %s: %s", f.dir, err)
+	}
+}
+
+// databaseCopy is a copy, in a file, of a database.
+type databaseCopy struct {
+	name string // Empty for the default database.
+	path string
+}
+
+// backupDatabases copies every database to a file in dir, the default
+// database first, and then the named databases in order of name. The copies
+// are taken using the SQLite backup API, so the databases are never held in
+// memory in their entirety.
+func (s *Store) backupDatabases(dir string) ([]databaseCopy, error) {
+	// Checkpointing first means the copies are read from database files
+	// which reflect every applied entry, without any frames in the WAL.
+	if err := s.db.Checkpoint(); err != nil {
+		s.logger.Warnf("failed to checkpoint database before backup: %s", err)
+	}
+	copies := []databaseCopy{{path: filepath.Join(dir, "db")}}
+	if err := s.db.Backup(copies[0].path); err != nil {
+		return nil, err
+	}
+
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	for _, name := range s.sortedNames() {
+		if err := s.dbs[name].Checkpoint(); err != nil {
+			s.logger.Warnf("failed to checkpoint database %s before backup: %s", name, err)
+		}
+		c := databaseCopy{name: name, path: filepath.Join(dir, "db."+name)}
+		if err := s.dbs[name].Backup(c.path); err != nil {
+			return nil, fmt.Errorf("database %s: %s", name, err)
+		}
+		copies = append(copies, c)
+	}
+	return copies, nil
+}
+
+// writeFile writes the size of the file at path, followed by its contents,
+// to w.
+func writeFile(w io.Writer, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(fi.Size())); err != nil {
+		return err
+	}
+	return copyFile(w, path)
+}
+
+// copyFile copies the contents of the file at path to w.
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// writeSection writes an optional section of a snapshot, identified by the
+// given magic number, to w.
+func writeSection(w io.Writer, magic uint64, data []byte) error {
+	b := new(bytes.Buffer)
+	if err := writeUint64(b, magic); err != nil {
+		return err
+	}
+	if err := writeUint64(b, uint64(len(data))); err != nil {
+		return err
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readSection reads the optional snapshot section, identified by the given
+// magic number, at the given offset of b. If the section is present, its
+// data and the offset following it are returned. Otherwise nil data and the
+// unchanged offset are returned.
+func readSection(b []byte, offset int64, magic uint64) ([]byte, int64, error) {
+	inc := int64(unsafe.Sizeof(magic))
+	if offset+2*inc > int64(len(b)) {
+		return nil, offset, nil
+	}
+	if m, err := readUint64(b[offset : offset+inc]); err != nil || m != magic {
+		return nil, offset, nil
+	}
+	sz, err := readUint64(b[offset+inc : offset+2*inc])
+	if err != nil {
+		return nil, offset, err
+	}
+	start := offset + 2*inc
+	if start+int64(sz) > int64(len(b)) {
+		return nil, offset, fmt.Errorf("section truncated")
+	}
+	return b[start : start+int64(sz)], start + int64(sz), nil
+}
 
 func readUint64(b []byte) (uint64, error) {
 	var sz uint64
@@ -2,18 +2,27 @@ package store
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
 	"github.com/rqlite/rqlite/command"
 	"github.com/rqlite/rqlite/command/encoding"
+	"github.com/rqlite/rqlite/encryption"
+	"github.com/rqlite/rqlite/logging"
 	"github.com/rqlite/rqlite/testdata/chinook"
+	"github.com/rqlite/rqlite/tracing"
 )
 
 func Test_OpenStoreSingleNode(t *testing.T) {
@@ -92,6 +101,1176 @@ func Test_SingleNodeInMemExecuteQuery(t *testing.T) {
 	}
 }
 
+func Test_SingleNodeExecuteRaftIndex(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	for _, stmt := range []string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	} {
+		re, err := s.Execute(executeRequestFromString(stmt, false, false))
+		if err != nil {
+			t.Fatalf("failed to execute on single node: %s", err.Error())
+		}
+		if exp, got := s.raft.AppliedIndex(), re[0].RaftIndex; exp != got {
+			t.Fatalf("wrong Raft index in execute result, exp %d, got %d", exp, got)
+		}
+	}
+}
+
+func Test_SingleNodeExecuteReturning(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	er := executeRequestFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(name) VALUES('fiona') RETURNING id, name`,
+	}, false, false)
+	r, err := s.Execute(er)
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if exp, got := `[{},{"last_insert_id":1,"rows_affected":1,"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"]]}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for execute\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeExecuteTimeoutNotAllowed(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	// Writes, and strong reads, are applied by every node, so may not be
+	// interrupted.
+	er := executeRequestFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, false, false)
+	er.Request.DbTimeout = int64(time.Second)
+	if _, err := s.Execute(er); err != ErrDBTimeoutNotAllowed {
+		t.Fatalf("wrong error for execute with timeout: %v", err)
+	}
+	if er.Request.DbTimeout != int64(time.Second) {
+		t.Fatalf("request modified by store")
+	}
+	qr := queryRequestFromString("SELECT * FROM foo", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_STRONG
+	qr.Request.DbTimeout = int64(time.Second)
+	if _, err := s.Query(qr); err != ErrDBTimeoutNotAllowed {
+		t.Fatalf("wrong error for strong query with timeout: %v", err)
+	}
+
+	// Nothing was written to the log.
+	qr.Request.DbTimeout = 0
+	r, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[{"error":"no such table: foo"}]`, asJSON(r); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeWriteBatching(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+	s.WriteBatchWindow = 100 * time.Millisecond
+	s.WriteBatchMaxSize = 100
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	er := executeRequestFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, false, false)
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	batchesBefore := stats.Get(numWriteBatches).String()
+	const numWrites = 10
+	type response struct {
+		results []*command.ExecuteResult
+		err     error
+	}
+	responses := make([]response, numWrites)
+	var wg sync.WaitGroup
+	for i := 0; i < numWrites; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stmts := []string{fmt.Sprintf(`INSERT INTO foo(id, name) VALUES(%d, 'fiona')`, i+1)}
+			if i == 0 {
+				// This transaction fails, and must not affect other requests.
+				stmts = append(stmts, `INSERT INTO foo(id, name) VALUES(1, 'fiona')`)
+			}
+			responses[i].results, responses[i].err = s.Execute(executeRequestFromStrings(stmts, false, i == 0))
+		}(i)
+	}
+	wg.Wait()
+
+	if batchesBefore == stats.Get(numWriteBatches).String() {
+		t.Fatalf("no write batches committed")
+	}
+	for i, r := range responses {
+		if r.err != nil {
+			t.Fatalf("failed to execute request %d: %s", i, r.err.Error())
+		}
+		exp := fmt.Sprintf(`[{"last_insert_id":%d,"rows_affected":1}]`, i+1)
+		if i == 0 {
+			exp = `[{"last_insert_id":1,"rows_affected":1},{"error":"UNIQUE constraint failed: foo.id"}]`
+		}
+		if got := asJSON(r.results); exp != got {
+			t.Fatalf("unexpected results for request %d\nexp: %s\ngot: %s", i, exp, got)
+		}
+	}
+
+	qr := queryRequestFromString("SELECT COUNT(*) FROM foo WHERE id=1", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+	r, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[0]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+	qr = queryRequestFromString("SELECT COUNT(*) FROM foo", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+	r, err = s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[9]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeQueuedExecute(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+	s.WriteQueueCapacity = 100
+	s.WriteQueueInterval = 10 * time.Millisecond
+	s.WriteBatchMaxSize = 4
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	er := executeRequestFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, false, false)
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	term, err := s.leaderTerm()
+	if err != nil {
+		t.Fatalf("failed to get leader term: %s", err.Error())
+	}
+	seq := term << sequenceTermShift
+	for i := 0; i < 10; i++ {
+		er := executeRequestFromString(fmt.Sprintf(`INSERT INTO foo(id, name) VALUES(%d, 'fiona')`, i+1), false, false)
+		n, err := s.ExecuteQueued(er)
+		if err != nil {
+			t.Fatalf("failed to queue write: %s", err.Error())
+		}
+		if n != seq+1 {
+			t.Fatalf("wrong sequence number, exp %d, got %d", seq+1, n)
+		}
+		seq = n
+	}
+	if err := s.WaitForQueued(seq, 5*time.Second); err != nil {
+		t.Fatalf("failed to wait for queued write: %s", err.Error())
+	}
+	for _, n := range []uint64{seq + 1, term << sequenceTermShift, (term+1)<<sequenceTermShift + 1, 1} {
+		if err := s.WaitForQueued(n, time.Second); err != ErrUnknownSequenceNumber {
+			t.Fatalf("wrong error waiting for unknown sequence number %d: %v", n, err)
+		}
+	}
+
+	qr := queryRequestFromString("SELECT COUNT(*) FROM foo", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+	r, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[10]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_WriteQueueDropped(t *testing.T) {
+	fail := true
+	var committed int
+	commit := func(ers []*command.ExecuteRequest) ([]*fsmExecuteResponse, error) {
+		if fail {
+			return nil, ErrNotLeader
+		}
+		resps := make([]*fsmExecuteResponse, len(ers))
+		for i := range resps {
+			resps[i] = &fsmExecuteResponse{}
+		}
+		committed += len(ers)
+		return resps, nil
+	}
+	logger := logging.New("store")
+	logger.SetOutput(ioutil.Discard)
+	leaderTerm := func() (uint64, error) {
+		return 2, nil
+	}
+	q := newWriteQueue(3, 10, time.Hour, commit, leaderTerm, logger)
+
+	er := executeRequestFromString(`INSERT INTO foo(id) VALUES(1)`, false, false)
+	for i := 0; i < 3; i++ {
+		if _, err := q.Enqueue(er, nil); err != nil {
+			t.Fatalf("failed to queue write: %s", err.Error())
+		}
+	}
+	if _, err := q.Enqueue(er, nil); err != ErrQueueFull {
+		t.Fatalf("wrong error queuing write to full queue: %v", err)
+	}
+
+	q.flush()
+	for seq := uint64(2<<32 + 1); seq <= 2<<32+3; seq++ {
+		if err := q.Wait(seq, time.Second); err != ErrQueuedWriteDropped {
+			t.Fatalf("wrong error waiting for dropped write %d: %v", seq, err)
+		}
+	}
+
+	fail = false
+	seq, err := q.Enqueue(er, nil)
+	if err != nil {
+		t.Fatalf("failed to queue write: %s", err.Error())
+	}
+	q.Close()
+	if err := q.Wait(seq, time.Second); err != nil {
+		t.Fatalf("failed to wait for queued write: %s", err.Error())
+	}
+	if committed != 1 {
+		t.Fatalf("wrong number of writes committed, exp 1, got %d", committed)
+	}
+}
+
+func Test_SingleNodeIdempotencyKey(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	er := executeRequestFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, false, false)
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	execute := func(key, user, database string) string {
+		er := executeRequestFromString(`INSERT INTO foo(name) VALUES('fiona')`, false, false)
+		er.IdempotencyKey = key
+		er.Request.User = user
+		er.Request.Database = database
+		r, err := s.Execute(er)
+		if err != nil {
+			t.Fatalf("failed to execute on single node: %s", err.Error())
+		}
+		return asJSON(r)
+	}
+	count := func() string {
+		qr := queryRequestFromString("SELECT COUNT(*) FROM foo", false, false)
+		qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+		r, err := s.Query(qr)
+		if err != nil {
+			t.Fatalf("failed to query single node: %s", err.Error())
+		}
+		return asJSON(r[0].Values)
+	}
+
+	for i := 0; i < 2; i++ {
+		if exp, got := `[{"last_insert_id":1,"rows_affected":1}]`, execute("abc", "", ""); exp != got {
+			t.Fatalf("unexpected results for execute %d\nexp: %s\ngot: %s", i, exp, got)
+		}
+	}
+	if exp, got := `[[1]]`, count(); exp != got {
+		t.Fatalf("repeated idempotency key executed again, exp %s, got %s", exp, got)
+	}
+
+	// Keys are scoped to the requesting user.
+	if exp, got := `[{"last_insert_id":2,"rows_affected":1}]`, execute("abc", "bob", ""); exp != got {
+		t.Fatalf("unexpected results for execute\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Keys are scoped to the database written.
+	if err := s.CreateDatabase("orders"); err != nil {
+		t.Fatalf("failed to create database: %s", err.Error())
+	}
+	er = executeRequestFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, false, false)
+	er.Request.Database = "orders"
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if exp, got := `[{"last_insert_id":1,"rows_affected":1}]`, execute("abc", "bob", "orders"); exp != got {
+		t.Fatalf("unexpected results for execute\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[{"last_insert_id":1,"rows_affected":1}]`, execute("abc", "bob", "orders"); exp != got {
+		t.Fatalf("unexpected results for repeated execute\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Ensure keys survive a snapshot and restore.
+	f, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	if err := f.Persist(&mockSnapshotSink{snapFile}); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+	s.idempotency.Reset()
+	snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to open snapshot file: %s", err.Error())
+	}
+	if err := s.Restore(snapFile); err != nil {
+		t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+	}
+	if exp, got := 3, s.idempotency.Len(); exp != got {
+		t.Fatalf("wrong number of idempotency keys after restore, exp %d, got %d", exp, got)
+	}
+	if exp, got := `[{"last_insert_id":1,"rows_affected":1}]`, execute("abc", "", ""); exp != got {
+		t.Fatalf("unexpected results for execute after restore\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[[2]]`, count(); exp != got {
+		t.Fatalf("repeated idempotency key executed again, exp %s, got %s", exp, got)
+	}
+
+	// Once the key expires, the request is executed again.
+	s.IdempotencyTTL = time.Millisecond
+	execute("def", "", "")
+	time.Sleep(10 * time.Millisecond)
+	if exp, got := `[{"last_insert_id":4,"rows_affected":1}]`, execute("def", "", ""); exp != got {
+		t.Fatalf("unexpected results for execute of expired key\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeIdempotencyKeyReused(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	er := executeRequestFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, r INTEGER)`, false, false)
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	execute := func(stmt string) (string, error) {
+		er := executeRequestFromString(stmt, false, false)
+		er.IdempotencyKey = "abc"
+		r, err := s.Execute(er)
+		return asJSON(r), err
+	}
+
+	// A retry matches the request as sent, before any rewrite.
+	for i := 0; i < 2; i++ {
+		r, err := execute(`INSERT INTO foo(r) VALUES(random())`)
+		if err != nil {
+			t.Fatalf("failed to execute on single node: %s", err.Error())
+		}
+		if exp, got := `[{"last_insert_id":1,"rows_affected":1}]`, r; exp != got {
+			t.Fatalf("unexpected results for execute %d\nexp: %s\ngot: %s", i, exp, got)
+		}
+	}
+	if _, err := execute(`INSERT INTO foo(r) VALUES(1)`); err != ErrIdempotencyKeyReused {
+		t.Fatalf("wrong error for reused idempotency key: %v", err)
+	}
+}
+
+func Test_SingleNodeNamedDatabaseStats(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	if err := s.CreateDatabase("orders"); err != nil {
+		t.Fatalf("failed to create database: %s", err.Error())
+	}
+	for _, database := range []string{"", "orders"} {
+		er := executeRequestFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, false, false)
+		er.Request.Database = database
+		if _, err := s.Execute(er); err != nil {
+			t.Fatalf("failed to execute on single node: %s", err.Error())
+		}
+	}
+
+	databases := map[string]int{}
+	for _, st := range s.StatementStats() {
+		if st.Fingerprint == "create table foo (id integer not null primary key, name text)" {
+			databases[st.Database] += int(st.Calls)
+		}
+	}
+	if exp, got := `{"":1,"orders":1}`, asJSON(databases); exp != got {
+		t.Fatalf("wrong statement stats by database, exp %s, got %s", exp, got)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatalf("failed to get store stats: %s", err.Error())
+	}
+	if _, ok := stats["sqlite3_databases"].(map[string]interface{})["orders"]; !ok {
+		t.Fatalf("named database missing from store stats")
+	}
+
+	s.ResetStatementStats()
+	if n := len(s.StatementStats()); n != 0 {
+		t.Fatalf("statement stats not reset, got %d fingerprints", n)
+	}
+}
+
+func Test_IdempotencyCacheMaxKeys(t *testing.T) {
+	c := newIdempotencyCache()
+	for i, key := range []string{"a", "b", "a", "c", "d"} {
+		c.Add(key, int64(100+i), nil, 3, nil, nil)
+	}
+	if exp, got := 3, c.Len(); exp != got {
+		t.Fatalf("wrong number of keys, exp %d, got %d", exp, got)
+	}
+	// The first "a" was replaced, so "b" is the oldest key, and evicted.
+	for key, exp := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := c.Get(key, 0); ok != exp {
+			t.Fatalf("wrong presence of key %s, exp %v, got %v", key, exp, ok)
+		}
+	}
+
+	c.Add("e", 200, nil, 0, nil, nil)
+	if exp, got := 4, c.Len(); exp != got {
+		t.Fatalf("wrong number of keys with no limit, exp %d, got %d", exp, got)
+	}
+}
+
+func Test_SingleNodeNamedDatabases(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	if err := s.CreateDatabase("1bad"); err != ErrInvalidDatabaseName {
+		t.Fatalf("wrong error creating database with invalid name: %v", err)
+	}
+	if err := s.CreateDatabase("orders"); err != nil {
+		t.Fatalf("failed to create database: %s", err.Error())
+	}
+	if err := s.CreateDatabase("orders"); err != ErrDatabaseExists {
+		t.Fatalf("wrong error creating existing database: %v", err)
+	}
+	if exp, got := `["orders"]`, asJSON(s.Databases()); exp != got {
+		t.Fatalf("wrong databases, exp %s, got %s", exp, got)
+	}
+
+	er := executeRequestFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	}, false, false)
+	er.Request.Database = "orders"
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	query := func(database string) string {
+		qr := queryRequestFromString("SELECT * FROM foo", false, false)
+		qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+		qr.Request.Database = database
+		r, err := s.Query(qr)
+		if err != nil {
+			return err.Error()
+		}
+		return asJSON(r)
+	}
+	if exp, got := `[{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"]]}]`, query("orders"); exp != got {
+		t.Fatalf("unexpected results for query of named database\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := `[{"error":"no such table: foo"}]`, query(""); exp != got {
+		t.Fatalf("named database table visible in default database\nexp: %s\ngot: %s", exp, got)
+	}
+	if exp, got := ErrDatabaseNotFound.Error(), query("other"); exp != got {
+		t.Fatalf("unexpected results for query of missing database\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// Ensure named databases survive a snapshot and restore.
+	f, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapFile, err := os.Create(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	if err := f.Persist(&mockSnapshotSink{snapFile}); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+	if err := s.DropDatabase("orders"); err != nil {
+		t.Fatalf("failed to drop database: %s", err.Error())
+	}
+	if exp, got := ErrDatabaseNotFound.Error(), query("orders"); exp != got {
+		t.Fatalf("unexpected results for query of dropped database\nexp: %s\ngot: %s", exp, got)
+	}
+	snapFile, err = os.Open(filepath.Join(snapDir, "snapshot"))
+	if err != nil {
+		t.Fatalf("failed to open snapshot file: %s", err.Error())
+	}
+	if err := s.Restore(snapFile); err != nil {
+		t.Fatalf("failed to restore snapshot from disk: %s", err.Error())
+	}
+	if exp, got := `[{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"]]}]`, query("orders"); exp != got {
+		t.Fatalf("unexpected results for query after restore\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_WriteNamed(t *testing.T) {
+	dir := mustTempDir()
+	defer os.RemoveAll(dir)
+
+	exp := &command.NamedDatabases{
+		Databases: []*command.NamedDatabase{
+			{Name: "empty"},
+			{Name: "orders", Data: bytes.Repeat([]byte("abc"), 1000)},
+		},
+	}
+	var copies []databaseCopy
+	for _, d := range exp.Databases {
+		c := databaseCopy{name: d.Name, path: filepath.Join(dir, d.Name)}
+		if err := ioutil.WriteFile(c.path, d.Data, 0644); err != nil {
+			t.Fatalf("failed to write database copy: %s", err)
+		}
+		copies = append(copies, c)
+	}
+
+	path := filepath.Join(dir, "databases.gz")
+	if err := writeNamed(path, copies); err != nil {
+		t.Fatalf("failed to write named databases: %s", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read named databases: %s", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("failed to decompress named databases: %s", err)
+	}
+	got, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to decompress named databases: %s", err)
+	}
+	want, err := proto.Marshal(exp)
+	if err != nil {
+		t.Fatalf("failed to marshal named databases: %s", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatalf("named databases not encoded as by proto.Marshal")
+	}
+
+	dbs, err := unmarshalNamed(b)
+	if err != nil {
+		t.Fatalf("failed to unmarshal named databases: %s", err)
+	}
+	if !proto.Equal(exp, dbs) {
+		t.Fatalf("wrong named databases, exp %v, got %v", exp, dbs)
+	}
+}
+
+func Test_SingleNodeSnapshotRelease(t *testing.T) {
+	s := mustNewStore(false)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	f, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+	tmps, err := filepath.Glob(filepath.Join(s.Path(), snapshotTmpPrefix+"*"))
+	if err != nil || len(tmps) != 1 {
+		t.Fatalf("expected one snapshot directory, got %v: %v", tmps, err)
+	}
+	f.Release()
+	if _, err := os.Stat(tmps[0]); !os.IsNotExist(err) {
+		t.Fatalf("snapshot directory exists after release")
+	}
+}
+
+func Test_SingleNodeRestoreCorruptNamedDatabases(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	if err := s.CreateDatabase("orders"); err != nil {
+		t.Fatalf("failed to create database: %s", err.Error())
+	}
+	er := executeRequestFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	}, false, false)
+	er.Request.Database = "orders"
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	f, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot node: %s", err.Error())
+	}
+	snapDir := mustTempDir()
+	defer os.RemoveAll(snapDir)
+	snapPath := filepath.Join(snapDir, "snapshot")
+	snapFile, err := os.Create(snapPath)
+	if err != nil {
+		t.Fatalf("failed to create snapshot file: %s", err.Error())
+	}
+	if err := f.Persist(&mockSnapshotSink{snapFile}); err != nil {
+		t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+	}
+	b, err := ioutil.ReadFile(snapPath)
+	if err != nil {
+		t.Fatalf("failed to read snapshot file: %s", err.Error())
+	}
+
+	// The named databases are the last section of the snapshot, so
+	// corrupting the final byte leaves them impossible to decode.
+	b[len(b)-1] ^= 0xff
+	if err := s.Restore(ioutil.NopCloser(bytes.NewReader(b))); err == nil {
+		t.Fatalf("restored snapshot with corrupt named databases")
+	}
+
+	qr := queryRequestFromString("SELECT * FROM foo", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+	qr.Request.Database = "orders"
+	r, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query named database: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
+func Test_SingleNodeMigrate(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	m1 := &command.Migration{Version: 1, Name: "create foo", Sql: `CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`}
+	m2 := &command.Migration{Version: 2, Sql: `ALTER TABLE foo ADD COLUMN age INTEGER; CREATE INDEX foo_age ON foo(age)`}
+	m3 := &command.Migration{Version: 3, Sql: `INSERT INTO foo(id, name) VALUES(1, "fiona")`}
+	migrate := func(ms ...*command.Migration) ([]int64, error) {
+		applied, err := s.Migrate(&command.MigrateRequest{Migrations: ms})
+		var versions []int64
+		for _, a := range applied {
+			versions = append(versions, a.Version)
+		}
+		return versions, err
+	}
+
+	if m, err := s.Migrations(""); err != nil || len(m) != 0 {
+		t.Fatalf("unexpected migrations before any applied: %v, %v", m, err)
+	}
+
+	applied, err := migrate(m1, m2)
+	if err != nil {
+		t.Fatalf("failed to migrate: %s", err.Error())
+	}
+	if exp, got := `[1,2]`, asJSON(applied); exp != got {
+		t.Fatalf("wrong migrations applied, exp %s, got %s", exp, got)
+	}
+
+	// Applying the same migrations again does nothing.
+	applied, err = migrate(m1, m2, m3)
+	if err != nil {
+		t.Fatalf("failed to migrate: %s", err.Error())
+	}
+	if exp, got := `[3]`, asJSON(applied); exp != got {
+		t.Fatalf("wrong migrations applied, exp %s, got %s", exp, got)
+	}
+	applied, err = migrate(m1, m2, m3)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("repeated migrations applied again: %v, %v", applied, err)
+	}
+
+	migrations, err := s.Migrations("")
+	if err != nil {
+		t.Fatalf("failed to get migrations: %s", err.Error())
+	}
+	if len(migrations) != 3 || migrations[0].Name != "create foo" || migrations[2].Checksum != migrationChecksum(m3) {
+		t.Fatalf("wrong migrations recorded: %s", asJSON(migrations))
+	}
+
+	// Modified and out-of-order migrations are rejected.
+	if _, err := migrate(m1, &command.Migration{Version: 2, Sql: `SELECT 1`}); err == nil || !strings.HasPrefix(err.Error(), ErrMigrationModified.Error()) {
+		t.Fatalf("modified migration not rejected: %v", err)
+	}
+	if _, err := migrate(m2, m1); err == nil || !strings.HasPrefix(err.Error(), ErrMigrationOutOfOrder.Error()) {
+		t.Fatalf("unordered migrations not rejected: %v", err)
+	}
+	m4 := &command.Migration{Version: 4, Sql: `CREATE TABLE bar (id INTEGER)`}
+	if _, err := migrate(&command.Migration{Version: 5, Sql: `CREATE TABLE qux (id INTEGER)`}); err != nil {
+		t.Fatalf("failed to migrate: %s", err.Error())
+	}
+	if _, err := migrate(m4); err == nil || !strings.HasPrefix(err.Error(), ErrMigrationOutOfOrder.Error()) {
+		t.Fatalf("out-of-order migration not rejected: %v", err)
+	}
+
+	// A failed migration applies nothing.
+	_, err = migrate(
+		&command.Migration{Version: 6, Sql: `CREATE TABLE baz (id INTEGER)`},
+		&command.Migration{Version: 7, Sql: `INSERT INTO nonsense VALUES(1)`},
+	)
+	if exp, got := "migration 7: no such table: nonsense", fmt.Sprint(err); exp != got {
+		t.Fatalf("wrong error for failed migration, exp %s, got %s", exp, got)
+	}
+	migrations, err = s.Migrations("")
+	if err != nil {
+		t.Fatalf("failed to get migrations: %s", err.Error())
+	}
+	if exp, got := 4, len(migrations); exp != got {
+		t.Fatalf("wrong number of migrations after failure, exp %d, got %d", exp, got)
+	}
+	qr := queryRequestFromString(`SELECT COUNT(*) FROM sqlite_master WHERE name = "baz"`, false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+	r, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[0]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("failed migration partially applied, exp %s, got %s", exp, got)
+	}
+}
+
+func Test_SingleNodeMigrateRewrite(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	m1 := &command.Migration{Version: 1, Sql: `CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, r INTEGER)`}
+	m2 := &command.Migration{Version: 2, Sql: `INSERT INTO foo(id, r) VALUES(1, random())`}
+	mr := &command.MigrateRequest{Migrations: []*command.Migration{m1, m2}}
+
+	prepared, err := s.prepareMigrate(mr)
+	if err != nil {
+		t.Fatalf("failed to prepare migrate request: %s", err.Error())
+	}
+	if strings.Contains(prepared.Migrations[1].Sql, "random()") {
+		t.Fatalf("migration not rewritten: %s", prepared.Migrations[1].Sql)
+	}
+	if exp, got := scriptChecksum(m2.Sql), prepared.Migrations[1].Checksum; exp != got {
+		t.Fatalf("wrong checksum for rewritten migration, exp %s, got %s", exp, got)
+	}
+
+	if _, err := s.Migrate(mr); err != nil {
+		t.Fatalf("failed to migrate: %s", err.Error())
+	}
+	if m2.Sql != `INSERT INTO foo(id, r) VALUES(1, random())` || m2.Checksum != "" {
+		t.Fatalf("migrate request modified: %s", asJSON(m2))
+	}
+
+	// The recorded checksum is that of the script as submitted, so
+	// resubmitting the script applies nothing.
+	applied, err := s.Migrate(mr)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("repeated migrations applied again: %v, %v", applied, err)
+	}
+	migrations, err := s.Migrations("")
+	if err != nil {
+		t.Fatalf("failed to get migrations: %s", err.Error())
+	}
+	if exp, got := scriptChecksum(m2.Sql), migrations[1].Checksum; exp != got {
+		t.Fatalf("wrong checksum recorded, exp %s, got %s", exp, got)
+	}
+}
+
+func Test_SingleNodeChecksumOnDisk(t *testing.T) {
+	var sums []string
+	for _, inmem := range []bool{true, false} {
+		func() {
+			s := mustNewStore(inmem)
+			defer os.RemoveAll(s.Path())
+
+			if err := s.Open(true); err != nil {
+				t.Fatalf("failed to open single-node store: %s", err.Error())
+			}
+			defer s.Close(true)
+			if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+				t.Fatalf("Error waiting for leader: %s", err)
+			}
+			if err := s.CreateDatabase("orders"); err != nil {
+				t.Fatalf("failed to create database: %s", err.Error())
+			}
+			for _, database := range []string{"", "orders"} {
+				er := executeRequestFromStrings([]string{
+					`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+					`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+				}, false, false)
+				er.Request.Database = database
+				if _, err := s.Execute(er); err != nil {
+					t.Fatalf("failed to execute on single node: %s", err.Error())
+				}
+			}
+
+			_, sum, err := s.Checksum()
+			if err != nil {
+				t.Fatalf("failed to get checksum: %s", err.Error())
+			}
+			sums = append(sums, sum)
+
+			// The copies checksummed are removed.
+			tmps, err := filepath.Glob(filepath.Join(s.Path(), checksumTmpPrefix+"*"))
+			if err != nil || len(tmps) != 0 {
+				t.Fatalf("checksum copies not removed: %v: %v", tmps, err)
+			}
+		}()
+	}
+	if sums[0] != sums[1] {
+		t.Fatalf("checksums of in-memory and on-disk databases differ: %s, %s", sums[0], sums[1])
+	}
+}
+
+func Test_SingleNodeChecksum(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	idx1, sum1, err := s.Checksum()
+	if err != nil {
+		t.Fatalf("failed to get checksum: %s", err.Error())
+	}
+	sum, err := s.ChecksumAt(idx1, time.Second)
+	if err != nil {
+		t.Fatalf("failed to get checksum at index %d: %s", idx1, err.Error())
+	}
+	if sum != sum1 {
+		t.Fatalf("checksum at index %d differs, exp %s, got %s", idx1, sum1, sum)
+	}
+
+	er := executeRequestFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, false, false)
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	idx2, sum2, err := s.Checksum()
+	if err != nil {
+		t.Fatalf("failed to get checksum: %s", err.Error())
+	}
+	if sum2 == sum1 {
+		t.Fatalf("checksum unchanged after creating table")
+	}
+
+	// A named database contributes to the checksum.
+	if err := s.CreateDatabase("other"); err != nil {
+		t.Fatalf("failed to create database: %s", err.Error())
+	}
+	_, sum3, err := s.Checksum()
+	if err != nil {
+		t.Fatalf("failed to get checksum: %s", err.Error())
+	}
+	if sum3 == sum2 {
+		t.Fatalf("checksum unchanged after creating named database")
+	}
+
+	// Earlier checksums are retained, but none is computed for other entries.
+	if sum, err := s.ChecksumAt(idx2, time.Second); err != nil || sum != sum2 {
+		t.Fatalf("wrong checksum at index %d, exp %s, got %s, %v", idx2, sum2, sum, err)
+	}
+	if _, err := s.ChecksumAt(idx2-1, time.Second); err != ErrChecksumNotFound {
+		t.Fatalf("wrong error for index without checksum, got %v", err)
+	}
+	if _, err := s.ChecksumAt(idx2+100, 500*time.Millisecond); err == nil {
+		t.Fatalf("no error for index not yet applied")
+	}
+}
+
+func Test_SingleNodeSlowQueryLog(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+	s.SlowQueryThreshold = time.Nanosecond
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	er := executeRequestFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	}, false, false)
+	er.Request.User = "bob"
+	r, err := s.Execute(er)
+	if err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if exp, got := `[{},{"last_insert_id":1,"rows_affected":1}]`, asJSON(r); exp != got {
+		t.Fatalf("timings returned when not requested\nexp: %s\ngot: %s", exp, got)
+	}
+
+	qr := queryRequestFromString("SELECT * FROM foo", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_STRONG
+	if _, err := s.Query(qr); err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(s.Path(), slowQueryLogFile))
+	if err != nil {
+		t.Fatalf("failed to read slow query log: %s", err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("wrong number of slow query log entries, exp 3, got %d", len(lines))
+	}
+	var rec slowQueryRecord
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatalf("failed to unmarshal slow query log entry: %s", err.Error())
+	}
+	if rec.SQL != `INSERT INTO foo(id, name) VALUES(1, "fiona")` || rec.User != "bob" || rec.Rows != 1 || rec.Index == 0 {
+		t.Fatalf("unexpected slow query log entry for execute: %s", lines[1])
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &rec); err != nil {
+		t.Fatalf("failed to unmarshal slow query log entry: %s", err.Error())
+	}
+	if rec.SQL != "SELECT * FROM foo" || rec.Level != "strong" || rec.Rows != 1 {
+		t.Fatalf("unexpected slow query log entry for query: %s", lines[2])
+	}
+}
+
+func Test_SingleNodeExecuteQueryTraced(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+	tracePath := filepath.Join(s.Path(), "traces.json")
+	e, err := tracing.NewFileExporter(tracePath)
+	if err != nil {
+		t.Fatalf("failed to create trace exporter: %s", err)
+	}
+	s.Tracer = tracing.NewTracer("rqlite", "node1", e)
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	er := executeRequestFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+	}, false, false)
+	er.Request.RequestId = "req-1"
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	qr := queryRequestFromString("SELECT * FROM foo", false, false)
+	qr.Request.RequestId = "req-2"
+	if _, err := s.Query(qr); err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if _, err := s.Execute(executeRequestFromString("INSERT INTO foo(id) VALUES(1)", false, false)); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+
+	if err := s.Tracer.Close(); err != nil {
+		t.Fatalf("failed to close tracer: %s", err)
+	}
+	b, err := ioutil.ReadFile(tracePath)
+	if err != nil {
+		t.Fatalf("failed to read trace file: %s", err)
+	}
+	var export struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(b, &export); err != nil {
+		t.Fatalf("failed to unmarshal trace file %s: %s", b, err)
+	}
+	spans := export.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("wrong number of spans, exp 3, got %d: %s", len(spans), b)
+	}
+	exec, apply, query := spans[0], spans[1], spans[2]
+	if exec.Name != "sqlite.execute" || apply.Name != "raft.apply" || query.Name != "sqlite.query" {
+		t.Fatalf("wrong spans recorded: %s", b)
+	}
+	if exec.ParentSpanID != apply.SpanID || exec.TraceID != tracing.TraceIDFromRequestID("req-1").String() {
+		t.Fatalf("execution not traced under Raft apply: %s", b)
+	}
+	if query.TraceID != tracing.TraceIDFromRequestID("req-2").String() {
+		t.Fatalf("query not traced: %s", b)
+	}
+}
+
+// Test_SingleNodeTraceNotLogged ensures request IDs and parent spans are not
+// written to the Raft log.
+func Test_SingleNodeTraceNotLogged(t *testing.T) {
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	er := executeRequestFromString(`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`, false, false)
+	er.Request.RequestId = "req-1"
+	er.Request.ParentSpanId = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	qr := queryRequestFromString("SELECT * FROM foo", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_STRONG
+	qr.Request.RequestId = "req-2"
+	qr.Request.ParentSpanId = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if _, err := s.Query(qr); err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+
+	last, err := s.raftLog.LastIndex()
+	if err != nil {
+		t.Fatalf("failed to get last index: %s", err)
+	}
+	var n int
+	for i := uint64(1); i <= last; i++ {
+		var l raft.Log
+		if err := s.raftLog.GetLog(i, &l); err != nil {
+			t.Fatalf("failed to get log entry %d: %s", i, err)
+		}
+		if l.Type != raft.LogCommand {
+			continue
+		}
+		var c command.Command
+		if err := command.Unmarshal(l.Data, &c); err != nil {
+			t.Fatalf("failed to unmarshal command: %s", err)
+		}
+		var req *command.Request
+		switch c.Type {
+		case command.Command_COMMAND_TYPE_EXECUTE:
+			var er command.ExecuteRequest
+			if err := command.UnmarshalSubCommand(&c, &er); err != nil {
+				t.Fatalf("failed to unmarshal execute request: %s", err)
+			}
+			req = er.Request
+		case command.Command_COMMAND_TYPE_QUERY:
+			var qr command.QueryRequest
+			if err := command.UnmarshalSubCommand(&c, &qr); err != nil {
+				t.Fatalf("failed to unmarshal query request: %s", err)
+			}
+			req = qr.Request
+		default:
+			continue
+		}
+		n++
+		if req.RequestId != "" || req.ParentSpanId != nil {
+			t.Fatalf("trace written to log entry %d: %s", i, req)
+		}
+	}
+	if n != 2 {
+		t.Fatalf("wrong number of requests in log, exp 2, got %d", n)
+	}
+}
+
 // Test_SingleNodeInMemExecuteQueryFail ensures database level errors are presented by the store.
 func Test_SingleNodeInMemExecuteQueryFail(t *testing.T) {
 	s := mustNewStore(true)
@@ -338,7 +1517,7 @@ COMMIT;
 
 	f, err := ioutil.TempFile("", "rqlite-baktest-")
 	defer os.Remove(f.Name())
-	s.logger.Printf("backup file is %s", f.Name())
+	s.logger.Infof("backup file is %s", f.Name())
 
 	if err := s.Backup(true, BackupBinary, f); err != nil {
 		t.Fatalf("Backup failed %s", err.Error())
@@ -351,10 +1530,20 @@ COMMIT;
 		t.Fatalf("Backup Failed: unable to read backup file, %s", err.Error())
 	}
 
+	// The SQLite file is in WAL mode, so only holds every change once
+	// checkpointed. SQLite does not maintain the file change counter, nor the
+	// version it is valid for, of a database in WAL mode, so ignore them.
+	if err := s.db.Checkpoint(); err != nil {
+		t.Fatalf("Backup Failed: unable to checkpoint source SQLite file, %s", err.Error())
+	}
 	dbFile, err := ioutil.ReadFile(filepath.Join(s.Path(), sqliteFile))
 	if err != nil {
 		t.Fatalf("Backup Failed: unable to read source SQLite file, %s", err.Error())
 	}
+	if len(bkp) >= 100 && len(dbFile) >= 100 {
+		copy(bkp[24:28], dbFile[24:28])
+		copy(bkp[92:96], dbFile[92:96])
+	}
 
 	if ret := bytes.Compare(bkp, dbFile); ret != 0 {
 		t.Fatalf("Backup Failed: backup bytes are not same")
@@ -388,7 +1577,7 @@ COMMIT;
 
 	f, err := ioutil.TempFile("", "rqlite-baktest-")
 	defer os.Remove(f.Name())
-	s.logger.Printf("backup file is %s", f.Name())
+	s.logger.Infof("backup file is %s", f.Name())
 
 	if err := s.Backup(true, BackupSQL, f); err != nil {
 		t.Fatalf("Backup failed %s", err.Error())
@@ -733,6 +1922,60 @@ func Test_MultiNodeJoinNonVoterRemove(t *testing.T) {
 	}
 }
 
+func Test_MultiNodeNonDeterministicExecute(t *testing.T) {
+	s0 := mustNewStore(true)
+	defer os.RemoveAll(s0.Path())
+	if err := s0.Open(true); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s0.Close(true)
+	if _, err := s0.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	s1 := mustNewStore(true)
+	defer os.RemoveAll(s1.Path())
+	if err := s1.Open(false); err != nil {
+		t.Fatalf("failed to open node for multi-node test: %s", err.Error())
+	}
+	defer s1.Close(true)
+	if err := s0.Join(s1.ID(), s1.Addr(), true); err != nil {
+		t.Fatalf("failed to join to node at %s: %s", s0.Addr(), err.Error())
+	}
+
+	er := executeRequestFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, r INTEGER, b BLOB, t TEXT)`,
+		`INSERT INTO foo(r, b, t) VALUES(random(), randomblob(16), strftime('%Y-%m-%d %H:%M:%f', 'now'))`,
+	}, false, false)
+	if _, err := s0.Execute(er); err != nil {
+		t.Fatalf("failed to execute on leader: %s", err.Error())
+	}
+	s0FsmIdx, err := s0.WaitForAppliedFSM(5 * time.Second)
+	if err != nil {
+		t.Fatalf("failed to wait for fsmIndex: %s", err.Error())
+	}
+	if _, err := s1.WaitForFSMIndex(s0FsmIdx, 5*time.Second); err != nil {
+		t.Fatalf("error waiting for follower to apply index: %s:", err.Error())
+	}
+
+	qr := queryRequestFromString("SELECT * FROM foo", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+	r0, err := s0.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query leader node: %s", err.Error())
+	}
+	r1, err := s1.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query follower node: %s", err.Error())
+	}
+	if len(r0[0].Values) != 1 {
+		t.Fatalf("wrong number of rows on leader: %s", asJSON(r0))
+	}
+	if exp, got := asJSON(r0[0].Values), asJSON(r1[0].Values); exp != got {
+		t.Fatalf("follower diverged from leader\nleader:   %s\nfollower: %s", exp, got)
+	}
+}
+
 func Test_MultiNodeExecuteQuery(t *testing.T) {
 	s0 := mustNewStore(true)
 	defer os.RemoveAll(s0.Path())
@@ -1121,6 +2364,71 @@ func Test_SingleNodeSnapshotOnDisk(t *testing.T) {
 	}
 }
 
+func Test_SingleNodeOnDiskStartup(t *testing.T) {
+	s := mustNewStore(false)
+	defer os.RemoveAll(s.Path())
+	s.dbConf.OnDiskStartup = true
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+	if !s.onDiskCreated {
+		t.Fatalf("on-disk database not created at open")
+	}
+
+	er := executeRequestFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+	}, false, false)
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if err := s.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("failed to snapshot single node: %s", err.Error())
+	}
+	er = executeRequestFromString(`INSERT INTO foo(id, name) VALUES(2, "declan")`, false, false)
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if err := s.Close(true); err != nil {
+		t.Fatalf("failed to close single-node store: %s", err.Error())
+	}
+
+	// Reopen the store, which restores the snapshot, and applies the log
+	// entry which follows it, directly to the on-disk database.
+	s = mustNewStoreAtPaths(s.Path(), "", false, false)
+	s.dbConf.OnDiskStartup = true
+	if err := s.Open(false); err != nil {
+		t.Fatalf("failed to reopen single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+	if err := s.WaitForInitialLogs(10 * time.Second); err != nil {
+		t.Fatalf("failed waiting for initial logs: %s", err)
+	}
+	if !s.onDiskCreated {
+		t.Fatalf("on-disk database not created after reopen")
+	}
+	if _, err := os.Stat(s.dbPath); err != nil {
+		t.Fatalf("on-disk database file missing after reopen: %s", err)
+	}
+
+	qr := queryRequestFromString("SELECT * FROM foo", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+	r, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[1,"fiona"],[2,"declan"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+}
+
 func Test_SingleNodeSnapshotInMem(t *testing.T) {
 	s := mustNewStore(true)
 	defer os.RemoveAll(s.Path())
@@ -1202,6 +2510,75 @@ func Test_SingleNodeSnapshotInMem(t *testing.T) {
 	}
 }
 
+func Test_SingleNodeRestoreTruncated(t *testing.T) {
+	for _, inmem := range []bool{true, false} {
+		func() {
+			s := mustNewStore(inmem)
+			defer os.RemoveAll(s.Path())
+
+			if err := s.Open(true); err != nil {
+				t.Fatalf("failed to open single-node store: %s", err.Error())
+			}
+			defer s.Close(true)
+			if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+				t.Fatalf("Error waiting for leader: %s", err)
+			}
+
+			er := executeRequestFromStrings([]string{
+				`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+				`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+			}, false, false)
+			if _, err := s.Execute(er); err != nil {
+				t.Fatalf("failed to execute on single node: %s", err.Error())
+			}
+
+			f, err := s.Snapshot()
+			if err != nil {
+				t.Fatalf("failed to snapshot node: %s", err.Error())
+			}
+			snapDir := mustTempDir()
+			defer os.RemoveAll(snapDir)
+			snapPath := filepath.Join(snapDir, "snapshot")
+			snapFile, err := os.Create(snapPath)
+			if err != nil {
+				t.Fatalf("failed to create snapshot file: %s", err.Error())
+			}
+			if err := f.Persist(&mockSnapshotSink{snapFile}); err != nil {
+				t.Fatalf("failed to persist snapshot to disk: %s", err.Error())
+			}
+
+			fi, err := os.Stat(snapPath)
+			if err != nil {
+				t.Fatalf("failed to stat snapshot: %s", err.Error())
+			}
+			if err := os.Truncate(snapPath, fi.Size()/2); err != nil {
+				t.Fatalf("failed to truncate snapshot: %s", err.Error())
+			}
+			snapFile, err = os.Open(snapPath)
+			if err != nil {
+				t.Fatalf("failed to open snapshot file: %s", err.Error())
+			}
+			if err := s.Restore(snapFile); err == nil {
+				t.Fatalf("restored truncated snapshot")
+			}
+
+			// The existing database is intact.
+			qr := queryRequestFromString("SELECT * FROM foo", false, false)
+			qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+			r, err := s.Query(qr)
+			if err != nil {
+				t.Fatalf("failed to query single node: %s", err.Error())
+			}
+			if exp, got := `[[1,"fiona"]]`, asJSON(r[0].Values); exp != got {
+				t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+			}
+			if _, err := s.Execute(executeRequestFromString(`INSERT INTO foo(id, name) VALUES(2, "fiona")`, false, false)); err != nil {
+				t.Fatalf("failed to execute on single node: %s", err.Error())
+			}
+		}()
+	}
+}
+
 func Test_SingleNodeRestoreNoncompressed(t *testing.T) {
 	s := mustNewStore(false)
 	defer os.RemoveAll(s.Path())
@@ -1290,6 +2667,103 @@ func Test_State(t *testing.T) {
 	}
 }
 
+func Test_SingleNodeEncryption(t *testing.T) {
+	keys, err := encryption.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatalf("failed to create keyring: %s", err.Error())
+	}
+	s := mustNewStore(true)
+	defer os.RemoveAll(s.Path())
+	s.Encryption = keys
+
+	if err := s.Open(true); err != nil {
+		t.Fatalf("failed to open single-node store: %s", err.Error())
+	}
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+
+	er := executeRequestFromStrings([]string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "zanzibar")`,
+	}, false, false)
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if err := s.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("failed to snapshot single node: %s", err.Error())
+	}
+	er = executeRequestFromString(`INSERT INTO foo(id, name) VALUES(2, "timbuktu")`, false, false)
+	if _, err := s.Execute(er); err != nil {
+		t.Fatalf("failed to execute on single node: %s", err.Error())
+	}
+	if err := s.Close(true); err != nil {
+		t.Fatalf("failed to close single-node store: %s", err.Error())
+	}
+
+	// Neither the log nor the snapshot contain the plaintext.
+	b, err := ioutil.ReadFile(filepath.Join(s.Path(), raftDBPath))
+	if err != nil {
+		t.Fatalf("failed to read Raft log: %s", err.Error())
+	}
+	if bytes.Contains(b, []byte("timbuktu")) {
+		t.Fatalf("Raft log contains plaintext")
+	}
+	snaps, err := filepath.Glob(filepath.Join(s.Path(), "snapshots", "*", "state.bin"))
+	if err != nil || len(snaps) != 1 {
+		t.Fatalf("failed to find snapshot: %v", err)
+	}
+	b, err = ioutil.ReadFile(snaps[0])
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %s", err.Error())
+	}
+	if sz, _ := readUint64(b[:8]); sz != encryptedMagic || !encryption.IsEncrypted(b[8:]) {
+		t.Fatalf("snapshot is not encrypted")
+	}
+
+	// Reopen the store, which decrypts the snapshot, and the log entry which
+	// follows it, after the key has been rotated.
+	keys, err = encryption.NewKeyring("k2", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	})
+	if err != nil {
+		t.Fatalf("failed to create keyring: %s", err.Error())
+	}
+	s = mustNewStoreAtPaths(s.Path(), "", true, false)
+	s.Encryption = keys
+	if err := s.Open(false); err != nil {
+		t.Fatalf("failed to reopen single-node store: %s", err.Error())
+	}
+	defer s.Close(true)
+	if _, err := s.WaitForLeader(10 * time.Second); err != nil {
+		t.Fatalf("Error waiting for leader: %s", err)
+	}
+	if err := s.WaitForInitialLogs(10 * time.Second); err != nil {
+		t.Fatalf("failed waiting for initial logs: %s", err)
+	}
+	qr := queryRequestFromString("SELECT * FROM foo", false, false)
+	qr.Level = command.QueryRequest_QUERY_REQUEST_LEVEL_NONE
+	r, err := s.Query(qr)
+	if err != nil {
+		t.Fatalf("failed to query single node: %s", err.Error())
+	}
+	if exp, got := `[[1,"zanzibar"],[2,"timbuktu"]]`, asJSON(r[0].Values); exp != got {
+		t.Fatalf("unexpected results for query\nexp: %s\ngot: %s", exp, got)
+	}
+
+	// A snapshot cannot be restored without the keys.
+	f, err := os.Open(snaps[0])
+	if err != nil {
+		t.Fatalf("failed to open snapshot: %s", err.Error())
+	}
+	defer f.Close()
+	s.Encryption = nil
+	if err := s.Restore(f); err == nil {
+		t.Fatalf("restored encrypted snapshot without keys")
+	}
+}
+
 func mustNewStoreAtPaths(dataPath, sqlitePath string, inmem, fk bool) *Store {
 	cfg := NewDBConfig(inmem)
 	cfg.FKConstraints = fk
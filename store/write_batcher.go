@@ -0,0 +1,122 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rqlite/rqlite/command"
+)
+
+// ErrBatcherClosed is returned when a write is submitted to a closed
+// write batcher.
+var ErrBatcherClosed = errors.New("write batcher closed")
+
+// batchedWrite is an execute request waiting to be committed as part of
+// a batch.
+type batchedWrite struct {
+	er *command.ExecuteRequest
+	ch chan *fsmExecuteResponse
+}
+
+// writeBatcher gathers concurrent execute requests, and commits them as a
+// single Raft log entry. A batch is committed once the window has elapsed
+// since its first request arrived, or once it holds maxSize requests.
+type writeBatcher struct {
+	window  time.Duration
+	maxSize int
+
+	// commit commits a batch of requests, returning the response for each
+	// request. If an error is returned, no request in the batch was applied.
+	commit func([]*command.ExecuteRequest) ([]*fsmExecuteResponse, error)
+
+	writeCh chan *batchedWrite
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newWriteBatcher returns a new, started, writeBatcher.
+func newWriteBatcher(window time.Duration, maxSize int,
+	commit func([]*command.ExecuteRequest) ([]*fsmExecuteResponse, error)) *writeBatcher {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	b := &writeBatcher{
+		window:  window,
+		maxSize: maxSize,
+		commit:  commit,
+		writeCh: make(chan *batchedWrite),
+		done:    make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+// Execute adds the request to the current batch, and blocks until the batch
+// has been committed.
+func (b *writeBatcher) Execute(er *command.ExecuteRequest) ([]*command.ExecuteResult, error) {
+	w := &batchedWrite{
+		er: er,
+		ch: make(chan *fsmExecuteResponse, 1),
+	}
+	select {
+	case b.writeCh <- w:
+	case <-b.done:
+		return nil, ErrBatcherClosed
+	}
+	r := <-w.ch
+	return r.results, r.error
+}
+
+// Close stops the batcher. Any batch being gathered is committed first.
+func (b *writeBatcher) Close() {
+	close(b.done)
+	b.wg.Wait()
+}
+
+func (b *writeBatcher) run() {
+	defer b.wg.Done()
+	for {
+		var batch []*batchedWrite
+		select {
+		case w := <-b.writeCh:
+			batch = append(batch, w)
+		case <-b.done:
+			return
+		}
+
+		timer := time.NewTimer(b.window)
+	gather:
+		for len(batch) < b.maxSize {
+			select {
+			case w := <-b.writeCh:
+				batch = append(batch, w)
+			case <-timer.C:
+				break gather
+			case <-b.done:
+				break gather
+			}
+		}
+		timer.Stop()
+		b.commitBatch(batch)
+	}
+}
+
+func (b *writeBatcher) commitBatch(batch []*batchedWrite) {
+	stats.Add(numWriteBatches, 1)
+	stats.Add(numBatchedWrites, int64(len(batch)))
+
+	ers := make([]*command.ExecuteRequest, len(batch))
+	for i := range batch {
+		ers[i] = batch[i].er
+	}
+	resps, err := b.commit(ers)
+	for i, w := range batch {
+		if err != nil {
+			w.ch <- &fsmExecuteResponse{error: err}
+			continue
+		}
+		w.ch <- resps[i]
+	}
+}
@@ -0,0 +1,316 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rqlite/rqlite/command"
+	"github.com/rqlite/rqlite/logging"
+	"github.com/rqlite/rqlite/tracing"
+)
+
+var (
+	// ErrQueueFull is returned when a write cannot be queued because the
+	// write queue is at capacity.
+	ErrQueueFull = errors.New("write queue full")
+
+	// ErrQueueDisabled is returned when a write is queued, but the write
+	// queue is not enabled.
+	ErrQueueDisabled = errors.New("write queue disabled")
+
+	// ErrQueuedWriteDropped is returned when waiting for a queued write
+	// which was discarded before it was committed.
+	ErrQueuedWriteDropped = errors.New("queued write dropped")
+
+	// ErrUnknownSequenceNumber is returned when waiting for a sequence
+	// number which has not been issued by this node.
+	ErrUnknownSequenceNumber = errors.New("unknown sequence number")
+
+	// ErrSequenceExhausted is returned when a write cannot be queued because
+	// every sequence number in the term has been issued.
+	ErrSequenceExhausted = errors.New("write queue sequence numbers exhausted")
+)
+
+const (
+	// maxDroppedRanges is the number of ranges of dropped sequence numbers
+	// retained, so that waiting for them returns an error.
+	maxDroppedRanges = 1024
+
+	// sequenceTermShift is the number of low bits of a sequence number which
+	// count the writes queued in a term. The remaining bits are the term.
+	sequenceTermShift = 32
+)
+
+// queuedWrite is an execute request waiting in the write queue.
+type queuedWrite struct {
+	seq  uint64
+	er   *command.ExecuteRequest
+	span *tracing.Span // Times the request until it is committed. May be nil.
+}
+
+// seqRange is an inclusive range of sequence numbers.
+type seqRange struct {
+	first, last uint64
+}
+
+// writeQueue holds execute requests which are acknowledged before they
+// are committed. A background flusher commits the queued requests, in
+// order, in batches of up to batchSize requests. If a batch cannot be
+// committed, for example because this node is no longer the leader, that
+// batch and every other queued request are dropped.
+//
+// Sequence numbers are scoped by the Raft term in which this node was leader
+// when the first request was queued, which forms their high bits. Raft elects
+// at most one leader per term, so a sequence number identifies a single
+// write across the cluster, even after the leader changes or restarts.
+type writeQueue struct {
+	capacity  int
+	batchSize int
+	interval  time.Duration
+
+	// commit commits a batch of requests, returning the response for each
+	// request. If an error is returned, no request in the batch was applied.
+	commit func([]*command.ExecuteRequest) ([]*fsmExecuteResponse, error)
+
+	// leaderTerm returns the current term, if this node is the leader in
+	// that term. It is called when the first request is queued.
+	leaderTerm func() (uint64, error)
+
+	mu      sync.Mutex
+	pending []*queuedWrite
+	term    uint64        // Term scoping sequence numbers. Zero until set.
+	lastSeq uint64        // Last sequence number issued.
+	doneSeq uint64        // Requests up to this sequence number are committed or dropped.
+	dropped []seqRange    // Most recent ranges of dropped sequence numbers.
+	changed chan struct{} // Closed, and replaced, when doneSeq advances.
+
+	flushCh chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	logger *logging.Logger
+}
+
+// newWriteQueue returns a new, started, writeQueue.
+func newWriteQueue(capacity, batchSize int, interval time.Duration,
+	commit func([]*command.ExecuteRequest) ([]*fsmExecuteResponse, error),
+	leaderTerm func() (uint64, error), logger *logging.Logger) *writeQueue {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	q := &writeQueue{
+		capacity:   capacity,
+		batchSize:  batchSize,
+		interval:   interval,
+		commit:     commit,
+		leaderTerm: leaderTerm,
+		changed:    make(chan struct{}),
+		flushCh:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		logger:     logger,
+	}
+	q.wg.Add(1)
+	go q.run()
+	return q
+}
+
+// Enqueue adds the request to the queue, returning its sequence number. The
+// span, if not nil, is ended once the request is committed or dropped.
+func (q *writeQueue) Enqueue(er *command.ExecuteRequest, span *tracing.Span) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) >= q.capacity {
+		stats.Add(numQueueFull, 1)
+		span.SetError(ErrQueueFull)
+		span.End()
+		return 0, ErrQueueFull
+	}
+	if q.term == 0 {
+		term, err := q.leaderTerm()
+		if err != nil {
+			span.SetError(err)
+			span.End()
+			return 0, err
+		}
+		q.term = term
+		q.lastSeq = term << sequenceTermShift
+		q.doneSeq = q.lastSeq
+	}
+	if q.lastSeq == (q.term+1)<<sequenceTermShift-1 {
+		span.SetError(ErrSequenceExhausted)
+		span.End()
+		return 0, ErrSequenceExhausted
+	}
+	q.lastSeq++
+	span.SetAttribute("sequence_number", q.lastSeq)
+	q.pending = append(q.pending, &queuedWrite{seq: q.lastSeq, er: er, span: span})
+	stats.Add(numQueuedWrites, 1)
+
+	if len(q.pending) >= q.batchSize {
+		select {
+		case q.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return q.lastSeq, nil
+}
+
+// Wait blocks until the request with the given sequence number has been
+// committed, or the timeout expires. If the request was dropped,
+// ErrQueuedWriteDropped is returned.
+func (q *writeQueue) Wait(seq uint64, timeout time.Duration) error {
+	tmr := time.NewTimer(timeout)
+	defer tmr.Stop()
+	for {
+		q.mu.Lock()
+		if q.term == 0 || seq <= q.term<<sequenceTermShift || seq > q.lastSeq {
+			q.mu.Unlock()
+			return ErrUnknownSequenceNumber
+		}
+		if seq <= q.doneSeq {
+			defer q.mu.Unlock()
+			for _, r := range q.dropped {
+				if seq >= r.first && seq <= r.last {
+					return ErrQueuedWriteDropped
+				}
+			}
+			return nil
+		}
+		ch := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-tmr.C:
+			return errors.New("timeout expired")
+		}
+	}
+}
+
+// Stats returns status and diagnostic information about the queue.
+func (q *writeQueue) Stats() map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return map[string]interface{}{
+		"depth":         len(q.pending),
+		"capacity":      q.capacity,
+		"batch_size":    q.batchSize,
+		"interval":      q.interval.String(),
+		"term":          q.term,
+		"last_sequence": q.lastSeq,
+		"done_sequence": q.doneSeq,
+	}
+}
+
+// Close stops the flusher, after making a final attempt to commit any
+// queued requests.
+func (q *writeQueue) Close() {
+	close(q.done)
+	q.wg.Wait()
+}
+
+func (q *writeQueue) run() {
+	defer q.wg.Done()
+	tck := time.NewTicker(q.interval)
+	defer tck.Stop()
+	for {
+		select {
+		case <-tck.C:
+		case <-q.flushCh:
+		case <-q.done:
+			q.flush()
+			return
+		}
+		q.flush()
+	}
+}
+
+// flush commits every queued request, in batches.
+func (q *writeQueue) flush() {
+	for {
+		q.mu.Lock()
+		n := len(q.pending)
+		if n == 0 {
+			q.mu.Unlock()
+			return
+		}
+		if n > q.batchSize {
+			n = q.batchSize
+		}
+		batch := q.pending[:n]
+		q.pending = q.pending[n:]
+		q.mu.Unlock()
+
+		ers := make([]*command.ExecuteRequest, len(batch))
+		for i := range batch {
+			ers[i] = batch[i].er
+		}
+		resps, err := q.commit(ers)
+		if err != nil {
+			q.drop(batch, err)
+			return
+		}
+		for _, r := range resps {
+			if hasExecuteError(r) {
+				stats.Add(numQueuedWriteErrors, 1)
+			}
+		}
+		for _, w := range batch {
+			w.span.End()
+		}
+		q.advance(batch[len(batch)-1].seq)
+	}
+}
+
+// drop discards the given batch, which could not be committed, along with
+// every request still queued.
+func (q *writeQueue) drop(batch []*queuedWrite, err error) {
+	q.mu.Lock()
+	n := len(batch) + len(q.pending)
+	first := batch[0].seq
+	last := batch[len(batch)-1].seq
+	if len(q.pending) > 0 {
+		last = q.pending[len(q.pending)-1].seq
+	}
+	for _, ws := range [][]*queuedWrite{batch, q.pending} {
+		for _, w := range ws {
+			w.span.SetError(err)
+			w.span.End()
+		}
+	}
+	q.pending = nil
+	q.dropped = append(q.dropped, seqRange{first: first, last: last})
+	if len(q.dropped) > maxDroppedRanges {
+		q.dropped = q.dropped[len(q.dropped)-maxDroppedRanges:]
+	}
+	q.mu.Unlock()
+
+	stats.Add(numQueuedWritesDropped, int64(n))
+	q.logger.Errorf("dropped %d queued writes (sequence numbers %d to %d): %s", n, first, last, err)
+	q.advance(last)
+}
+
+// advance marks every request up to and including seq as done, waking
+// any waiters.
+func (q *writeQueue) advance(seq uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.doneSeq = seq
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// hasExecuteError returns whether the response, or any result in it,
+// contains an error.
+func hasExecuteError(r *fsmExecuteResponse) bool {
+	if r.error != nil {
+		return true
+	}
+	for _, res := range r.results {
+		if res.Error != "" {
+			return true
+		}
+	}
+	return false
+}
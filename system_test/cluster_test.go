@@ -1,6 +1,7 @@
 package system
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"testing"
@@ -312,6 +313,67 @@ func Test_MultiNodeClusterNodes(t *testing.T) {
 	}
 }
 
+// Test_MultiNodeClusterVerify checks every node of a cluster holds the same data.
+func Test_MultiNodeClusterVerify(t *testing.T) {
+	node1 := mustNewLeaderNode()
+	defer node1.Deprovision()
+
+	node2 := mustNewNode(false)
+	defer node2.Deprovision()
+	if err := node2.Join(node1); err != nil {
+		t.Fatalf("node failed to join leader: %s", err.Error())
+	}
+	node3 := mustNewNode(false)
+	defer node3.Deprovision()
+	if err := node3.Join(node1); err != nil {
+		t.Fatalf("node failed to join leader: %s", err.Error())
+	}
+	c := Cluster{node1, node2, node3}
+	leader, err := c.Leader()
+	if err != nil {
+		t.Fatalf("failed to find cluster leader: %s", err.Error())
+	}
+
+	for _, stmt := range []string{
+		`CREATE TABLE foo (id INTEGER NOT NULL PRIMARY KEY, name TEXT)`,
+		`INSERT INTO foo(id, name) VALUES(1, "fiona")`,
+		`INSERT INTO foo(id, name) VALUES(2, "declan")`,
+	} {
+		if _, err := leader.Execute(stmt); err != nil {
+			t.Fatalf("failed to execute %s: %s", stmt, err.Error())
+		}
+	}
+
+	body, err := leader.Verify()
+	if err != nil {
+		t.Fatalf("failed to verify cluster: %s", err.Error())
+	}
+	result := struct {
+		Checksum string `json:"checksum"`
+		Nodes    map[string]struct {
+			Checksum string `json:"checksum"`
+			Match    bool   `json:"match"`
+			Error    string `json:"error"`
+		} `json:"nodes"`
+		Diverged []string `json:"diverged"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatalf("failed to unmarshal verify response %s: %s", body, err.Error())
+	}
+	if len(result.Nodes) != len(c) {
+		t.Fatalf("verify response has wrong number of nodes: %s", body)
+	}
+	for _, n := range c {
+		ns, ok := result.Nodes[n.ID]
+		if !ok || !ns.Match || ns.Checksum != result.Checksum {
+			t.Fatalf("node %s does not match leader: %s", n.ID, body)
+		}
+	}
+	if len(result.Diverged) != 0 {
+		t.Fatalf("nodes diverged from leader: %s", body)
+	}
+}
+
 // Test_MultiNodeClusterNodesNonVoter checks nodes/ endpoint with a non-voting node.
 func Test_MultiNodeClusterNodesNonVoter(t *testing.T) {
 	node1 := mustNewLeaderNode()
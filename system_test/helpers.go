@@ -154,6 +154,16 @@ func (n *Node) QueryParameterized(stmt []interface{}) (string, error) {
 	return n.postQuery(string(j))
 }
 
+// RequestMulti sends multiple statements, of any kind, to the node's request
+// endpoint.
+func (n *Node) RequestMulti(stmts []string) (string, error) {
+	j, err := json.Marshal(stmts)
+	if err != nil {
+		return "", err
+	}
+	return n.postRequest(string(j))
+}
+
 // Noop inserts a noop command into the Store's Raft log.
 func (n *Node) Noop(id string) error {
 	return n.Store.Noop(id)
@@ -241,6 +251,25 @@ func (n *Node) Status() (string, error) {
 	return string(body), nil
 }
 
+// Verify returns the output of the verify endpoint for node.
+func (n *Node) Verify() (string, error) {
+	v, _ := url.Parse("http://" + n.APIAddr + "/db/verify")
+
+	resp, err := http.Get(v.String())
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("verify endpoint returned: %s", resp.Status)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
 // Expvar returns the expvar output for node.
 func (n *Node) Expvar() (string, error) {
 	v, _ := url.Parse("http://" + n.APIAddr + "/debug/vars")
@@ -293,6 +322,19 @@ func (n *Node) postExecute(stmt string) (string, error) {
 	return string(body), nil
 }
 
+func (n *Node) postRequest(stmt string) (string, error) {
+	resp, err := http.Post("http://"+n.APIAddr+"/db/request", "application/json", strings.NewReader(stmt))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
 func (n *Node) postQuery(stmt string) (string, error) {
 	resp, err := http.Post("http://"+n.APIAddr+"/db/query", "application/json", strings.NewReader(stmt))
 	if err != nil {
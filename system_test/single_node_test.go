@@ -158,6 +158,32 @@ func Test_SingleNodeMulti(t *testing.T) {
 	}
 }
 
+func Test_SingleNodeRequestMixed(t *testing.T) {
+	node := mustNewLeaderNode()
+	defer node.Deprovision()
+
+	r, err := node.RequestMulti([]string{
+		`CREATE TABLE foo (id integer not null primary key, name text)`,
+		`INSERT INTO foo(name) VALUES("fiona")`,
+		`SELECT * FROM foo`,
+		`INSERT INTO foo(name) VALUES("declan")`,
+	})
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err.Error())
+	}
+	if exp := `{"results":[{},{"last_insert_id":1,"rows_affected":1},{"columns":["id","name"],"types":["integer","text"],"values":[[1,"fiona"]]},{"last_insert_id":2,"rows_affected":1}]}`; r != exp {
+		t.Fatalf("test received wrong result\nexp: %s\ngot: %s", exp, r)
+	}
+
+	r, err = node.RequestMulti([]string{`SELECT name FROM foo WHERE id=2`})
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err.Error())
+	}
+	if exp := `{"results":[{"columns":["name"],"types":["text"],"values":[["declan"]]}]}`; r != exp {
+		t.Fatalf("test received wrong result\nexp: %s\ngot: %s", exp, r)
+	}
+}
+
 func Test_SingleNodeConcurrentRequests(t *testing.T) {
 	var err error
 	node := mustNewLeaderNode()
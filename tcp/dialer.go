@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"time"
+
+	"github.com/rqlite/rqlite/rtls"
 )
 
 // NewDialer returns an initialized Dialer
@@ -21,6 +23,14 @@ type Dialer struct {
 	header          byte
 	remoteEncrypted bool
 	skipVerify      bool
+
+	// CACerts, if set, holds the root certificates against which remote
+	// nodes are verified. Otherwise the system's root certificates are used.
+	CACerts *rtls.CAReloader
+
+	// Certs, if set, holds the certificate presented to remote nodes which
+	// request one.
+	Certs *rtls.CertReloader
 }
 
 // Dial dials the cluster service at the given addr and returns a connection.
@@ -31,6 +41,12 @@ func (d *Dialer) Dial(addr string, timeout time.Duration) (conn net.Conn, retErr
 		conf := &tls.Config{
 			InsecureSkipVerify: d.skipVerify,
 		}
+		if d.CACerts != nil {
+			conf.RootCAs = d.CACerts.Pool()
+		}
+		if d.Certs != nil {
+			conf.GetClientCertificate = d.Certs.GetClientCertificate
+		}
 		conn, retErr = tls.DialWithDialer(dialer, "tcp", addr, conf)
 	} else {
 		conn, retErr = dialer.Dial("tcp", addr)
@@ -1,13 +1,23 @@
 package tcp
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/rqlite/rqlite/rtls"
 	"github.com/rqlite/rqlite/testdata/x509"
 )
 
@@ -74,6 +84,39 @@ func Test_DialerHeaderTLS(t *testing.T) {
 	}
 }
 
+func Test_DialerHeaderTLSVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rqlite-dialer-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	cert, key := mustWriteSelfSignedCert(dir)
+
+	tlsConfig, err := createTLSConfig(cert, key, "")
+	if err != nil {
+		t.Fatalf("failed to create TLS config: %s", err.Error())
+	}
+	s := &echoServer{ln: tls.NewListener(mustTCPListener("127.0.0.1:0"), tlsConfig)}
+	defer s.Close()
+	go s.Start(t)
+
+	// The server's certificate is not signed by a system root certificate.
+	d := NewDialer(23, true, false)
+	if _, err := d.Dial(s.Addr(), 5*time.Second); err == nil {
+		t.Fatalf("dialed TLS echo server with unverifiable certificate")
+	}
+
+	d.CACerts, err = rtls.NewCAReloader(cert)
+	if err != nil {
+		t.Fatalf("failed to load root certificates: %s", err.Error())
+	}
+	conn, err := d.Dial(s.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial TLS echo server: %s", err.Error())
+	}
+	defer conn.Close()
+}
+
 func Test_DialerHeaderTLSBadConnect(t *testing.T) {
 	s, cert, key := mustNewEchoServerTLS()
 	defer s.Close()
@@ -158,3 +201,37 @@ func mustNewEchoServerTLS() (*echoServer, string, string) {
 		ln: tls.NewListener(ln, tlsConfig),
 	}, cert, key
 }
+
+// mustWriteSelfSignedCert writes a self-signed certificate for 127.0.0.1,
+// and its key, to files in dir.
+func mustWriteSelfSignedCert(dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("failed to generate key")
+	}
+	tmpl := &stdx509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rqlite"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := stdx509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic("failed to create certificate")
+	}
+	b, err := stdx509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		panic("failed to marshal key")
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		panic("failed to write certificate")
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		panic("failed to write key")
+	}
+	return certFile, keyFile
+}
@@ -2,18 +2,17 @@ package tcp
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"expvar"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net"
-	"os"
 	"strconv"
 	"sync"
 	"time"
+
+	"github.com/rqlite/rqlite/logging"
+	"github.com/rqlite/rqlite/rtls"
 )
 
 const (
@@ -78,7 +77,7 @@ type Mux struct {
 	Timeout time.Duration
 
 	// Out-of-band error logger
-	Logger *log.Logger
+	Logger *logging.Logger
 
 	// Path to root X.509 certificate.
 	x509CACert string
@@ -93,6 +92,8 @@ type Mux struct {
 	InsecureSkipVerify bool
 
 	tlsConfig *tls.Config
+	certs     *rtls.CertReloader
+	caCerts   *rtls.CAReloader
 }
 
 // NewMux returns a new instance of Mux for ln. If adv is nil,
@@ -108,7 +109,7 @@ func NewMux(ln net.Listener, adv net.Addr) (*Mux, error) {
 		addr:    addr,
 		m:       make(map[byte]*listener),
 		Timeout: DefaultTimeout,
-		Logger:  log.New(os.Stderr, "[mux] ", log.LstdFlags),
+		Logger:  logging.New("tcp"),
 	}, nil
 }
 
@@ -120,10 +121,17 @@ func NewTLSMux(ln net.Listener, adv net.Addr, cert, key, caCert string) (*Mux, e
 		return nil, err
 	}
 
-	mux.tlsConfig, err = createTLSConfig(cert, key, caCert)
+	mux.certs, err = rtls.NewCertReloader(cert, key)
 	if err != nil {
 		return nil, err
 	}
+	if caCert != "" {
+		mux.caCerts, err = rtls.NewCAReloader(caCert)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mux.tlsConfig = newTLSConfig(mux.certs, mux.caCerts)
 
 	mux.ln = tls.NewListener(ln, mux.tlsConfig)
 	mux.remoteEncrypted = true
@@ -140,7 +148,7 @@ func (mux *Mux) Serve() error {
 	if mux.tlsConfig != nil {
 		tlsStr = "TLS "
 	}
-	mux.Logger.Printf("%smux serving on %s, advertising %s", tlsStr, mux.ln.Addr().String(), mux.addr)
+	mux.Logger.Infof("%smux serving on %s, advertising %s", tlsStr, mux.ln.Addr().String(), mux.addr)
 
 	for {
 		// Wait for the next connection.
@@ -167,6 +175,27 @@ func (mux *Mux) Serve() error {
 	}
 }
 
+// CACerts returns the root certificates against which other nodes are
+// verified, or nil if none were set.
+func (mux *Mux) CACerts() *rtls.CAReloader {
+	return mux.caCerts
+}
+
+// ReloadCertificates loads the certificate, key, and root certificates
+// from their files again. Connections already established are unaffected.
+func (mux *Mux) ReloadCertificates() error {
+	if mux.certs == nil {
+		return nil
+	}
+	if err := mux.certs.Reload(); err != nil {
+		return err
+	}
+	if mux.caCerts != nil {
+		return mux.caCerts.Reload()
+	}
+	return nil
+}
+
 // Stats returns status of the mux.
 func (mux *Mux) Stats() (interface{}, error) {
 	s := map[string]string{
@@ -192,7 +221,7 @@ func (mux *Mux) handleConn(conn net.Conn) {
 	// Set a read deadline so connections with no data don't timeout.
 	if err := conn.SetReadDeadline(time.Now().Add(mux.Timeout)); err != nil {
 		conn.Close()
-		mux.Logger.Printf("tcp.Mux: cannot set read deadline: %s", err)
+		mux.Logger.Warnf("tcp.Mux: cannot set read deadline: %s", err)
 		return
 	}
 
@@ -200,14 +229,14 @@ func (mux *Mux) handleConn(conn net.Conn) {
 	var typ [1]byte
 	if _, err := io.ReadFull(conn, typ[:]); err != nil {
 		conn.Close()
-		mux.Logger.Printf("tcp.Mux: cannot read header byte: %s", err)
+		mux.Logger.Warnf("tcp.Mux: cannot read header byte: %s", err)
 		return
 	}
 
 	// Reset read deadline and let the listener handle that.
 	if err := conn.SetReadDeadline(time.Time{}); err != nil {
 		conn.Close()
-		mux.Logger.Printf("tcp.Mux: cannot reset set read deadline: %s", err)
+		mux.Logger.Warnf("tcp.Mux: cannot reset set read deadline: %s", err)
 		return
 	}
 
@@ -216,7 +245,7 @@ func (mux *Mux) handleConn(conn net.Conn) {
 	if handler == nil {
 		conn.Close()
 		stats.Add(numUnregisteredHandlers, 1)
-		mux.Logger.Printf("tcp.Mux: handler not registered for request from %s: %d (unsupported protocol?)",
+		mux.Logger.Warnf("tcp.Mux: handler not registered for request from %s: %d (unsupported protocol?)",
 			conn.RemoteAddr().String(), typ[0])
 		return
 	}
@@ -246,6 +275,8 @@ func (mux *Mux) Listen(header byte) *Layer {
 		tlsConfig:      mux.tlsConfig,
 	}
 	layer.dialer = NewDialer(header, mux.remoteEncrypted, mux.InsecureSkipVerify)
+	layer.dialer.CACerts = mux.caCerts
+	layer.dialer.Certs = mux.certs
 
 	return layer
 }
@@ -281,27 +312,39 @@ func newTLSListener(ln net.Listener, certFile, keyFile, caCertFile string) (net.
 }
 
 // createTLSConfig returns a TLS config from the given cert, key and optionally
-// Certificate Authority cert.
+// Certificate Authority cert. Each is reloaded when its file changes.
 func createTLSConfig(certFile, keyFile, caCertFile string) (*tls.Config, error) {
-	var err error
-	config := &tls.Config{}
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	certs, err := rtls.NewCertReloader(certFile, keyFile)
 	if err != nil {
 		return nil, err
 	}
-
+	var caCerts *rtls.CAReloader
 	if caCertFile != "" {
-		asn1Data, err := ioutil.ReadFile(caCertFile)
+		caCerts, err = rtls.NewCAReloader(caCertFile)
 		if err != nil {
 			return nil, err
 		}
-		config.RootCAs = x509.NewCertPool()
-		ok := config.RootCAs.AppendCertsFromPEM([]byte(asn1Data))
-		if !ok {
-			return nil, fmt.Errorf("failed to parse root certificate(s) in %q", caCertFile)
-		}
 	}
+	return newTLSConfig(certs, caCerts), nil
+}
 
-	return config, nil
+// newTLSConfig returns a TLS config which presents the certificate held by
+// certs, and, if caCerts is not nil, verifies peers against the root
+// certificates it currently holds. Connections dialed by a Layer are
+// verified by its Dialer, which also reads the current root certificates.
+func newTLSConfig(certs *rtls.CertReloader, caCerts *rtls.CAReloader) *tls.Config {
+	config := &tls.Config{
+		GetCertificate:       certs.GetCertificate,
+		GetClientCertificate: certs.GetClientCertificate,
+	}
+	if caCerts != nil {
+		config.RootCAs = caCerts.Pool()
+		// Pick up any change to the root certificates on each handshake.
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := config.Clone()
+			c.RootCAs = caCerts.Pool()
+			return c, nil
+		}
+	}
+	return config
 }
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -41,7 +42,7 @@ func TestMux(t *testing.T) {
 		}
 		mux.Timeout = 200 * time.Millisecond
 		if !testing.Verbose() {
-			mux.Logger = log.New(ioutil.Discard, "", 0)
+			mux.Logger.SetOutput(ioutil.Discard)
 		}
 		for i := uint8(0); i < n; i++ {
 			ln := mux.Listen(byte(i))
@@ -140,7 +141,7 @@ func TestMux_Advertise(t *testing.T) {
 	}
 	mux.Timeout = 200 * time.Millisecond
 	if !testing.Verbose() {
-		mux.Logger = log.New(ioutil.Discard, "", 0)
+		mux.Logger.SetOutput(ioutil.Discard)
 	}
 
 	layer := mux.Listen(1)
@@ -197,6 +198,54 @@ func TestTLSMux(t *testing.T) {
 	}
 }
 
+// Ensure a layer dials other nodes using the root certificates loaded
+// when the mux's certificates were last reloaded.
+func TestTLSMux_ReloadCACert(t *testing.T) {
+	dir := mustTempDir()
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "node"), 0700); err != nil {
+		t.Fatalf("failed to create node dir: %s", err.Error())
+	}
+	if err := os.Mkdir(filepath.Join(dir, "peer"), 0700); err != nil {
+		t.Fatalf("failed to create peer dir: %s", err.Error())
+	}
+	cert, key := mustWriteSelfSignedCert(filepath.Join(dir, "node"))
+	peerCert, peerKey := mustWriteSelfSignedCert(filepath.Join(dir, "peer"))
+
+	caCert := filepath.Join(dir, "ca.pem")
+	mustCopyFile(cert, caCert)
+
+	tcpListener := mustTCPListener("127.0.0.1:0")
+	defer tcpListener.Close()
+	mux, err := NewTLSMux(tcpListener, nil, cert, key, caCert)
+	if err != nil {
+		t.Fatalf("failed to create mux: %s", err.Error())
+	}
+	layer := mux.Listen(5)
+
+	tlsConfig, err := createTLSConfig(peerCert, peerKey, "")
+	if err != nil {
+		t.Fatalf("failed to create TLS config: %s", err.Error())
+	}
+	s := &echoServer{ln: tls.NewListener(mustTCPListener("127.0.0.1:0"), tlsConfig)}
+	defer s.Close()
+	go s.Start(t)
+
+	if _, err := layer.Dial(s.Addr(), 5*time.Second); err == nil {
+		t.Fatalf("dialed peer whose certificate is not signed by the root certificate")
+	}
+
+	mustCopyFile(peerCert, caCert)
+	if err := mux.ReloadCertificates(); err != nil {
+		t.Fatalf("failed to reload certificates: %s", err.Error())
+	}
+	conn, err := layer.Dial(s.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial peer after reloading root certificate: %s", err.Error())
+	}
+	conn.Close()
+}
+
 func TestTLSMux_Fail(t *testing.T) {
 	tcpListener := mustTCPListener("127.0.0.1:0")
 	defer tcpListener.Close()
@@ -220,6 +269,24 @@ func (m *mockAddr) String() string {
 }
 
 // mustTCPListener returns a listener on bind, or panics.
+func mustTempDir() string {
+	dir, err := ioutil.TempDir("", "rqlite-mux-test-")
+	if err != nil {
+		panic("failed to create temp dir")
+	}
+	return dir
+}
+
+func mustCopyFile(src, dst string) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		panic("failed to read file")
+	}
+	if err := ioutil.WriteFile(dst, b, 0600); err != nil {
+		panic("failed to write file")
+	}
+}
+
 func mustTCPListener(bind string) net.Listener {
 	l, err := net.Listen("tcp", bind)
 	if err != nil {
@@ -0,0 +1,147 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// The types below encode an OTLP ExportTraceServiceRequest as JSON, as
+// specified by the OpenTelemetry protocol.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              Kind           `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// Span status codes.
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// encode returns the spans, recorded by the given resource, as an OTLP
+// ExportTraceServiceRequest encoded as JSON.
+func encode(resource []attribute, spans []*Span) ([]byte, error) {
+	ss := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		ss[i] = otlpSpan{
+			TraceID:           s.traceID.String(),
+			SpanID:            s.id.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.attrs),
+			Status:            otlpStatus{Code: statusUnset},
+		}
+		if s.parent.IsValid() {
+			ss[i].ParentSpanID = s.parent.String()
+		}
+		if s.err != "" {
+			ss[i].Status = otlpStatus{Code: statusError, Message: s.err}
+		}
+	}
+
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{Attributes: encodeAttributes(resource)},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: "github.com/rqlite/rqlite"},
+						Spans: ss,
+					},
+				},
+			},
+		},
+	})
+}
+
+func encodeAttributes(attrs []attribute) []otlpKeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	kvs := make([]otlpKeyValue, len(attrs))
+	for i, a := range attrs {
+		kvs[i] = otlpKeyValue{Key: a.key, Value: encodeValue(a.value)}
+	}
+	return kvs
+}
+
+func encodeValue(v interface{}) otlpAnyValue {
+	var i int64
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case float32:
+		f := float64(v)
+		return otlpAnyValue{DoubleValue: &f}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	case int:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint32:
+		i = int64(v)
+	case uint64:
+		i = int64(v)
+	default:
+		s := fmt.Sprint(v)
+		return otlpAnyValue{StringValue: &s}
+	}
+	// OTLP JSON encodes 64-bit integers as strings.
+	s := strconv.FormatInt(i, 10)
+	return otlpAnyValue{IntValue: &s}
+}
@@ -0,0 +1,369 @@
+// Package tracing records spans, timing the stages of handling a request,
+// and exports them in OpenTelemetry (OTLP) JSON format. Every span belongs
+// to the trace of a request, identified by its request ID, so the spans
+// recorded by each node which handles the request form a single trace.
+//
+// A nil *Tracer records nothing, and the spans it returns are nil, on
+// which every method is a no-op. Code can therefore be instrumented
+// unconditionally, whether or not tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/rqlite/rqlite/logging"
+)
+
+const (
+	// maxQueuedSpans is the number of ended spans held for export. Spans
+	// ended while the queue is full are dropped.
+	maxQueuedSpans = 4096
+
+	// maxBatchSize is the maximum number of spans exported at once.
+	maxBatchSize = 512
+
+	// exportInterval is the longest a span waits to be exported.
+	exportInterval = time.Second
+)
+
+// stats captures stats for tracing.
+var stats *expvar.Map
+
+const (
+	numSpansExported = "spans_exported"
+	numSpansDropped  = "spans_dropped"
+	numExportErrors  = "export_errors"
+)
+
+func init() {
+	stats = expvar.NewMap("tracing")
+	stats.Add(numSpansExported, 0)
+	stats.Add(numSpansDropped, 0)
+	stats.Add(numExportErrors, 0)
+}
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// IsValid returns whether the ID is not all zeros.
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// String returns the ID in hex.
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// IsValid returns whether the ID is not all zeros.
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// String returns the ID in hex.
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// Bytes returns the ID for transmission, or nil if it is not valid.
+func (s SpanID) Bytes() []byte {
+	if !s.IsValid() {
+		return nil
+	}
+	return s[:]
+}
+
+// SpanIDFromBytes returns the span ID transmitted as b, or the zero ID if
+// b is not a span ID.
+func SpanIDFromBytes(b []byte) SpanID {
+	var s SpanID
+	if len(b) == len(s) {
+		copy(s[:], b)
+	}
+	return s
+}
+
+// NewRequestID returns a random request ID, 32 hex characters long, which
+// is also a valid trace ID.
+func NewRequestID() string {
+	var t TraceID
+	rand.Read(t[:])
+	return t.String()
+}
+
+// TraceIDFromRequestID returns the ID of the trace of the request with the
+// given ID. A request ID of 32 hex characters is used as the trace ID as
+// is. Any other request ID is hashed to a trace ID. An empty request ID has
+// no trace, and returns the zero ID.
+func TraceIDFromRequestID(id string) TraceID {
+	var t TraceID
+	if id == "" {
+		return t
+	}
+	if len(id) == 2*len(t) {
+		if _, err := hex.Decode(t[:], []byte(id)); err == nil && t.IsValid() {
+			return t
+		}
+	}
+	sum := sha256.Sum256([]byte(id))
+	copy(t[:], sum[:])
+	return t
+}
+
+// Kind is the kind of a span, as defined by OpenTelemetry.
+type Kind int
+
+// Span kinds.
+const (
+	KindInternal Kind = 1 // An operation within a node.
+	KindServer   Kind = 2 // The handling of a request from another process.
+	KindClient   Kind = 3 // A request made to another node.
+)
+
+// Exporter is the interface an object must support to receive spans. Each
+// call to Export passes an OTLP ExportTraceServiceRequest, encoded as JSON.
+type Exporter interface {
+	Export(b []byte) error
+	Close() error
+}
+
+// Tracer records spans, and exports them in the background.
+type Tracer struct {
+	resource  []attribute
+	exporters []Exporter
+
+	spanCh chan *Span
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	logger *logging.Logger
+}
+
+// NewTracer returns a new, started, Tracer which exports spans to each of
+// the exporters. The spans are attributed to the given service, and the
+// given instance of that service.
+func NewTracer(service, instance string, exporters ...Exporter) *Tracer {
+	t := &Tracer{
+		resource: []attribute{
+			{"service.name", service},
+			{"service.instance.id", instance},
+		},
+		exporters: exporters,
+		spanCh:    make(chan *Span, maxQueuedSpans),
+		done:      make(chan struct{}),
+		logger:    logging.New("tracing"),
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+// Start starts a span of the given trace, with the given parent span. If
+// the parent ID is the zero ID, the span is the root span of its trace. If
+// the trace ID is the zero ID, no span is started, and nil is returned.
+func (t *Tracer) Start(name string, traceID TraceID, parent SpanID) *Span {
+	return t.StartAt(name, traceID, parent, time.Now())
+}
+
+// StartAt starts a span, as for Start, which began at the given time.
+func (t *Tracer) StartAt(name string, traceID TraceID, parent SpanID, start time.Time) *Span {
+	if t == nil || !traceID.IsValid() {
+		return nil
+	}
+	s := &Span{
+		t:       t,
+		name:    name,
+		kind:    KindInternal,
+		traceID: traceID,
+		parent:  parent,
+		start:   start,
+	}
+	rand.Read(s.id[:])
+	return s
+}
+
+// Close exports every span already ended, and closes the exporters.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	close(t.done)
+	t.wg.Wait()
+	for _, e := range t.exporters {
+		if err := e.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tracer) end(s *Span) {
+	select {
+	case t.spanCh <- s:
+	default:
+		stats.Add(numSpansDropped, 1)
+	}
+}
+
+func (t *Tracer) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.spanCh:
+			batch = append(batch, s)
+			if len(batch) >= maxBatchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.spanCh:
+					batch = append(batch, s)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	b, err := encode(t.resource, batch)
+	if err != nil {
+		stats.Add(numExportErrors, 1)
+		t.logger.Errorf("failed to encode spans: %s", err)
+		return
+	}
+	for _, e := range t.exporters {
+		if err := e.Export(b); err != nil {
+			stats.Add(numExportErrors, 1)
+			t.logger.Warnf("failed to export %d spans: %s", len(batch), err)
+			continue
+		}
+	}
+	stats.Add(numSpansExported, int64(len(batch)))
+}
+
+// attribute is a key-value pair describing a span, or the resource which
+// recorded it.
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span times a single stage of handling a request. A Span must not be
+// changed once ended.
+type Span struct {
+	t       *Tracer
+	name    string
+	kind    Kind
+	traceID TraceID
+	id      SpanID
+	parent  SpanID
+	start   time.Time
+	end     time.Time
+	attrs   []attribute
+	err     string
+}
+
+// TraceID returns the ID of the trace of the span.
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.traceID
+}
+
+// ID returns the ID of the span.
+func (s *Span) ID() SpanID {
+	if s == nil {
+		return SpanID{}
+	}
+	return s.id
+}
+
+// Child starts a span whose parent is s.
+func (s *Span) Child(name string) *Span {
+	return s.ChildAt(name, time.Now())
+}
+
+// ChildAt starts a span whose parent is s, which began at the given time.
+func (s *Span) ChildAt(name string, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.t.StartAt(name, s.traceID, s.id, start)
+}
+
+// SetKind sets the kind of the span. Spans are KindInternal by default.
+func (s *Span) SetKind(k Kind) {
+	if s == nil {
+		return
+	}
+	s.kind = k
+}
+
+// SetAttribute sets an attribute of the span. The value should be a string,
+// bool, integer, or float.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// SetError marks the span as failed, if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+// End ends the span, and queues it for export.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends the span at the given time, and queues it for export.
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.end = end
+	s.t.end(s)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the span s.
+func NewContext(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(contextKey{}).(*Span)
+	return s
+}
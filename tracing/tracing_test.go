@@ -0,0 +1,145 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_TraceIDFromRequestID(t *testing.T) {
+	if TraceIDFromRequestID("").IsValid() {
+		t.Fatalf("empty request ID has a trace ID")
+	}
+
+	id := NewRequestID()
+	if exp, got := id, TraceIDFromRequestID(id).String(); exp != got {
+		t.Fatalf("wrong trace ID for hex request ID, exp %s, got %s", exp, got)
+	}
+
+	tid := TraceIDFromRequestID("my-request")
+	if !tid.IsValid() {
+		t.Fatalf("no trace ID for request ID")
+	}
+	if tid != TraceIDFromRequestID("my-request") {
+		t.Fatalf("trace ID for request ID is not stable")
+	}
+}
+
+func Test_NilTracer(t *testing.T) {
+	var tr *Tracer
+	s := tr.Start("nil", TraceIDFromRequestID("abc"), SpanID{})
+	if s != nil {
+		t.Fatalf("nil tracer started a span")
+	}
+	s.SetAttribute("key", "value")
+	s.SetError(errors.New("failed"))
+	s.Child("child").End()
+	s.End()
+	if s.ID().IsValid() || s.ID().Bytes() != nil {
+		t.Fatalf("nil span has valid ID")
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("failed to close nil tracer: %s", err)
+	}
+}
+
+func Test_FileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rqlite-tracing-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "traces.json")
+
+	e, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatalf("failed to create file exporter: %s", err)
+	}
+	tr := NewTracer("rqlite", "node1", e)
+
+	root := tr.Start("root", TraceIDFromRequestID("req-1"), SpanID{})
+	root.SetKind(KindServer)
+	root.SetAttribute("request_id", "req-1")
+	child := root.Child("child")
+	child.SetAttribute("rows", 3)
+	child.SetError(errors.New("no such table"))
+	child.End()
+	root.End()
+	if err := tr.Close(); err != nil {
+		t.Fatalf("failed to close tracer: %s", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read trace file: %s", err)
+	}
+	var req otlpRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		t.Fatalf("failed to unmarshal trace file %s: %s", b, err)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("wrong structure of trace file: %s", b)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("wrong number of spans exported, exp 2, got %d", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.Name != "child" || r.Name != "root" {
+		t.Fatalf("wrong span names: %s", b)
+	}
+	if c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID || r.ParentSpanID != "" {
+		t.Fatalf("wrong span relationships: %s", b)
+	}
+	if r.Kind != KindServer || c.Kind != KindInternal {
+		t.Fatalf("wrong span kinds: %s", b)
+	}
+	if c.Status.Code != statusError || c.Status.Message != "no such table" {
+		t.Fatalf("wrong span status: %s", b)
+	}
+	if !strings.Contains(string(b), `{"key":"rows","value":{"intValue":"3"}}`) {
+		t.Fatalf("wrong span attributes: %s", b)
+	}
+	if !strings.Contains(string(b), `{"key":"service.instance.id","value":{"stringValue":"node1"}}`) {
+		t.Fatalf("wrong resource attributes: %s", b)
+	}
+}
+
+func Test_HTTPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	tr := NewTracer("rqlite", "node1", NewHTTPExporter(ts.URL+"/v1/traces"))
+	tr.Start("root", TraceIDFromRequestID("req-1"), SpanID{}).End()
+	if err := tr.Close(); err != nil {
+		t.Fatalf("failed to close tracer: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 || !strings.Contains(bodies[0], `"name":"root"`) {
+		t.Fatalf("wrong spans received by collector: %v", bodies)
+	}
+
+	if err := NewHTTPExporter(ts.URL + "/bad").Export([]byte("{}")); err == nil {
+		t.Fatalf("no error for collector failure")
+	}
+}